@@ -0,0 +1,921 @@
+// Package api 提供网关的 HTTP 管理接口，请求和应答都是 JSON。
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/x14n/evgateway/internal/auth"
+	"github.com/x14n/evgateway/internal/chargerconfig"
+	"github.com/x14n/evgateway/internal/chargingprofile"
+	"github.com/x14n/evgateway/internal/diagnostics"
+	"github.com/x14n/evgateway/internal/firmware"
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/smartcharging"
+)
+
+var (
+	ErrBadRequest = errors.New("bad request")
+	ErrNoToken    = errors.New("api token required when listening on a non-loopback address")
+)
+
+const (
+	maxFirmwareSize = 512 << 20 // 限制上传的固件镜像大小
+	maxBodySize     = 1 << 20   // 限制其他接口的 JSON 请求体大小
+)
+
+// Server 是管理接口。Token 不为空时要求请求带 Authorization: Bearer <Token>，
+// 为空时只允许监听回环地址
+type Server struct {
+	Gateway  *gateway.Gateway
+	Token    string
+	Config   *chargerconfig.Manager // 为空时配置接口返回 404
+	Firmware *firmware.Manager      // 为空时固件接口返回 404
+
+	Diagnostics *diagnostics.Store // 为空时诊断接口返回 404
+	Auth        *auth.Manager      // 为空时标签接口返回 404
+
+	SmartCharging *smartcharging.Manager   // 为空时负载均衡接口返回 404
+	Profiles      *chargingprofile.Manager // 为空时充电曲线接口返回 404
+
+	mux *http.ServeMux
+}
+
+func NewServer(gw *gateway.Gateway) *Server {
+	s := &Server{Gateway: gw, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /api/sessions", s.listSessions)
+	s.mux.HandleFunc("GET /api/broadcasts", s.listBroadcasts)
+	s.mux.HandleFunc("POST /api/broadcasts", s.createBroadcast)
+	s.mux.HandleFunc("GET /api/broadcasts/{id}", s.getBroadcast)
+	s.mux.HandleFunc("POST /api/chargers/{id}/remote-start", s.remoteStart)
+	s.mux.HandleFunc("POST /api/transactions/{id}/remote-stop", s.remoteStop)
+	s.mux.HandleFunc("GET /api/chargers/{id}/configuration", s.getConfiguration)
+	s.mux.HandleFunc("GET /api/chargers/{id}/configuration/desired", s.getDesiredConfiguration)
+	s.mux.HandleFunc("PUT /api/chargers/{id}/configuration/{key}", s.setConfiguration)
+	s.mux.HandleFunc("POST /api/chargers/{id}/configuration/reconcile", s.reconcileConfiguration)
+	s.mux.HandleFunc("GET /api/firmware", s.listFirmware)
+	s.mux.HandleFunc("PUT /api/firmware/{version}", s.uploadFirmware)
+	s.mux.HandleFunc("DELETE /api/firmware/{version}", s.deleteFirmware)
+	s.mux.HandleFunc("GET /api/rollouts", s.listRollouts)
+	s.mux.HandleFunc("POST /api/rollouts", s.createRollout)
+	s.mux.HandleFunc("GET /api/rollouts/{id}", s.getRollout)
+	s.mux.HandleFunc("POST /api/rollouts/{id}/pause", s.rolloutAction((*firmware.Manager).Pause))
+	s.mux.HandleFunc("POST /api/rollouts/{id}/resume", s.rolloutAction((*firmware.Manager).Resume))
+	s.mux.HandleFunc("POST /api/rollouts/{id}/cancel", s.rolloutAction((*firmware.Manager).Cancel))
+	s.mux.HandleFunc("GET /api/diagnostics", s.listDiagnostics)
+	s.mux.HandleFunc("POST /api/chargers/{id}/diagnostics", s.requestDiagnostics)
+	s.mux.HandleFunc("GET /api/chargers/{id}/diagnostics", s.chargerDiagnostics)
+	s.mux.HandleFunc("GET /api/chargers/{id}/diagnostics/{name}", s.downloadDiagnostics)
+	s.mux.HandleFunc("DELETE /api/chargers/{id}/diagnostics/{name}", s.deleteDiagnostics)
+	s.mux.HandleFunc("GET /api/tokens", s.listTokens)
+	s.mux.HandleFunc("GET /api/tokens/{idTag}", s.getToken)
+	s.mux.HandleFunc("PUT /api/tokens/{idTag}", s.putToken)
+	s.mux.HandleFunc("DELETE /api/tokens/{idTag}", s.deleteToken)
+	s.mux.HandleFunc("GET /api/local-list", s.getLocalList)
+	s.mux.HandleFunc("POST /api/chargers/{id}/local-list/sync", s.syncLocalList)
+	s.mux.HandleFunc("GET /api/smart-charging/sites", s.listSites)
+	s.mux.HandleFunc("GET /api/smart-charging/sites/{site}", s.getSite)
+	s.mux.HandleFunc("PUT /api/smart-charging/sites/{site}", s.putSite)
+	s.mux.HandleFunc("DELETE /api/smart-charging/sites/{site}", s.deleteSite)
+	s.mux.HandleFunc("GET /api/charging-profiles", s.listProfiles)
+	s.mux.HandleFunc("GET /api/charging-profiles/{id}", s.getProfile)
+	s.mux.HandleFunc("PUT /api/charging-profiles/{id}", s.putProfile)
+	s.mux.HandleFunc("DELETE /api/charging-profiles/{id}", s.deleteProfile)
+	s.mux.HandleFunc("GET /api/chargers/{id}/composite-schedule", s.compositeSchedule)
+	s.mux.HandleFunc("POST /api/chargers/{id}/charging-profiles/push", s.pushProfiles)
+	return s
+}
+
+// ListenAndServe 在 addr 上提供管理接口。没有设置 Token 时拒绝监听回环以外的地址
+func (s *Server) ListenAndServe(addr string) error {
+	if s.Token == "" && !loopback(addr) {
+		return fmt.Errorf("%w: %s", ErrNoToken, addr)
+	}
+	fmt.Println("API server listen at :", addr)
+	return http.ListenAndServe(addr, s)
+}
+
+// loopback 判断监听地址是否只在本机可达，省略主机名表示所有网卡
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// selectorFromQuery 从 ?charger=&site=&tag=&firmware= 构造选择条件，charger 和 tag 可以重复
+func selectorFromQuery(r *http.Request) gateway.Selector {
+	q := r.URL.Query()
+	return gateway.Selector{
+		ChargerIDs: q["charger"],
+		Site:       q.Get("site"),
+		Tags:       q["tag"],
+		Firmware:   q.Get("firmware"),
+	}
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := s.Gateway.Select(selectorFromQuery(r))
+	out := make([]gateway.Metadata, 0, len(sessions))
+	for _, sess := range sessions {
+		out = append(out, sess.Metadata())
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// BroadcastRequest 是创建广播的请求体。Action 不为空时以 CmdCall 发出并等待应答，
+// 否则以 Cmd 发出，Payload 原样作为帧负载
+type BroadcastRequest struct {
+	Selector gateway.Selector `json:"selector"`
+	gateway.CommandRequest
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// BroadcastView 是广播任务的应答，列表中不带每个充电桩的结果
+type BroadcastView struct {
+	ID       string                    `json:"id"`
+	Selector gateway.Selector          `json:"selector"`
+	Cmd      byte                      `json:"cmd"`
+	Action   string                    `json:"action,omitempty"`
+	Created  time.Time                 `json:"created"`
+	Finished *time.Time                `json:"finished,omitempty"`
+	Progress gateway.BroadcastProgress `json:"progress"`
+	Results  []gateway.BroadcastResult `json:"results,omitempty"`
+}
+
+func broadcastView(j *gateway.BroadcastJob, withResults bool) BroadcastView {
+	v := BroadcastView{
+		ID:       j.ID,
+		Selector: j.Selector,
+		Cmd:      j.Cmd,
+		Action:   j.Action,
+		Created:  j.Created,
+		Progress: j.Progress(),
+	}
+	if f := j.Finished(); !f.IsZero() {
+		v.Finished = &f
+	}
+	if withResults {
+		v.Results = j.Results()
+	}
+	return v
+}
+
+func (s *Server) createBroadcast(w http.ResponseWriter, r *http.Request) {
+	var req BroadcastRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: %v", ErrBadRequest, err))
+		return
+	}
+
+	frame, err := req.Frame()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: %v", ErrBadRequest, err))
+		return
+	}
+
+	job, err := s.Gateway.Broadcast(req.Selector, frame, gateway.BroadcastConcurrency(req.Concurrency))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, broadcastView(job, true))
+}
+
+func (s *Server) listBroadcasts(w http.ResponseWriter, r *http.Request) {
+	jobs := s.Gateway.Broadcasts()
+	out := make([]BroadcastView, 0, len(jobs))
+	for _, j := range jobs {
+		out = append(out, broadcastView(j, false))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) getBroadcast(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.Gateway.GetBroadcast(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("broadcast not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, broadcastView(job, true))
+}
+
+// CommandResponse 是远程命令的应答，Status 为充电桩返回的状态
+type CommandResponse struct {
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (s *Server) remoteStart(w http.ResponseWriter, r *http.Request) {
+	var req gateway.RemoteStartRequest
+	if err := decodeJSON(w, r, &req); err != nil || req.IDTag == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: idTag is required", ErrBadRequest))
+		return
+	}
+	resp, err := s.Gateway.RemoteStart(r.Context(), r.PathValue("id"), req)
+	writeCommand(w, resp, err)
+}
+
+func (s *Server) remoteStop(w http.ResponseWriter, r *http.Request) {
+	txID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: bad transaction id", ErrBadRequest))
+		return
+	}
+	resp, err := s.Gateway.RemoteStop(r.Context(), gateway.RemoteStopRequest{TransactionID: txID})
+	writeCommand(w, resp, err)
+}
+
+// getConfiguration 实时读取充电桩的配置，?key= 可以重复
+func (s *Server) getConfiguration(w http.ResponseWriter, r *http.Request) {
+	resp, err := s.Gateway.GetConfiguration(r.Context(), r.PathValue("id"), r.URL.Query()["key"]...)
+	if err != nil {
+		writeError(w, commandStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// DesiredConfiguration 是充电桩的期望配置和最近一次核对的结果
+type DesiredConfiguration struct {
+	Desired map[string]string     `json:"desired"`
+	Report  *chargerconfig.Report `json:"report,omitempty"`
+}
+
+func (s *Server) getDesiredConfiguration(w http.ResponseWriter, r *http.Request) {
+	if s.Config == nil {
+		writeError(w, http.StatusNotFound, errConfigDisabled)
+		return
+	}
+	id := r.PathValue("id")
+	out := DesiredConfiguration{Desired: s.Config.Store().Desired(id)}
+	if out.Desired == nil {
+		out.Desired = map[string]string{}
+	}
+	if rep, ok := s.Config.Report(id); ok {
+		out.Report = &rep
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// SetConfigurationRequest 是修改期望配置的请求体
+type SetConfigurationRequest struct {
+	Value *string `json:"value"`
+}
+
+// setConfiguration 保存期望值并立即下发。充电桩离线时返回 404，期望值仍然保存，重连时修正
+func (s *Server) setConfiguration(w http.ResponseWriter, r *http.Request) {
+	if s.Config == nil {
+		writeError(w, http.StatusNotFound, errConfigDisabled)
+		return
+	}
+	var req SetConfigurationRequest
+	if err := decodeJSON(w, r, &req); err != nil || req.Value == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: value is required", ErrBadRequest))
+		return
+	}
+	resp, err := s.Config.Set(r.Context(), r.PathValue("id"), r.PathValue("key"), *req.Value)
+	writeCommand(w, resp, err)
+}
+
+func (s *Server) reconcileConfiguration(w http.ResponseWriter, r *http.Request) {
+	if s.Config == nil {
+		writeError(w, http.StatusNotFound, errConfigDisabled)
+		return
+	}
+	id := r.PathValue("id")
+	if _, ok := s.Gateway.GetSession(id); !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: %s", gateway.ErrChargerOffline, id))
+		return
+	}
+	rep, err := s.Config.Reconcile(r.Context(), id)
+	if errors.Is(err, chargerconfig.ErrReconcileRunning) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeError(w, commandStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+var (
+	errConfigDisabled   = errors.New("desired configuration not enabled")
+	errFirmwareDisabled = errors.New("firmware repository not enabled")
+	errAuthDisabled     = errors.New("token store not enabled")
+	errSmartCharging    = errors.New("smart charging not enabled")
+	errProfilesDisabled = errors.New("charging profiles not enabled")
+)
+
+// TokenView 是标签和当前的鉴权结果
+type TokenView struct {
+	auth.Token
+	IDTagInfo gateway.IDTagInfo `json:"idTagInfo"`
+}
+
+// TokenRequest 是新增或修改标签的请求体
+type TokenRequest struct {
+	ParentIDTag string     `json:"parentIdTag,omitempty"`
+	ExpiryDate  *time.Time `json:"expiryDate,omitempty"`
+	Blocked     bool       `json:"blocked,omitempty"`
+}
+
+// LocalList 是标签表的版本和各充电桩的同步结果
+type LocalList struct {
+	Version  int              `json:"version"`
+	Chargers []auth.SyncState `json:"chargers"`
+}
+
+func (s *Server) tokenView(t auth.Token) TokenView {
+	return TokenView{Token: t, IDTagInfo: s.Auth.Authorize("", t.IDTag)}
+}
+
+func (s *Server) listTokens(w http.ResponseWriter, r *http.Request) {
+	if s.Auth == nil {
+		writeError(w, http.StatusNotFound, errAuthDisabled)
+		return
+	}
+	tokens := s.Auth.Store().List()
+	out := make([]TokenView, 0, len(tokens))
+	for _, t := range tokens {
+		out = append(out, s.tokenView(t))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) getToken(w http.ResponseWriter, r *http.Request) {
+	if s.Auth == nil {
+		writeError(w, http.StatusNotFound, errAuthDisabled)
+		return
+	}
+	t, ok := s.Auth.Store().Get(r.PathValue("idTag"))
+	if !ok {
+		writeError(w, http.StatusNotFound, auth.ErrUnknownToken)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.tokenView(t))
+}
+
+func (s *Server) putToken(w http.ResponseWriter, r *http.Request) {
+	if s.Auth == nil {
+		writeError(w, http.StatusNotFound, errAuthDisabled)
+		return
+	}
+	var req TokenRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: %v", ErrBadRequest, err))
+		return
+	}
+	t, err := s.Auth.Put(auth.Token{
+		IDTag:       r.PathValue("idTag"),
+		ParentIDTag: req.ParentIDTag,
+		ExpiryDate:  req.ExpiryDate,
+		Blocked:     req.Blocked,
+	})
+	switch {
+	case errors.Is(err, auth.ErrBadToken):
+		writeError(w, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.tokenView(t))
+}
+
+func (s *Server) deleteToken(w http.ResponseWriter, r *http.Request) {
+	if s.Auth == nil {
+		writeError(w, http.StatusNotFound, errAuthDisabled)
+		return
+	}
+	err := s.Auth.Delete(r.PathValue("idTag"))
+	switch {
+	case errors.Is(err, auth.ErrUnknownToken):
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getLocalList(w http.ResponseWriter, r *http.Request) {
+	if s.Auth == nil {
+		writeError(w, http.StatusNotFound, errAuthDisabled)
+		return
+	}
+	writeJSON(w, http.StatusOK, LocalList{Version: s.Auth.Store().Version(), Chargers: s.Auth.States()})
+}
+
+// syncLocalList 立即把本地鉴权列表同步到充电桩，同步失败的原因在结果中
+func (s *Server) syncLocalList(w http.ResponseWriter, r *http.Request) {
+	if s.Auth == nil {
+		writeError(w, http.StatusNotFound, errAuthDisabled)
+		return
+	}
+	id := r.PathValue("id")
+	if _, ok := s.Gateway.GetSession(id); !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: %s", gateway.ErrChargerOffline, id))
+		return
+	}
+	state, ok := s.Auth.Sync(r.Context(), id)
+	if !ok {
+		writeError(w, http.StatusConflict, errors.New("sync already in progress"))
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// DiagnosticsRequest 是索取诊断日志的请求体，时间为空表示不限
+type DiagnosticsRequest struct {
+	StartTime *time.Time `json:"startTime,omitempty"`
+	StopTime  *time.Time `json:"stopTime,omitempty"`
+}
+
+// ChargerDiagnostics 是充电桩的诊断请求和已上传的文件
+type ChargerDiagnostics struct {
+	Requests []diagnostics.Request `json:"requests"`
+	Files    []diagnostics.File    `json:"files"`
+}
+
+func (s *Server) listDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if s.Diagnostics == nil {
+		writeError(w, http.StatusNotFound, gateway.ErrDiagnosticsDisabled)
+		return
+	}
+	files, err := s.Diagnostics.AllFiles()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, append([]diagnostics.File{}, files...))
+}
+
+// requestDiagnostics 让充电桩上传日志，充电桩应答后返回，上传在后台进行
+func (s *Server) requestDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if s.Diagnostics == nil {
+		writeError(w, http.StatusNotFound, gateway.ErrDiagnosticsDisabled)
+		return
+	}
+	var req DiagnosticsRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%w: %v", ErrBadRequest, err))
+			return
+		}
+	}
+	if req.StartTime != nil && req.StopTime != nil && req.StopTime.Before(*req.StartTime) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: stopTime before startTime", ErrBadRequest))
+		return
+	}
+	d, err := s.Diagnostics.Request(r.Context(), r.PathValue("id"), req.StartTime, req.StopTime)
+	if err != nil {
+		writeError(w, commandStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, d)
+}
+
+func (s *Server) chargerDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if s.Diagnostics == nil {
+		writeError(w, http.StatusNotFound, gateway.ErrDiagnosticsDisabled)
+		return
+	}
+	id := r.PathValue("id")
+	files, err := s.Diagnostics.Files(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	out := ChargerDiagnostics{Requests: s.Diagnostics.Requests(id), Files: files}
+	if out.Requests == nil {
+		out.Requests = []diagnostics.Request{}
+	}
+	if out.Files == nil {
+		out.Files = []diagnostics.File{}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) downloadDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if s.Diagnostics == nil {
+		writeError(w, http.StatusNotFound, gateway.ErrDiagnosticsDisabled)
+		return
+	}
+	name := r.PathValue("name")
+	f, err := s.Diagnostics.Open(r.PathValue("id"), name)
+	if err != nil {
+		writeError(w, diagnosticsStatus(err), err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+func (s *Server) deleteDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if s.Diagnostics == nil {
+		writeError(w, http.StatusNotFound, gateway.ErrDiagnosticsDisabled)
+		return
+	}
+	if err := s.Diagnostics.Delete(r.PathValue("id"), r.PathValue("name")); err != nil {
+		writeError(w, diagnosticsStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func diagnosticsStatus(err error) int {
+	switch {
+	case errors.Is(err, diagnostics.ErrBadFileName):
+		return http.StatusBadRequest
+	case errors.Is(err, diagnostics.ErrUnknownFile):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *Server) listSites(w http.ResponseWriter, r *http.Request) {
+	if s.SmartCharging == nil {
+		writeError(w, http.StatusNotFound, errSmartCharging)
+		return
+	}
+	writeJSON(w, http.StatusOK, append([]smartcharging.SiteStatus{}, s.SmartCharging.Statuses()...))
+}
+
+// getSite 返回站点配置和各枪当前的限值
+func (s *Server) getSite(w http.ResponseWriter, r *http.Request) {
+	if s.SmartCharging == nil {
+		writeError(w, http.StatusNotFound, errSmartCharging)
+		return
+	}
+	st, ok := s.SmartCharging.Status(r.PathValue("site"))
+	if !ok {
+		writeError(w, http.StatusNotFound, smartcharging.ErrUnknownSite)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// putSite 新增或修改站点配置，限值在后台重新分配
+func (s *Server) putSite(w http.ResponseWriter, r *http.Request) {
+	if s.SmartCharging == nil {
+		writeError(w, http.StatusNotFound, errSmartCharging)
+		return
+	}
+	var site smartcharging.Site
+	if err := decodeJSON(w, r, &site); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: %v", ErrBadRequest, err))
+		return
+	}
+	site.ID = r.PathValue("site")
+	err := s.SmartCharging.PutSite(site)
+	switch {
+	case errors.Is(err, smartcharging.ErrBadSite):
+		writeError(w, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	st, _ := s.SmartCharging.Status(site.ID)
+	writeJSON(w, http.StatusOK, st)
+}
+
+func (s *Server) deleteSite(w http.ResponseWriter, r *http.Request) {
+	if s.SmartCharging == nil {
+		writeError(w, http.StatusNotFound, errSmartCharging)
+		return
+	}
+	err := s.SmartCharging.DeleteSite(r.PathValue("site"))
+	switch {
+	case errors.Is(err, smartcharging.ErrUnknownSite):
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listFirmware(w http.ResponseWriter, r *http.Request) {
+	if s.Firmware == nil {
+		writeError(w, http.StatusNotFound, errFirmwareDisabled)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Firmware.Repository().List())
+}
+
+// uploadFirmware 以请求体为镜像内容新增版本，应答带计算出的 SHA256
+func (s *Server) uploadFirmware(w http.ResponseWriter, r *http.Request) {
+	if s.Firmware == nil {
+		writeError(w, http.StatusNotFound, errFirmwareDisabled)
+		return
+	}
+	img, err := s.Firmware.Repository().Add(r.PathValue("version"), http.MaxBytesReader(w, r.Body, maxFirmwareSize))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusCreated, img)
+	case errors.Is(err, firmware.ErrImageExists):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, firmware.ErrBadVersion):
+		writeError(w, http.StatusBadRequest, err)
+	case errors.As(err, &tooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (s *Server) deleteFirmware(w http.ResponseWriter, r *http.Request) {
+	if s.Firmware == nil {
+		writeError(w, http.StatusNotFound, errFirmwareDisabled)
+		return
+	}
+	switch err := s.Firmware.Repository().Delete(r.PathValue("version")); {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, firmware.ErrUnknownImage):
+		writeError(w, http.StatusNotFound, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (s *Server) listRollouts(w http.ResponseWriter, r *http.Request) {
+	if s.Firmware == nil {
+		writeError(w, http.StatusNotFound, errFirmwareDisabled)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Firmware.List())
+}
+
+func (s *Server) createRollout(w http.ResponseWriter, r *http.Request) {
+	if s.Firmware == nil {
+		writeError(w, http.StatusNotFound, errFirmwareDisabled)
+		return
+	}
+	var spec firmware.Spec
+	if err := decodeJSON(w, r, &spec); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: %v", ErrBadRequest, err))
+		return
+	}
+	ro, err := s.Firmware.Start(spec)
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusAccepted, ro)
+	case errors.Is(err, firmware.ErrUnknownImage), errors.Is(err, firmware.ErrBadSpec), errors.Is(err, firmware.ErrNoTargets):
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (s *Server) getRollout(w http.ResponseWriter, r *http.Request) {
+	if s.Firmware == nil {
+		writeError(w, http.StatusNotFound, errFirmwareDisabled)
+		return
+	}
+	ro, ok := s.Firmware.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: %s", firmware.ErrUnknownRollout, r.PathValue("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, ro)
+}
+
+// rolloutAction 包装暂停、恢复和取消发布
+func (s *Server) rolloutAction(action func(*firmware.Manager, string) (firmware.Rollout, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Firmware == nil {
+			writeError(w, http.StatusNotFound, errFirmwareDisabled)
+			return
+		}
+		ro, err := action(s.Firmware, r.PathValue("id"))
+		switch {
+		case err == nil:
+			writeJSON(w, http.StatusOK, ro)
+		case errors.Is(err, firmware.ErrUnknownRollout):
+			writeError(w, http.StatusNotFound, err)
+		case errors.Is(err, firmware.ErrRolloutFinished):
+			writeError(w, http.StatusConflict, err)
+		default:
+			writeError(w, http.StatusInternalServerError, err)
+		}
+	}
+}
+
+// CompositeSchedule 是枪的合成曲线和充电桩最近一次下发的结果
+type CompositeSchedule struct {
+	ChargerID        string                     `json:"chargerId"`
+	ConnectorID      int                        `json:"connectorId"`
+	ChargingSchedule gateway.ChargingSchedule   `json:"chargingSchedule"`
+	Push             *chargingprofile.PushState `json:"push,omitempty"`
+}
+
+// listProfiles 返回充电曲线，?charger= 只返回该充电桩的曲线
+func (s *Server) listProfiles(w http.ResponseWriter, r *http.Request) {
+	if s.Profiles == nil {
+		writeError(w, http.StatusNotFound, errProfilesDisabled)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Profiles.Store().List(r.URL.Query().Get("charger")))
+}
+
+func (s *Server) getProfile(w http.ResponseWriter, r *http.Request) {
+	if s.Profiles == nil {
+		writeError(w, http.StatusNotFound, errProfilesDisabled)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: bad profile id", ErrBadRequest))
+		return
+	}
+	p, ok := s.Profiles.Store().Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, chargingprofile.ErrUnknownProfile)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// putProfile 新增或替换充电曲线，合成后的曲线在后台下发
+func (s *Server) putProfile(w http.ResponseWriter, r *http.Request) {
+	if s.Profiles == nil {
+		writeError(w, http.StatusNotFound, errProfilesDisabled)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: bad profile id", ErrBadRequest))
+		return
+	}
+	var p chargingprofile.Profile
+	if err := decodeJSON(w, r, &p); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: %v", ErrBadRequest, err))
+		return
+	}
+	p.ChargingProfileID = id
+	p, err = s.Profiles.Put(p)
+	switch {
+	case errors.Is(err, chargingprofile.ErrBadProfile):
+		writeError(w, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Server) deleteProfile(w http.ResponseWriter, r *http.Request) {
+	if s.Profiles == nil {
+		writeError(w, http.StatusNotFound, errProfilesDisabled)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: bad profile id", ErrBadRequest))
+		return
+	}
+	err = s.Profiles.Delete(id)
+	switch {
+	case errors.Is(err, chargingprofile.ErrUnknownProfile):
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// compositeSchedule 返回枪从现在起生效的限值，?connector= 缺省为 0 即整桩，?duration= 为秒数，缺省一天
+func (s *Server) compositeSchedule(w http.ResponseWriter, r *http.Request) {
+	if s.Profiles == nil {
+		writeError(w, http.StatusNotFound, errProfilesDisabled)
+		return
+	}
+	q := r.URL.Query()
+	connectorID, duration := 0, 24*3600
+	var err error
+	if v := q.Get("connector"); v != "" {
+		if connectorID, err = strconv.Atoi(v); err != nil || connectorID < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%w: bad connector", ErrBadRequest))
+			return
+		}
+	}
+	if v := q.Get("duration"); v != "" {
+		if duration, err = strconv.Atoi(v); err != nil || duration <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%w: bad duration", ErrBadRequest))
+			return
+		}
+	}
+	id := r.PathValue("id")
+	out := CompositeSchedule{
+		ChargerID:        id,
+		ConnectorID:      connectorID,
+		ChargingSchedule: s.Profiles.CompositeSchedule(id, connectorID, time.Duration(duration)*time.Second),
+	}
+	if st, ok := s.Profiles.State(id); ok {
+		out.Push = &st
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// pushProfiles 立即把合成曲线下发到充电桩，下发失败的原因在结果中
+func (s *Server) pushProfiles(w http.ResponseWriter, r *http.Request) {
+	if s.Profiles == nil {
+		writeError(w, http.StatusNotFound, errProfilesDisabled)
+		return
+	}
+	id := r.PathValue("id")
+	if _, ok := s.Gateway.GetSession(id); !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: %s", gateway.ErrChargerOffline, id))
+		return
+	}
+	state, ok := s.Profiles.Push(r.Context(), id)
+	if !ok {
+		writeError(w, http.StatusConflict, errors.New("push already in progress"))
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// writeCommand 把命令结果映射为 HTTP 状态码：充电桩不在线或交易不存在 404，
+// 充电桩拒绝或交易已结束 409，充电桩返回错误 502，等待应答超时 504
+func writeCommand(w http.ResponseWriter, resp gateway.CommandStatus, err error) {
+	if err == nil {
+		writeJSON(w, http.StatusOK, CommandResponse{Status: resp.Status})
+		return
+	}
+	writeJSON(w, commandStatus(err), CommandResponse{Status: resp.Status, Error: err.Error()})
+}
+
+func commandStatus(err error) int {
+	var callErr *gateway.CallError
+	switch {
+	case errors.Is(err, gateway.ErrChargerOffline), errors.Is(err, gateway.ErrUnknownTransaction):
+		return http.StatusNotFound
+	case errors.Is(err, gateway.ErrCommandRejected), errors.Is(err, gateway.ErrTransactionStopped):
+		return http.StatusConflict
+	case errors.Is(err, gateway.ErrCallTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, gateway.ErrNotSupported):
+		return http.StatusNotImplemented
+	case errors.As(err, &callErr):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("[api] encode response error: %v\n", err)
+	}
+}
+
+// decodeJSON 解码请求体，超过 maxBodySize 时返回错误
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	return json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,537 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/auth"
+	"github.com/x14n/evgateway/internal/chargerconfig"
+	"github.com/x14n/evgateway/internal/chargingprofile"
+	"github.com/x14n/evgateway/internal/diagnostics"
+	"github.com/x14n/evgateway/internal/firmware"
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/gateway/gatewaytest"
+	"github.com/x14n/evgateway/internal/protocol"
+	"github.com/x14n/evgateway/internal/smartcharging"
+	"github.com/x14n/evgateway/internal/transport"
+)
+
+func newTestAPI(t *testing.T) (*gateway.Gateway, *httptest.Server) {
+	t.Helper()
+	gw := gateway.NewGateway()
+	srv := NewServer(gw)
+	srv.Token = "secret"
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	return gw, ts
+}
+
+func doJSON(t *testing.T, method, url string, body, out any) int {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req, _ := http.NewRequest(method, url, &buf)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("decode %s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAuthAndLimits(t *testing.T) {
+	srv := NewServer(gateway.NewGateway())
+	if err := srv.ListenAndServe(":0"); !errors.Is(err, ErrNoToken) {
+		t.Errorf("expected ErrNoToken on all interfaces without a token, got %v", err)
+	}
+	for addr, want := range map[string]bool{"127.0.0.1:0": true, "[::1]:80": true, "localhost:80": true, "10.0.0.1:80": false, ":80": false} {
+		if got := loopback(addr); got != want {
+			t.Errorf("loopback(%q) = %v, want %v", addr, got, want)
+		}
+	}
+
+	_, ts := newTestAPI(t)
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/sessions", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", resp.StatusCode)
+	}
+	huge := BroadcastRequest{CommandRequest: gateway.CommandRequest{Cmd: protocol.CmdStatus, Payload: json.RawMessage(`"` + strings.Repeat("x", maxBodySize) + `"`)}}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/api/broadcasts", huge, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an oversized body, got %d", code)
+	}
+}
+
+func TestCommandStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{gateway.ErrChargerOffline, http.StatusNotFound},
+		{gateway.ErrCommandRejected, http.StatusConflict},
+		{gateway.ErrCallTimeout, http.StatusGatewayTimeout},
+		{fmt.Errorf("%w: ChangeConfiguration", gateway.ErrNotSupported), http.StatusNotImplemented},
+		{&gateway.CallError{Code: "InternalError"}, http.StatusBadGateway},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := commandStatus(tt.err); got != tt.want {
+			t.Errorf("commandStatus(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBroadcastAPI(t *testing.T) {
+	gw, ts := newTestAPI(t)
+	frames := make(chan protocol.Frame, 4)
+	for _, id := range []string{"CP1", "CP2"} {
+		server, charger := transport.Pipe()
+		defer charger.Close()
+		s := &gateway.Session{ID: id, Addr: id, Transport: server}
+		s.SetLabels(gateway.Labels{Site: "depot", Tags: []string{"dc"}})
+		gw.AddSession(s)
+		go func() {
+			if f, err := charger.ReadFrame(); err == nil {
+				frames <- f
+			}
+		}()
+	}
+
+	resp, err := http.Get(ts.URL + "/api/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", resp.StatusCode)
+	}
+
+	var sessions []gateway.Metadata
+	if code := doJSON(t, http.MethodGet, ts.URL+"/api/sessions?tag=dc&site=depot", nil, &sessions); code != http.StatusOK || len(sessions) != 2 {
+		t.Fatalf("list sessions: %d %+v", code, sessions)
+	}
+
+	var view BroadcastView
+	req := BroadcastRequest{Selector: gateway.Selector{Tags: []string{"dc"}}, CommandRequest: gateway.CommandRequest{Cmd: protocol.CmdStatus, Payload: json.RawMessage(`{"msg":"hello"}`)}}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/api/broadcasts", req, &view); code != http.StatusAccepted {
+		t.Fatalf("create broadcast: %d", code)
+	}
+	if view.Progress.Total != 2 {
+		t.Fatalf("expected 2 targets, got %+v", view.Progress)
+	}
+	for range 2 {
+		select {
+		case f := <-frames:
+			if f.Cmd != protocol.CmdStatus || string(f.Payload) != `{"msg":"hello"}` {
+				t.Errorf("unexpected frame cmd %d payload %q", f.Cmd, f.Payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("charger did not receive the broadcast")
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		doJSON(t, http.MethodGet, ts.URL+"/api/broadcasts/"+view.ID, nil, &view)
+		if view.Finished != nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if view.Finished == nil || view.Progress.Sent != 2 || len(view.Results) != 2 {
+		t.Fatalf("unexpected broadcast state %+v", view)
+	}
+
+	var list []BroadcastView
+	if doJSON(t, http.MethodGet, ts.URL+"/api/broadcasts", nil, &list); len(list) != 1 || list[0].Results != nil {
+		t.Errorf("unexpected broadcast list %+v", list)
+	}
+	if code := doJSON(t, http.MethodGet, ts.URL+"/api/broadcasts/bc-404", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/api/broadcasts", BroadcastRequest{}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without cmd or action, got %d", code)
+	}
+	bad := BroadcastRequest{CommandRequest: gateway.CommandRequest{Cmd: protocol.CmdStatus, Payload: json.RawMessage(`[1,2]`)}}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/api/broadcasts", bad, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a payload that is not an object, got %d", code)
+	}
+}
+
+func TestRemoteStartAPI(t *testing.T) {
+	gw, ts := newTestAPI(t)
+	gatewaytest.Connect(t, gw, "CP1", func(gateway.CallRequest) *gateway.CallResult {
+		return &gateway.CallResult{Payload: json.RawMessage(`{"status":"Accepted"}`)}
+	})
+
+	var resp CommandResponse
+	code := doJSON(t, http.MethodPost, ts.URL+"/api/chargers/CP1/remote-start", gateway.RemoteStartRequest{ConnectorID: 1, IDTag: "TAG1"}, &resp)
+	if code != http.StatusOK || resp.Status != gateway.StatusAccepted {
+		t.Fatalf("remote start: %d %+v", code, resp)
+	}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/api/chargers/CP-OFF/remote-start", gateway.RemoteStartRequest{IDTag: "TAG1"}, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an offline charger, got %d", code)
+	}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/api/chargers/CP1/remote-start", map[string]any{}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without id tag, got %d", code)
+	}
+
+	tx := gw.StartTransaction("CP1", 1, "TAG1", 0, time.Now())
+	code = doJSON(t, http.MethodPost, ts.URL+"/api/transactions/"+strconv.Itoa(tx.ID)+"/remote-stop", nil, &resp)
+	if code != http.StatusOK || resp.Status != gateway.StatusAccepted {
+		t.Fatalf("remote stop: %d %+v", code, resp)
+	}
+	if code := doJSON(t, http.MethodPost, ts.URL+"/api/transactions/999/remote-stop", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown transaction, got %d", code)
+	}
+}
+
+func TestConfigurationAPI(t *testing.T) {
+	gw, ts := newTestAPI(t)
+	if code := doJSON(t, http.MethodGet, ts.URL+"/api/chargers/CP1/configuration/desired", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 while desired config is disabled, got %d", code)
+	}
+	srv := NewServer(gw)
+	srv.Token = "secret"
+	srv.Config = chargerconfig.NewManager(gw, chargerconfig.NewStore())
+	defer srv.Config.Close()
+	ts2 := httptest.NewServer(srv)
+	defer ts2.Close()
+
+	gatewaytest.Connect(t, gw, "CP1", func(req gateway.CallRequest) *gateway.CallResult {
+		payload := json.RawMessage(`{"status":"Accepted"}`)
+		if req.Action == gateway.ActionGetConfiguration {
+			payload = json.RawMessage(`{"configurationKey":[{"key":"HeartbeatInterval","readonly":false,"value":"60"}]}`)
+		}
+		return &gateway.CallResult{Payload: payload}
+	})
+
+	var conf gateway.GetConfigurationResponse
+	if code := doJSON(t, http.MethodGet, ts2.URL+"/api/chargers/CP1/configuration?key=HeartbeatInterval", nil, &conf); code != http.StatusOK || len(conf.ConfigurationKey) != 1 {
+		t.Fatalf("get configuration: %d %+v", code, conf)
+	}
+	var resp CommandResponse
+	if code := doJSON(t, http.MethodPut, ts2.URL+"/api/chargers/CP1/configuration/HeartbeatInterval", map[string]string{"value": "300"}, &resp); code != http.StatusOK || resp.Status != gateway.StatusAccepted {
+		t.Fatalf("set configuration: %d %+v", code, resp)
+	}
+	if code := doJSON(t, http.MethodPut, ts2.URL+"/api/chargers/CP1/configuration/HeartbeatInterval", map[string]string{}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without value, got %d", code)
+	}
+	if code := doJSON(t, http.MethodPut, ts2.URL+"/api/chargers/CP-OFF/configuration/HeartbeatInterval", map[string]string{"value": "300"}, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an offline charger, got %d", code)
+	}
+
+	var rep chargerconfig.Report
+	if code := doJSON(t, http.MethodPost, ts2.URL+"/api/chargers/CP1/configuration/reconcile", nil, &rep); code != http.StatusOK || len(rep.Drift) != 1 || rep.Drift[0].Status != chargerconfig.DriftApplied {
+		t.Fatalf("reconcile: %d %+v", code, rep)
+	}
+	var desired DesiredConfiguration
+	if code := doJSON(t, http.MethodGet, ts2.URL+"/api/chargers/CP-OFF/configuration/desired", nil, &desired); code != http.StatusOK || desired.Desired["HeartbeatInterval"] != "300" || desired.Report != nil {
+		t.Errorf("desired for offline charger: %d %+v", code, desired)
+	}
+	if code := doJSON(t, http.MethodGet, ts2.URL+"/api/chargers/CP1/configuration/desired", nil, &desired); code != http.StatusOK || desired.Report == nil {
+		t.Errorf("desired: %d %+v", code, desired)
+	}
+}
+
+func TestFirmwareAPI(t *testing.T) {
+	gw, ts := newTestAPI(t)
+	gw.SetCallTimeout(time.Second)
+	repo, err := firmware.OpenRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(gw)
+	srv.Token = "secret"
+	srv.Firmware = firmware.NewManager(gw, repo)
+	srv.Firmware.BaseURL = "http://gw/firmware"
+	defer srv.Firmware.Close()
+	ts2 := httptest.NewServer(srv)
+	defer ts2.Close()
+	if code := doJSON(t, http.MethodGet, ts.URL+"/api/rollouts", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 while firmware is disabled, got %d", code)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, ts2.URL+"/api/firmware/2.0", strings.NewReader("image"))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var img firmware.Image
+	json.NewDecoder(resp.Body).Decode(&img)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || img.Size != 5 || img.SHA256 == "" {
+		t.Fatalf("upload: %d %+v", resp.StatusCode, img)
+	}
+	var images []firmware.Image
+	if doJSON(t, http.MethodGet, ts2.URL+"/api/firmware", nil, &images); len(images) != 1 {
+		t.Fatalf("unexpected images %+v", images)
+	}
+
+	gatewaytest.Connect(t, gw, "CP1", func(gateway.CallRequest) *gateway.CallResult {
+		return &gateway.CallResult{Payload: json.RawMessage(`{}`)}
+	})
+
+	var ro firmware.Rollout
+	if code := doJSON(t, http.MethodPost, ts2.URL+"/api/rollouts", firmware.Spec{Version: "2.0"}, &ro); code != http.StatusAccepted || ro.Progress.Total != 1 {
+		t.Fatalf("create rollout: %d %+v", code, ro)
+	}
+	if code := doJSON(t, http.MethodPost, ts2.URL+"/api/rollouts", firmware.Spec{Version: "9.9"}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown image, got %d", code)
+	}
+	if code := doJSON(t, http.MethodPost, ts2.URL+"/api/rollouts/"+ro.ID+"/pause", nil, &ro); code != http.StatusOK || ro.State != firmware.RolloutPaused {
+		t.Fatalf("pause: %d %+v", code, ro)
+	}
+	if code := doJSON(t, http.MethodPost, ts2.URL+"/api/rollouts/"+ro.ID+"/cancel", nil, &ro); code != http.StatusOK || ro.State != firmware.RolloutCancelled {
+		t.Fatalf("cancel: %d %+v", code, ro)
+	}
+	if code := doJSON(t, http.MethodPost, ts2.URL+"/api/rollouts/"+ro.ID+"/resume", nil, nil); code != http.StatusConflict {
+		t.Errorf("expected 409 resuming a cancelled rollout, got %d", code)
+	}
+	if code := doJSON(t, http.MethodGet, ts2.URL+"/api/rollouts/fw-404", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+	var list []firmware.Rollout
+	if doJSON(t, http.MethodGet, ts2.URL+"/api/rollouts", nil, &list); len(list) != 1 || list[0].Targets != nil {
+		t.Errorf("unexpected rollout list %+v", list)
+	}
+}
+
+func TestDiagnosticsAPI(t *testing.T) {
+	gw, ts := newTestAPI(t)
+	gw.SetCallTimeout(time.Second)
+	if code := doJSON(t, http.MethodGet, ts.URL+"/api/diagnostics", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 while diagnostics are disabled, got %d", code)
+	}
+	srv := NewServer(gw)
+	srv.Token = "secret"
+	store, err := diagnostics.NewStore(gw, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Diagnostics = store
+	ts2 := httptest.NewServer(srv)
+	defer ts2.Close()
+
+	gatewaytest.Connect(t, gw, "CP1", func(gateway.CallRequest) *gateway.CallResult {
+		return &gateway.CallResult{Payload: json.RawMessage(`{"fileName":"cp1.log"}`)}
+	})
+
+	var d diagnostics.Request
+	if code := doJSON(t, http.MethodPost, ts2.URL+"/api/chargers/CP1/diagnostics", nil, &d); code != http.StatusAccepted || d.FileName != "cp1.log" {
+		t.Fatalf("request diagnostics: %d %+v", code, d)
+	}
+	start, stop := time.Now(), time.Now().Add(-time.Hour)
+	if code := doJSON(t, http.MethodPost, ts2.URL+"/api/chargers/CP1/diagnostics", DiagnosticsRequest{StartTime: &start, StopTime: &stop}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an inverted window, got %d", code)
+	}
+	if code := doJSON(t, http.MethodPost, ts2.URL+"/api/chargers/CP-OFF/diagnostics", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an offline charger, got %d", code)
+	}
+	if err := gw.WriteDiagnosticsChunk("CP1", gateway.DiagnosticsChunk{FileName: "cp1.log", Data: []byte("boot ok"), Last: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	var cd ChargerDiagnostics
+	if code := doJSON(t, http.MethodGet, ts2.URL+"/api/chargers/CP1/diagnostics", nil, &cd); code != http.StatusOK || len(cd.Files) != 1 || cd.Requests[0].Status != diagnostics.RequestCompleted {
+		t.Fatalf("charger diagnostics: %d %+v", code, cd)
+	}
+	req, _ := http.NewRequest(http.MethodGet, ts2.URL+"/api/chargers/CP1/diagnostics/cp1.log", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "boot ok" {
+		t.Fatalf("download: %d %q", resp.StatusCode, body)
+	}
+	var all []diagnostics.File
+	if doJSON(t, http.MethodGet, ts2.URL+"/api/diagnostics", nil, &all); len(all) != 1 || all[0].ChargerID != "CP1" {
+		t.Errorf("unexpected files %+v", all)
+	}
+	if code := doJSON(t, http.MethodDelete, ts2.URL+"/api/chargers/CP1/diagnostics/cp1.log", nil, nil); code != http.StatusNoContent {
+		t.Errorf("delete: %d", code)
+	}
+	if code := doJSON(t, http.MethodGet, ts2.URL+"/api/chargers/CP1/diagnostics/cp1.log", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 after delete, got %d", code)
+	}
+}
+
+func TestTokenAPI(t *testing.T) {
+	gw, ts := newTestAPI(t)
+	gw.SetCallTimeout(time.Second)
+	if code := doJSON(t, http.MethodGet, ts.URL+"/api/tokens", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 while the token store is disabled, got %d", code)
+	}
+	srv := NewServer(gw)
+	srv.Token = "secret"
+	srv.Auth = auth.NewManager(gw, auth.NewStore())
+	defer srv.Auth.Close()
+	ts2 := httptest.NewServer(srv)
+	defer ts2.Close()
+
+	var tv TokenView
+	if code := doJSON(t, http.MethodPut, ts2.URL+"/api/tokens/FLEET", TokenRequest{Blocked: true}, &tv); code != http.StatusOK || tv.IDTagInfo.Status != gateway.AuthBlocked {
+		t.Fatalf("put group: %d %+v", code, tv)
+	}
+	if code := doJSON(t, http.MethodPut, ts2.URL+"/api/tokens/CARD1", TokenRequest{ParentIDTag: "FLEET"}, &tv); code != http.StatusOK || tv.Version != 2 || tv.IDTagInfo.Status != gateway.AuthBlocked {
+		t.Fatalf("put card: %d %+v", code, tv)
+	}
+	if code := doJSON(t, http.MethodPut, ts2.URL+"/api/tokens/FLEET", TokenRequest{ParentIDTag: "CARD1"}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a group cycle, got %d", code)
+	}
+	if code := doJSON(t, http.MethodDelete, ts2.URL+"/api/tokens/FLEET", nil, nil); code != http.StatusNoContent {
+		t.Errorf("delete: %d", code)
+	}
+	if code := doJSON(t, http.MethodGet, ts2.URL+"/api/tokens/CARD1", nil, &tv); code != http.StatusOK || tv.IDTagInfo.Status != gateway.AuthAccepted {
+		t.Errorf("get: %d %+v", code, tv)
+	}
+	if code := doJSON(t, http.MethodGet, ts2.URL+"/api/tokens/FLEET", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a deleted tag, got %d", code)
+	}
+	var tokens []TokenView
+	if doJSON(t, http.MethodGet, ts2.URL+"/api/tokens", nil, &tokens); len(tokens) != 1 {
+		t.Errorf("unexpected tokens %+v", tokens)
+	}
+
+	gatewaytest.Connect(t, gw, "CP1", func(req gateway.CallRequest) *gateway.CallResult {
+		payload := json.RawMessage(`{"status":"Accepted"}`)
+		if req.Action == gateway.ActionGetLocalListVersion {
+			payload = json.RawMessage(`{"listVersion":0}`)
+		}
+		return &gateway.CallResult{Payload: payload}
+	})
+	var state auth.SyncState
+	if code := doJSON(t, http.MethodPost, ts2.URL+"/api/chargers/CP1/local-list/sync", nil, &state); code != http.StatusOK || state.Status != auth.SyncUpdated || state.Version != 3 {
+		t.Fatalf("sync: %d %+v", code, state)
+	}
+	if code := doJSON(t, http.MethodPost, ts2.URL+"/api/chargers/CP-OFF/local-list/sync", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an offline charger, got %d", code)
+	}
+	var ll LocalList
+	if doJSON(t, http.MethodGet, ts2.URL+"/api/local-list", nil, &ll); ll.Version != 3 || len(ll.Chargers) != 1 {
+		t.Errorf("unexpected local list %+v", ll)
+	}
+}
+
+func TestSmartChargingAPI(t *testing.T) {
+	gw, ts := newTestAPI(t)
+	if code := doJSON(t, http.MethodGet, ts.URL+"/api/smart-charging/sites", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 while smart charging is disabled, got %d", code)
+	}
+	srv := NewServer(gw)
+	srv.Token = "secret"
+	srv.SmartCharging = smartcharging.NewManager(gw, smartcharging.NewStore())
+	defer srv.SmartCharging.Close()
+	ts2 := httptest.NewServer(srv)
+	defer ts2.Close()
+
+	site := smartcharging.Site{Capacity: 50000, Strategy: "random"}
+	if code := doJSON(t, http.MethodPut, ts2.URL+"/api/smart-charging/sites/S1", site, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown strategy, got %d", code)
+	}
+	site.Strategy = smartcharging.StrategyPriority
+	var st smartcharging.SiteStatus
+	if code := doJSON(t, http.MethodPut, ts2.URL+"/api/smart-charging/sites/S1", site, &st); code != http.StatusOK || st.Site.ID != "S1" || st.Site.Capacity != 50000 {
+		t.Fatalf("put site: %d %+v", code, st)
+	}
+	var sites []smartcharging.SiteStatus
+	if doJSON(t, http.MethodGet, ts2.URL+"/api/smart-charging/sites", nil, &sites); len(sites) != 1 || sites[0].Connectors == nil {
+		t.Errorf("unexpected sites %+v", sites)
+	}
+	if code := doJSON(t, http.MethodDelete, ts2.URL+"/api/smart-charging/sites/S1", nil, nil); code != http.StatusNoContent {
+		t.Errorf("delete: %d", code)
+	}
+	if code := doJSON(t, http.MethodGet, ts2.URL+"/api/smart-charging/sites/S1", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a deleted site, got %d", code)
+	}
+	if code := doJSON(t, http.MethodDelete, ts2.URL+"/api/smart-charging/sites/S1", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 deleting an unknown site, got %d", code)
+	}
+}
+
+func TestChargingProfileAPI(t *testing.T) {
+	gw, ts := newTestAPI(t)
+	if code := doJSON(t, http.MethodGet, ts.URL+"/api/charging-profiles", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 while charging profiles are disabled, got %d", code)
+	}
+	srv := NewServer(gw)
+	srv.Token = "secret"
+	srv.Profiles = chargingprofile.NewManager(gw, chargingprofile.NewStore())
+	defer srv.Profiles.Close()
+	ts2 := httptest.NewServer(srv)
+	defer ts2.Close()
+
+	// 每天 17 点到 21 点限制为 3 kW
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := chargingprofile.Profile{ChargerID: "CP1", ChargingProfile: gateway.ChargingProfile{
+		ChargingProfilePurpose: gateway.PurposeTxDefault,
+		ChargingProfileKind:    gateway.KindRecurring,
+		ChargingSchedule: gateway.ChargingSchedule{
+			StartSchedule:    &start,
+			ChargingRateUnit: gateway.RateUnitW,
+			ChargingSchedulePeriod: []gateway.ChargingSchedulePeriod{
+				{StartPeriod: 0, Limit: 11000}, {StartPeriod: 17 * 3600, Limit: 3000}, {StartPeriod: 21 * 3600, Limit: 11000},
+			},
+		},
+	}}
+	if code := doJSON(t, http.MethodPut, ts2.URL+"/api/charging-profiles/1", p, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a recurrency kind, got %d", code)
+	}
+	p.RecurrencyKind = gateway.RecurrencyDaily
+	var got chargingprofile.Profile
+	if code := doJSON(t, http.MethodPut, ts2.URL+"/api/charging-profiles/1", p, &got); code != http.StatusOK || got.ChargingProfileID != 1 {
+		t.Fatalf("put profile: %d %+v", code, got)
+	}
+	var list []chargingprofile.Profile
+	if doJSON(t, http.MethodGet, ts2.URL+"/api/charging-profiles?charger=CP1", nil, &list); len(list) != 1 {
+		t.Errorf("unexpected profiles %+v", list)
+	}
+	if doJSON(t, http.MethodGet, ts2.URL+"/api/charging-profiles?charger=CP2", nil, &list); len(list) != 0 {
+		t.Errorf("expected no profiles for CP2, got %+v", list)
+	}
+
+	var cs CompositeSchedule
+	if code := doJSON(t, http.MethodGet, ts2.URL+"/api/chargers/CP1/composite-schedule?connector=1&duration=86400", nil, &cs); code != http.StatusOK {
+		t.Fatalf("composite schedule: %d", code)
+	}
+	if s := cs.ChargingSchedule; s.Duration != 86400 || len(s.ChargingSchedulePeriod) < 2 {
+		t.Errorf("expected the peak hours in the composite schedule, got %+v", s)
+	}
+	if code := doJSON(t, http.MethodGet, ts2.URL+"/api/chargers/CP1/composite-schedule?duration=-1", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad duration, got %d", code)
+	}
+	if code := doJSON(t, http.MethodPost, ts2.URL+"/api/chargers/CP1/charging-profiles/push", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 pushing to an offline charger, got %d", code)
+	}
+	if code := doJSON(t, http.MethodDelete, ts2.URL+"/api/charging-profiles/1", nil, nil); code != http.StatusNoContent {
+		t.Errorf("delete: %d", code)
+	}
+	if code := doJSON(t, http.MethodDelete, ts2.URL+"/api/charging-profiles/1", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 deleting an unknown profile, got %d", code)
+	}
+}
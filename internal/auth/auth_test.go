@@ -0,0 +1,292 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/gateway/gatewaytest"
+)
+
+func TestAuthorize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	store, err := LoadStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := gateway.NewGateway()
+	if info := gw.Authorize("CP1", "ANY"); info.Status != gateway.AuthAccepted {
+		t.Fatalf("expected everything accepted without a token store, got %+v", info)
+	}
+	m := NewManager(gw, store)
+	defer m.Close()
+
+	past, soon := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	later := soon.Add(time.Hour)
+	for _, tok := range []Token{
+		{IDTag: "CARD1"},
+		{IDTag: "CARD2", Blocked: true},
+		{IDTag: "CARD3", ExpiryDate: &past},
+		{IDTag: "FLEET", ExpiryDate: &soon},
+		{IDTag: "CARD4", ParentIDTag: "FLEET", ExpiryDate: &later},
+	} {
+		if _, err := m.Put(tok); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for tag, want := range map[string]string{
+		"CARD1":   gateway.AuthAccepted,
+		"CARD2":   gateway.AuthBlocked,
+		"CARD3":   gateway.AuthExpired,
+		"CARD4":   gateway.AuthAccepted,
+		"UNKNOWN": gateway.AuthInvalid,
+	} {
+		if info := gw.Authorize("CP1", tag); info.Status != want {
+			t.Errorf("%s: expected %s, got %+v", tag, want, info)
+		}
+	}
+	// 分组更早过期，组内标签随之过期
+	if info := gw.Authorize("CP1", "CARD4"); info.ParentIDTag != "FLEET" || !info.ExpiryDate.Equal(soon) {
+		t.Errorf("expected the group expiry, got %+v", info)
+	}
+
+	// 修改分组后缓存失效
+	if _, err := m.Put(Token{IDTag: "FLEET", Blocked: true}); err != nil {
+		t.Fatal(err)
+	}
+	if info := gw.Authorize("CP1", "CARD4"); info.Status != gateway.AuthBlocked {
+		t.Errorf("expected CARD4 blocked with its group, got %+v", info)
+	}
+	if _, err := m.Put(Token{IDTag: "FLEET", ParentIDTag: "CARD4"}); !errors.Is(err, ErrBadToken) {
+		t.Errorf("expected a group cycle to be rejected, got %v", err)
+	}
+	if _, err := m.Put(Token{IDTag: "012345678901234567890"}); !errors.Is(err, ErrBadToken) {
+		t.Errorf("expected a long id tag to be rejected, got %v", err)
+	}
+	if err := m.Delete("FLEET"); err != nil {
+		t.Fatal(err)
+	}
+	if info := gw.Authorize("CP1", "CARD4"); info.Status != gateway.AuthAccepted || !info.ExpiryDate.Equal(later) {
+		t.Errorf("expected CARD4 accepted once its group is gone, got %+v", info)
+	}
+	if err := m.Delete("FLEET"); !errors.Is(err, ErrUnknownToken) {
+		t.Errorf("expected ErrUnknownToken, got %v", err)
+	}
+
+	reloaded, err := LoadStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Version() != store.Version() || len(reloaded.List()) != 4 {
+		t.Fatalf("store not persisted: version %d, %+v", reloaded.Version(), reloaded.List())
+	}
+	if _, removed := reloaded.Changes(0); len(removed) != 1 || removed[0] != "FLEET" {
+		t.Errorf("deletion not persisted: %v", removed)
+	}
+}
+
+func TestStoreSaveFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	store, err := LoadStore(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put(Token{IDTag: "CARD1"}); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
+
+	// 写文件失败时标签表和版本都保持原状
+	if _, err := store.Put(Token{IDTag: "CARD2"}); err == nil {
+		t.Fatal("expected save error")
+	}
+	if err := store.Delete("CARD1"); err == nil {
+		t.Fatal("expected save error")
+	}
+	if _, ok := store.Get("CARD2"); ok {
+		t.Error("CARD2 kept after failed save")
+	}
+	if _, ok := store.Get("CARD1"); !ok {
+		t.Error("CARD1 removed after failed save")
+	}
+	if store.Version() != 1 {
+		t.Errorf("version = %d, want 1", store.Version())
+	}
+}
+
+// charger 模拟一个保存本地鉴权列表的充电桩
+type charger struct {
+	mu       sync.Mutex
+	version  int
+	list     map[string]gateway.IDTagInfo
+	requests []gateway.SendLocalListRequest
+	mismatch bool // 拒绝差量更新
+}
+
+func (c *charger) snapshot() (int, map[string]gateway.IDTagInfo, []gateway.SendLocalListRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version, maps.Clone(c.list), append([]gateway.SendLocalListRequest(nil), c.requests...)
+}
+
+func connect(t *testing.T, gw *gateway.Gateway, id string, version int) *charger {
+	t.Helper()
+	c := &charger{version: version, list: make(map[string]gateway.IDTagInfo)}
+	gatewaytest.Connect(t, gw, id, func(req gateway.CallRequest) *gateway.CallResult {
+		var resp any
+		c.mu.Lock()
+		switch req.Action {
+		case gateway.ActionGetLocalListVersion:
+			resp = gateway.GetLocalListVersionResponse{ListVersion: c.version}
+		case gateway.ActionSendLocalList:
+			var r gateway.SendLocalListRequest
+			json.Unmarshal(req.Payload, &r)
+			c.requests = append(c.requests, r)
+			resp = c.apply(r)
+		}
+		c.mu.Unlock()
+		payload, _ := json.Marshal(resp)
+		return &gateway.CallResult{Payload: payload}
+	})
+	gw.Emit(gateway.Event{Type: gateway.EventSessionRegistered, ChargerID: id})
+	return c
+}
+
+func (c *charger) apply(r gateway.SendLocalListRequest) gateway.CommandStatus {
+	if c.version < 0 {
+		return gateway.CommandStatus{Status: gateway.StatusNotSupported}
+	}
+	if r.UpdateType == gateway.UpdateFull {
+		clear(c.list)
+	} else if c.mismatch || r.ListVersion <= c.version {
+		return gateway.CommandStatus{Status: gateway.StatusVersionMismatch}
+	}
+	for _, d := range r.LocalAuthorizationList {
+		if d.IDTagInfo == nil {
+			delete(c.list, d.IDTag)
+		} else {
+			c.list[d.IDTag] = *d.IDTagInfo
+		}
+	}
+	c.version = r.ListVersion
+	return gateway.CommandStatus{Status: gateway.StatusAccepted}
+}
+
+func waitState(t *testing.T, m *Manager, id string, done func(SyncState) bool) SyncState {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s, _ := m.State(id)
+		if done(s) {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not reach the expected sync state: %+v", id, s)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSyncLocalList(t *testing.T) {
+	gw := gatewaytest.NewGateway(t, time.Second)
+
+	store := NewStore()
+	for _, tok := range []Token{{IDTag: "CARD1"}, {IDTag: "CARD2"}, {IDTag: "FLEET"}, {IDTag: "CARD3", ParentIDTag: "FLEET"}} {
+		if _, err := store.Put(tok); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := NewManager(gw, store)
+	m.SyncDelay = 10 * time.Millisecond
+	defer m.Close()
+
+	cp := connect(t, gw, "CP1", 0)
+	connect(t, gw, "CP-OLD", -1)
+	st := waitState(t, m, "CP1", func(s SyncState) bool { return s.Status == SyncUpdated })
+	if st.UpdateType != gateway.UpdateFull || st.Entries != 4 || st.Version != 4 {
+		t.Fatalf("unexpected first sync %+v", st)
+	}
+	waitState(t, m, "CP-OLD", func(s SyncState) bool { return s.Status == SyncNotSupported })
+
+	// 连续的修改合并为一次差量同步
+	m.Put(Token{IDTag: "CARD4"})
+	m.Delete("CARD2")
+	m.Put(Token{IDTag: "FLEET", Blocked: true})
+	st = waitState(t, m, "CP1", func(s SyncState) bool { return s.Version == store.Version() })
+	version, list, reqs := cp.snapshot()
+	if st.UpdateType != gateway.UpdateDifferential || len(reqs) != 2 {
+		t.Fatalf("expected one differential update, got %+v after %d requests", st, len(reqs))
+	}
+	// CARD2 删除，CARD4 新增，FLEET 和组内的 CARD3 状态变化
+	if diff := reqs[1].LocalAuthorizationList; len(diff) != 4 || diff[0].IDTag != "CARD2" || diff[0].IDTagInfo != nil {
+		t.Errorf("unexpected differential list %+v", diff)
+	}
+	if version != 7 || len(list) != 4 || list["CARD3"].Status != gateway.AuthBlocked || list["CARD3"].ParentIDTag != "FLEET" {
+		t.Errorf("unexpected list on the charger: version %d %+v", version, list)
+	}
+	if _, ok := list["CARD2"]; ok {
+		t.Error("CARD2 still on the charger")
+	}
+
+	// 充电桩拒绝差量更新时改发完整列表
+	cp.mu.Lock()
+	cp.mismatch = true
+	cp.mu.Unlock()
+	m.Put(Token{IDTag: "CARD5"})
+	st = waitState(t, m, "CP1", func(s SyncState) bool { return s.Version == store.Version() })
+	if st.UpdateType != gateway.UpdateFull || st.Entries != 5 {
+		t.Errorf("expected a full update after the mismatch, got %+v", st)
+	}
+
+	// 重连时版本一致不再下发
+	_, _, before := cp.snapshot()
+	gw.Emit(gateway.Event{Type: gateway.EventSessionRegistered, ChargerID: "CP1"})
+	waitState(t, m, "CP1", func(s SyncState) bool { return s.Status == SyncUpToDate })
+	if _, _, after := cp.snapshot(); len(after) != len(before) {
+		t.Errorf("list sent again although the charger is up to date")
+	}
+}
+
+func TestSyncAllRegisteredOnly(t *testing.T) {
+	gw := gatewaytest.NewGateway(t, time.Second)
+	store := NewStore()
+	if _, err := store.Put(Token{IDTag: "CARD1"}); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(gw, store)
+	defer m.Close()
+
+	// 未注册的连接和被重连取代的旧连接收到命令时记录下来
+	stray := make(chan string, 4)
+	for _, id := range []string{"", "CP2"} {
+		gatewaytest.Connect(t, gw, id, func(gateway.CallRequest) *gateway.CallResult {
+			stray <- id
+			return nil
+		})
+	}
+	connect(t, gw, "CP1", 0)
+	connect(t, gw, "CP2", 0)
+	waitState(t, m, "CP1", func(s SyncState) bool { return s.Status == SyncUpdated })
+	waitState(t, m, "CP2", func(s SyncState) bool { return s.Status == SyncUpdated })
+
+	m.SyncAll(context.Background())
+	states := m.States()
+	if len(states) != 2 || states[0].ChargerID != "CP1" || states[1].ChargerID != "CP2" {
+		t.Errorf("unexpected sync states %+v", states)
+	}
+	select {
+	case id := <-stray:
+		t.Errorf("stale connection %q received a command", id)
+	default:
+	}
+}
@@ -0,0 +1,346 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/timewheel"
+	"github.com/x14n/evgateway/utils"
+)
+
+// DefaultSyncDelay 是标签修改后等待同步的时间
+const DefaultSyncDelay = 2 * time.Second
+
+// cacheSize 限制鉴权缓存的条目数，未知标签也会缓存，超过后整个清空
+const cacheSize = 10000
+
+// syncConcurrency 限制同时同步列表的充电桩数
+const syncConcurrency = 16
+
+// 本地鉴权列表的同步结果
+const (
+	SyncUpToDate     = "up_to_date"    // 充电桩上的版本已是最新
+	SyncUpdated      = "updated"       // 已下发
+	SyncNotSupported = "not_supported" // 充电桩不支持本地鉴权列表
+	SyncFailed       = "failed"
+)
+
+// SyncState 是充电桩最近一次同步列表的结果，Version 是同步后充电桩上的版本
+type SyncState struct {
+	ChargerID  string    `json:"chargerId"`
+	Version    int       `json:"version"`
+	UpdateType string    `json:"updateType,omitempty"`
+	Entries    int       `json:"entries,omitempty"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// resolved 是沿分组展开后的标签，过期与否在查询时才判断
+type resolved struct {
+	known   bool
+	blocked bool
+	expiry  *time.Time // 标签和各级分组中最早的过期时间
+	parent  string
+}
+
+func (r resolved) info(now time.Time) gateway.IDTagInfo {
+	info := gateway.IDTagInfo{Status: gateway.AuthAccepted, ExpiryDate: r.expiry, ParentIDTag: r.parent}
+	switch {
+	case !r.known:
+		return gateway.IDTagInfo{Status: gateway.AuthInvalid}
+	case r.blocked:
+		info.Status = gateway.AuthBlocked
+	case r.expiry != nil && !now.Before(*r.expiry):
+		info.Status = gateway.AuthExpired
+	}
+	return info
+}
+
+// Manager 回答充电桩的鉴权查询，并在充电桩注册和标签修改后同步本地鉴权列表。
+// 查询只依赖本地的标签表，展开分组的结果按列表版本缓存
+type Manager struct {
+	SyncDelay time.Duration // 标签修改后等待该时间再同步，合并连续的修改
+
+	gw    *gateway.Gateway
+	store *Store
+	sub   *gateway.Subscription
+
+	mu           sync.Mutex
+	cache        map[string]resolved
+	cacheVersion int
+	states       map[string]SyncState
+	syncs        utils.Coalescer // 同步期间列表又有修改，结束后再同步一次
+	timer        *timewheel.Timer
+	closed       bool
+	wg           sync.WaitGroup
+}
+
+// NewManager 设置为网关的鉴权并订阅注册事件，充电桩每次注册都同步一次列表
+func NewManager(gw *gateway.Gateway, store *Store) *Manager {
+	m := &Manager{
+		SyncDelay: DefaultSyncDelay,
+		gw:        gw,
+		store:     store,
+		cache:     make(map[string]resolved),
+		states:    make(map[string]SyncState),
+	}
+	gw.SetAuthorizer(m)
+	m.sub = gw.Subscribe(func(e gateway.Event) {
+		m.spawn(func() { m.Sync(context.Background(), e.ChargerID) })
+	}, gateway.Types(gateway.EventSessionRegistered))
+	return m
+}
+
+// Close 取消订阅和待执行的同步，并等待进行中的同步结束
+func (m *Manager) Close() {
+	m.sub.Close()
+	m.mu.Lock()
+	m.closed = true
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// spawn 在后台执行 f，关闭后不再执行
+func (m *Manager) spawn(f func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		f()
+	}()
+}
+
+// Store 返回标签表
+func (m *Manager) Store() *Store {
+	return m.store
+}
+
+// Put 保存标签，稍后同步到在线的充电桩
+func (m *Manager) Put(t Token) (Token, error) {
+	t, err := m.store.Put(t)
+	if err != nil {
+		return Token{}, err
+	}
+	m.scheduleSync()
+	return t, nil
+}
+
+// Delete 删除标签，稍后同步到在线的充电桩
+func (m *Manager) Delete(idTag string) error {
+	if err := m.store.Delete(idTag); err != nil {
+		return err
+	}
+	m.scheduleSync()
+	return nil
+}
+
+func (m *Manager) scheduleSync() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed || m.timer != nil {
+		return
+	}
+	m.timer = m.gw.Timers().AfterFunc(m.SyncDelay, func() {
+		m.mu.Lock()
+		m.timer = nil
+		m.mu.Unlock()
+		m.spawn(func() { m.SyncAll(context.Background()) })
+	})
+}
+
+// Authorize 实现 gateway.Authorizer。未知标签为 Invalid，标签或任一级分组被禁用为 Blocked，
+// 过期为 Expired
+func (m *Manager) Authorize(chargerID, idTag string) gateway.IDTagInfo {
+	return m.lookup(idTag).info(time.Now())
+}
+
+func (m *Manager) lookup(idTag string) resolved {
+	// 先读版本再展开，缓存的结果不会比版本旧
+	version := m.store.Version()
+	m.mu.Lock()
+	if m.cacheVersion != version || len(m.cache) >= cacheSize {
+		clear(m.cache)
+		m.cacheVersion = version
+	}
+	r, ok := m.cache[idTag]
+	m.mu.Unlock()
+	if ok {
+		return r
+	}
+	r = m.resolve(idTag)
+	m.mu.Lock()
+	if m.cacheVersion == version {
+		m.cache[idTag] = r
+	}
+	m.mu.Unlock()
+	return r
+}
+
+// resolve 沿分组向上展开标签，不存在的分组视为没有分组
+func (m *Manager) resolve(idTag string) resolved {
+	t, ok := m.store.Get(idTag)
+	if !ok {
+		return resolved{}
+	}
+	r := resolved{known: true, blocked: t.Blocked, expiry: t.ExpiryDate, parent: t.ParentIDTag}
+	parent := t.ParentIDTag
+	for range maxGroupDepth {
+		g, ok := m.store.Get(parent)
+		if !ok {
+			break
+		}
+		r.blocked = r.blocked || g.Blocked
+		if g.ExpiryDate != nil && (r.expiry == nil || g.ExpiryDate.Before(*r.expiry)) {
+			r.expiry = g.ExpiryDate
+		}
+		parent = g.ParentIDTag
+	}
+	return r
+}
+
+// State 返回充电桩最近一次同步的结果
+func (m *Manager) State(chargerID string) (SyncState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.states[chargerID]
+	return s, ok
+}
+
+// States 按充电桩 ID 排序返回所有同步结果
+func (m *Manager) States() []SyncState {
+	m.mu.Lock()
+	out := make([]SyncState, 0, len(m.states))
+	for _, s := range m.states {
+		out = append(out, s)
+	}
+	m.mu.Unlock()
+	slices.SortFunc(out, func(a, b SyncState) int { return strings.Compare(a.ChargerID, b.ChargerID) })
+	return out
+}
+
+// SyncAll 同步所有在线的充电桩，未注册和已被重连取代的连接不参与
+func (m *Manager) SyncAll(ctx context.Context) {
+	sem := make(chan struct{}, syncConcurrency)
+	var wg sync.WaitGroup
+	for _, s := range m.gw.Select(gateway.Selector{}) {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			m.Sync(ctx, s.ID)
+		}()
+	}
+	wg.Wait()
+}
+
+// Sync 把列表同步到充电桩，返回同步结果。同一充电桩已有同步在进行时返回 false，
+// 进行中的同步结束后会再同步一次
+func (m *Manager) Sync(ctx context.Context, chargerID string) (SyncState, bool) {
+	var state SyncState
+	ok := m.syncs.Do(ctx, chargerID, func() {
+		state = m.sync(ctx, chargerID)
+		m.mu.Lock()
+		m.states[chargerID] = state
+		m.mu.Unlock()
+	})
+	return state, ok
+}
+
+func (m *Manager) sync(ctx context.Context, chargerID string) SyncState {
+	state := SyncState{ChargerID: chargerID, Time: time.Now()}
+	current, err := m.gw.GetLocalListVersion(ctx, chargerID)
+	if err != nil {
+		state.Status, state.Error = SyncFailed, err.Error()
+		fmt.Printf("[auth] get local list version from %s error: %v\n", chargerID, err)
+		return state
+	}
+	state.Version = current
+	if current < 0 {
+		state.Status = SyncNotSupported
+		return state
+	}
+	// 先读版本再取列表，列表的内容不会比版本旧
+	target := m.store.Version()
+	if current == target {
+		state.Status = SyncUpToDate
+		return state
+	}
+
+	req := m.request(current, target)
+	resp, err := m.gw.SendLocalList(ctx, chargerID, req)
+	if err != nil && req.UpdateType == gateway.UpdateDifferential &&
+		(resp.Status == gateway.StatusVersionMismatch || resp.Status == gateway.StatusFailed) {
+		// 充电桩上的列表与记录的版本对不上，改发完整列表
+		req = m.request(0, target)
+		resp, err = m.gw.SendLocalList(ctx, chargerID, req)
+	}
+	state.UpdateType, state.Entries = req.UpdateType, len(req.LocalAuthorizationList)
+	switch {
+	case err == nil:
+		state.Status, state.Version = SyncUpdated, target
+	case resp.Status == gateway.StatusNotSupported:
+		state.Status = SyncNotSupported
+	default:
+		state.Status, state.Error = SyncFailed, err.Error()
+	}
+	fmt.Printf("[auth] local list %s %d -> %d (%s, %d entries): %s\n", chargerID, current, target, req.UpdateType, state.Entries, state.Status)
+	return state
+}
+
+// request 生成从 current 版本更新到 target 版本的列表。充电桩没有列表或版本比记录的新时发完整列表。
+// 差量列表除了修改过的标签，还包括分组有变化的标签
+func (m *Manager) request(current, target int) gateway.SendLocalListRequest {
+	now := time.Now()
+	req := gateway.SendLocalListRequest{ListVersion: target, UpdateType: gateway.UpdateFull}
+	tokens := m.store.List()
+	if current > 0 && current < target {
+		req.UpdateType = gateway.UpdateDifferential
+		changed, removed := m.store.Changes(current)
+		touched := make(map[string]bool, len(changed)+len(removed))
+		for _, t := range changed {
+			touched[t.IDTag] = true
+		}
+		for _, tag := range removed {
+			touched[tag] = true
+		}
+		tokens = slices.DeleteFunc(tokens, func(t Token) bool { return !m.groupTouched(t, touched) })
+		for _, tag := range removed {
+			req.LocalAuthorizationList = append(req.LocalAuthorizationList, gateway.AuthorizationData{IDTag: tag})
+		}
+	}
+	for _, t := range tokens {
+		info := m.lookup(t.IDTag).info(now)
+		req.LocalAuthorizationList = append(req.LocalAuthorizationList, gateway.AuthorizationData{IDTag: t.IDTag, IDTagInfo: &info})
+	}
+	return req
+}
+
+// groupTouched 判断标签本身或任一级分组是否在 touched 中
+func (m *Manager) groupTouched(t Token, touched map[string]bool) bool {
+	tag := t.IDTag
+	for range maxGroupDepth + 1 {
+		if touched[tag] {
+			return true
+		}
+		g, ok := m.store.Get(tag)
+		if !ok || g.ParentIDTag == "" {
+			return false
+		}
+		tag = g.ParentIDTag
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+// Package auth 保存 RFID 卡等 ID 标签，回答充电桩的鉴权查询，并把本地鉴权列表同步到充电桩。
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/utils"
+)
+
+// MaxIDTagLength 是 OCPP 1.6 IdToken 的最大长度
+const MaxIDTagLength = 20
+
+// maxGroupDepth 限制分组的嵌套层数
+const maxGroupDepth = 8
+
+var (
+	ErrBadToken     = errors.New("bad id tag")
+	ErrUnknownToken = errors.New("unknown id tag")
+)
+
+// Token 是一个 ID 标签。ParentIDTag 指向所属分组，分组本身也是一个 Token，
+// 分组被禁用或过期时组内的标签一同失效
+type Token struct {
+	IDTag       string     `json:"idTag"`
+	ParentIDTag string     `json:"parentIdTag,omitempty"`
+	ExpiryDate  *time.Time `json:"expiryDate,omitempty"`
+	Blocked     bool       `json:"blocked,omitempty"`
+	Version     int        `json:"version"` // 最后一次修改时的列表版本
+}
+
+// Store 是 ID 标签表。每次修改列表版本加一，删除的标签保留删除时的版本，
+// 用于向充电桩发送差量列表。设置了文件时每次修改都写回文件
+type Store struct {
+	path string
+
+	mu      sync.RWMutex
+	version int
+	tokens  map[string]Token
+	removed map[string]int
+}
+
+type storeFile struct {
+	Version int            `json:"version"`
+	Tokens  []Token        `json:"tokens"`
+	Removed map[string]int `json:"removed,omitempty"`
+}
+
+// NewStore 创建只在内存中的标签表
+func NewStore() *Store {
+	return &Store{tokens: make(map[string]Token), removed: make(map[string]int)}
+}
+
+// LoadStore 从 JSON 文件加载标签表，文件不存在时为空
+func LoadStore(path string) (*Store, error) {
+	s := NewStore()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f storeFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse token file: %w", err)
+	}
+	s.version = f.Version
+	for _, t := range f.Tokens {
+		s.tokens[t.IDTag] = t
+	}
+	for tag, v := range f.Removed {
+		s.removed[tag] = v
+	}
+	return s, nil
+}
+
+// Version 返回列表版本，每次修改加一
+func (s *Store) Version() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.version
+}
+
+// Get 按原样匹配查找标签
+func (s *Store) Get(idTag string) (Token, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tokens[idTag]
+	return t, ok
+}
+
+// List 按标签排序返回所有标签
+func (s *Store) List() []Token {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		out = append(out, t)
+	}
+	slices.SortFunc(out, func(a, b Token) int { return strings.Compare(a.IDTag, b.IDTag) })
+	return out
+}
+
+// Put 新增或修改标签，返回保存后的标签
+func (s *Store) Put(t Token) (Token, error) {
+	if t.IDTag == "" || len(t.IDTag) > MaxIDTagLength || len(t.ParentIDTag) > MaxIDTagLength {
+		return Token{}, fmt.Errorf("%w: id tag must be 1 to %d characters", ErrBadToken, MaxIDTagLength)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkParent(t.IDTag, t.ParentIDTag); err != nil {
+		return Token{}, err
+	}
+	tokens, removed := maps.Clone(s.tokens), maps.Clone(s.removed)
+	t.Version = s.version + 1
+	tokens[t.IDTag] = t
+	delete(removed, t.IDTag)
+	if err := s.save(t.Version, tokens, removed); err != nil {
+		return Token{}, err
+	}
+	return t, nil
+}
+
+// checkParent 拒绝成环或过深的分组。调用方持锁
+func (s *Store) checkParent(idTag, parent string) error {
+	for depth := 0; parent != ""; depth++ {
+		if parent == idTag {
+			return fmt.Errorf("%w: %s is its own group", ErrBadToken, idTag)
+		}
+		if depth == maxGroupDepth {
+			return fmt.Errorf("%w: groups nested deeper than %d", ErrBadToken, maxGroupDepth)
+		}
+		parent = s.tokens[parent].ParentIDTag
+	}
+	return nil
+}
+
+// Delete 删除标签。组内的标签保留，分组不存在时视为没有分组
+func (s *Store) Delete(idTag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[idTag]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownToken, idTag)
+	}
+	tokens, removed := maps.Clone(s.tokens), maps.Clone(s.removed)
+	delete(tokens, idTag)
+	removed[idTag] = s.version + 1
+	return s.save(s.version+1, tokens, removed)
+}
+
+// Changes 返回 since 版本之后修改和删除的标签
+func (s *Store) Changes(since int) (changed []Token, removed []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tokens {
+		if t.Version > since {
+			changed = append(changed, t)
+		}
+	}
+	for tag, v := range s.removed {
+		if v > since {
+			removed = append(removed, tag)
+		}
+	}
+	slices.SortFunc(changed, func(a, b Token) int { return strings.Compare(a.IDTag, b.IDTag) })
+	slices.Sort(removed)
+	return changed, removed
+}
+
+// save 把修改后的副本写回文件，成功后才替换内存中的标签表，写失败时保持原状。调用方持锁
+func (s *Store) save(version int, tokens map[string]Token, removed map[string]int) error {
+	f := storeFile{Version: version, Tokens: make([]Token, 0, len(tokens)), Removed: removed}
+	for _, t := range tokens {
+		f.Tokens = append(f.Tokens, t)
+	}
+	slices.SortFunc(f.Tokens, func(a, b Token) int { return strings.Compare(a.IDTag, b.IDTag) })
+	if err := utils.SaveJSON(s.path, f); err != nil {
+		return err
+	}
+	s.version, s.tokens, s.removed = version, tokens, removed
+	return nil
+}
@@ -0,0 +1,234 @@
+package chargerconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/utils"
+)
+
+// 偏差项的处理结果
+const (
+	DriftPending        = "pending"         // 充电桩离线，等重连时修正
+	DriftApplied        = "applied"         // 已修改
+	DriftRebootRequired = "reboot_required" // 已修改，重启后生效
+	DriftRejected       = "rejected"        // 充电桩拒绝修改
+	DriftReadonly       = "readonly"        // 只读配置，无法修正
+	DriftFailed         = "failed"          // 下发失败或超时
+)
+
+// ErrReconcileRunning 表示同一充电桩已有核对在进行，由手动触发的 Reconcile 返回
+var ErrReconcileRunning = errors.New("reconcile already in progress")
+
+// Drift 是一个与期望不一致的配置项，Actual 为 nil 表示充电桩没有上报该键
+type Drift struct {
+	Key     string  `json:"key"`
+	Desired string  `json:"desired"`
+	Actual  *string `json:"actual,omitempty"`
+	Status  string  `json:"status"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Report 是最近一次核对的结果
+type Report struct {
+	ChargerID string                     `json:"chargerId"`
+	Time      time.Time                  `json:"time"`
+	Actual    []gateway.ConfigurationKey `json:"actual"`
+	Drift     []Drift                    `json:"drift"`
+	Error     string                     `json:"error,omitempty"` // 读取配置失败的原因
+}
+
+// Manager 在充电桩注册后读取实际配置，与期望配置比较并下发不一致的项
+type Manager struct {
+	gw    *gateway.Gateway
+	store *Store
+	sub   *gateway.Subscription
+
+	mu      sync.Mutex
+	reports map[string]Report
+	running map[string]chan struct{} // 正在核对的充电桩，核对结束时关闭
+	runs    utils.Coalescer          // 注册触发的核对期间充电桩又注册了，结束后再核对一次
+	wg      sync.WaitGroup
+}
+
+// NewManager 订阅注册事件，有期望配置的充电桩每次注册都核对一次
+func NewManager(gw *gateway.Gateway, store *Store) *Manager {
+	m := &Manager{
+		gw:      gw,
+		store:   store,
+		reports: make(map[string]Report),
+		running: make(map[string]chan struct{}),
+	}
+	m.sub = gw.Subscribe(func(e gateway.Event) {
+		if len(m.store.Desired(e.ChargerID)) == 0 {
+			return
+		}
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.runs.Do(context.Background(), e.ChargerID, func() {
+				end, _ := m.begin(e.ChargerID, true)
+				defer end()
+				if _, err := m.reconcile(context.Background(), e.ChargerID); errors.Is(err, gateway.ErrNotSupported) {
+					fmt.Printf("[config] %s cannot read configuration, skip reconcile: %v\n", e.ChargerID, err)
+				}
+			})
+		}()
+	}, gateway.Types(gateway.EventSessionRegistered))
+	return m
+}
+
+// Close 取消订阅并等待进行中的核对结束
+func (m *Manager) Close() {
+	m.sub.Close()
+	m.wg.Wait()
+}
+
+// Store 返回期望配置
+func (m *Manager) Store() *Store {
+	return m.store
+}
+
+// Set 保存期望值，充电桩在线时立即下发。离线时返回 gateway.ErrChargerOffline，期望值仍然保存，重连时修正
+func (m *Manager) Set(ctx context.Context, chargerID, key, value string) (gateway.CommandStatus, error) {
+	if err := m.store.Set(chargerID, key, value); err != nil {
+		return gateway.CommandStatus{}, err
+	}
+	return m.gw.ChangeConfiguration(ctx, chargerID, key, value)
+}
+
+// Report 返回最近一次核对的结果
+func (m *Manager) Report(chargerID string) (Report, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.reports[chargerID]
+	return r, ok
+}
+
+// Reconcile 读取充电桩的全部配置，下发与期望不一致的项，返回核对结果。
+// 同一充电桩已有核对在进行时返回 ErrReconcileRunning，协议版本不支持读写配置时返回 gateway.ErrNotSupported
+func (m *Manager) Reconcile(ctx context.Context, chargerID string) (Report, error) {
+	end, ok := m.begin(chargerID, false)
+	if !ok {
+		return Report{}, ErrReconcileRunning
+	}
+	defer end()
+	return m.reconcile(ctx, chargerID)
+}
+
+// begin 登记一次核对，返回结束时调用的 end。已有核对在进行时，wait 为 true 则等它结束，否则返回 false
+func (m *Manager) begin(chargerID string, wait bool) (end func(), ok bool) {
+	for {
+		m.mu.Lock()
+		running, busy := m.running[chargerID]
+		if !busy {
+			done := make(chan struct{})
+			m.running[chargerID] = done
+			m.mu.Unlock()
+			return func() {
+				m.mu.Lock()
+				delete(m.running, chargerID)
+				m.mu.Unlock()
+				close(done)
+			}, true
+		}
+		m.mu.Unlock()
+		if !wait {
+			return nil, false
+		}
+		<-running
+	}
+}
+
+func (m *Manager) reconcile(ctx context.Context, chargerID string) (Report, error) {
+	report := Report{ChargerID: chargerID, Time: time.Now()}
+	actual, err := m.gw.GetConfiguration(ctx, chargerID)
+	if errors.Is(err, gateway.ErrNotSupported) {
+		return Report{}, err
+	}
+	if err != nil {
+		fmt.Printf("[config] get configuration from %s error: %v\n", chargerID, err)
+		report.Error = err.Error()
+		m.setReport(report)
+		return report, nil
+	}
+	report.Actual = actual.ConfigurationKey
+	report.Drift = diff(m.store.Desired(chargerID), actual)
+	if len(report.Drift) > 0 {
+		m.gw.Emit(gateway.Event{Type: gateway.EventConfigDrift, ChargerID: chargerID, Data: report.Drift})
+	}
+
+	for i := range report.Drift {
+		d := &report.Drift[i]
+		if d.Status == DriftReadonly {
+			continue
+		}
+		resp, err := m.gw.ChangeConfiguration(ctx, chargerID, d.Key, d.Desired)
+		switch {
+		case err == nil && resp.Status == gateway.StatusRebootRequired:
+			d.Status = DriftRebootRequired
+		case err == nil:
+			d.Status = DriftApplied
+		case errors.Is(err, gateway.ErrCommandRejected):
+			d.Status = DriftRejected
+			d.Error = err.Error()
+		default:
+			d.Status = DriftFailed
+			d.Error = err.Error()
+		}
+		fmt.Printf("[config] %s %s: %q -> %q %s\n", chargerID, d.Key, deref(d.Actual), d.Desired, d.Status)
+	}
+	m.setReport(report)
+	return report, nil
+}
+
+func (m *Manager) setReport(r Report) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reports[r.ChargerID] = r
+}
+
+// diff 按键排序列出实际值与期望不一致的项
+func diff(desired map[string]string, actual gateway.GetConfigurationResponse) []Drift {
+	reported := make(map[string]gateway.ConfigurationKey, len(actual.ConfigurationKey))
+	for _, kv := range actual.ConfigurationKey {
+		reported[kv.Key] = kv
+	}
+	var out []Drift
+	for key, want := range desired {
+		kv, ok := reported[key]
+		if ok && kv.Value != nil && *kv.Value == want {
+			continue
+		}
+		d := Drift{Key: key, Desired: want, Status: DriftPending}
+		if ok {
+			d.Actual = kv.Value
+			if kv.Readonly {
+				d.Status = DriftReadonly
+			}
+		}
+		out = append(out, d)
+	}
+	slices.SortFunc(out, func(a, b Drift) int {
+		switch {
+		case a.Key < b.Key:
+			return -1
+		case a.Key > b.Key:
+			return 1
+		}
+		return 0
+	})
+	return out
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
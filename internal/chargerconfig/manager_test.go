@@ -0,0 +1,266 @@
+package chargerconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/gateway/gatewaytest"
+	"github.com/x14n/evgateway/internal/transport"
+)
+
+// charger 模拟一个按 OCPP 1.6 读写配置的充电桩
+type charger struct {
+	mu       sync.Mutex
+	config   map[string]string
+	readonly map[string]bool
+	reject   map[string]bool
+	changes  []string
+}
+
+func (c *charger) reply(req gateway.CallRequest) gateway.CallResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch req.Action {
+	case gateway.ActionGetConfiguration:
+		var resp gateway.GetConfigurationResponse
+		for k, v := range c.config {
+			resp.ConfigurationKey = append(resp.ConfigurationKey, gateway.ConfigurationKey{Key: k, Readonly: c.readonly[k], Value: &v})
+		}
+		data, _ := json.Marshal(resp)
+		return gateway.CallResult{Payload: data}
+	case gateway.ActionChangeConfiguration:
+		var req2 gateway.ChangeConfigurationRequest
+		json.Unmarshal(req.Payload, &req2)
+		status := gateway.StatusAccepted
+		if c.reject[req2.Key] {
+			status = gateway.StatusRejected
+		} else {
+			c.config[req2.Key] = req2.Value
+			c.changes = append(c.changes, req2.Key)
+		}
+		data, _ := json.Marshal(gateway.CommandStatus{Status: status})
+		return gateway.CallResult{Payload: data}
+	}
+	return gateway.CallResult{ErrorCode: "NotImplemented"}
+}
+
+func connect(t *testing.T, gw *gateway.Gateway, id string, c *charger) {
+	t.Helper()
+	gatewaytest.Connect(t, gw, id, func(req gateway.CallRequest) *gateway.CallResult {
+		r := c.reply(req)
+		return &r
+	})
+}
+
+func TestReconcileOnRegister(t *testing.T) {
+	gw := gatewaytest.NewGateway(t, 200*time.Millisecond)
+	store := NewStore()
+	store.Set("CP1", "HeartbeatInterval", "300")
+	store.Set("CP1", "MeterValueSampleInterval", "60")
+	store.Set("CP1", "ChargePointVendor", "acme")
+	store.Set("CP1", "LocalAuthListEnabled", "true")
+	m := NewManager(gw, store)
+	defer m.Close()
+
+	drift := make(chan gateway.Event, 1)
+	sub := gw.Subscribe(func(e gateway.Event) { drift <- e }, gateway.Types(gateway.EventConfigDrift))
+	defer sub.Close()
+
+	c := &charger{
+		config: map[string]string{
+			"HeartbeatInterval":        "60",
+			"MeterValueSampleInterval": "60",
+			"ChargePointVendor":        "other",
+			"LocalAuthListEnabled":     "false",
+		},
+		readonly: map[string]bool{"ChargePointVendor": true},
+		reject:   map[string]bool{"LocalAuthListEnabled": true},
+	}
+	connect(t, gw, "CP1", c)
+	gw.Emit(gateway.Event{Type: gateway.EventSessionRegistered, ChargerID: "CP1"})
+
+	select {
+	case e := <-drift:
+		if d, _ := e.Data.([]Drift); len(d) != 3 {
+			t.Fatalf("expected 3 drifted keys, got %+v", e.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no drift event")
+	}
+
+	var rep Report
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var ok bool
+		if rep, ok = m.Report("CP1"); ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	want := map[string]string{
+		"ChargePointVendor":    DriftReadonly,
+		"HeartbeatInterval":    DriftApplied,
+		"LocalAuthListEnabled": DriftRejected,
+	}
+	if len(rep.Drift) != len(want) {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	for _, d := range rep.Drift {
+		if want[d.Key] != d.Status {
+			t.Errorf("%s: expected %s, got %s", d.Key, want[d.Key], d.Status)
+		}
+	}
+	c.mu.Lock()
+	if c.config["HeartbeatInterval"] != "300" || len(c.changes) != 1 {
+		t.Errorf("unexpected charger config %v changes %v", c.config, c.changes)
+	}
+	c.mu.Unlock()
+
+	// 已修正的键再次核对不应有偏差
+	rep, _ = m.Reconcile(context.Background(), "CP1")
+	if len(rep.Drift) != 2 {
+		t.Errorf("expected only readonly and rejected keys left, got %+v", rep.Drift)
+	}
+}
+
+func TestRegisterDuringReconcile(t *testing.T) {
+	gw := gatewaytest.NewGateway(t, 5*time.Second)
+	store := NewStore()
+	store.Set("CP1", "HeartbeatInterval", "300")
+	m := NewManager(gw, store)
+	defer m.Close()
+
+	c := &charger{config: map[string]string{"HeartbeatInterval": "300"}}
+	gets := make(chan struct{}, 4)
+	release := make(chan struct{})
+	gatewaytest.Connect(t, gw, "CP1", func(req gateway.CallRequest) *gateway.CallResult {
+		if req.Action == gateway.ActionGetConfiguration {
+			gets <- struct{}{}
+			<-release
+		}
+		r := c.reply(req)
+		return &r
+	})
+
+	gw.Emit(gateway.Event{Type: gateway.EventSessionRegistered, ChargerID: "CP1"})
+	select {
+	case <-gets:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no reconcile after register")
+	}
+	// 第一次核对卡在 GetConfiguration 时又注册两次，只补核对一次
+	gw.Emit(gateway.Event{Type: gateway.EventSessionRegistered, ChargerID: "CP1"})
+	gw.Emit(gateway.Event{Type: gateway.EventSessionRegistered, ChargerID: "CP1"})
+	if _, err := m.Reconcile(context.Background(), "CP1"); !errors.Is(err, ErrReconcileRunning) {
+		t.Fatalf("expected ErrReconcileRunning, got %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	select {
+	case <-gets:
+	case <-time.After(2 * time.Second):
+		t.Fatal("registration during reconcile was dropped")
+	}
+	m.Close()
+	if n := len(gets); n != 0 {
+		t.Errorf("expected exactly two reconciles, got %d more", n)
+	}
+}
+
+// noConfig 模拟不支持读写配置的链路，例如 OCPP 2.0.1
+type noConfig struct {
+	transport.Transport
+}
+
+func (noConfig) Call(ctx context.Context, action string, req, resp any) error {
+	return gateway.ErrNotSupported
+}
+
+func TestReconcileNotSupported(t *testing.T) {
+	gw := gatewaytest.NewGateway(t, 200*time.Millisecond)
+	store := NewStore()
+	store.Set("CP1", "HeartbeatInterval", "300")
+	m := NewManager(gw, store)
+	defer m.Close()
+
+	server, conn := transport.Pipe()
+	defer conn.Close()
+	gw.AddSession(&gateway.Session{ID: "CP1", Addr: "CP1", Transport: noConfig{server}})
+
+	if _, err := m.Reconcile(context.Background(), "CP1"); !errors.Is(err, gateway.ErrNotSupported) {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+	if rep, ok := m.Report("CP1"); ok {
+		t.Errorf("unsupported charger should not get a failure report: %+v", rep)
+	}
+	if _, err := m.Set(context.Background(), "CP1", "HeartbeatInterval", "60"); !errors.Is(err, gateway.ErrNotSupported) {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestSetOffline(t *testing.T) {
+	gw := gatewaytest.NewGateway(t, 200*time.Millisecond)
+	path := filepath.Join(t.TempDir(), "desired.json")
+	store, err := LoadStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(gw, store)
+	defer m.Close()
+
+	if _, err := m.Set(context.Background(), "CP1", "HeartbeatInterval", "120"); err == nil {
+		t.Fatal("expected offline error")
+	}
+	reloaded, err := LoadStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := reloaded.Desired("CP1")["HeartbeatInterval"]; v != "120" {
+		t.Fatalf("desired value not persisted, got %q", v)
+	}
+
+	c := &charger{config: map[string]string{"HeartbeatInterval": "60"}}
+	connect(t, gw, "CP1", c)
+	if resp, err := m.Set(context.Background(), "CP1", "HeartbeatInterval", "90"); err != nil || resp.Status != gateway.StatusAccepted {
+		t.Fatalf("set online: %+v %v", resp, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.config["HeartbeatInterval"] != "90" {
+		t.Errorf("expected value applied, got %q", c.config["HeartbeatInterval"])
+	}
+}
+
+func TestStoreSaveFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	store, err := LoadStore(filepath.Join(dir, "desired.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("CP1", "HeartbeatInterval", "60"); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
+
+	// 写文件失败时内存中的期望值保持原状
+	if err := store.Set("CP1", "HeartbeatInterval", "120"); err == nil {
+		t.Fatal("expected save error")
+	}
+	if err := store.Delete("CP1", "HeartbeatInterval"); err == nil {
+		t.Fatal("expected save error")
+	}
+	if v := store.Desired("CP1")["HeartbeatInterval"]; v != "60" {
+		t.Fatalf("desired = %q, want 60", v)
+	}
+}
@@ -0,0 +1,94 @@
+// Package chargerconfig 保存每个充电桩的期望配置，发现实际配置的偏差并在重连时自动修正。
+package chargerconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"sync"
+
+	"github.com/x14n/evgateway/utils"
+)
+
+// Store 是期望配置，按充电桩 ID 和配置键保存值。设置了文件时每次修改都写回文件
+type Store struct {
+	path string
+
+	mu      sync.RWMutex
+	desired map[string]map[string]string
+}
+
+// NewStore 创建只在内存中的期望配置
+func NewStore() *Store {
+	return &Store{desired: make(map[string]map[string]string)}
+}
+
+// LoadStore 从 JSON 文件加载期望配置，格式为 {"充电桩ID": {"键": "值"}}，文件不存在时为空
+func LoadStore(path string) (*Store, error) {
+	s := NewStore()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.desired); err != nil {
+		return nil, fmt.Errorf("parse desired config file: %w", err)
+	}
+	if s.desired == nil {
+		s.desired = make(map[string]map[string]string)
+	}
+	return s, nil
+}
+
+// Desired 返回充电桩的期望配置副本
+func (s *Store) Desired(chargerID string) map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.desired[chargerID])
+}
+
+// Set 设置期望值
+func (s *Store) Set(chargerID, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	desired := maps.Clone(s.desired)
+	m := maps.Clone(desired[chargerID])
+	if m == nil {
+		m = make(map[string]string)
+	}
+	m[key] = value
+	desired[chargerID] = m
+	return s.save(desired)
+}
+
+// Delete 删除期望值，之后不再修正该键
+func (s *Store) Delete(chargerID, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.desired[chargerID][key]; !ok {
+		return nil
+	}
+	desired := maps.Clone(s.desired)
+	m := maps.Clone(desired[chargerID])
+	delete(m, key)
+	if len(m) == 0 {
+		delete(desired, chargerID)
+	} else {
+		desired[chargerID] = m
+	}
+	return s.save(desired)
+}
+
+// save 把修改后的副本写回文件，成功后才替换内存中的配置，写失败时保持原状。调用方持锁
+func (s *Store) save(desired map[string]map[string]string) error {
+	if err := utils.SaveJSON(s.path, desired); err != nil {
+		return err
+	}
+	s.desired = desired
+	return nil
+}
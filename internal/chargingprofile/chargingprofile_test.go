@@ -0,0 +1,328 @@
+package chargingprofile
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/gateway/gatewaytest"
+	"github.com/x14n/evgateway/internal/handlers"
+)
+
+var day = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func at(d time.Duration) *time.Time {
+	t := day.Add(d)
+	return &t
+}
+
+func periods(unit string, startLimit ...float64) gateway.ChargingSchedule {
+	s := gateway.ChargingSchedule{ChargingRateUnit: unit}
+	for i := 0; i < len(startLimit); i += 2 {
+		s.ChargingSchedulePeriod = append(s.ChargingSchedulePeriod, gateway.ChargingSchedulePeriod{
+			StartPeriod: int(startLimit[i]), Limit: startLimit[i+1],
+		})
+	}
+	return s
+}
+
+// peakHours 是整桩的缺省曲线，每天 17 点到 21 点限制为 3 kW
+func peakHours(id int) Profile {
+	s := periods(gateway.RateUnitW, 0, 11000, 17*3600, 3000, 21*3600, 11000)
+	s.StartSchedule = at(0)
+	return Profile{ChargerID: "CP1", ChargingProfile: gateway.ChargingProfile{
+		ChargingProfileID:      id,
+		ChargingProfilePurpose: gateway.PurposeTxDefault,
+		ChargingProfileKind:    gateway.KindRecurring,
+		RecurrencyKind:         gateway.RecurrencyDaily,
+		ChargingSchedule:       s,
+	}}
+}
+
+func TestComposite(t *testing.T) {
+	// 枪 1 在 1 月 2 日 18 点起暂停 1 小时
+	pause := periods(gateway.RateUnitW, 0, 0)
+	pause.StartSchedule, pause.Duration = at(42*time.Hour), 3600
+	// 1 月 2 日 20 点起整桩不超过 7.4 kW
+	max := periods(gateway.RateUnitW, 0, 7400)
+	max.StartSchedule = at(0)
+	// 交易 42 开始后的半小时单相 16 A
+	boost := periods(gateway.RateUnitA, 0, 16)
+	boost.ChargingSchedulePeriod[0].NumberPhases = 1
+	boost.Duration = 1800
+	profiles := []Profile{
+		peakHours(1),
+		{ChargerID: "CP1", ConnectorID: 1, ChargingProfile: gateway.ChargingProfile{
+			ChargingProfileID: 2, StackLevel: 1, ChargingProfilePurpose: gateway.PurposeTxDefault,
+			ChargingProfileKind: gateway.KindAbsolute, ChargingSchedule: pause,
+		}},
+		{ChargerID: "CP1", ChargingProfile: gateway.ChargingProfile{
+			ChargingProfileID: 3, ChargingProfilePurpose: gateway.PurposeChargePointMax,
+			ChargingProfileKind: gateway.KindAbsolute, ValidFrom: at(44 * time.Hour), ChargingSchedule: max,
+		}},
+		{ChargerID: "CP1", ConnectorID: 1, ChargingProfile: gateway.ChargingProfile{
+			ChargingProfileID: 4, TransactionID: 42, ChargingProfilePurpose: gateway.PurposeTx,
+			ChargingProfileKind: gateway.KindRelative, ChargingSchedule: boost,
+		}},
+	}
+	from := day.Add(40 * time.Hour) // 1 月 2 日 16 点
+	for _, tc := range []struct {
+		name     string
+		profiles []Profile
+		target   Target
+		from     time.Time
+		want     []float64 // 依次为 StartPeriod 和 Limit
+	}{
+		{"charger", profiles, Target{}, from,
+			[]float64{0, 11000, 3600, 3000, 5 * 3600, 7400}},
+		{"other connector", profiles, Target{ConnectorID: 2}, from,
+			[]float64{0, 11000, 3600, 3000, 5 * 3600, 7400}},
+		{"connector pause", profiles, Target{ConnectorID: 1}, from,
+			[]float64{0, 11000, 3600, 3000, 2 * 3600, 0, 3 * 3600, 3000, 5 * 3600, 7400}},
+		{"transaction", profiles, Target{ConnectorID: 1, TransactionID: 42, Started: from.Add(30 * time.Minute)}, from,
+			[]float64{0, 11000, 1800, 3680, 3600, 3000, 2 * 3600, 0, 3 * 3600, 3000, 5 * 3600, 7400}},
+		{"next day", profiles, Target{ConnectorID: 2}, day.Add(44 * time.Hour),
+			[]float64{0, 3000, 3600, 7400, 21 * 3600, 3000}},
+		{"no profiles", nil, Target{ConnectorID: 1}, from,
+			[]float64{0, DefaultMaxPower}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := Composite(tc.profiles, tc.target, tc.from, 24*time.Hour, DefaultMaxPower)
+			var got []float64
+			for _, p := range s.ChargingSchedulePeriod {
+				got = append(got, float64(p.StartPeriod), p.Limit)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+			if s.ChargingRateUnit != gateway.RateUnitW || s.Duration != 24*3600 || !s.StartSchedule.Equal(tc.from) {
+				t.Errorf("unexpected schedule %+v", s)
+			}
+		})
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	s, err := LoadStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := peakHours(1)
+	bad.ConnectorID = 1
+	bad.ChargingProfilePurpose = gateway.PurposeChargePointMax
+	unordered := peakHours(1)
+	unordered.ChargingSchedule = periods(gateway.RateUnitW, 0, 1000, 60, 2000, 30, 3000)
+	noStart := peakHours(1)
+	noStart.ChargingSchedule.StartSchedule = nil
+	for _, p := range []Profile{bad, unordered, noStart} {
+		if _, _, err := s.Put(p); !errors.Is(err, ErrBadProfile) {
+			t.Errorf("expected ErrBadProfile for %+v, got %v", p, err)
+		}
+	}
+	if _, _, err := s.Put(peakHours(1)); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := reloaded.Get(1); !ok || p.RecurrencyKind != gateway.RecurrencyDaily || len(p.ChargingSchedule.ChargingSchedulePeriod) != 3 {
+		t.Fatalf("profile not persisted: %+v", reloaded.List(""))
+	}
+	if _, err := s.Delete(2); !errors.Is(err, ErrUnknownProfile) {
+		t.Errorf("expected ErrUnknownProfile, got %v", err)
+	}
+}
+
+// charger 模拟一个保存充电曲线的充电桩
+type charger struct {
+	mu       sync.Mutex
+	profiles map[int]gateway.SetChargingProfileRequest
+}
+
+func (c *charger) snapshot() map[int]gateway.SetChargingProfileRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.profiles)
+}
+
+func connect(t *testing.T, gw *gateway.Gateway, id string) *charger {
+	t.Helper()
+	c := &charger{profiles: make(map[int]gateway.SetChargingProfileRequest)}
+	gatewaytest.Connect(t, gw, id, func(req gateway.CallRequest) *gateway.CallResult {
+		resp := gateway.CommandStatus{Status: gateway.StatusAccepted}
+		c.mu.Lock()
+		switch req.Action {
+		case gateway.ActionSetChargingProfile:
+			var r gateway.SetChargingProfileRequest
+			json.Unmarshal(req.Payload, &r)
+			c.profiles[r.CsChargingProfiles.ChargingProfileID] = r
+		case gateway.ActionClearChargingProfile:
+			var r gateway.ClearChargingProfileRequest
+			json.Unmarshal(req.Payload, &r)
+			if _, ok := c.profiles[*r.ID]; !ok {
+				resp.Status = gateway.StatusUnknown
+			}
+			delete(c.profiles, *r.ID)
+		}
+		c.mu.Unlock()
+		payload, _ := json.Marshal(resp)
+		return &gateway.CallResult{Payload: payload}
+	})
+	gw.Emit(gateway.Event{Type: gateway.EventSessionRegistered, ChargerID: id})
+	return c
+}
+
+func waitProfiles(t *testing.T, c *charger, done func(map[int]gateway.SetChargingProfileRequest) bool) map[int]gateway.SetChargingProfileRequest {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		profiles := c.snapshot()
+		if done(profiles) {
+			return profiles
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("charger did not reach the expected profiles: %+v", profiles)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPush(t *testing.T) {
+	gw := gatewaytest.NewGateway(t, time.Second)
+	m := NewManager(gw, NewStore())
+	m.Horizon = time.Hour
+	defer m.Close()
+	cp := connect(t, gw, "CP1")
+
+	max := periods(gateway.RateUnitW, 0, 7400)
+	max.StartSchedule = at(0)
+	for _, p := range []Profile{peakHours(1), {ChargerID: "CP1", ChargingProfile: gateway.ChargingProfile{
+		ChargingProfileID: 2, ChargingProfilePurpose: gateway.PurposeChargePointMax,
+		ChargingProfileKind: gateway.KindAbsolute, ChargingSchedule: max,
+	}}} {
+		if _, err := m.Put(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	profiles := waitProfiles(t, cp, func(p map[int]gateway.SetChargingProfileRequest) bool { return len(p) == 2 })
+	if p := profiles[ProfileIDBase]; p.ConnectorID != 0 || p.CsChargingProfiles.ChargingProfilePurpose != gateway.PurposeChargePointMax ||
+		p.CsChargingProfiles.ChargingSchedule.ChargingSchedulePeriod[0].Limit != 7400 {
+		t.Errorf("unexpected charger limit %+v", p)
+	}
+	if p := profiles[ProfileIDBase+100]; p.ConnectorID != 0 || p.CsChargingProfiles.ChargingProfilePurpose != gateway.PurposeTxDefault ||
+		p.CsChargingProfiles.ChargingProfileKind != gateway.KindAbsolute || p.CsChargingProfiles.ChargingSchedule.Duration != 3600 {
+		t.Errorf("unexpected default profile %+v", p)
+	}
+
+	// 交易开始后下发交易曲线，交易曲线从交易开始计时
+	tx := gw.StartTransaction("CP1", 2, "CARD", 0, time.Now())
+	gw.Emit(gateway.Event{Type: gateway.EventTransactionStarted, ChargerID: "CP1", Data: handlers.TransactionEvent{
+		TransactionID: tx.ID, ConnectorID: 2, StartedAt: tx.StartedAt,
+	}})
+	waitProfiles(t, cp, func(p map[int]gateway.SetChargingProfileRequest) bool { return len(p) == 3 })
+	slow := periods(gateway.RateUnitW, 0, 2000)
+	if _, err := m.Put(Profile{ChargerID: "CP1", ChargingProfile: gateway.ChargingProfile{
+		ChargingProfileID: 3, TransactionID: tx.ID, ChargingProfilePurpose: gateway.PurposeTx,
+		ChargingProfileKind: gateway.KindRelative, ChargingSchedule: slow,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	profiles = waitProfiles(t, cp, func(p map[int]gateway.SetChargingProfileRequest) bool {
+		txp := p[ProfileIDBase+202]
+		return txp.CsChargingProfiles.ChargingSchedule.ChargingSchedulePeriod[0].Limit == 2000
+	})
+	if p := profiles[ProfileIDBase+202]; p.ConnectorID != 2 || p.CsChargingProfiles.TransactionID != tx.ID {
+		t.Errorf("unexpected transaction profile %+v", p)
+	}
+	if _, err := m.Put(Profile{ChargerID: "CP1", ChargingProfile: gateway.ChargingProfile{
+		ChargingProfileID: 4, TransactionID: tx.ID + 1, ChargingProfilePurpose: gateway.PurposeTx,
+		ChargingProfileKind: gateway.KindRelative, ChargingSchedule: slow,
+	}}); !errors.Is(err, ErrBadProfile) {
+		t.Errorf("expected a profile for an unknown transaction to be rejected, got %v", err)
+	}
+
+	// 删除的曲线从充电桩上清除
+	if err := m.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	waitProfiles(t, cp, func(p map[int]gateway.SetChargingProfileRequest) bool {
+		_, ok := p[ProfileIDBase]
+		return !ok
+	})
+	if st, _ := m.Push(t.Context(), "CP1"); st.Status != PushApplied || st.Profiles != 2 {
+		t.Errorf("unexpected push state %+v", st)
+	}
+
+	// 交易结束后删除交易的曲线
+	gw.StopTransaction("CP1", tx.ID, 0, time.Now(), "Local")
+	gw.Emit(gateway.Event{Type: gateway.EventTransactionStopped, ChargerID: "CP1", Data: handlers.TransactionEvent{
+		TransactionID: tx.ID, ConnectorID: 2, StartedAt: tx.StartedAt,
+	}})
+	if _, ok := m.Store().Get(3); ok {
+		t.Error("transaction profile kept after the transaction stopped")
+	}
+}
+
+// delegate 记录限值变化的通知
+type delegate struct {
+	mu      sync.Mutex
+	changed int
+}
+
+func (d *delegate) Manages(chargerID string) bool { return true }
+
+func (d *delegate) LimitChanged(chargerID string) {
+	d.mu.Lock()
+	d.changed++
+	d.mu.Unlock()
+}
+
+func TestDelegate(t *testing.T) {
+	gw := gatewaytest.NewGateway(t, time.Second)
+	d := &delegate{}
+	m := NewManager(gw, NewStore())
+	m.Delegate = d
+	defer m.Close()
+	cp := connect(t, gw, "CP1")
+
+	max := periods(gateway.RateUnitW, 0, 7400)
+	max.StartSchedule = at(0)
+	for _, p := range []Profile{peakHours(1), {ChargerID: "CP1", ChargingProfile: gateway.ChargingProfile{
+		ChargingProfileID: 2, ChargingProfilePurpose: gateway.PurposeChargePointMax,
+		ChargingProfileKind: gateway.KindAbsolute, ChargingSchedule: max,
+	}}} {
+		if _, err := m.Put(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, _ := m.Push(t.Context(), "CP1")
+	if st.Status != PushDelegated || st.Profiles != 1 {
+		t.Errorf("expected only the charger limit pushed, got %+v", st)
+	}
+	if profiles := cp.snapshot(); len(profiles) != 1 || profiles[ProfileIDBase].ConnectorID != 0 {
+		t.Errorf("unexpected profiles on the charger %+v", profiles)
+	}
+	d.mu.Lock()
+	changed := d.changed
+	d.mu.Unlock()
+	if changed == 0 {
+		t.Error("delegate not notified")
+	}
+
+	for hour, want := range map[int]float64{16: 7400, 18: 3000} {
+		if limit, ok := m.Limit("CP1", 1, day.Add(time.Duration(hour)*time.Hour)); !ok || limit != want {
+			t.Errorf("%d:00: expected %.0f, got %.0f %v", hour, want, limit, ok)
+		}
+	}
+	if _, ok := m.Limit("CP2", 1, day); ok {
+		t.Error("expected no limit for a charger without profiles")
+	}
+}
@@ -0,0 +1,201 @@
+package chargingprofile
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+)
+
+// Voltage 是按电流设置的限值换算为功率时的相电压，未给出相数时按三相计算
+const Voltage = 230
+
+// Target 是合成曲线的对象。ConnectorID 为 0 时合成整桩的上限和缺省曲线；枪上有交易时给出交易 ID 和开始时间，
+// Relative 曲线从交易开始时计时，没有交易时从合成的起点计时
+type Target struct {
+	ConnectorID   int
+	TransactionID int
+	Started       time.Time
+}
+
+// Composite 合成 target 在 [from, from+d) 内生效的限值，单位 W，时间取整到秒。
+// 同一用途中 StackLevel 大的曲线优先，同级时枪上的曲线优先于整桩的曲线；
+// 交易曲线覆盖缺省曲线，再与整桩上限取较小值。没有曲线限制的时段限值为 maxPower
+func Composite(profiles []Profile, target Target, from time.Time, d time.Duration, maxPower float64) gateway.ChargingSchedule {
+	from = from.Truncate(time.Second)
+	to := from.Add(d)
+	if target.Started.IsZero() {
+		target.Started = from
+	}
+	l := newLayers(profiles, target)
+
+	points := []time.Time{from}
+	for _, p := range slices.Concat(l.max, l.tx, l.txDefault) {
+		points = p.changes(points, from, to, target.Started)
+	}
+	slices.SortFunc(points, time.Time.Compare)
+	points = slices.CompactFunc(points, time.Time.Equal)
+
+	sched := gateway.ChargingSchedule{Duration: int(d / time.Second), StartSchedule: &from, ChargingRateUnit: gateway.RateUnitW}
+	for _, t := range points {
+		limit, ok := l.limit(t)
+		if !ok {
+			limit = maxPower
+		}
+		start := int(t.Sub(from) / time.Second)
+		periods := sched.ChargingSchedulePeriod
+		if n := len(periods); n > 0 && periods[n-1].StartPeriod == start {
+			periods = periods[:n-1]
+		}
+		if n := len(periods); n == 0 || periods[n-1].Limit != limit {
+			periods = append(periods, gateway.ChargingSchedulePeriod{StartPeriod: start, Limit: limit})
+		}
+		sched.ChargingSchedulePeriod = periods
+	}
+	return sched
+}
+
+// layers 是按用途分开的曲线，各自按优先级排序
+type layers struct {
+	started            time.Time
+	max, tx, txDefault []Profile
+}
+
+func newLayers(profiles []Profile, target Target) layers {
+	l := layers{started: target.Started}
+	for _, p := range profiles {
+		switch {
+		case p.ChargingProfilePurpose == gateway.PurposeChargePointMax:
+			l.max = append(l.max, p)
+		case p.ChargingProfilePurpose == gateway.PurposeTxDefault && (p.ConnectorID == 0 || p.ConnectorID == target.ConnectorID):
+			l.txDefault = append(l.txDefault, p)
+		case p.ChargingProfilePurpose == gateway.PurposeTx && target.TransactionID != 0 && p.TransactionID == target.TransactionID:
+			l.tx = append(l.tx, p)
+		}
+	}
+	for _, ps := range [][]Profile{l.max, l.tx, l.txDefault} {
+		slices.SortFunc(ps, func(a, b Profile) int {
+			if c := cmp.Compare(b.StackLevel, a.StackLevel); c != 0 {
+				return c
+			}
+			return cmp.Compare(b.ConnectorID, a.ConnectorID)
+		})
+	}
+	return l
+}
+
+// limit 返回 t 时生效的限值，没有曲线限制时返回 false
+func (l layers) limit(t time.Time) (float64, bool) {
+	limit, limited := top(l.tx, t, l.started)
+	if !limited {
+		limit, limited = top(l.txDefault, t, l.started)
+	}
+	if m, ok := top(l.max, t, l.started); ok && (!limited || m < limit) {
+		limit, limited = m, true
+	}
+	return limit, limited
+}
+
+// top 返回排在最前的生效曲线的限值
+func top(ps []Profile, t, started time.Time) (float64, bool) {
+	for _, p := range ps {
+		if limit, ok := p.limit(t, started); ok {
+			return limit, true
+		}
+	}
+	return 0, false
+}
+
+// limit 返回曲线在 t 时的限值，按电流设置的限值换算为 W
+func (p Profile) limit(t, started time.Time) (float64, bool) {
+	start, ok := p.window(t, started)
+	if !ok {
+		return 0, false
+	}
+	offset := int(t.Sub(start) / time.Second)
+	var period gateway.ChargingSchedulePeriod
+	for _, pp := range p.ChargingSchedule.ChargingSchedulePeriod {
+		if pp.StartPeriod > offset {
+			break
+		}
+		period = pp
+	}
+	if p.ChargingSchedule.ChargingRateUnit == gateway.RateUnitA {
+		return period.Limit * Voltage * float64(cmp.Or(period.NumberPhases, 3)), true
+	}
+	return period.Limit, true
+}
+
+// window 返回曲线在 t 时生效的计划起点，Relative 曲线从 started 计时。
+// Recurring 曲线取 t 之前最近一次重复的起点
+func (p Profile) window(t, started time.Time) (time.Time, bool) {
+	if p.ValidFrom != nil && t.Before(*p.ValidFrom) || p.ValidTo != nil && !t.Before(*p.ValidTo) {
+		return time.Time{}, false
+	}
+	var start time.Time
+	switch p.ChargingProfileKind {
+	case gateway.KindRelative:
+		start = started
+	case gateway.KindAbsolute:
+		start = *p.ChargingSchedule.StartSchedule
+	case gateway.KindRecurring:
+		start = *p.ChargingSchedule.StartSchedule
+		if period := p.recurrence(); !t.Before(start) {
+			start = start.Add(t.Sub(start) / period * period)
+		}
+	}
+	if t.Before(start) {
+		return time.Time{}, false
+	}
+	if d := p.ChargingSchedule.Duration; d > 0 && !t.Before(start.Add(time.Duration(d)*time.Second)) {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+// changes 把曲线在 (from, to) 内可能改变限值的时刻追加到 points
+func (p Profile) changes(points []time.Time, from, to, started time.Time) []time.Time {
+	add := func(t time.Time) {
+		if t.After(from) && t.Before(to) {
+			points = append(points, t)
+		}
+	}
+	if p.ValidFrom != nil {
+		add(*p.ValidFrom)
+	}
+	if p.ValidTo != nil {
+		add(*p.ValidTo)
+	}
+	var starts []time.Time
+	switch p.ChargingProfileKind {
+	case gateway.KindRelative:
+		starts = append(starts, started)
+	case gateway.KindAbsolute:
+		starts = append(starts, *p.ChargingSchedule.StartSchedule)
+	case gateway.KindRecurring:
+		start, period := *p.ChargingSchedule.StartSchedule, p.recurrence()
+		if from.After(start) {
+			start = start.Add(from.Sub(start) / period * period)
+		}
+		for ; start.Before(to); start = start.Add(period) {
+			starts = append(starts, start)
+		}
+	}
+	for _, start := range starts {
+		for _, pp := range p.ChargingSchedule.ChargingSchedulePeriod {
+			add(start.Add(time.Duration(pp.StartPeriod) * time.Second))
+		}
+		if d := p.ChargingSchedule.Duration; d > 0 {
+			add(start.Add(time.Duration(d) * time.Second))
+		}
+	}
+	return points
+}
+
+func (p Profile) recurrence() time.Duration {
+	if p.RecurrencyKind == gateway.RecurrencyWeekly {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
@@ -0,0 +1,428 @@
+package chargingprofile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/handlers"
+	"github.com/x14n/evgateway/internal/timewheel"
+	"github.com/x14n/evgateway/utils"
+)
+
+// ProfileIDBase 是下发到充电桩的合成曲线 ID：整桩上限为该值，缺省曲线为该值加 100 加枪号，
+// 交易曲线为该值加 200 加枪号
+const ProfileIDBase = 2000
+
+const (
+	DefaultHorizon    = 24 * time.Hour
+	DefaultMaxPower   = 350000 // W，大于充电桩的能力，表示不限制
+	DefaultRetryDelay = 30 * time.Second
+)
+
+// 下发结果
+const (
+	PushApplied   = "applied"
+	PushDelegated = "delegated" // 交易和缺省曲线由 Delegate 负责，只下发了整桩上限
+	PushFailed    = "failed"
+)
+
+// PushState 是充电桩最近一次下发的结果，Profiles 是充电桩上由网关下发的合成曲线数
+type PushState struct {
+	ChargerID string    `json:"chargerId"`
+	Status    string    `json:"status"`
+	Profiles  int       `json:"profiles"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Delegate 接管部分充电桩的交易和缺省曲线，例如站点负载均衡。这些充电桩只下发整桩上限，
+// Delegate 分配功率时用 Manager.Limit 查询当前限值
+type Delegate interface {
+	Manages(chargerID string) bool
+	// LimitChanged 在充电桩的曲线修改或到达时段边界时调用
+	LimitChanged(chargerID string)
+}
+
+type transaction struct {
+	id          int
+	connectorID int
+	started     time.Time
+}
+
+// planned 是一条要下发的合成曲线
+type planned struct {
+	connectorID int
+	profile     gateway.ChargingProfile
+}
+
+// Manager 合成充电桩的曲线并下发，在曲线修改、交易开始和充电桩注册时重新下发。
+// 每次下发 Horizon 时长的 Absolute 曲线，过半时重新下发，Recurring 曲线随之滚动
+type Manager struct {
+	Horizon    time.Duration
+	MaxPower   float64 // 没有曲线限制的时段下发的限值
+	RetryDelay time.Duration
+	Delegate   Delegate
+
+	gw    *gateway.Gateway
+	store *Store
+	sub   *gateway.Subscription
+
+	mu     sync.Mutex
+	txs    map[string][]transaction // 按充电桩记录进行中的交易
+	pushed map[string]map[int]bool  // 充电桩上由网关下发的合成曲线 ID
+	states map[string]PushState
+	pushes utils.Coalescer // 下发期间又有修改，结束后再下发一次
+	timers map[string]*timewheel.Timer
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewManager 订阅注册和交易事件
+func NewManager(gw *gateway.Gateway, store *Store) *Manager {
+	m := &Manager{
+		Horizon:    DefaultHorizon,
+		MaxPower:   DefaultMaxPower,
+		RetryDelay: DefaultRetryDelay,
+		gw:         gw,
+		store:      store,
+		txs:        make(map[string][]transaction),
+		pushed:     make(map[string]map[int]bool),
+		states:     make(map[string]PushState),
+		timers:     make(map[string]*timewheel.Timer),
+	}
+	m.sub = gw.Subscribe(m.onEvent, gateway.Types(
+		gateway.EventSessionRegistered,
+		gateway.EventTransactionStarted,
+		gateway.EventTransactionStopped,
+	))
+	return m
+}
+
+// Close 取消订阅和待执行的下发，并等待进行中的下发结束
+func (m *Manager) Close() {
+	m.sub.Close()
+	m.mu.Lock()
+	m.closed = true
+	for _, t := range m.timers {
+		t.Stop()
+	}
+	clear(m.timers)
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// spawn 在后台执行 f，关闭后不再执行
+func (m *Manager) spawn(f func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		f()
+	}()
+}
+
+func (m *Manager) schedulePush(chargerID string) {
+	m.spawn(func() { m.Push(context.Background(), chargerID) })
+}
+
+// Store 返回曲线表
+func (m *Manager) Store() *Store {
+	return m.store
+}
+
+// Put 保存曲线并重新下发到充电桩。交易曲线的交易必须在该充电桩上进行中，枪号取交易所在的枪
+func (m *Manager) Put(p Profile) (Profile, error) {
+	if p.ChargingProfilePurpose == gateway.PurposeTx && p.TransactionID != 0 {
+		tx, ok := m.gw.GetTransaction(p.TransactionID)
+		if !ok || !tx.Active() || tx.ChargerID != p.ChargerID {
+			return Profile{}, fmt.Errorf("%w: transaction %d not active on %s", ErrBadProfile, p.TransactionID, p.ChargerID)
+		}
+		p.ConnectorID = tx.ConnectorID
+		m.track(p.ChargerID, transaction{id: tx.ID, connectorID: tx.ConnectorID, started: tx.StartedAt})
+	}
+	old, replaced, err := m.store.Put(p)
+	if err != nil {
+		return Profile{}, err
+	}
+	m.schedulePush(p.ChargerID)
+	if replaced && old.ChargerID != p.ChargerID {
+		m.schedulePush(old.ChargerID)
+	}
+	return p, nil
+}
+
+// Delete 删除曲线并重新下发到充电桩
+func (m *Manager) Delete(id int) error {
+	p, err := m.store.Delete(id)
+	if err != nil {
+		return err
+	}
+	m.schedulePush(p.ChargerID)
+	return nil
+}
+
+// track 记录进行中的交易，同一把枪上的旧交易被替换
+func (m *Manager) track(chargerID string, tx transaction) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	txs := slices.DeleteFunc(m.txs[chargerID], func(t transaction) bool { return t.connectorID == tx.connectorID })
+	m.txs[chargerID] = append(txs, tx)
+}
+
+func (m *Manager) onEvent(e gateway.Event) {
+	switch e.Type {
+	case gateway.EventSessionRegistered:
+		m.mu.Lock()
+		pushed := len(m.pushed[e.ChargerID]) > 0
+		m.mu.Unlock()
+		if !pushed && len(m.store.List(e.ChargerID)) == 0 {
+			return
+		}
+	case gateway.EventTransactionStarted:
+		tx, ok := e.Data.(handlers.TransactionEvent)
+		if !ok {
+			return
+		}
+		m.track(e.ChargerID, transaction{id: tx.TransactionID, connectorID: tx.ConnectorID, started: tx.StartedAt})
+		if len(m.store.List(e.ChargerID)) == 0 {
+			return
+		}
+	case gateway.EventTransactionStopped:
+		tx, ok := e.Data.(handlers.TransactionEvent)
+		if !ok {
+			return
+		}
+		// 充电桩在交易结束时删除交易曲线
+		m.mu.Lock()
+		m.txs[e.ChargerID] = slices.DeleteFunc(m.txs[e.ChargerID], func(t transaction) bool { return t.id == tx.TransactionID })
+		if len(m.txs[e.ChargerID]) == 0 {
+			delete(m.txs, e.ChargerID)
+		}
+		delete(m.pushed[e.ChargerID], ProfileIDBase+200+tx.ConnectorID)
+		m.mu.Unlock()
+		if err := m.store.DeleteTransaction(tx.TransactionID); err != nil {
+			fmt.Printf("[chargingprofile] delete profiles of transaction %d error: %v\n", tx.TransactionID, err)
+		}
+		return
+	}
+	m.schedulePush(e.ChargerID)
+}
+
+// target 返回枪的合成对象，枪上有交易时包括交易
+func (m *Manager) target(chargerID string, connectorID int, now time.Time) Target {
+	target := Target{ConnectorID: connectorID, Started: now}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, tx := range m.txs[chargerID] {
+		if connectorID != 0 && tx.connectorID == connectorID {
+			target.TransactionID, target.Started = tx.id, tx.started
+		}
+	}
+	return target
+}
+
+// Limit 返回枪在 at 时生效的限值，单位 W，没有曲线限制时返回 false
+func (m *Manager) Limit(chargerID string, connectorID int, at time.Time) (float64, bool) {
+	return newLayers(m.store.List(chargerID), m.target(chargerID, connectorID, at)).limit(at)
+}
+
+// CompositeSchedule 合成枪从现在起 d 内生效的限值，ConnectorID 为 0 时为整桩
+func (m *Manager) CompositeSchedule(chargerID string, connectorID int, d time.Duration) gateway.ChargingSchedule {
+	now := time.Now()
+	return Composite(m.store.List(chargerID), m.target(chargerID, connectorID, now), now, d, m.MaxPower)
+}
+
+// State 返回充电桩最近一次下发的结果
+func (m *Manager) State(chargerID string) (PushState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.states[chargerID]
+	return s, ok
+}
+
+// States 按充电桩 ID 排序返回所有下发结果
+func (m *Manager) States() []PushState {
+	m.mu.Lock()
+	out := slices.Collect(maps.Values(m.states))
+	m.mu.Unlock()
+	slices.SortFunc(out, func(a, b PushState) int { return strings.Compare(a.ChargerID, b.ChargerID) })
+	return out
+}
+
+// Push 合成充电桩的曲线并下发，删除不再需要的合成曲线，返回下发结果。
+// 同一充电桩已有下发在进行时返回 false，进行中的下发结束后会再下发一次
+func (m *Manager) Push(ctx context.Context, chargerID string) (PushState, bool) {
+	var state PushState
+	ok := m.pushes.Do(ctx, chargerID, func() {
+		state = m.push(ctx, chargerID)
+		m.mu.Lock()
+		m.states[chargerID] = state
+		m.mu.Unlock()
+	})
+	return state, ok
+}
+
+func (m *Manager) push(ctx context.Context, chargerID string) PushState {
+	now := time.Now()
+	state := PushState{ChargerID: chargerID, Status: PushApplied, Time: now}
+	if _, ok := m.gw.GetSession(chargerID); !ok {
+		// 充电桩注册后会再下发
+		state.Status, state.Error = PushFailed, gateway.ErrChargerOffline.Error()
+		return state
+	}
+	profiles := m.store.List(chargerID)
+	delegated := m.Delegate != nil && m.Delegate.Manages(chargerID)
+	plan := m.plan(chargerID, profiles, delegated, now)
+
+	m.mu.Lock()
+	old := maps.Clone(m.pushed[chargerID])
+	m.mu.Unlock()
+	pushed := make(map[int]bool, len(plan))
+	var errs []error
+	for _, p := range plan {
+		id := p.profile.ChargingProfileID
+		if _, err := m.gw.SetChargingProfile(ctx, chargerID, p.connectorID, p.profile); err != nil {
+			errs = append(errs, fmt.Errorf("set profile %d: %w", id, err))
+			pushed[id] = old[id]
+			continue
+		}
+		pushed[id] = true
+	}
+	for id := range old {
+		if _, ok := pushed[id]; ok {
+			continue
+		}
+		resp, err := m.gw.ClearChargingProfile(ctx, chargerID, gateway.ClearChargingProfileRequest{ID: &id})
+		if err != nil && resp.Status != gateway.StatusUnknown {
+			errs = append(errs, fmt.Errorf("clear profile %d: %w", id, err))
+			pushed[id] = true
+		}
+	}
+	maps.DeleteFunc(pushed, func(_ int, ok bool) bool { return !ok })
+
+	if delegated {
+		state.Status = PushDelegated
+		m.Delegate.LimitChanged(chargerID)
+	}
+	state.Profiles = len(pushed)
+	next := m.Horizon / 2
+	if err := errors.Join(errs...); err != nil {
+		state.Status, state.Error = PushFailed, err.Error()
+		next = min(next, m.RetryDelay)
+		fmt.Printf("[chargingprofile] push profiles to %s error: %v\n", chargerID, err)
+	}
+	if delegated {
+		if d, ok := m.nextChange(chargerID, profiles, now); ok {
+			next = min(next, d)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(pushed) > 0 {
+		m.pushed[chargerID] = pushed
+	} else {
+		delete(m.pushed, chargerID)
+	}
+	if t := m.timers[chargerID]; t != nil {
+		t.Stop()
+		delete(m.timers, chargerID)
+	}
+	if !m.closed && (len(profiles) > 0 || len(pushed) > 0) {
+		m.timers[chargerID] = m.gw.Timers().AfterFunc(next, func() {
+			m.mu.Lock()
+			delete(m.timers, chargerID)
+			m.mu.Unlock()
+			m.schedulePush(chargerID)
+		})
+	}
+	return state
+}
+
+// plan 生成要下发的合成曲线：整桩上限和整桩缺省曲线下发到枪 0，枪上的缺省曲线下发到该枪，
+// 进行中的交易下发交易曲线，其中 Relative 曲线从交易开始计时。由 Delegate 负责的充电桩只下发整桩上限
+func (m *Manager) plan(chargerID string, profiles []Profile, delegated bool, now time.Time) []planned {
+	var limits, defaults []Profile
+	connectors := make(map[int]bool)
+	for _, p := range profiles {
+		switch p.ChargingProfilePurpose {
+		case gateway.PurposeChargePointMax:
+			limits = append(limits, p)
+		case gateway.PurposeTxDefault:
+			defaults = append(defaults, p)
+			connectors[p.ConnectorID] = true
+		}
+	}
+	var out []planned
+	add := func(connectorID, id int, purpose string, ps []Profile, target Target) {
+		out = append(out, planned{connectorID: connectorID, profile: gateway.ChargingProfile{
+			ChargingProfileID:      id,
+			TransactionID:          target.TransactionID,
+			ChargingProfilePurpose: purpose,
+			ChargingProfileKind:    gateway.KindAbsolute,
+			ChargingSchedule:       Composite(ps, target, now, m.Horizon, m.MaxPower),
+		}})
+	}
+	if len(limits) > 0 {
+		add(0, ProfileIDBase, gateway.PurposeChargePointMax, limits, Target{})
+	}
+	if delegated {
+		return out
+	}
+	for _, n := range slices.Sorted(maps.Keys(connectors)) {
+		add(n, ProfileIDBase+100+n, gateway.PurposeTxDefault, defaults, Target{ConnectorID: n})
+	}
+	m.mu.Lock()
+	txs := slices.Clone(m.txs[chargerID])
+	m.mu.Unlock()
+	for _, tx := range txs {
+		ps := slices.Clone(defaults)
+		for _, p := range profiles {
+			if p.ChargingProfilePurpose == gateway.PurposeTx && p.TransactionID == tx.id {
+				ps = append(ps, p)
+			}
+		}
+		if len(ps) > 0 {
+			add(tx.connectorID, ProfileIDBase+200+tx.connectorID, gateway.PurposeTx, ps,
+				Target{ConnectorID: tx.connectorID, TransactionID: tx.id, Started: tx.started})
+		}
+	}
+	return out
+}
+
+// nextChange 返回距离充电桩上任一把枪的限值下次变化的时间
+func (m *Manager) nextChange(chargerID string, profiles []Profile, now time.Time) (time.Duration, bool) {
+	connectors := []int{0}
+	for _, p := range profiles {
+		connectors = append(connectors, p.ConnectorID)
+	}
+	m.mu.Lock()
+	for _, tx := range m.txs[chargerID] {
+		connectors = append(connectors, tx.connectorID)
+	}
+	m.mu.Unlock()
+	slices.Sort(connectors)
+	var next time.Duration
+	for _, n := range slices.Compact(connectors) {
+		sched := Composite(profiles, m.target(chargerID, n, now), now, m.Horizon, m.MaxPower)
+		if len(sched.ChargingSchedulePeriod) > 1 {
+			d := sched.StartSchedule.Add(time.Duration(sched.ChargingSchedulePeriod[1].StartPeriod) * time.Second).Sub(now)
+			d = max(d, time.Second)
+			if next == 0 || d < next {
+				next = d
+			}
+		}
+	}
+	return next, next > 0
+}
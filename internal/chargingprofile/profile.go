@@ -0,0 +1,204 @@
+// Package chargingprofile 保存运营方按充电桩、枪或交易设置的充电曲线，
+// 按 OCPP 的叠加规则合成每把枪生效的限值，并以合成后的曲线下发到充电桩，例如在峰时电价时段降低功率。
+package chargingprofile
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/utils"
+)
+
+var (
+	ErrBadProfile     = errors.New("bad charging profile")
+	ErrUnknownProfile = errors.New("unknown charging profile")
+)
+
+// Profile 是运营方设置的一条充电曲线，ChargingProfileID 在网关内唯一。
+// ConnectorID 为 0 表示整桩；交易曲线设置 TransactionID，ConnectorID 取交易所在的枪
+type Profile struct {
+	ChargerID   string `json:"chargerId"`
+	ConnectorID int    `json:"connectorId"`
+	gateway.ChargingProfile
+}
+
+func (p Profile) validate() error {
+	s := p.ChargingSchedule
+	switch {
+	case p.ChargerID == "":
+		return fmt.Errorf("%w: chargerId is required", ErrBadProfile)
+	case p.ChargingProfileID <= 0:
+		return fmt.Errorf("%w: chargingProfileId must be positive", ErrBadProfile)
+	case p.ConnectorID < 0 || p.StackLevel < 0 || s.Duration < 0:
+		return fmt.Errorf("%w: negative connectorId, stackLevel or duration", ErrBadProfile)
+	case p.ValidFrom != nil && p.ValidTo != nil && !p.ValidTo.After(*p.ValidFrom):
+		return fmt.Errorf("%w: validTo not after validFrom", ErrBadProfile)
+	}
+	switch p.ChargingProfilePurpose {
+	case gateway.PurposeChargePointMax:
+		if p.ConnectorID != 0 || p.TransactionID != 0 {
+			return fmt.Errorf("%w: %s applies to the whole charger", ErrBadProfile, p.ChargingProfilePurpose)
+		}
+	case gateway.PurposeTxDefault:
+		if p.TransactionID != 0 {
+			return fmt.Errorf("%w: %s cannot have a transactionId", ErrBadProfile, p.ChargingProfilePurpose)
+		}
+	case gateway.PurposeTx:
+		if p.TransactionID == 0 {
+			return fmt.Errorf("%w: %s requires a transactionId", ErrBadProfile, p.ChargingProfilePurpose)
+		}
+	default:
+		return fmt.Errorf("%w: unknown purpose %q", ErrBadProfile, p.ChargingProfilePurpose)
+	}
+	switch p.ChargingProfileKind {
+	case gateway.KindAbsolute, gateway.KindRelative:
+	case gateway.KindRecurring:
+		if p.RecurrencyKind != gateway.RecurrencyDaily && p.RecurrencyKind != gateway.RecurrencyWeekly {
+			return fmt.Errorf("%w: unknown recurrencyKind %q", ErrBadProfile, p.RecurrencyKind)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrBadProfile, p.ChargingProfileKind)
+	}
+	if p.ChargingProfileKind != gateway.KindRelative && s.StartSchedule == nil {
+		return fmt.Errorf("%w: %s profile requires startSchedule", ErrBadProfile, p.ChargingProfileKind)
+	}
+	if s.ChargingRateUnit != gateway.RateUnitW && s.ChargingRateUnit != gateway.RateUnitA {
+		return fmt.Errorf("%w: unknown chargingRateUnit %q", ErrBadProfile, s.ChargingRateUnit)
+	}
+	if len(s.ChargingSchedulePeriod) == 0 || s.ChargingSchedulePeriod[0].StartPeriod != 0 {
+		return fmt.Errorf("%w: the first period must start at 0", ErrBadProfile)
+	}
+	for i, period := range s.ChargingSchedulePeriod {
+		switch {
+		case i > 0 && period.StartPeriod <= s.ChargingSchedulePeriod[i-1].StartPeriod:
+			return fmt.Errorf("%w: periods not in ascending order", ErrBadProfile)
+		case period.Limit < 0:
+			return fmt.Errorf("%w: negative limit", ErrBadProfile)
+		case period.NumberPhases < 0 || period.NumberPhases > 3:
+			return fmt.Errorf("%w: numberPhases must be 1 to 3", ErrBadProfile)
+		}
+	}
+	return nil
+}
+
+// Store 保存充电曲线。设置了文件时每次修改都写回文件
+type Store struct {
+	path string
+
+	mu       sync.RWMutex
+	profiles map[int]Profile
+}
+
+// NewStore 创建只在内存中的曲线表
+func NewStore() *Store {
+	return &Store{profiles: make(map[int]Profile)}
+}
+
+// LoadStore 从 JSON 文件加载充电曲线，格式为曲线的数组，文件不存在时为空
+func LoadStore(path string) (*Store, error) {
+	s := NewStore()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var profiles []Profile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("parse charging profile file: %w", err)
+	}
+	for _, p := range profiles {
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+		s.profiles[p.ChargingProfileID] = p
+	}
+	return s, nil
+}
+
+// Get 返回充电曲线
+func (s *Store) Get(id int) (Profile, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.profiles[id]
+	return p, ok
+}
+
+// List 按 ID 排序返回充电桩的曲线，chargerID 为空时返回所有曲线
+func (s *Store) List(chargerID string) []Profile {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]Profile, 0)
+	for _, p := range s.profiles {
+		if chargerID == "" || p.ChargerID == chargerID {
+			out = append(out, p)
+		}
+	}
+	slices.SortFunc(out, func(a, b Profile) int { return cmp.Compare(a.ChargingProfileID, b.ChargingProfileID) })
+	return out
+}
+
+// Put 新增或替换曲线，返回被替换的曲线。曲线改到其他充电桩时，原充电桩也需要重新下发
+func (s *Store) Put(p Profile) (Profile, bool, error) {
+	if err := p.validate(); err != nil {
+		return Profile{}, false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.profiles[p.ChargingProfileID]
+	profiles := maps.Clone(s.profiles)
+	profiles[p.ChargingProfileID] = p
+	if err := s.save(profiles); err != nil {
+		return Profile{}, false, err
+	}
+	return old, ok, nil
+}
+
+// Delete 删除曲线，返回被删除的曲线
+func (s *Store) Delete(id int) (Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.profiles[id]
+	if !ok {
+		return Profile{}, ErrUnknownProfile
+	}
+	profiles := maps.Clone(s.profiles)
+	delete(profiles, id)
+	if err := s.save(profiles); err != nil {
+		return Profile{}, err
+	}
+	return p, nil
+}
+
+// DeleteTransaction 删除交易的曲线，交易结束后调用
+func (s *Store) DeleteTransaction(txID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	profiles := maps.Clone(s.profiles)
+	maps.DeleteFunc(profiles, func(_ int, p Profile) bool { return p.TransactionID == txID })
+	if len(profiles) == len(s.profiles) {
+		return nil
+	}
+	return s.save(profiles)
+}
+
+// save 把修改后的副本写回文件，成功后才替换内存中的曲线，写失败时保持原状。调用方持锁
+func (s *Store) save(profiles map[int]Profile) error {
+	list := slices.SortedFunc(maps.Values(profiles), func(a, b Profile) int {
+		return cmp.Compare(a.ChargingProfileID, b.ChargingProfileID)
+	})
+	if err := utils.SaveJSON(s.path, list); err != nil {
+		return err
+	}
+	s.profiles = profiles
+	return nil
+}
@@ -2,18 +2,103 @@ package config
 
 import (
 	"time"
+
+	"github.com/x14n/evgateway/internal/protocol"
+	"github.com/x14n/evgateway/internal/timewheel"
 )
 
 type Config struct {
-	Addr           string
-	HeatbeatTTL    time.Duration
-	WorkerPoolSize int
+	Addr     string
+	OCPPAddr string // OCPP-J WebSocket 监听地址，为空表示不启用
+	TLSAddr  string // 二进制协议的 TLS 监听地址，为空表示不启用
+	TLSCert  string
+	TLSKey   string
+	WSAddr   string // 二进制协议的 WebSocket 监听地址，为空表示不启用
+	UDPAddr  string // 遥测充电桩的 UDP 监听地址，为空表示不启用
+	UDPAck   bool   // UDP 数据报是否确认和重传
+
+	Bridges []BridgeConverter // 网关主动连接的 RS-485 串口转换器
+
+	HeatbeatTTL     time.Duration // 会话空闲多久后开始存活探测
+	ProbeInterval   time.Duration // 存活探测的间隔
+	ProbeMaxMissed  int           // 连续多少次探测没有应答判定断线
+	RegisterTimeout time.Duration // 连接建立后必须完成注册的时间
+	TimerTick       time.Duration // 超时时间轮的精度
+	WorkerPoolSize  int
+	CredentialFile  string // 负载加密密钥文件，为空表示不启用
+	InventoryFile   string // 充电桩台账文件，提供站点、运营商和标签，为空表示不启用
+	DesiredConfFile string // 充电桩期望配置文件，重连时修正偏差，为空表示不启用
+
+	OCPPSecurityProfile int    // OCPP 安全配置 0-3，缺省为 1。0 不认证，只应在测试环境使用
+	OCPPPasswordFile    string // 安全配置 1、2 的口令文件
+	OCPPTLSCert         string // 安全配置 2、3 的服务端证书
+	OCPPTLSKey          string
+	OCPPClientCA        string // 安全配置 3 校验充电桩证书的 CA
+
+	MQTTBroker      string // 北向 MQTT broker 地址，为空表示不启用
+	MQTTClientID    string
+	MQTTUsername    string
+	MQTTPassword    string
+	MQTTTopicPrefix string
+	MQTTQoS         byte
+
+	Webhooks              []Webhook // 事件回调地址
+	WebhookDeadLetterFile string    // 回调最终失败的事件追加到该文件
+
+	TCPKeepAliveIdle     time.Duration // 连接空闲多久后开始发送 TCP keepalive，0 取缺省值
+	TCPKeepAliveInterval time.Duration // TCP keepalive 探测间隔
+	TCPKeepAliveCount    int           // 多少次 TCP keepalive 没有应答后断开
+
+	APIAddr     string        // HTTP 管理接口监听地址，为空表示不启用
+	APIToken    string        // 管理接口的 Bearer 令牌，为空时不校验且只能监听回环地址
+	CallTimeout time.Duration // 网关下发请求等待充电桩应答的时间
+
+	FirmwareDir     string // 固件仓库目录，为空表示不启用固件发布
+	FirmwareAddr    string // 供充电桩下载固件的 HTTP 监听地址，镜像位于 /firmware/<版本号>
+	FirmwareBaseURL string // 写入 UpdateFirmware 的下载地址前缀，为空时只能经连接推送
+
+	DiagnosticsDir string // 诊断文件的保存目录，为空表示不接收上传
+
+	TokenFile string // ID 标签文件，用于刷卡鉴权和本地鉴权列表，为空时接受所有标签
+	SiteFile  string // 站点容量文件，用于站点负载均衡，为空表示不启用
+
+	ChargingProfileFile string // 充电曲线文件，合成后下发到充电桩，为空表示不启用
+
+	ReassemblyTimeout  time.Duration // 分片消息的最长重组时间
+	ReassemblyMaxBytes int           // 每个会话重组缓冲的上限
+}
+
+// BridgeConverter 是一个串口转 TCP 转换器及其总线上的充电桩地址
+type BridgeConverter struct {
+	Addr      string
+	Addresses []byte
+}
+
+// Webhook 是一个事件回调地址，Events 为空表示所有事件
+type Webhook struct {
+	URL    string
+	Secret string // HMAC-SHA256 签名密钥，为空不签名
+	Events []string
 }
 
 func LoadConfig() *Config {
 	return &Config{
-		Addr:           ":12345",
-		HeatbeatTTL:    60 * time.Second,
-		WorkerPoolSize: 10,
+		Addr:            ":12345",
+		OCPPAddr:        ":12346",
+		HeatbeatTTL:     60 * time.Second,
+		ProbeInterval:   10 * time.Second,
+		ProbeMaxMissed:  3,
+		RegisterTimeout: 30 * time.Second,
+		TimerTick:       timewheel.DefaultTick,
+		WorkerPoolSize:  10,
+		CredentialFile:  "",
+		MQTTClientID:    "evgateway",
+
+		OCPPSecurityProfile: 1, // HTTP 基本认证
+
+		CallTimeout: 30 * time.Second,
+
+		ReassemblyTimeout:  protocol.DefaultReassemblyTimeout,
+		ReassemblyMaxBytes: protocol.DefaultReassemblyMaxBytes,
 	}
 }
@@ -0,0 +1,109 @@
+package credential
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Store 按充电桩 ID 提供负载加密使用的密钥
+type Store interface {
+	Key(chargerID string) ([]byte, bool)
+}
+
+// MemoryStore 是线程安全的内存密钥表
+type MemoryStore struct {
+	mu        sync.RWMutex
+	keys      map[string][]byte
+	passwords map[string]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		keys:      make(map[string][]byte),
+		passwords: make(map[string]string),
+	}
+}
+
+func (m *MemoryStore) Key(chargerID string) ([]byte, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	k, ok := m.keys[chargerID]
+	return k, ok
+}
+
+// SetKey 设置或替换充电桩的密钥
+func (m *MemoryStore) SetKey(chargerID string, key []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[chargerID] = key
+}
+
+// LoadFile 从 JSON 文件加载密钥，格式为 {"充电桩ID": "十六进制密钥"}
+func LoadFile(path string) (*MemoryStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse credential file: %w", err)
+	}
+
+	store := NewMemoryStore()
+	for id, hexKey := range raw {
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return nil, fmt.Errorf("bad key for charger %s: %w", id, err)
+		}
+		if len(key) != 16 && len(key) != 32 {
+			return nil, fmt.Errorf("bad key for charger %s: want 16 or 32 bytes, got %d", id, len(key))
+		}
+		store.SetKey(id, key)
+	}
+	return store, nil
+}
+
+// PasswordStore 校验 OCPP 基本认证（安全配置 1、2）使用的口令
+type PasswordStore interface {
+	CheckPassword(chargerID, password string) bool
+}
+
+// SetPassword 设置或替换充电桩的基本认证口令
+func (m *MemoryStore) SetPassword(chargerID, password string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.passwords[chargerID] = password
+}
+
+// CheckPassword 以常量时间比较口令，未配置口令的充电桩一律失败
+func (m *MemoryStore) CheckPassword(chargerID, password string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	want, ok := m.passwords[chargerID]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+}
+
+// LoadPasswordFile 从 JSON 文件加载口令，格式为 {"充电桩ID": "口令"}
+func LoadPasswordFile(path string) (*MemoryStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse password file: %w", err)
+	}
+
+	store := NewMemoryStore()
+	for id, password := range raw {
+		store.SetPassword(id, password)
+	}
+	return store, nil
+}
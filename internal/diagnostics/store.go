@@ -0,0 +1,430 @@
+// Package diagnostics 向充电桩索取诊断日志，接收经现有连接分片上传的文件并按充电桩保存。
+package diagnostics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/timewheel"
+)
+
+const (
+	DefaultUploadTimeout = 10 * time.Minute
+	DefaultMaxFileSize   = 256 << 20
+	maxRequestHistory    = 100 // 保留最近多少个请求供查询
+	partSuffix           = ".part"
+)
+
+var (
+	ErrNotRequested = errors.New("no diagnostics requested from charger")
+	ErrBadFileName  = errors.New("bad diagnostics file name")
+	ErrFileTooLarge = errors.New("diagnostics file too large")
+	ErrBadChunk     = errors.New("diagnostics chunk outside the file")
+	ErrUnknownFile  = errors.New("unknown diagnostics file")
+)
+
+var fileNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// 请求的状态
+const (
+	RequestPending   = "pending"   // 已下发，尚未收到分片
+	RequestUploading = "uploading" // 正在接收分片
+	RequestCompleted = "completed"
+	RequestNoData    = "no_data" // 充电桩没有该时间段的日志
+	RequestFailed    = "failed"  // 下发失败或上传超时
+)
+
+// Request 是一次诊断日志请求
+type Request struct {
+	ID        string     `json:"id"`
+	ChargerID string     `json:"chargerId"`
+	StartTime *time.Time `json:"startTime,omitempty"`
+	StopTime  *time.Time `json:"stopTime,omitempty"`
+	FileName  string     `json:"fileName,omitempty"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	Created   time.Time  `json:"created"`
+	Updated   time.Time  `json:"updated"`
+}
+
+func (r *Request) active() bool {
+	return r.Status == RequestPending || r.Status == RequestUploading
+}
+
+// File 是已经上传完成的诊断文件
+type File struct {
+	ChargerID string    `json:"chargerId"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Uploaded  time.Time `json:"uploaded"`
+}
+
+type upload struct {
+	req *Request
+
+	mu      sync.Mutex
+	f       *os.File
+	covered []span // 已写入的字节区间，按起点排序且互不相邻，重发或重新切分的分片不会重复计数
+	total   int64  // 收到 Last 之前为 -1
+	done    bool
+}
+
+// span 是半开区间 [start, end)
+type span struct {
+	start, end int64
+}
+
+// cover 记录 [start, end) 已写入，与已有区间合并
+func (u *upload) cover(start, end int64) {
+	if start >= end {
+		return
+	}
+	i := 0
+	for i < len(u.covered) && u.covered[i].end < start {
+		i++
+	}
+	j := i
+	for j < len(u.covered) && u.covered[j].start <= end {
+		start = min(start, u.covered[j].start)
+		end = max(end, u.covered[j].end)
+		j++
+	}
+	u.covered = slices.Replace(u.covered, i, j, span{start, end})
+}
+
+// full 报告 [0, total) 是否都已写入
+func (u *upload) full() bool {
+	switch {
+	case u.total < 0:
+		return false
+	case u.total == 0:
+		return true
+	}
+	return len(u.covered) > 0 && u.covered[0].start == 0 && u.covered[0].end >= u.total
+}
+
+// Store 保存诊断文件，每个充电桩一个目录，上传中的文件带 .part 后缀。
+// 只接受有进行中请求的充电桩上传
+type Store struct {
+	UploadTimeout time.Duration // 请求下发后必须在该时间内上传完成
+	MaxFileSize   int64
+
+	gw  *gateway.Gateway
+	dir string
+
+	mu       sync.Mutex
+	requests []*Request
+	timers   map[*Request]*timewheel.Timer
+	uploads  map[string]*upload // 键为充电桩 ID 和文件名
+	nextID   int
+}
+
+// NewStore 打开 dir 下的诊断文件存储并设置为网关的上传目的地
+func NewStore(gw *gateway.Gateway, dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		UploadTimeout: DefaultUploadTimeout,
+		MaxFileSize:   DefaultMaxFileSize,
+		gw:            gw,
+		dir:           dir,
+		timers:        make(map[*Request]*timewheel.Timer),
+		uploads:       make(map[string]*upload),
+	}
+	gw.SetDiagnostics(s)
+	return s, nil
+}
+
+// Request 让充电桩上传 [start, stop] 时间段的日志，返回充电桩应答后的请求状态
+func (s *Store) Request(ctx context.Context, chargerID string, start, stop *time.Time) (Request, error) {
+	if _, ok := s.gw.GetSession(chargerID); !ok {
+		return Request{}, fmt.Errorf("%w: %s", gateway.ErrChargerOffline, chargerID)
+	}
+	// 先登记请求，充电桩可能在应答之前就开始上传
+	s.mu.Lock()
+	s.nextID++
+	now := time.Now()
+	req := &Request{
+		ID:        "diag-" + strconv.Itoa(s.nextID),
+		ChargerID: chargerID,
+		StartTime: start,
+		StopTime:  stop,
+		Status:    RequestPending,
+		Created:   now,
+		Updated:   now,
+	}
+	s.requests = append(s.requests, req)
+	if len(s.requests) > maxRequestHistory {
+		s.requests = slices.Delete(s.requests, 0, len(s.requests)-maxRequestHistory)
+	}
+	s.timers[req] = s.gw.Timers().AfterFunc(s.UploadTimeout, func() {
+		s.fail(req, "upload not completed within "+s.UploadTimeout.String())
+	})
+	s.mu.Unlock()
+
+	resp, err := s.gw.GetDiagnostics(ctx, chargerID, gateway.GetDiagnosticsRequest{StartTime: start, StopTime: stop})
+	if err != nil {
+		s.fail(req, err.Error())
+		return s.snapshot(req), err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case !req.active():
+	case resp.FileName == "":
+		s.finish(req, RequestNoData, "")
+	case req.FileName == "":
+		req.FileName = resp.FileName
+		req.Updated = time.Now()
+	}
+	fmt.Printf("[diagnostics] requested logs from %s: %s\n", chargerID, req.Status)
+	return *req, nil
+}
+
+// WriteChunk 实现 gateway.DiagnosticsSink
+func (s *Store) WriteChunk(chargerID string, c gateway.DiagnosticsChunk) error {
+	if !fileNamePattern.MatchString(c.FileName) || strings.HasSuffix(c.FileName, partSuffix) {
+		return fmt.Errorf("%w: %q", ErrBadFileName, c.FileName)
+	}
+	u, err := s.upload(chargerID, c.FileName)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	if u.done {
+		u.mu.Unlock()
+		return nil // 完成后重发的分片
+	}
+	end := c.Offset + int64(len(c.Data))
+	switch {
+	case c.Offset < 0 || u.total >= 0 && end > u.total:
+		u.mu.Unlock()
+		return fmt.Errorf("%w: %d-%d", ErrBadChunk, c.Offset, end)
+	case end > s.MaxFileSize:
+		u.mu.Unlock()
+		s.fail(u.req, ErrFileTooLarge.Error())
+		return ErrFileTooLarge
+	}
+	// 重发的数据与已写入的相同，覆盖写入即可
+	if _, err := u.f.WriteAt(c.Data, c.Offset); err != nil {
+		u.mu.Unlock()
+		s.fail(u.req, err.Error())
+		return err
+	}
+	u.cover(c.Offset, end)
+	if c.Last {
+		u.total = end
+	}
+	complete := u.full()
+	if complete {
+		u.done = true
+	}
+	u.mu.Unlock()
+
+	if complete {
+		return s.complete(chargerID, c.FileName, u)
+	}
+	return nil
+}
+
+// upload 返回进行中的上传，第一片到达时创建 .part 文件
+func (s *Store) upload(chargerID, name string) (*upload, error) {
+	key := chargerID + "/" + name
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.uploads[key]; ok {
+		return u, nil
+	}
+	var req *Request
+	for _, r := range slices.Backward(s.requests) {
+		if r.ChargerID == chargerID && r.active() && (r.FileName == "" || r.FileName == name) {
+			req = r
+			break
+		}
+	}
+	if req == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotRequested, chargerID)
+	}
+
+	dir := s.chargerDir(chargerID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name+partSuffix), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	u := &upload{req: req, f: f, total: -1}
+	s.uploads[key] = u
+	req.FileName = name
+	req.Status = RequestUploading
+	req.Updated = time.Now()
+	return u, nil
+}
+
+// complete 关闭并改名上传完成的文件。持锁进行，与超时的 fail 互斥
+func (s *Store) complete(chargerID, name string, u *upload) error {
+	s.mu.Lock()
+	if !u.req.active() {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s request %s already %s", ErrNotRequested, chargerID, u.req.ID, u.req.Status)
+	}
+	delete(s.uploads, chargerID+"/"+name)
+	dir := s.chargerDir(chargerID)
+	err := u.f.Close()
+	if err == nil {
+		err = os.Rename(filepath.Join(dir, name+partSuffix), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(u.f.Name())
+		s.finish(u.req, RequestFailed, err.Error())
+		s.mu.Unlock()
+		fmt.Printf("[diagnostics] request %s to %s failed: %v\n", u.req.ID, chargerID, err)
+		return err
+	}
+	s.finish(u.req, RequestCompleted, "")
+	s.mu.Unlock()
+
+	file := File{ChargerID: chargerID, Name: name, Size: u.total, Uploaded: time.Now()}
+	fmt.Printf("[diagnostics] received %s from %s (%d bytes)\n", name, chargerID, u.total)
+	s.gw.Emit(gateway.Event{Type: gateway.EventDiagnosticsUploaded, ChargerID: chargerID, Data: file})
+	return nil
+}
+
+// fail 结束请求并丢弃上传了一半的文件
+func (s *Store) fail(req *Request, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !req.active() {
+		return
+	}
+	s.finish(req, RequestFailed, reason)
+	key := req.ChargerID + "/" + req.FileName
+	if u, ok := s.uploads[key]; ok {
+		delete(s.uploads, key)
+		u.mu.Lock()
+		u.done = true
+		u.f.Close()
+		os.Remove(u.f.Name())
+		u.mu.Unlock()
+	}
+	fmt.Printf("[diagnostics] request %s to %s failed: %s\n", req.ID, req.ChargerID, reason)
+}
+
+// finish 设置请求的最终状态。调用方持锁
+func (s *Store) finish(req *Request, status, reason string) {
+	req.Status = status
+	req.Error = reason
+	req.Updated = time.Now()
+	if t, ok := s.timers[req]; ok {
+		t.Stop()
+		delete(s.timers, req)
+	}
+}
+
+func (s *Store) snapshot(req *Request) Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *req
+}
+
+// Requests 返回最近的请求，chargerID 为空时返回全部
+func (s *Store) Requests(chargerID string) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Request
+	for _, r := range s.requests {
+		if chargerID == "" || r.ChargerID == chargerID {
+			out = append(out, *r)
+		}
+	}
+	return out
+}
+
+// Files 返回充电桩已上传完成的文件，按上传时间排序
+func (s *Store) Files(chargerID string) ([]File, error) {
+	entries, err := os.ReadDir(s.chargerDir(chargerID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []File
+	for _, e := range entries {
+		if e.IsDir() || strings.HasSuffix(e.Name(), partSuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		out = append(out, File{ChargerID: chargerID, Name: e.Name(), Size: info.Size(), Uploaded: info.ModTime()})
+	}
+	slices.SortFunc(out, func(a, b File) int { return a.Uploaded.Compare(b.Uploaded) })
+	return out, nil
+}
+
+// AllFiles 返回所有充电桩的文件
+func (s *Store) AllFiles() ([]File, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []File
+	for _, e := range entries {
+		chargerID, err := url.PathUnescape(e.Name())
+		if !e.IsDir() || err != nil {
+			continue
+		}
+		files, err := s.Files(chargerID)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, files...)
+	}
+	return out, nil
+}
+
+// Open 打开已上传完成的文件
+func (s *Store) Open(chargerID, name string) (*os.File, error) {
+	if !fileNamePattern.MatchString(name) || strings.HasSuffix(name, partSuffix) {
+		return nil, fmt.Errorf("%w: %q", ErrBadFileName, name)
+	}
+	f, err := os.Open(filepath.Join(s.chargerDir(chargerID), name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s/%s", ErrUnknownFile, chargerID, name)
+	}
+	return f, err
+}
+
+// Delete 删除已上传完成的文件
+func (s *Store) Delete(chargerID, name string) error {
+	if !fileNamePattern.MatchString(name) || strings.HasSuffix(name, partSuffix) {
+		return fmt.Errorf("%w: %q", ErrBadFileName, name)
+	}
+	err := os.Remove(filepath.Join(s.chargerDir(chargerID), name))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s/%s", ErrUnknownFile, chargerID, name)
+	}
+	return err
+}
+
+// chargerDir 返回充电桩的目录，充电桩 ID 转义后作为目录名，点号也转义以免出现 . 和 ..
+func (s *Store) chargerDir(chargerID string) string {
+	return filepath.Join(s.dir, strings.ReplaceAll(url.PathEscape(chargerID), ".", "%2E"))
+}
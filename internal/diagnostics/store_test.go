@@ -0,0 +1,171 @@
+package diagnostics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/gateway/gatewaytest"
+)
+
+// connect 模拟一个充电桩，对 GetDiagnostics 应答 fileName
+func connect(t *testing.T, gw *gateway.Gateway, id, fileName string) {
+	t.Helper()
+	payload, _ := json.Marshal(gateway.GetDiagnosticsResponse{FileName: fileName})
+	gatewaytest.Connect(t, gw, id, func(gateway.CallRequest) *gateway.CallResult {
+		return &gateway.CallResult{Payload: payload}
+	})
+}
+
+func newTestStore(t *testing.T) (*gateway.Gateway, *Store) {
+	t.Helper()
+	gw := gatewaytest.NewGateway(t, time.Second)
+	s, err := NewStore(gw, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gw, s
+}
+
+func TestUploadOutOfOrder(t *testing.T) {
+	gw, s := newTestStore(t)
+	connect(t, gw, "CP1", "cp1-logs.tar.gz")
+	uploaded := make(chan gateway.Event, 1)
+	sub := gw.Subscribe(func(e gateway.Event) { uploaded <- e }, gateway.Types(gateway.EventDiagnosticsUploaded))
+	defer sub.Close()
+
+	chunk := gateway.DiagnosticsChunk{FileName: "cp1-logs.tar.gz", Data: []byte("x")}
+	if err := gw.WriteDiagnosticsChunk("CP1", chunk); !errors.Is(err, ErrNotRequested) {
+		t.Fatalf("expected unsolicited upload to be rejected, got %v", err)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	req, err := s.Request(context.Background(), "CP1", &start, nil)
+	if err != nil || req.Status != RequestPending || req.FileName != "cp1-logs.tar.gz" {
+		t.Fatalf("request: %v %+v", err, req)
+	}
+
+	parts := []gateway.DiagnosticsChunk{
+		{FileName: "cp1-logs.tar.gz", Offset: 10, Data: []byte("world"), Last: true},
+		{FileName: "cp1-logs.tar.gz", Offset: 5, Data: []byte(", ho ")},
+		{FileName: "cp1-logs.tar.gz", Offset: 5, Data: []byte(", ho ")}, // 重发
+		{FileName: "cp1-logs.tar.gz", Offset: 0, Data: []byte("hello")},
+	}
+	for _, c := range parts {
+		if err := gw.WriteDiagnosticsChunk("CP1", c); err != nil {
+			t.Fatalf("chunk at %d: %v", c.Offset, err)
+		}
+	}
+	select {
+	case e := <-uploaded:
+		if f, _ := e.Data.(File); f.Name != "cp1-logs.tar.gz" || f.Size != 15 {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no upload event")
+	}
+
+	files, err := s.Files("CP1")
+	if err != nil || len(files) != 1 {
+		t.Fatalf("files: %v %+v", err, files)
+	}
+	f, err := s.Open("CP1", "cp1-logs.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "hello, ho world" {
+		t.Errorf("unexpected content %q", data)
+	}
+	if reqs := s.Requests("CP1"); len(reqs) != 1 || reqs[0].Status != RequestCompleted {
+		t.Errorf("unexpected requests %+v", reqs)
+	}
+	if _, err := s.Open("CP1", "../../etc/passwd"); !errors.Is(err, ErrBadFileName) {
+		t.Errorf("expected ErrBadFileName, got %v", err)
+	}
+}
+
+func TestUploadRechunkedRetransmit(t *testing.T) {
+	gw, s := newTestStore(t)
+	connect(t, gw, "CP1", "cp1.log")
+	if _, err := s.Request(context.Background(), "CP1", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重发时按不同长度切分，与已写入的区间部分重叠，12-15 仍然缺失
+	parts := []gateway.DiagnosticsChunk{
+		{FileName: "cp1.log", Offset: 15, Data: []byte("56789"), Last: true},
+		{FileName: "cp1.log", Offset: 0, Data: []byte("0123456789")},
+		{FileName: "cp1.log", Offset: 5, Data: []byte("5678901")},
+	}
+	for _, c := range parts {
+		if err := gw.WriteDiagnosticsChunk("CP1", c); err != nil {
+			t.Fatalf("chunk at %d: %v", c.Offset, err)
+		}
+	}
+	if reqs := s.Requests("CP1"); reqs[0].Status != RequestUploading {
+		t.Fatalf("completed with a gap: %+v", reqs[0])
+	}
+	if err := gw.WriteDiagnosticsChunk("CP1", gateway.DiagnosticsChunk{FileName: "cp1.log", Offset: 10, Data: []byte("01234")}); err != nil {
+		t.Fatal(err)
+	}
+	if reqs := s.Requests("CP1"); reqs[0].Status != RequestCompleted {
+		t.Fatalf("not completed: %+v", reqs[0])
+	}
+	f, err := s.Open("CP1", "cp1.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "01234567890123456789" {
+		t.Errorf("unexpected content %q", data)
+	}
+}
+
+func TestUploadTimeoutAndLimits(t *testing.T) {
+	gw, s := newTestStore(t)
+	s.UploadTimeout = 30 * time.Millisecond
+	s.MaxFileSize = 8
+	connect(t, gw, "CP1", "big.log")
+	connect(t, gw, "CP-EMPTY", "")
+
+	if req, err := s.Request(context.Background(), "CP-EMPTY", nil, nil); err != nil || req.Status != RequestNoData {
+		t.Fatalf("expected no_data, got %v %+v", err, req)
+	}
+	if _, err := s.Request(context.Background(), "CP-OFF", nil, nil); !errors.Is(err, gateway.ErrChargerOffline) {
+		t.Errorf("expected ErrChargerOffline, got %v", err)
+	}
+
+	if _, err := s.Request(context.Background(), "CP1", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.WriteDiagnosticsChunk("CP1", gateway.DiagnosticsChunk{FileName: "big.log", Data: []byte("0123456789")}); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("expected ErrFileTooLarge, got %v", err)
+	}
+	if reqs := s.Requests("CP1"); reqs[0].Status != RequestFailed {
+		t.Fatalf("expected the request to fail, got %+v", reqs[0])
+	}
+
+	if _, err := s.Request(context.Background(), "CP1", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.WriteDiagnosticsChunk("CP1", gateway.DiagnosticsChunk{FileName: "big.log", Data: []byte("0123")}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.Requests("CP1")[1].Status != RequestFailed {
+		if time.Now().After(deadline) {
+			t.Fatalf("upload did not time out: %+v", s.Requests("CP1")[1])
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if files, _ := s.Files("CP1"); len(files) != 0 {
+		t.Errorf("partial upload left behind: %+v", files)
+	}
+}
@@ -0,0 +1,367 @@
+package firmware
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/gateway/gatewaytest"
+)
+
+func TestRepository(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := repo.Add("2.0.1", bytes.NewReader([]byte("firmware")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("firmware"))
+	if img.Size != 8 || img.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected image %+v", img)
+	}
+	if _, err := repo.Add("2.0.1", bytes.NewReader(nil)); !errors.Is(err, ErrImageExists) {
+		t.Errorf("expected ErrImageExists, got %v", err)
+	}
+	if _, err := repo.Add("../evil", bytes.NewReader(nil)); !errors.Is(err, ErrBadVersion) {
+		t.Errorf("expected ErrBadVersion, got %v", err)
+	}
+
+	reopened, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reopened.List(); len(list) != 1 || list[0].SHA256 != img.SHA256 {
+		t.Fatalf("index not persisted: %+v", list)
+	}
+	if err := reopened.Verify("2.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL + "/2.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "firmware" || resp.Header.Get("Digest") != "sha-256="+img.SHA256 {
+		t.Errorf("unexpected download %q %v", body, resp.Header)
+	}
+
+	os.WriteFile(filepath.Join(dir, "2.0.1.bin"), []byte("tampered"), 0o644)
+	if err := repo.Verify("2.0.1"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if err := repo.Delete("2.0.1"); err != nil || len(repo.List()) != 0 {
+		t.Errorf("delete: %v", err)
+	}
+}
+
+// charger 模拟一个接收固件的充电桩，react 决定收到完整固件或下载地址后上报什么状态
+type charger struct {
+	id    string
+	gw    *gateway.Gateway
+	react func(c *charger) []string
+
+	mu       sync.Mutex
+	image    bytes.Buffer
+	location string
+}
+
+func connect(t *testing.T, gw *gateway.Gateway, id, firmware string, log *eventLog, react func(*charger) []string) *charger {
+	t.Helper()
+	c := &charger{id: id, gw: gw, react: react}
+	// 安装状态要在应答之后上报，所以在 reply 里直接应答并返回 nil
+	var s *gateway.Session
+	s = gatewaytest.Connect(t, gw, id, func(req gateway.CallRequest) *gateway.CallResult {
+		complete := false
+		c.mu.Lock()
+		switch req.Action {
+		case gateway.ActionFirmwareChunk:
+			var chunk gateway.FirmwareChunk
+			json.Unmarshal(req.Payload, &chunk)
+			if chunk.Offset == 0 {
+				log.add("start " + id)
+			}
+			c.image.Write(chunk.Data)
+			complete = chunk.Last
+		case gateway.ActionUpdateFirmware:
+			var r gateway.UpdateFirmwareRequest
+			json.Unmarshal(req.Payload, &r)
+			c.location = r.Location
+			log.add("start " + id)
+			complete = true
+		}
+		c.mu.Unlock()
+		gw.ResolveCall(s, gateway.CallResult{ID: req.ID, Payload: json.RawMessage(`{"status":"Accepted"}`)})
+		if complete {
+			for _, st := range react(c) {
+				log.add(st + " " + id)
+				gw.Emit(gateway.Event{Type: gateway.EventFirmwareStatus, ChargerID: id, Data: gateway.FirmwareStatusEvent{Status: st}})
+			}
+		}
+		return nil
+	})
+	s.SetInfo(gateway.ChargerInfo{Firmware: firmware})
+	gw.AddSession(s)
+	return c
+}
+
+type eventLog struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (l *eventLog) add(s string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, s)
+}
+
+func newTestManager(t *testing.T, size int) (*gateway.Gateway, *Manager, []byte) {
+	t.Helper()
+	gw := gatewaytest.NewGateway(t, time.Second)
+
+	repo, err := OpenRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := make([]byte, size)
+	rand.Read(image)
+	if _, err := repo.Add("2.0", bytes.NewReader(image)); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(gw, repo)
+	t.Cleanup(m.Close)
+	return gw, m, image
+}
+
+func waitRollout(t *testing.T, m *Manager, id string, done func(Rollout) bool) Rollout {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		r, _ := m.Get(id)
+		if done(r) {
+			return r
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rollout did not reach the expected state: %+v", r)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRolloutStagedStream(t *testing.T) {
+	gw, m, image := newTestManager(t, gateway.FirmwareChunkSize+500)
+	log := &eventLog{}
+	installed := func(*charger) []string {
+		return []string{gateway.FirmwareDownloaded, gateway.FirmwareInstalling, gateway.FirmwareInstalled}
+	}
+	var chargers []*charger
+	for _, id := range []string{"CP1", "CP2", "CP3", "CP4"} {
+		chargers = append(chargers, connect(t, gw, id, "1.0", log, installed))
+	}
+	connect(t, gw, "CP-NEW", "2.0", log, installed)
+	connect(t, gw, "CP-OTHER", "1.0", log, installed)
+
+	r, err := m.Start(Spec{Version: "2.0", Selector: gateway.Selector{ChargerIDs: []string{"CP1", "CP2", "CP3", "CP4", "CP-NEW"}}, Stages: []int{25, 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Progress.Total != 4 || r.Spec.Transfer != TransferStream {
+		t.Fatalf("unexpected rollout %+v", r)
+	}
+	r = waitRollout(t, m, r.ID, func(r Rollout) bool { return r.State == RolloutCompleted })
+	if r.Progress.Installed != 4 || r.Stage != 1 {
+		t.Fatalf("unexpected progress %+v", r)
+	}
+
+	// 第一批只有一台，它装完之后第二批才开始
+	log.mu.Lock()
+	first := r.Targets[0].ChargerID
+	if log.entries[0] != "start "+first || log.entries[3] != "Installed "+first {
+		t.Errorf("first stage did not finish before the second started: %v", log.entries)
+	}
+	log.mu.Unlock()
+	for _, c := range chargers {
+		c.mu.Lock()
+		if !bytes.Equal(c.image.Bytes(), image) {
+			t.Errorf("%s received %d bytes of %d", c.id, c.image.Len(), len(image))
+		}
+		c.mu.Unlock()
+	}
+}
+
+func TestRolloutAutoPause(t *testing.T) {
+	gw, m, _ := newTestManager(t, 100)
+	m.BaseURL = "http://gw/firmware/"
+	log := &eventLog{}
+	failed := func(*charger) []string { return []string{gateway.FirmwareDownloading, gateway.FirmwareDownloadFailed} }
+	var chargers []*charger
+	for _, id := range []string{"CP1", "CP2", "CP3", "CP4", "CP5", "CP6"} {
+		chargers = append(chargers, connect(t, gw, id, "1.0", log, failed))
+	}
+	paused := make(chan gateway.Event, 2)
+	sub := gw.Subscribe(func(e gateway.Event) { paused <- e }, gateway.Types(gateway.EventRolloutPaused))
+	defer sub.Close()
+
+	r, err := m.Start(Spec{Version: "2.0", FailureThreshold: 0.5, MinSamples: 2, Concurrency: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = waitRollout(t, m, r.ID, func(r Rollout) bool { return r.State == RolloutPaused && r.Progress.InProgress == 0 })
+	if r.Progress.Failed != 2 || r.Progress.Pending != 4 || r.Reason == "" {
+		t.Fatalf("expected a pause after 2 failures, got %+v", r)
+	}
+	select {
+	case <-paused:
+	case <-time.After(time.Second):
+		t.Fatal("no rollout_paused event")
+	}
+	for _, c := range chargers {
+		c.mu.Lock()
+		if c.location != "" && c.location != "http://gw/firmware/2.0" {
+			t.Errorf("unexpected download location %q", c.location)
+		}
+		c.mu.Unlock()
+	}
+
+	// 恢复后失败率重新统计，再失败两台又会暂停
+	if _, err := m.Resume(r.ID); err != nil {
+		t.Fatal(err)
+	}
+	r = waitRollout(t, m, r.ID, func(r Rollout) bool { return r.State == RolloutPaused && r.Progress.Failed == 4 })
+	r, err = m.Cancel(r.ID)
+	if err != nil || r.State != RolloutCancelled || r.Progress.Skipped != 2 {
+		t.Fatalf("cancel: %v %+v", err, r)
+	}
+	if _, err := m.Resume(r.ID); !errors.Is(err, ErrRolloutFinished) {
+		t.Errorf("expected ErrRolloutFinished, got %v", err)
+	}
+}
+
+func TestRolloutInstallResult(t *testing.T) {
+	gw, m, _ := newTestManager(t, 100)
+	m.BaseURL = "http://gw/firmware"
+	m.InstallTimeout = 50 * time.Millisecond
+	log := &eventLog{}
+	silent := func(*charger) []string { return nil }
+	connect(t, gw, "CP-SILENT", "1.0", log, silent)
+	// 重启后以新版本重新注册，没有上报 Installed
+	connect(t, gw, "CP-REBOOT", "1.0", log, func(c *charger) []string {
+		s, _ := c.gw.GetSession(c.id)
+		s.SetInfo(gateway.ChargerInfo{Firmware: "2.0"})
+		go c.gw.Emit(gateway.Event{Type: gateway.EventSessionRegistered, ChargerID: c.id})
+		return nil
+	})
+
+	r, err := m.Start(Spec{Version: "2.0", FailureThreshold: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = waitRollout(t, m, r.ID, func(r Rollout) bool { return r.State == RolloutCompleted })
+	for _, tg := range r.Targets {
+		want := TargetInstalled
+		if tg.ChargerID == "CP-SILENT" {
+			want = TargetFailed
+		}
+		if tg.Status != want {
+			t.Errorf("%s: expected %s, got %s (%s)", tg.ChargerID, want, tg.Status, tg.Error)
+		}
+	}
+
+	if _, err := m.Start(Spec{Version: "9.9"}); !errors.Is(err, ErrUnknownImage) {
+		t.Errorf("expected ErrUnknownImage, got %v", err)
+	}
+	if _, err := m.Start(Spec{Version: "2.0", Stages: []int{50, 40}}); !errors.Is(err, ErrBadSpec) {
+		t.Errorf("expected ErrBadSpec, got %v", err)
+	}
+	if _, err := m.Start(Spec{Version: "2.0", Selector: gateway.Selector{Site: "nowhere"}}); !errors.Is(err, ErrNoTargets) {
+		t.Errorf("expected ErrNoTargets, got %v", err)
+	}
+}
+
+// connectStuck 模拟收到命令后不应答的充电桩，下发一直挂在 Call 上。每收到一个请求通知一次
+func connectStuck(t *testing.T, gw *gateway.Gateway, id string) <-chan struct{} {
+	t.Helper()
+	received := make(chan struct{}, 1)
+	gatewaytest.Connect(t, gw, id, func(gateway.CallRequest) *gateway.CallResult {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	return received
+}
+
+func TestRolloutCancelStopsDelivery(t *testing.T) {
+	gw, m, _ := newTestManager(t, 100)
+	gw.SetCallTimeout(10 * time.Second)
+	received := connectStuck(t, gw, "CP-STUCK")
+
+	r, err := m.Start(Spec{Version: "2.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no firmware chunk sent")
+	}
+	r, err = m.Cancel(r.ID)
+	if err != nil || r.Targets[0].Status != TargetFailed {
+		t.Fatalf("cancel: %v %+v", err, r)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("cancel did not stop the firmware stream")
+	}
+}
+
+func TestRolloutPrune(t *testing.T) {
+	gw, m, _ := newTestManager(t, 100)
+	gw.SetCallTimeout(10 * time.Second)
+	connectStuck(t, gw, "CP1")
+
+	var first string
+	for i := range maxFinishedRollouts + 5 {
+		r, err := m.Start(Spec{Version: "2.0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = r.ID
+		}
+		if _, err := m.Cancel(r.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(m.List()); n > maxFinishedRollouts+1 {
+		t.Errorf("kept %d rollouts", n)
+	}
+	if _, ok := m.Get(first); ok {
+		t.Error("oldest finished rollout not evicted")
+	}
+}
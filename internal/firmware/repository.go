@@ -0,0 +1,236 @@
+// Package firmware 管理固件镜像并按批次向充电桩发布。
+package firmware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/utils"
+)
+
+const indexFile = "index.json"
+
+var (
+	ErrImageExists      = errors.New("firmware image already exists")
+	ErrUnknownImage     = errors.New("unknown firmware image")
+	ErrBadVersion       = errors.New("bad firmware version")
+	ErrChecksumMismatch = errors.New("firmware checksum mismatch")
+)
+
+// 版本号同时用作文件名和下载地址的一段
+var versionPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Image 是仓库中的一个固件镜像
+type Image struct {
+	Version string    `json:"version"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	Created time.Time `json:"created"`
+}
+
+// Repository 是本地固件仓库，镜像按版本号存为 dir 下的文件，元数据保存在 index.json
+type Repository struct {
+	dir string
+
+	mu     sync.RWMutex
+	images map[string]Image
+}
+
+// OpenRepository 打开目录下的仓库，目录不存在时创建
+func OpenRepository(dir string) (*Repository, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	r := &Repository{dir: dir, images: make(map[string]Image)}
+	data, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Image
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse firmware index: %w", err)
+	}
+	for _, img := range list {
+		r.images[img.Version] = img
+	}
+	return r, nil
+}
+
+// Add 把 src 存为新版本并计算 SHA256，版本已存在时返回 ErrImageExists
+func (r *Repository) Add(version string, src io.Reader) (Image, error) {
+	if !versionPattern.MatchString(version) {
+		return Image{}, fmt.Errorf("%w: %q", ErrBadVersion, version)
+	}
+	if _, ok := r.Get(version); ok {
+		return Image{}, fmt.Errorf("%w: %s", ErrImageExists, version)
+	}
+
+	tmp, err := os.CreateTemp(r.dir, version+".tmp*")
+	if err != nil {
+		return Image{}, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return Image{}, err
+	}
+	img := Image{Version: version, Size: size, SHA256: hex.EncodeToString(h.Sum(nil)), Created: time.Now().UTC()}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.images[version]; ok {
+		return Image{}, fmt.Errorf("%w: %s", ErrImageExists, version)
+	}
+	if err := os.Rename(tmp.Name(), r.path(version)); err != nil {
+		return Image{}, err
+	}
+	r.images[version] = img
+	if err := r.saveIndex(); err != nil {
+		delete(r.images, version)
+		os.Remove(r.path(version))
+		return Image{}, err
+	}
+	fmt.Printf("[firmware] added %s (%d bytes, sha256 %s)\n", version, size, img.SHA256)
+	return img, nil
+}
+
+// Get 返回镜像的元数据
+func (r *Repository) Get(version string) (Image, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	img, ok := r.images[version]
+	return img, ok
+}
+
+// List 返回所有镜像，按创建时间排序
+func (r *Repository) List() []Image {
+	r.mu.RLock()
+	out := make([]Image, 0, len(r.images))
+	for _, img := range r.images {
+		out = append(out, img)
+	}
+	r.mu.RUnlock()
+	slices.SortFunc(out, func(a, b Image) int { return a.Created.Compare(b.Created) })
+	return out
+}
+
+// Delete 删除镜像
+func (r *Repository) Delete(version string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	img, ok := r.images[version]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownImage, version)
+	}
+	delete(r.images, version)
+	if err := r.saveIndex(); err != nil {
+		r.images[version] = img
+		return err
+	}
+	return os.Remove(r.path(version))
+}
+
+// Open 打开镜像。读到末尾时校验 SHA256，不一致返回 ErrChecksumMismatch 而不是 io.EOF
+func (r *Repository) Open(version string) (io.ReadCloser, Image, error) {
+	img, ok := r.Get(version)
+	if !ok {
+		return nil, Image{}, fmt.Errorf("%w: %s", ErrUnknownImage, version)
+	}
+	f, err := os.Open(r.path(version))
+	if err != nil {
+		return nil, Image{}, err
+	}
+	return &verifyingReader{f: f, h: sha256.New(), want: img.SHA256}, img, nil
+}
+
+// Verify 重新计算镜像的 SHA256 并与入库时的值比较
+func (r *Repository) Verify(version string) error {
+	rc, _, err := r.Open(version)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(io.Discard, rc)
+	return err
+}
+
+// ServeHTTP 以 GET /<版本号> 提供镜像下载，供充电桩按 UpdateFirmware 的地址下载
+func (r *Repository) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	version := strings.TrimPrefix(req.URL.Path, "/")
+	img, ok := r.Get(version)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	f, err := os.Open(r.path(version))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+img.SHA256+`"`)
+	w.Header().Set("Digest", "sha-256="+img.SHA256)
+	http.ServeContent(w, req, version, img.Created, f)
+}
+
+func (r *Repository) path(version string) string {
+	return filepath.Join(r.dir, version+".bin")
+}
+
+// saveIndex 整体写回索引文件。调用方持锁
+func (r *Repository) saveIndex() error {
+	list := make([]Image, 0, len(r.images))
+	for _, img := range r.images {
+		list = append(list, img)
+	}
+	slices.SortFunc(list, func(a, b Image) int { return strings.Compare(a.Version, b.Version) })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(filepath.Join(r.dir, indexFile), data, 0o644)
+}
+
+type verifyingReader struct {
+	f    *os.File
+	h    hash.Hash
+	want string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.f.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.h.Sum(nil)) != v.want {
+		return n, fmt.Errorf("%w: %s", ErrChecksumMismatch, v.f.Name())
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.f.Close()
+}
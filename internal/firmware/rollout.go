@@ -0,0 +1,623 @@
+package firmware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/timewheel"
+)
+
+// 发布的状态
+const (
+	RolloutRunning   = "running"
+	RolloutPaused    = "paused"
+	RolloutCompleted = "completed"
+	RolloutCancelled = "cancelled"
+)
+
+// 每个充电桩的状态
+const (
+	TargetPending   = "pending"   // 所在批次尚未开始
+	TargetSending   = "sending"   // 正在下发 UpdateFirmware 或推送固件
+	TargetWaiting   = "waiting"   // 已下发，等待充电桩上报安装结果
+	TargetInstalled = "installed" // 上报 Installed 或以新版本重新注册
+	TargetFailed    = "failed"    // 下发失败、上报失败或超时
+	TargetSkipped   = "skipped"   // 发布取消时尚未开始
+)
+
+// 固件的下发方式
+const (
+	TransferLocation = "location" // 充电桩按 UpdateFirmware 给出的地址自行下载
+	TransferStream   = "stream"   // 网关经现有连接分片推送
+)
+
+const (
+	DefaultFailureThreshold = 0.2
+	DefaultMinSamples       = 5
+	DefaultConcurrency      = 10
+	DefaultInstallTimeout   = 30 * time.Minute
+
+	// maxFinishedRollouts 限制保留的已结束发布数，超过时丢弃最早结束的
+	maxFinishedRollouts = 100
+)
+
+var (
+	ErrUnknownRollout  = errors.New("unknown rollout")
+	ErrBadSpec         = errors.New("bad rollout spec")
+	ErrNoTargets       = errors.New("no charger matches the rollout")
+	ErrRolloutFinished = errors.New("rollout already finished")
+)
+
+// Spec 描述一次发布。Selector 选出在线的目标，按标签发布时填 Selector.Tags；
+// Stages 是各批次累计覆盖的百分比，如 [10, 50, 100]，为空时一批全部发出
+type Spec struct {
+	Version          string           `json:"version"`
+	Selector         gateway.Selector `json:"selector"`
+	Stages           []int            `json:"stages,omitempty"`
+	Transfer         string           `json:"transfer,omitempty"`         // 缺省在配置了下载地址时为 location，否则为 stream
+	FailureThreshold float64          `json:"failureThreshold,omitempty"` // 失败率超过该值自动暂停，0-1
+	MinSamples       int              `json:"minSamples,omitempty"`       // 至少多少台有结果后才计算失败率
+	Concurrency      int              `json:"concurrency,omitempty"`      // 同时下发的充电桩数
+}
+
+// Target 是一个充电桩在发布中的状态，FirmwareStatus 是它最近上报的固件状态
+type Target struct {
+	ChargerID      string    `json:"chargerId"`
+	Stage          int       `json:"stage"`
+	Status         string    `json:"status"`
+	FirmwareStatus string    `json:"firmwareStatus,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Updated        time.Time `json:"updated,omitempty"`
+}
+
+func (t Target) done() bool {
+	return t.Status == TargetInstalled || t.Status == TargetFailed || t.Status == TargetSkipped
+}
+
+// Progress 汇总各状态的充电桩数量
+type Progress struct {
+	Total      int `json:"total"`
+	Pending    int `json:"pending"`
+	InProgress int `json:"inProgress"`
+	Installed  int `json:"installed"`
+	Failed     int `json:"failed"`
+	Skipped    int `json:"skipped"`
+}
+
+// Rollout 是发布的快照
+type Rollout struct {
+	ID       string     `json:"id"`
+	Spec     Spec       `json:"spec"`
+	State    string     `json:"state"`
+	Stage    int        `json:"stage"`            // 当前批次，从 0 开始
+	Reason   string     `json:"reason,omitempty"` // 暂停的原因
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Progress Progress   `json:"progress"`
+	Targets  []Target   `json:"targets,omitempty"`
+}
+
+type rollout struct {
+	Rollout
+	stageEnd []int // 每批次结束的下标
+	index    map[string]int
+	timers   map[string]*timewheel.Timer
+	ctx      context.Context // 取消发布时中止进行中的下发
+	cancel   context.CancelFunc
+
+	// 恢复发布时的计数，失败率只统计恢复之后的结果
+	baseDone, baseFailed int
+}
+
+// busy 报告是否还有充电桩在下发或等待结果
+func (r *rollout) busy() bool {
+	for _, t := range r.Targets {
+		if t.Status == TargetSending || t.Status == TargetWaiting {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rollout) counts() (done, failed int) {
+	for _, t := range r.Targets {
+		switch t.Status {
+		case TargetInstalled:
+			done++
+		case TargetFailed:
+			done++
+			failed++
+		}
+	}
+	return done, failed
+}
+
+func (r *rollout) snapshot(withTargets bool) Rollout {
+	out := r.Rollout
+	out.Spec.Stages = slices.Clone(r.Spec.Stages)
+	if r.Finished != nil {
+		f := *r.Finished
+		out.Finished = &f
+	}
+	out.Progress = Progress{Total: len(r.Targets)}
+	for _, t := range r.Targets {
+		switch t.Status {
+		case TargetPending:
+			out.Progress.Pending++
+		case TargetSending, TargetWaiting:
+			out.Progress.InProgress++
+		case TargetInstalled:
+			out.Progress.Installed++
+		case TargetFailed:
+			out.Progress.Failed++
+		case TargetSkipped:
+			out.Progress.Skipped++
+		}
+	}
+	out.Targets = nil
+	if withTargets {
+		out.Targets = slices.Clone(r.Targets)
+	}
+	return out
+}
+
+// Manager 按批次发布固件，跟踪每个充电桩上报的进度，失败率过高时自动暂停
+type Manager struct {
+	BaseURL        string        // 镜像下载地址的前缀，地址为 BaseURL/<版本号>，为空时只能推送
+	InstallTimeout time.Duration // 下发后等待安装结果的时间
+
+	gw     *gateway.Gateway
+	repo   *Repository
+	subs   []*gateway.Subscription
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	rollouts []*rollout
+	nextID   int
+	events   []gateway.Event // 持锁期间产生的事件，解锁后发布
+}
+
+// NewManager 创建发布管理并订阅固件进度和注册事件
+func NewManager(gw *gateway.Gateway, repo *Repository) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		InstallTimeout: DefaultInstallTimeout,
+		gw:             gw,
+		repo:           repo,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+	m.subs = append(m.subs,
+		gw.Subscribe(m.onFirmwareStatus, gateway.Types(gateway.EventFirmwareStatus)),
+		gw.Subscribe(m.onRegistered, gateway.Types(gateway.EventSessionRegistered)),
+	)
+	return m
+}
+
+// Close 取消订阅，中止进行中的下发并等待其结束
+func (m *Manager) Close() {
+	for _, s := range m.subs {
+		s.Close()
+	}
+	m.cancel()
+	m.wg.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.rollouts {
+		for _, t := range r.timers {
+			t.Stop()
+		}
+	}
+}
+
+// Repository 返回固件仓库
+func (m *Manager) Repository() *Repository {
+	return m.repo
+}
+
+// Start 创建发布并立即开始第一批。已经运行目标版本的充电桩不参与
+func (m *Manager) Start(spec Spec) (Rollout, error) {
+	if err := m.normalize(&spec); err != nil {
+		return Rollout{}, err
+	}
+
+	var ids []string
+	for _, s := range m.gw.Select(spec.Selector) {
+		if s.Info().Firmware != spec.Version {
+			ids = append(ids, s.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return Rollout{}, ErrNoTargets
+	}
+
+	m.mu.Lock()
+	defer m.unlock()
+	m.nextID++
+	r := &rollout{
+		Rollout: Rollout{
+			ID:      "fw-" + strconv.Itoa(m.nextID),
+			Spec:    spec,
+			State:   RolloutRunning,
+			Created: time.Now(),
+		},
+		index:  make(map[string]int, len(ids)),
+		timers: make(map[string]*timewheel.Timer),
+	}
+	r.ctx, r.cancel = context.WithCancel(m.ctx)
+	// 按发布 ID 和充电桩 ID 的哈希排序，批次成员稳定且不按 ID 聚集
+	slices.SortFunc(ids, func(a, b string) int {
+		ha, hb := stageHash(r.ID, a), stageHash(r.ID, b)
+		switch {
+		case ha < hb:
+			return -1
+		case ha > hb:
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+	for _, pct := range spec.Stages {
+		end := max((len(ids)*pct+99)/100, 1)
+		r.stageEnd = append(r.stageEnd, end)
+	}
+	for i, id := range ids {
+		stage, _ := slices.BinarySearch(r.stageEnd, i+1)
+		r.Targets = append(r.Targets, Target{ChargerID: id, Stage: stage, Status: TargetPending})
+		r.index[id] = i
+	}
+	m.prune()
+	m.rollouts = append(m.rollouts, r)
+	fmt.Printf("[firmware] rollout %s of %s to %d chargers in %d stages\n", r.ID, spec.Version, len(ids), len(r.stageEnd))
+	m.advance(r)
+	return r.snapshot(true), nil
+}
+
+func (m *Manager) normalize(spec *Spec) error {
+	if _, ok := m.repo.Get(spec.Version); !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownImage, spec.Version)
+	}
+	if len(spec.Stages) == 0 {
+		spec.Stages = []int{100}
+	}
+	for i, pct := range spec.Stages {
+		if pct <= 0 || pct > 100 || i > 0 && pct <= spec.Stages[i-1] {
+			return fmt.Errorf("%w: stages must increase within 1-100", ErrBadSpec)
+		}
+	}
+	if spec.Stages[len(spec.Stages)-1] != 100 {
+		return fmt.Errorf("%w: the last stage must be 100", ErrBadSpec)
+	}
+	switch spec.Transfer {
+	case "":
+		spec.Transfer = TransferStream
+		if m.BaseURL != "" {
+			spec.Transfer = TransferLocation
+		}
+	case TransferLocation:
+		if m.BaseURL == "" {
+			return fmt.Errorf("%w: no firmware download url configured", ErrBadSpec)
+		}
+	case TransferStream:
+	default:
+		return fmt.Errorf("%w: unknown transfer %q", ErrBadSpec, spec.Transfer)
+	}
+	if spec.Transfer == TransferStream {
+		// 推送前确认镜像完整，避免把损坏的固件分发给整批充电桩
+		if err := m.repo.Verify(spec.Version); err != nil {
+			return err
+		}
+	}
+	if spec.FailureThreshold < 0 || spec.FailureThreshold > 1 {
+		return fmt.Errorf("%w: failure threshold must be within 0-1", ErrBadSpec)
+	}
+	if spec.FailureThreshold == 0 {
+		spec.FailureThreshold = DefaultFailureThreshold
+	}
+	if spec.MinSamples <= 0 {
+		spec.MinSamples = DefaultMinSamples
+	}
+	if spec.Concurrency <= 0 {
+		spec.Concurrency = DefaultConcurrency
+	}
+	return nil
+}
+
+func stageHash(rolloutID, chargerID string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(rolloutID))
+	h.Write([]byte{0})
+	h.Write([]byte(chargerID))
+	return h.Sum32()
+}
+
+// Get 返回发布及每个充电桩的状态
+func (m *Manager) Get(id string) (Rollout, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r := m.find(id); r != nil {
+		return r.snapshot(true), true
+	}
+	return Rollout{}, false
+}
+
+// List 返回所有发布，不带每个充电桩的状态，最新的在最后
+func (m *Manager) List() []Rollout {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Rollout, 0, len(m.rollouts))
+	for _, r := range m.rollouts {
+		out = append(out, r.snapshot(false))
+	}
+	return out
+}
+
+// Pause 暂停发布，已经下发的充电桩继续跟踪结果
+func (m *Manager) Pause(id string) (Rollout, error) {
+	m.mu.Lock()
+	defer m.unlock()
+	r := m.find(id)
+	switch {
+	case r == nil:
+		return Rollout{}, fmt.Errorf("%w: %s", ErrUnknownRollout, id)
+	case r.Finished != nil:
+		return Rollout{}, fmt.Errorf("%w: %s", ErrRolloutFinished, id)
+	}
+	if r.State == RolloutRunning {
+		r.State = RolloutPaused
+		r.Reason = "paused by operator"
+	}
+	return r.snapshot(true), nil
+}
+
+// Resume 继续暂停的发布，失败率从恢复时重新统计
+func (m *Manager) Resume(id string) (Rollout, error) {
+	m.mu.Lock()
+	defer m.unlock()
+	r := m.find(id)
+	switch {
+	case r == nil:
+		return Rollout{}, fmt.Errorf("%w: %s", ErrUnknownRollout, id)
+	case r.Finished != nil:
+		return Rollout{}, fmt.Errorf("%w: %s", ErrRolloutFinished, id)
+	}
+	if r.State == RolloutPaused {
+		r.State = RolloutRunning
+		r.Reason = ""
+		r.baseDone, r.baseFailed = r.counts()
+		m.advance(r)
+	}
+	return r.snapshot(true), nil
+}
+
+// Cancel 结束发布并中止进行中的下发，尚未开始的充电桩标记为 skipped，正在下发的标记为 failed
+func (m *Manager) Cancel(id string) (Rollout, error) {
+	m.mu.Lock()
+	defer m.unlock()
+	r := m.find(id)
+	switch {
+	case r == nil:
+		return Rollout{}, fmt.Errorf("%w: %s", ErrUnknownRollout, id)
+	case r.Finished != nil:
+		return Rollout{}, fmt.Errorf("%w: %s", ErrRolloutFinished, id)
+	}
+	now := time.Now()
+	for i := range r.Targets {
+		switch t := &r.Targets[i]; t.Status {
+		case TargetPending:
+			t.Status = TargetSkipped
+			t.Updated = now
+		case TargetSending:
+			t.Status = TargetFailed
+			t.Error = "rollout cancelled"
+			t.Updated = now
+		}
+	}
+	r.State = RolloutCancelled
+	r.Finished = &now
+	r.cancel()
+	return r.snapshot(true), nil
+}
+
+// prune 丢弃最早结束的发布，只保留 maxFinishedRollouts 个。还在等待结果的发布保留。调用方持锁
+func (m *Manager) prune() {
+	finished := 0
+	for _, r := range m.rollouts {
+		if r.Finished != nil {
+			finished++
+		}
+	}
+	m.rollouts = slices.DeleteFunc(m.rollouts, func(r *rollout) bool {
+		if finished <= maxFinishedRollouts || r.Finished == nil || r.busy() {
+			return false
+		}
+		finished--
+		r.cancel()
+		return true
+	})
+}
+
+func (m *Manager) find(id string) *rollout {
+	for _, r := range m.rollouts {
+		if r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// unlock 解锁后发布持锁期间产生的事件，订阅方可以安全地回调 Manager
+func (m *Manager) unlock() {
+	events := m.events
+	m.events = nil
+	m.mu.Unlock()
+	for _, e := range events {
+		m.gw.Emit(e)
+	}
+}
+
+// advance 在当前批次内按并发数下发，批次全部有结果后进入下一批。调用方持锁
+func (m *Manager) advance(r *rollout) {
+	for r.State == RolloutRunning {
+		end := r.stageEnd[r.Stage]
+		sending := 0
+		for _, t := range r.Targets {
+			if t.Status == TargetSending {
+				sending++
+			}
+		}
+		finished := true
+		for i := range end {
+			t := &r.Targets[i]
+			if t.Status == TargetPending && sending < r.Spec.Concurrency {
+				t.Status = TargetSending
+				t.Updated = time.Now()
+				sending++
+				m.launch(r, t.ChargerID)
+			}
+			if !t.done() {
+				finished = false
+			}
+		}
+		if !finished {
+			return
+		}
+		if r.Stage == len(r.stageEnd)-1 {
+			now := time.Now()
+			r.State = RolloutCompleted
+			r.Finished = &now
+			r.cancel()
+			fmt.Printf("[firmware] rollout %s completed\n", r.ID)
+			return
+		}
+		r.Stage++
+		fmt.Printf("[firmware] rollout %s entering stage %d\n", r.ID, r.Stage)
+	}
+}
+
+// launch 在后台下发固件，完成后等待充电桩上报结果。调用方持锁
+func (m *Manager) launch(r *rollout, chargerID string) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		err := m.deliver(r.ctx, r.Spec, chargerID)
+
+		m.mu.Lock()
+		defer m.unlock()
+		t := &r.Targets[r.index[chargerID]]
+		if t.Status != TargetSending {
+			return // 下发期间已收到最终结果
+		}
+		if err != nil {
+			fmt.Printf("[firmware] deliver %s to %s error: %v\n", r.Spec.Version, chargerID, err)
+			m.finish(r, chargerID, TargetFailed, err.Error())
+			return
+		}
+		t.Status = TargetWaiting
+		t.Updated = time.Now()
+		r.timers[chargerID] = m.gw.Timers().AfterFunc(m.InstallTimeout, func() {
+			m.mu.Lock()
+			defer m.unlock()
+			if r.Targets[r.index[chargerID]].Status == TargetWaiting {
+				m.finish(r, chargerID, TargetFailed, "no install result within "+m.InstallTimeout.String())
+			}
+		})
+		m.advance(r)
+	}()
+}
+
+func (m *Manager) deliver(ctx context.Context, spec Spec, chargerID string) error {
+	if spec.Transfer == TransferLocation {
+		return m.gw.UpdateFirmware(ctx, chargerID, gateway.UpdateFirmwareRequest{
+			Location: strings.TrimSuffix(m.BaseURL, "/") + "/" + spec.Version,
+		})
+	}
+	rc, img, err := m.repo.Open(spec.Version)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return m.gw.StreamFirmware(ctx, chargerID, img.Version, img.Size, img.SHA256, rc)
+}
+
+// finish 记录充电桩的最终结果，失败率超过阈值时暂停发布，然后继续下发。调用方持锁
+func (m *Manager) finish(r *rollout, chargerID, status, reason string) {
+	t := &r.Targets[r.index[chargerID]]
+	t.Status = status
+	t.Error = reason
+	t.Updated = time.Now()
+	if timer, ok := r.timers[chargerID]; ok {
+		timer.Stop()
+		delete(r.timers, chargerID)
+	}
+
+	if r.State == RolloutRunning {
+		done, failed := r.counts()
+		done -= r.baseDone
+		failed -= r.baseFailed
+		if done >= r.Spec.MinSamples && float64(failed) > r.Spec.FailureThreshold*float64(done) {
+			r.State = RolloutPaused
+			r.Reason = fmt.Sprintf("failure rate %d/%d exceeds %.0f%%", failed, done, r.Spec.FailureThreshold*100)
+			fmt.Printf("[firmware] rollout %s paused: %s\n", r.ID, r.Reason)
+			m.events = append(m.events, gateway.Event{Type: gateway.EventRolloutPaused, Data: r.snapshot(false)})
+		}
+	}
+	m.advance(r)
+}
+
+// active 找出充电桩正在进行中的发布
+func (m *Manager) active(chargerID string) *rollout {
+	for _, r := range m.rollouts {
+		if i, ok := r.index[chargerID]; ok {
+			if s := r.Targets[i].Status; s == TargetSending || s == TargetWaiting {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Manager) onFirmwareStatus(e gateway.Event) {
+	st, ok := e.Data.(gateway.FirmwareStatusEvent)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.unlock()
+	r := m.active(e.ChargerID)
+	if r == nil {
+		return
+	}
+	t := &r.Targets[r.index[e.ChargerID]]
+	t.FirmwareStatus = st.Status
+	t.Updated = time.Now()
+	switch st.Status {
+	case gateway.FirmwareInstalled:
+		m.finish(r, e.ChargerID, TargetInstalled, "")
+	case gateway.FirmwareDownloadFailed, gateway.FirmwareInstallationFailed,
+		"InstallVerificationFailed", "InvalidSignature":
+		m.finish(r, e.ChargerID, TargetFailed, st.Status)
+	}
+}
+
+// onRegistered 把以目标版本重新注册的充电桩视为安装成功，有些充电桩重启前来不及上报 Installed
+func (m *Manager) onRegistered(e gateway.Event) {
+	s, ok := m.gw.GetSession(e.ChargerID)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.unlock()
+	if r := m.active(e.ChargerID); r != nil && s.Info().Firmware == r.Spec.Version {
+		m.finish(r, e.ChargerID, TargetInstalled, "")
+	}
+}
@@ -0,0 +1,303 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+const (
+	DefaultBroadcastConcurrency = 32
+	maxBroadcastHistory         = 100 // 保留最近多少个广播任务供查询
+)
+
+var ErrBadBroadcastCall = errors.New("broadcast call frame without action")
+
+// 广播中每个充电桩的结果
+const (
+	BroadcastPending  = "pending"
+	BroadcastSent     = "sent"      // 已写入链路，普通帧没有应答
+	BroadcastAcked    = "acked"     // CmdCall 收到了正常应答
+	BroadcastFailed   = "failed"    // 发送失败或充电桩返回错误
+	BroadcastTimedOut = "timed_out" // CmdCall 没有在 CallTimeout 内应答
+)
+
+// Selector 选出广播的目标，非空的条件需要同时满足，全部为空时选中所有已注册的充电桩
+type Selector struct {
+	ChargerIDs []string `json:"chargerIds,omitempty"`
+	Site       string   `json:"site,omitempty"`
+	Tags       []string `json:"tags,omitempty"` // 必须带有全部标签
+	Firmware   string   `json:"firmware,omitempty"`
+}
+
+func (sel Selector) match(s *Session) bool {
+	if len(sel.ChargerIDs) > 0 && !slices.Contains(sel.ChargerIDs, s.ID) {
+		return false
+	}
+	if sel.Site != "" && s.Site() != sel.Site {
+		return false
+	}
+	if sel.Firmware != "" && s.Info().Firmware != sel.Firmware {
+		return false
+	}
+	tags := s.Tags()
+	for _, t := range sel.Tags {
+		if !slices.Contains(tags, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// Select 返回满足条件的已注册会话，按充电桩 ID 排序。候选集取自最窄的索引
+func (g *Gateway) Select(sel Selector) []*Session {
+	var candidates []*Session
+	switch {
+	case len(sel.ChargerIDs) > 0:
+		for _, id := range sel.ChargerIDs {
+			if s, ok := g.GetSession(id); ok {
+				candidates = append(candidates, s)
+			}
+		}
+	case sel.Site != "":
+		candidates = g.SessionsBySite(sel.Site)
+	case len(sel.Tags) > 0:
+		candidates = g.SessionsByTag(sel.Tags[0])
+	default:
+		candidates = g.ListSessions()
+	}
+
+	out := make([]*Session, 0, len(candidates))
+	for _, s := range candidates {
+		// 未注册的连接和已被重连取代的旧连接不参与
+		if cur, ok := g.GetSession(s.ID); !ok || cur != s {
+			continue
+		}
+		if sel.match(s) {
+			out = append(out, s)
+		}
+	}
+	slices.SortFunc(out, func(a, b *Session) int {
+		switch {
+		case a.ID < b.ID:
+			return -1
+		case a.ID > b.ID:
+			return 1
+		}
+		return 0
+	})
+	return slices.CompactFunc(out, func(a, b *Session) bool { return a == b })
+}
+
+// BroadcastResult 是一个充电桩的投递结果
+type BroadcastResult struct {
+	ChargerID string    `json:"chargerId"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time,omitempty"`
+}
+
+// BroadcastProgress 汇总各状态的充电桩数量
+type BroadcastProgress struct {
+	Total    int `json:"total"`
+	Pending  int `json:"pending"`
+	Sent     int `json:"sent"`
+	Acked    int `json:"acked"`
+	Failed   int `json:"failed"`
+	TimedOut int `json:"timedOut"`
+}
+
+// BroadcastJob 是一次广播，投递在后台进行
+type BroadcastJob struct {
+	ID       string
+	Selector Selector
+	Cmd      byte
+	Action   string // CmdCall 的 action，普通帧为空
+	Created  time.Time
+
+	mu       sync.Mutex
+	results  []BroadcastResult
+	index    map[string]int
+	finished time.Time
+	done     chan struct{}
+}
+
+// Progress 返回当前进度
+func (j *BroadcastJob) Progress() BroadcastProgress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	p := BroadcastProgress{Total: len(j.results)}
+	for _, r := range j.results {
+		switch r.Status {
+		case BroadcastPending:
+			p.Pending++
+		case BroadcastSent:
+			p.Sent++
+		case BroadcastAcked:
+			p.Acked++
+		case BroadcastFailed:
+			p.Failed++
+		case BroadcastTimedOut:
+			p.TimedOut++
+		}
+	}
+	return p
+}
+
+// Results 返回每个充电桩的结果
+func (j *BroadcastJob) Results() []BroadcastResult {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return slices.Clone(j.results)
+}
+
+// Finished 返回完成时间，未完成时为零值
+func (j *BroadcastJob) Finished() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.finished
+}
+
+// Done 在所有充电桩都有结果后关闭
+func (j *BroadcastJob) Done() <-chan struct{} {
+	return j.done
+}
+
+func (j *BroadcastJob) set(chargerID, status string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	r := &j.results[j.index[chargerID]]
+	r.Status = status
+	r.Time = time.Now()
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+type broadcastOptions struct {
+	concurrency int
+}
+
+// BroadcastOption 配置一次广播
+type BroadcastOption func(*broadcastOptions)
+
+// BroadcastConcurrency 限制同时进行的发送数，CmdCall 的等待应答也占用名额
+func BroadcastConcurrency(n int) BroadcastOption {
+	return func(o *broadcastOptions) { o.concurrency = n }
+}
+
+// Broadcast 把帧发给选中的所有充电桩，立即返回任务，结果在后台收集。
+// CmdCall 帧对每个充电桩单独分配请求 ID 并等待应答，其他帧写入链路即算完成
+func (g *Gateway) Broadcast(sel Selector, f *protocol.Frame, opts ...BroadcastOption) (*BroadcastJob, error) {
+	o := broadcastOptions{concurrency: DefaultBroadcastConcurrency}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.concurrency <= 0 {
+		o.concurrency = DefaultBroadcastConcurrency
+	}
+	var call *CallRequest
+	if f.Cmd == protocol.CmdCall {
+		call = &CallRequest{}
+		if err := json.Unmarshal(f.Payload, call); err != nil || call.Action == "" {
+			return nil, ErrBadBroadcastCall
+		}
+	}
+
+	targets := g.Select(sel)
+	job := &BroadcastJob{
+		ID:       "bc-" + strconv.FormatUint(g.nextJobID.Add(1), 10),
+		Selector: sel,
+		Cmd:      f.Cmd,
+		Created:  time.Now(),
+		results:  make([]BroadcastResult, len(targets)),
+		index:    make(map[string]int, len(targets)),
+		done:     make(chan struct{}),
+	}
+	if call != nil {
+		job.Action = call.Action
+	}
+	for i, s := range targets {
+		job.results[i] = BroadcastResult{ChargerID: s.ID, Status: BroadcastPending}
+		job.index[s.ID] = i
+	}
+	g.addBroadcast(job)
+
+	go func() {
+		sem := make(chan struct{}, o.concurrency)
+		var wg sync.WaitGroup
+		for _, s := range targets {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				if call != nil {
+					var req any
+					if len(call.Payload) > 0 {
+						req = call.Payload
+					}
+					err := g.Call(context.Background(), s, call.Action, req, nil)
+					switch {
+					case err == nil:
+						job.set(s.ID, BroadcastAcked, nil)
+					case errors.Is(err, ErrCallTimeout):
+						job.set(s.ID, BroadcastTimedOut, err)
+					default:
+						job.set(s.ID, BroadcastFailed, err)
+					}
+					return
+				}
+				// Send 会改写版本和压缩标志，每个会话用自己的副本
+				fc := *f
+				if err := s.Send(&fc); err != nil {
+					job.set(s.ID, BroadcastFailed, err)
+					return
+				}
+				job.set(s.ID, BroadcastSent, nil)
+			}()
+		}
+		wg.Wait()
+		job.mu.Lock()
+		job.finished = time.Now()
+		job.mu.Unlock()
+		close(job.done)
+	}()
+	return job, nil
+}
+
+func (g *Gateway) addBroadcast(job *BroadcastJob) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.broadcasts = append(g.broadcasts, job)
+	if len(g.broadcasts) > maxBroadcastHistory {
+		g.broadcasts = slices.Delete(g.broadcasts, 0, len(g.broadcasts)-maxBroadcastHistory)
+	}
+}
+
+// Broadcasts 返回最近的广播任务，最新的在最后
+func (g *Gateway) Broadcasts() []*BroadcastJob {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return slices.Clone(g.broadcasts)
+}
+
+// GetBroadcast 按 ID 查找最近的广播任务
+func (g *Gateway) GetBroadcast(id string) (*BroadcastJob, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, j := range g.broadcasts {
+		if j.ID == id {
+			return j, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,127 @@
+package gateway_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/gateway/gatewaytest"
+	"github.com/x14n/evgateway/internal/protocol"
+	"github.com/x14n/evgateway/internal/transport"
+)
+
+// fakeCharger 登记带标签的充电桩，按 reply 应答网关的 CmdCall
+func fakeCharger(t *testing.T, g *gateway.Gateway, id string, labels gateway.Labels, reply func(gateway.CallRequest) *gateway.CallResult) *gateway.Session {
+	t.Helper()
+	s := gatewaytest.Connect(t, g, id, reply)
+	s.SetLabels(labels)
+	g.AddSession(s)
+	return s
+}
+
+func newTestGateway(t *testing.T) *gateway.Gateway {
+	return gatewaytest.NewGateway(t, 50*time.Millisecond)
+}
+
+func TestBroadcastCallResults(t *testing.T) {
+	g := newTestGateway(t)
+	fakeCharger(t, g, "CP1", gateway.Labels{Site: "depot", Tags: []string{"dc"}}, func(gateway.CallRequest) *gateway.CallResult { return &gateway.CallResult{} })
+	fakeCharger(t, g, "CP2", gateway.Labels{Site: "depot", Tags: []string{"dc"}}, func(gateway.CallRequest) *gateway.CallResult {
+		return &gateway.CallResult{ErrorCode: "NotSupported"}
+	})
+	fakeCharger(t, g, "CP3", gateway.Labels{Site: "depot", Tags: []string{"dc"}}, func(gateway.CallRequest) *gateway.CallResult { return nil })
+	fakeCharger(t, g, "CP4", gateway.Labels{Site: "depot", Tags: []string{"ac"}}, func(gateway.CallRequest) *gateway.CallResult { return &gateway.CallResult{} })
+	g.AddSession(&gateway.Session{Addr: "unregistered"})
+
+	payload, _ := json.Marshal(gateway.CallRequest{Action: "Reset", Payload: json.RawMessage(`{"type":"Soft"}`)})
+	job, err := g.Broadcast(gateway.Selector{Site: "depot", Tags: []string{"dc"}}, protocol.NewFrame(protocol.ProtocolV1, protocol.CmdCall, payload), gateway.BroadcastConcurrency(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-job.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("broadcast did not finish")
+	}
+
+	want := map[string]string{"CP1": gateway.BroadcastAcked, "CP2": gateway.BroadcastFailed, "CP3": gateway.BroadcastTimedOut}
+	results := job.Results()
+	if len(results) != len(want) {
+		t.Fatalf("expected %d results, got %+v", len(want), results)
+	}
+	for _, r := range results {
+		if r.Status != want[r.ChargerID] {
+			t.Errorf("%s: expected %s, got %s (%s)", r.ChargerID, want[r.ChargerID], r.Status, r.Error)
+		}
+	}
+	if p := job.Progress(); p.Total != 3 || p.Acked != 1 || p.Failed != 1 || p.TimedOut != 1 || p.Pending != 0 {
+		t.Errorf("unexpected progress %+v", p)
+	}
+	if j, ok := g.GetBroadcast(job.ID); !ok || j != job {
+		t.Error("job not kept for queries")
+	}
+}
+
+func TestBroadcastPlainFrame(t *testing.T) {
+	g := newTestGateway(t)
+	received := make(chan string, 2)
+	for _, id := range []string{"CP1", "CP2"} {
+		server, charger := transport.Pipe()
+		defer charger.Close()
+		s := &gateway.Session{ID: id, Addr: id, Transport: server}
+		s.SetInfo(gateway.ChargerInfo{Firmware: "1.0"})
+		g.AddSession(s)
+		go func() {
+			if f, err := charger.ReadFrame(); err == nil && f.Cmd == protocol.CmdStatus {
+				received <- id
+			}
+		}()
+	}
+	old := &gateway.Session{ID: "CP3", Addr: "CP3"}
+	old.SetInfo(gateway.ChargerInfo{Firmware: "0.9"})
+	g.AddSession(old)
+
+	job, err := g.Broadcast(gateway.Selector{Firmware: "1.0"}, protocol.NewFrame(protocol.ProtocolV1, protocol.CmdStatus, []byte("{}")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-job.Done()
+	if p := job.Progress(); p.Total != 2 || p.Sent != 2 {
+		t.Fatalf("unexpected progress %+v", p)
+	}
+	for range 2 {
+		<-received
+	}
+
+	if _, err := g.Broadcast(gateway.Selector{}, protocol.NewFrame(protocol.ProtocolV1, protocol.CmdCall, []byte("{}"))); err == nil {
+		t.Error("expected an error for a call without action")
+	}
+}
+
+func TestCallChargerOffline(t *testing.T) {
+	g := newTestGateway(t)
+	g.SetCallTimeout(time.Minute)
+	received := make(chan struct{})
+	s := fakeCharger(t, g, "CP1", gateway.Labels{}, func(gateway.CallRequest) *gateway.CallResult {
+		close(received)
+		return nil
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- g.Call(context.Background(), s, "Reset", nil, nil) }()
+	<-received
+	s.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, gateway.ErrChargerOffline) {
+			t.Fatalf("expected ErrChargerOffline, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call kept waiting after the charger disconnected")
+	}
+	if err := g.Call(context.Background(), s, "Reset", nil, nil); !errors.Is(err, gateway.ErrSessionClosed) {
+		t.Errorf("expected ErrSessionClosed on a closed session, got %v", err)
+	}
+}
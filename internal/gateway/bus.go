@@ -0,0 +1,151 @@
+package gateway
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type EventHandler func(Event)
+
+// Bus 是进程内的发布/订阅事件总线。
+// 同步订阅者在发布者的 goroutine 中依次调用，会拖慢处理器；
+// 异步订阅者有自己的 goroutine 和有界缓冲，缓冲满时丢弃新事件并计数。
+type Bus struct {
+	mu   sync.RWMutex
+	subs []*Subscription
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// SubscribeOption 配置订阅
+type SubscribeOption func(*Subscription)
+
+// Async 让订阅者异步处理事件，最多缓冲 size 个事件
+func Async(size int) SubscribeOption {
+	return func(s *Subscription) {
+		s.ch = make(chan Event, max(size, 1))
+	}
+}
+
+// Types 只接收指定类型的事件
+func Types(types ...string) SubscribeOption {
+	return func(s *Subscription) {
+		s.types = make(map[string]bool, len(types))
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+}
+
+// Subscription 是一个订阅者，Close 后不再收到事件
+type Subscription struct {
+	bus     *Bus
+	handler EventHandler
+	types   map[string]bool // nil 表示所有类型
+	ch      chan Event      // nil 表示同步订阅
+	chMu    sync.RWMutex    // 保护 ch 的关闭，发送方持读锁
+	closed  bool
+	done    chan struct{}
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Subscribe 注册订阅者
+func (b *Bus) Subscribe(h EventHandler, opts ...SubscribeOption) *Subscription {
+	s := &Subscription{bus: b, handler: h, done: make(chan struct{})}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.ch != nil {
+		go s.run()
+	} else {
+		close(s.done)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, s)
+	return s
+}
+
+// Publish 把事件交给所有订阅者，Time 为空时取当前时间
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+	for _, s := range subs {
+		if s.types != nil && !s.types[e.Type] {
+			continue
+		}
+		if s.ch == nil {
+			s.call(e)
+			continue
+		}
+		s.enqueue(e)
+	}
+}
+
+func (s *Subscription) enqueue(e Event) {
+	s.chMu.RLock()
+	defer s.chMu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.ch <- e:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Dropped 返回异步订阅因缓冲满丢弃的事件数
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close 取消订阅；异步订阅会先处理完已缓冲的事件再返回，
+// 同步订阅在 Close 返回后仍可能收到并发发布中的事件
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		b := s.bus
+		b.mu.Lock()
+		for i, sub := range b.subs {
+			if sub == s {
+				b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+				break
+			}
+		}
+		b.mu.Unlock()
+		if s.ch != nil {
+			s.chMu.Lock()
+			s.closed = true
+			close(s.ch)
+			s.chMu.Unlock()
+		}
+	})
+	<-s.done
+}
+
+func (s *Subscription) run() {
+	defer close(s.done)
+	for e := range s.ch {
+		s.call(e)
+	}
+}
+
+// call 调用处理器，订阅者的 panic 不影响发布者和其他订阅者
+func (s *Subscription) call(e Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("[event] subscriber panic on %s: %v\n", e.Type, r)
+		}
+	}()
+	s.handler(e)
+}
@@ -0,0 +1,74 @@
+package gateway
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestBusSyncAndTypes(t *testing.T) {
+	b := NewBus()
+	var all, status []string
+	b.Subscribe(func(e Event) { all = append(all, e.Type) })
+	sub := b.Subscribe(func(e Event) { status = append(status, e.ChargerID) }, Types(EventStatusChanged))
+
+	b.Publish(Event{Type: EventHeartbeat, ChargerID: "CP1"})
+	b.Publish(Event{Type: EventStatusChanged, ChargerID: "CP1"})
+	sub.Close()
+	b.Publish(Event{Type: EventStatusChanged, ChargerID: "CP2"})
+
+	if len(all) != 3 {
+		t.Errorf("expected 3 events for the catch-all subscriber, got %v", all)
+	}
+	if len(status) != 1 || status[0] != "CP1" {
+		t.Errorf("filtered subscriber got %v", status)
+	}
+}
+
+func TestBusAsyncBounded(t *testing.T) {
+	b := NewBus()
+	block := make(chan struct{})
+	started := make(chan struct{}, 1)
+	var mu sync.Mutex
+	var got []string
+	sub := b.Subscribe(func(e Event) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-block
+		mu.Lock()
+		got = append(got, e.ChargerID)
+		mu.Unlock()
+	}, Async(2))
+
+	// 第一个事件被处理器取走并阻塞，随后两个进入缓冲，其余丢弃
+	b.Publish(Event{Type: EventHeartbeat, ChargerID: "1"})
+	<-started
+	for _, id := range []string{"2", "3", "4", "5"} {
+		b.Publish(Event{Type: EventHeartbeat, ChargerID: id})
+	}
+	if sub.Dropped() != 2 {
+		t.Errorf("expected 2 dropped events, got %d", sub.Dropped())
+	}
+
+	close(block)
+	sub.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 3 || got[0] != "1" || got[1] != "2" || got[2] != "3" {
+		t.Errorf("async subscriber got %v", got)
+	}
+	// Close 之后发布不会 panic
+	b.Publish(Event{Type: EventHeartbeat})
+}
+
+func TestBusSubscriberPanic(t *testing.T) {
+	b := NewBus()
+	b.Subscribe(func(Event) { panic("boom") })
+	called := false
+	b.Subscribe(func(Event) { called = true })
+	b.Publish(Event{Type: EventHeartbeat})
+	if !called {
+		t.Fatal("a panicking subscriber must not stop delivery to the others")
+	}
+}
@@ -0,0 +1,177 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+const DefaultCallTimeout = 30 * time.Second
+
+var (
+	ErrCallTimeout    = errors.New("call timed out")
+	ErrUnexpectedCall = errors.New("unexpected call result")
+	ErrBadCommand     = errors.New("bad command")
+	ErrChargerOffline = errors.New("charger offline")
+)
+
+// CommandRequest 是北向接口下发给充电桩的命令，HTTP API 的广播和 MQTT 命令共用。
+// Action 不为空时以 CmdCall 发出，否则以 Cmd 发出；Payload 为空或 JSON 对象
+type CommandRequest struct {
+	Cmd     byte            `json:"cmd,omitempty"`
+	Action  string          `json:"action,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Frame 校验命令并编码成帧，缺少命令字或负载不是 JSON 对象时返回 ErrBadCommand
+func (c CommandRequest) Frame() (*protocol.Frame, error) {
+	if len(c.Payload) > 0 {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(c.Payload, &obj); err != nil || obj == nil {
+			return nil, fmt.Errorf("%w: payload must be a JSON object", ErrBadCommand)
+		}
+	}
+	switch {
+	case c.Action != "":
+		data, err := json.Marshal(CallRequest{Action: c.Action, Payload: c.Payload})
+		if err != nil {
+			return nil, err
+		}
+		return protocol.NewFrame(protocol.ProtocolV1, protocol.CmdCall, data), nil
+	case c.Cmd != 0:
+		return protocol.NewFrame(protocol.ProtocolV1, c.Cmd, c.Payload), nil
+	}
+	return nil, fmt.Errorf("%w: cmd or action is required", ErrBadCommand)
+}
+
+// CallRequest 是 CmdCall 帧的负载
+type CallRequest struct {
+	ID      string          `json:"id"`
+	Action  string          `json:"action"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// CallResult 是 CmdCallResult 帧的负载，ErrorCode 不为空表示充电桩拒绝执行
+type CallResult struct {
+	ID               string          `json:"id"`
+	Payload          json.RawMessage `json:"payload,omitempty"`
+	ErrorCode        string          `json:"errorCode,omitempty"`
+	ErrorDescription string          `json:"errorDescription,omitempty"`
+}
+
+// CallError 是充电桩对请求的错误应答
+type CallError struct {
+	Code        string
+	Description string
+}
+
+func (e *CallError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// Caller 由自带请求应答语义的链路实现（如 OCPP），Gateway.Call 直接交给链路处理
+type Caller interface {
+	Call(ctx context.Context, action string, req, resp any) error
+}
+
+// Call 向会话发送请求并等待应答，resp 为 nil 时丢弃应答负载。
+// 等待时间取 ctx 的截止时间和 CallTimeout 中较早的一个，超时在时间轮上计时；
+// 等待期间链路关闭时返回 ErrChargerOffline
+func (g *Gateway) Call(ctx context.Context, s *Session, action string, req, resp any) error {
+	if c, ok := s.Transport.(Caller); ok {
+		ctx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+		timer := g.Timers().AfterFunc(g.CallTimeout(), func() { cancel(ErrCallTimeout) })
+		defer timer.Stop()
+		err := c.Call(ctx, action, req, resp)
+		if err != nil && errors.Is(context.Cause(ctx), ErrCallTimeout) {
+			return fmt.Errorf("%s to %s: %w", action, s.ID, ErrCallTimeout)
+		}
+		return err
+	}
+
+	var payload json.RawMessage
+	if req != nil {
+		var err error
+		if payload, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+	id := strconv.FormatUint(s.nextCallID.Add(1), 10)
+	data, err := json.Marshal(CallRequest{ID: id, Action: action, Payload: payload})
+	if err != nil {
+		return err
+	}
+
+	ch := s.addPending(id)
+	defer s.removePending(id)
+	done := s.Done()
+	if err := s.Send(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdCall, data)); err != nil {
+		return err
+	}
+
+	timeout := make(chan struct{})
+	timer := g.Timers().AfterFunc(g.CallTimeout(), func() { close(timeout) })
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		if r.ErrorCode != "" {
+			return &CallError{Code: r.ErrorCode, Description: r.ErrorDescription}
+		}
+		if resp == nil || len(r.Payload) == 0 {
+			return nil
+		}
+		return json.Unmarshal(r.Payload, resp)
+	case <-timeout:
+		return fmt.Errorf("%s to %s: %w", action, s.ID, ErrCallTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return fmt.Errorf("%s to %s: %w", action, s.ID, ErrChargerOffline)
+	}
+}
+
+// ResolveCall 把充电桩的应答交给等待中的 Call，没有对应的请求时返回 ErrUnexpectedCall
+func (g *Gateway) ResolveCall(s *Session, r CallResult) error {
+	ch, ok := s.pendingCall(r.ID)
+	if !ok {
+		return fmt.Errorf("%w: %s from %s", ErrUnexpectedCall, r.ID, s.ID)
+	}
+	select {
+	case ch <- r:
+	default: // 重复的应答
+	}
+	return nil
+}
+
+func (s *Session) addPending(id string) chan CallResult {
+	ch := make(chan CallResult, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.calls == nil {
+		s.calls = make(map[string]chan CallResult)
+	}
+	s.calls[id] = ch
+	return ch
+}
+
+func (s *Session) removePending(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.calls, id)
+}
+
+func (s *Session) pendingCall(id string) (chan CallResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch, ok := s.calls[id]
+	return ch, ok
+}
@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"context"
+	"time"
+)
+
+// 充电曲线相关的请求，负载沿用 OCPP 1.6
+const (
+	ActionSetChargingProfile   = "SetChargingProfile"
+	ActionClearChargingProfile = "ClearChargingProfile"
+)
+
+// 充电曲线的用途，取值同 OCPP 1.6 ChargingProfilePurposeType
+const (
+	PurposeChargePointMax = "ChargePointMaxProfile" // 整桩的功率上限，ConnectorID 必须为 0
+	PurposeTxDefault      = "TxDefaultProfile"      // 新交易的缺省曲线
+	PurposeTx             = "TxProfile"             // 只对 TransactionID 指定的交易生效
+)
+
+// 充电曲线的类型
+const (
+	KindAbsolute  = "Absolute"  // 从 StartSchedule 开始
+	KindRecurring = "Recurring" // 从 StartSchedule 开始按天或按周重复
+	KindRelative  = "Relative"  // 从交易开始时计时
+)
+
+// StatusUnknown 是 ClearChargingProfile 的应答状态，充电桩上没有符合条件的曲线
+const StatusUnknown = "Unknown"
+
+// Recurring 曲线的重复周期
+const (
+	RecurrencyDaily  = "Daily"
+	RecurrencyWeekly = "Weekly"
+)
+
+// 限值的单位
+const (
+	RateUnitW = "W"
+	RateUnitA = "A"
+)
+
+// ChargingSchedulePeriod 是充电计划中的一段，StartPeriod 为距计划开始的秒数
+type ChargingSchedulePeriod struct {
+	StartPeriod  int     `json:"startPeriod"`
+	Limit        float64 `json:"limit"`
+	NumberPhases int     `json:"numberPhases,omitempty"`
+}
+
+// ChargingSchedule 是按时间段给出的限值，Duration 为 0 表示最后一段一直有效
+type ChargingSchedule struct {
+	Duration               int                      `json:"duration,omitempty"` // 秒
+	StartSchedule          *time.Time               `json:"startSchedule,omitempty"`
+	ChargingRateUnit       string                   `json:"chargingRateUnit"`
+	ChargingSchedulePeriod []ChargingSchedulePeriod `json:"chargingSchedulePeriod"`
+	MinChargingRate        float64                  `json:"minChargingRate,omitempty"`
+}
+
+// ChargingProfile 是一条充电曲线。同一用途下 StackLevel 大的优先
+type ChargingProfile struct {
+	ChargingProfileID      int              `json:"chargingProfileId"`
+	TransactionID          int              `json:"transactionId,omitempty"`
+	StackLevel             int              `json:"stackLevel"`
+	ChargingProfilePurpose string           `json:"chargingProfilePurpose"`
+	ChargingProfileKind    string           `json:"chargingProfileKind"`
+	RecurrencyKind         string           `json:"recurrencyKind,omitempty"` // Daily 或 Weekly
+	ValidFrom              *time.Time       `json:"validFrom,omitempty"`
+	ValidTo                *time.Time       `json:"validTo,omitempty"`
+	ChargingSchedule       ChargingSchedule `json:"chargingSchedule"`
+}
+
+// SetChargingProfileRequest 把充电曲线下发到枪，ConnectorID 为 0 表示整桩
+type SetChargingProfileRequest struct {
+	ConnectorID        int             `json:"connectorId"`
+	CsChargingProfiles ChargingProfile `json:"csChargingProfiles"`
+}
+
+// SetChargingProfile 下发充电曲线。充电桩拒绝时返回 ErrCommandRejected
+func (g *Gateway) SetChargingProfile(ctx context.Context, chargerID string, connectorID int, p ChargingProfile) (CommandStatus, error) {
+	return g.command(ctx, chargerID, ActionSetChargingProfile, SetChargingProfileRequest{ConnectorID: connectorID, CsChargingProfiles: p})
+}
+
+// ClearChargingProfileRequest 删除充电桩上的充电曲线，给出 ID 时按 ID 删除，否则删除符合其余条件的曲线
+type ClearChargingProfileRequest struct {
+	ID                     *int   `json:"id,omitempty"`
+	ConnectorID            *int   `json:"connectorId,omitempty"`
+	ChargingProfilePurpose string `json:"chargingProfilePurpose,omitempty"`
+	StackLevel             *int   `json:"stackLevel,omitempty"`
+}
+
+// ClearChargingProfile 删除充电曲线。充电桩上没有符合条件的曲线时返回 ErrCommandRejected，状态为 StatusUnknown
+func (g *Gateway) ClearChargingProfile(ctx context.Context, chargerID string, req ClearChargingProfileRequest) (CommandStatus, error) {
+	return g.command(ctx, chargerID, ActionClearChargingProfile, req)
+}
@@ -0,0 +1,69 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+)
+
+// 读写充电桩配置的 action，负载沿用 OCPP 1.6
+const (
+	ActionGetConfiguration    = "GetConfiguration"
+	ActionChangeConfiguration = "ChangeConfiguration"
+)
+
+// ChangeConfiguration 的应答状态，除 StatusAccepted、StatusRejected 外的取值
+const (
+	StatusRebootRequired = "RebootRequired"
+	StatusNotSupported   = "NotSupported"
+)
+
+// ConfigurationKey 是充电桩上报的一个配置项
+type ConfigurationKey struct {
+	Key      string  `json:"key"`
+	Readonly bool    `json:"readonly"`
+	Value    *string `json:"value,omitempty"` // 充电桩没有值时为空
+}
+
+// GetConfigurationRequest 读取配置，Key 为空表示全部
+type GetConfigurationRequest struct {
+	Key []string `json:"key,omitempty"`
+}
+
+// GetConfigurationResponse 是充电桩的配置，UnknownKey 列出不认识的键
+type GetConfigurationResponse struct {
+	ConfigurationKey []ConfigurationKey `json:"configurationKey,omitempty"`
+	UnknownKey       []string           `json:"unknownKey,omitempty"`
+}
+
+// ChangeConfigurationRequest 修改一个配置项
+type ChangeConfigurationRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// GetConfiguration 读取充电桩的配置
+func (g *Gateway) GetConfiguration(ctx context.Context, chargerID string, keys ...string) (GetConfigurationResponse, error) {
+	s, ok := g.GetSession(chargerID)
+	if !ok {
+		return GetConfigurationResponse{}, fmt.Errorf("%w: %s", ErrChargerOffline, chargerID)
+	}
+	var resp GetConfigurationResponse
+	err := g.Call(ctx, s, ActionGetConfiguration, GetConfigurationRequest{Key: keys}, &resp)
+	return resp, err
+}
+
+// ChangeConfiguration 修改充电桩的一个配置项。RebootRequired 视为成功，其他非 Accepted 状态返回 ErrCommandRejected
+func (g *Gateway) ChangeConfiguration(ctx context.Context, chargerID, key, value string) (CommandStatus, error) {
+	s, ok := g.GetSession(chargerID)
+	if !ok {
+		return CommandStatus{}, fmt.Errorf("%w: %s", ErrChargerOffline, chargerID)
+	}
+	var resp CommandStatus
+	if err := g.Call(ctx, s, ActionChangeConfiguration, ChangeConfigurationRequest{Key: key, Value: value}, &resp); err != nil {
+		return CommandStatus{}, err
+	}
+	if resp.Status != StatusAccepted && resp.Status != StatusRebootRequired {
+		return resp, fmt.Errorf("%w: %s %s", ErrCommandRejected, key, resp.Status)
+	}
+	return resp, nil
+}
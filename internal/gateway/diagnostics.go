@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ActionGetDiagnostics 让充电桩上传诊断日志，负载沿用 OCPP 1.6
+const ActionGetDiagnostics = "GetDiagnostics"
+
+var ErrDiagnosticsDisabled = errors.New("diagnostics upload not enabled")
+
+// GetDiagnosticsRequest 请求一段时间内的诊断日志。Location 为空时充电桩经现有连接
+// 以 CmdDiagnosticsChunk 分片上传，这是二进制协议的扩展；OCPP 充电桩必须给出上传地址
+type GetDiagnosticsRequest struct {
+	Location      string     `json:"location,omitempty"`
+	Retries       int        `json:"retries,omitempty"`
+	RetryInterval int        `json:"retryInterval,omitempty"` // 秒
+	StartTime     *time.Time `json:"startTime,omitempty"`
+	StopTime      *time.Time `json:"stopTime,omitempty"`
+}
+
+// GetDiagnosticsResponse 给出将要上传的文件名，充电桩没有日志时为空
+type GetDiagnosticsResponse struct {
+	FileName string `json:"fileName,omitempty"`
+}
+
+// DiagnosticsChunk 是 CmdDiagnosticsChunk 的负载。分片可能乱序到达，按 Offset 写入，
+// Last 的一片决定文件总长
+type DiagnosticsChunk struct {
+	FileName string `json:"fileName"`
+	Offset   int64  `json:"offset"`
+	Data     []byte `json:"data"`
+	Last     bool   `json:"last,omitempty"`
+}
+
+// DiagnosticsChunkAck 是网关对每一片的应答，充电桩据此控制发送窗口
+type DiagnosticsChunkAck struct {
+	FileName string `json:"fileName"`
+	Offset   int64  `json:"offset"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// DiagnosticsSink 接收充电桩上传的诊断文件分片
+type DiagnosticsSink interface {
+	WriteChunk(chargerID string, c DiagnosticsChunk) error
+}
+
+// SetDiagnostics 设置诊断文件的存储，为空时拒绝上传
+func (g *Gateway) SetDiagnostics(sink DiagnosticsSink) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.diagnostics = sink
+}
+
+// WriteDiagnosticsChunk 把分片交给诊断文件存储
+func (g *Gateway) WriteDiagnosticsChunk(chargerID string, c DiagnosticsChunk) error {
+	g.mu.RLock()
+	sink := g.diagnostics
+	g.mu.RUnlock()
+	if sink == nil {
+		return ErrDiagnosticsDisabled
+	}
+	return sink.WriteChunk(chargerID, c)
+}
+
+// GetDiagnostics 让充电桩上传诊断日志
+func (g *Gateway) GetDiagnostics(ctx context.Context, chargerID string, req GetDiagnosticsRequest) (GetDiagnosticsResponse, error) {
+	s, ok := g.GetSession(chargerID)
+	if !ok {
+		return GetDiagnosticsResponse{}, fmt.Errorf("%w: %s", ErrChargerOffline, chargerID)
+	}
+	var resp GetDiagnosticsResponse
+	err := g.Call(ctx, s, ActionGetDiagnostics, req, &resp)
+	return resp, err
+}
@@ -1,6 +1,7 @@
 package gateway
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/x14n/evgateway/internal/protocol"
@@ -8,6 +9,8 @@ import (
 
 type HandlerFunc func(*Gateway, *Session, protocol.Frame) error
 
+var ErrUnknownCommand = errors.New("unknown command")
+
 type Dispatcher struct {
 	handlers map[byte]HandlerFunc
 }
@@ -23,11 +26,23 @@ func (d *Dispatcher) RegisterHandler(cmd byte, handler HandlerFunc) {
 }
 
 func (d *Dispatcher) Dispatch(gw *Gateway, session *Session, frame protocol.Frame) {
-	if handler, ok := d.handlers[frame.Cmd]; ok {
-		if err := handler(gw, session, frame); err != nil {
-			fmt.Printf("Dispatcher error %v", err)
+	if err := d.Handle(gw, session, frame); err != nil {
+		fmt.Printf("[Dispatcher] cmd %d error: %v\n", frame.Cmd, err)
+		if errors.Is(err, ErrUnknownCommand) {
+			gw.Emit(Event{Type: EventFrameRejected, ChargerID: session.ID, Data: FrameRejectedEvent{
+				Addr:   session.Addr,
+				Cmd:    frame.Cmd,
+				Reason: err.Error(),
+			}})
 		}
-	} else {
-		fmt.Printf("[Dispatcher] unknown error : %v", frame.Cmd)
 	}
 }
+
+// Handle 同步调用命令对应的处理器并返回其错误，供需要应答结果的前端使用
+func (d *Dispatcher) Handle(gw *Gateway, session *Session, frame protocol.Frame) error {
+	handler, ok := d.handlers[frame.Cmd]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownCommand, frame.Cmd)
+	}
+	return handler(gw, session, frame)
+}
@@ -0,0 +1,75 @@
+package gateway
+
+import "time"
+
+// 网关事件类型，也是北向消息中的 type 字段
+const (
+	EventSessionConnected    = "session_connected"    // 链路建立，充电桩尚未注册，ChargerID 为空
+	EventSessionRegistered   = "session_registered"   // 注册成功
+	EventSessionExpired      = "session_expired"      // 心跳超时被清理
+	EventSessionClosed       = "session_closed"       // 已注册的充电桩断开连接
+	EventHeartbeat           = "heartbeat"            // 收到心跳
+	EventStatusChanged       = "status_changed"       // 上报的状态与上一次不同
+	EventErrorReported       = "error_reported"       // 充电桩上报故障
+	EventFrameRejected       = "frame_rejected"       // 帧被丢弃：校验失败、无法解密、分片错误或未知命令
+	EventTransactionStarted  = "transaction_started"  // 交易开始
+	EventTransactionStopped  = "transaction_stopped"  // 交易结束
+	EventMeterValues         = "meter_values"         // 计量数据
+	EventConfigDrift         = "config_drift"         // 充电桩的实际配置与期望配置不一致
+	EventFirmwareStatus      = "firmware_status"      // 充电桩上报固件更新进度
+	EventRolloutPaused       = "rollout_paused"       // 固件发布因失败率过高自动暂停，ChargerID 为空
+	EventDiagnosticsUploaded = "diagnostics_uploaded" // 诊断文件上传完成
+)
+
+// Event 是一条网关事件，Data 会原样编码成 JSON 交给北向接口
+type Event struct {
+	Type      string
+	ChargerID string
+	Time      time.Time
+	Data      any
+}
+
+// SessionConnectedEvent 是链路建立事件的负载
+type SessionConnectedEvent struct {
+	Addr string `json:"addr"`
+}
+
+// SessionExpiredEvent 是会话过期事件的负载
+type SessionExpiredEvent struct {
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// SessionClosedEvent 是断开连接事件的负载
+type SessionClosedEvent struct {
+	Addr string `json:"addr"`
+}
+
+// StatusChangedEvent 是状态变化事件的负载，Previous 在首次上报时为空
+type StatusChangedEvent struct {
+	Status   map[string]any `json:"status"`
+	Previous map[string]any `json:"previous,omitempty"`
+}
+
+// FirmwareStatusEvent 是固件进度事件的负载，RequestID 仅 OCPP 2.0.1 有
+type FirmwareStatusEvent struct {
+	Status    string `json:"status"`
+	RequestID int    `json:"requestId,omitempty"`
+}
+
+// FrameRejectedEvent 是丢帧事件的负载，未注册的链路用 Addr 区分
+type FrameRejectedEvent struct {
+	Addr   string `json:"addr"`
+	Cmd    byte   `json:"cmd,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Subscribe 订阅网关事件，见 Bus.Subscribe
+func (g *Gateway) Subscribe(h EventHandler, opts ...SubscribeOption) *Subscription {
+	return g.bus.Subscribe(h, opts...)
+}
+
+// Emit 发布网关事件，Time 为空时取当前时间
+func (g *Gateway) Emit(e Event) {
+	g.bus.Publish(e)
+}
@@ -0,0 +1,104 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// 固件更新使用的 action。UpdateFirmware 沿用 OCPP 1.6，FirmwareChunk 是二进制协议的扩展，
+// 用于充电桩无法自行下载时由网关经现有连接推送固件
+const (
+	ActionUpdateFirmware = "UpdateFirmware"
+	ActionFirmwareChunk  = "FirmwareChunk"
+)
+
+// FirmwareChunkSize 是推送固件时每片的原始字节数，base64 编码并加上 CmdCall 的 JSON 外壳后
+// 仍小于 protocol.DefaultMaxPayloadSize
+const FirmwareChunkSize = 32 * 1024
+
+// 充电桩上报的固件状态，取值同 OCPP FirmwareStatus，2.0.1 另有更细的中间状态
+const (
+	FirmwareIdle               = "Idle"
+	FirmwareDownloading        = "Downloading"
+	FirmwareDownloaded         = "Downloaded"
+	FirmwareDownloadFailed     = "DownloadFailed"
+	FirmwareInstalling         = "Installing"
+	FirmwareInstalled          = "Installed"
+	FirmwareInstallationFailed = "InstallationFailed"
+)
+
+var ErrFirmwareSize = errors.New("firmware size mismatch")
+
+// UpdateFirmwareRequest 让充电桩从 Location 下载固件，RetrieveDate 之后开始
+type UpdateFirmwareRequest struct {
+	Location      string    `json:"location"`
+	RetrieveDate  time.Time `json:"retrieveDate"`
+	Retries       int       `json:"retries,omitempty"`
+	RetryInterval int       `json:"retryInterval,omitempty"` // 秒
+}
+
+// FirmwareChunk 是推送的一片固件。每片都带版本、总长和校验和，充电桩收到
+// Last 的一片后校验 SHA256 并开始安装，随后用 CmdFirmwareStatus 上报进度
+type FirmwareChunk struct {
+	Version string `json:"version"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	Offset  int64  `json:"offset"`
+	Data    []byte `json:"data"`
+	Last    bool   `json:"last,omitempty"`
+}
+
+// UpdateFirmware 让充电桩下载固件。OCPP 1.6 的应答没有状态，视为接受
+func (g *Gateway) UpdateFirmware(ctx context.Context, chargerID string, req UpdateFirmwareRequest) error {
+	s, ok := g.GetSession(chargerID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrChargerOffline, chargerID)
+	}
+	if req.RetrieveDate.IsZero() {
+		req.RetrieveDate = time.Now().UTC()
+	}
+	var resp CommandStatus
+	if err := g.Call(ctx, s, ActionUpdateFirmware, req, &resp); err != nil {
+		return err
+	}
+	if resp.Status != "" && resp.Status != StatusAccepted {
+		return fmt.Errorf("%w: %s %s", ErrCommandRejected, ActionUpdateFirmware, resp.Status)
+	}
+	return nil
+}
+
+// StreamFirmware 把 r 中的固件分片推送给充电桩，每片等到应答再发下一片，
+// 期间该会话的其他帧照常收发。size 和 sha256 由调用方给出，读到的长度不符时返回 ErrFirmwareSize
+func (g *Gateway) StreamFirmware(ctx context.Context, chargerID, version string, size int64, sha256 string, r io.Reader) error {
+	s, ok := g.GetSession(chargerID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrChargerOffline, chargerID)
+	}
+	buf := make([]byte, FirmwareChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := offset+int64(n) >= size
+		if n == 0 && !last || offset+int64(n) > size {
+			return fmt.Errorf("%w: %s read %d of %d bytes", ErrFirmwareSize, version, offset+int64(n), size)
+		}
+		chunk := FirmwareChunk{Version: version, Size: size, SHA256: sha256, Offset: offset, Data: buf[:n], Last: last}
+		var resp CommandStatus
+		if err := g.Call(ctx, s, ActionFirmwareChunk, chunk, &resp); err != nil {
+			return fmt.Errorf("firmware chunk at %d: %w", offset, err)
+		}
+		if resp.Status != StatusAccepted {
+			return fmt.Errorf("%w: %s at %d %s", ErrCommandRejected, ActionFirmwareChunk, offset, resp.Status)
+		}
+		offset += int64(n)
+		if last {
+			return nil
+		}
+	}
+}
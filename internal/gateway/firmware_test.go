@@ -0,0 +1,65 @@
+package gateway_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+func TestStreamFirmware(t *testing.T) {
+	g := newTestGateway(t)
+	image := make([]byte, 3*gateway.FirmwareChunkSize+100)
+	rand.Read(image)
+
+	var got bytes.Buffer
+	var chunks int
+	fakeCharger(t, g, "CP1", gateway.Labels{}, func(req gateway.CallRequest) *gateway.CallResult {
+		if data, _ := json.Marshal(req); len(data) >= protocol.DefaultMaxPayloadSize {
+			t.Errorf("call payload of %d bytes exceeds the frame limit", len(data))
+		}
+		var c gateway.FirmwareChunk
+		json.Unmarshal(req.Payload, &c)
+		if req.Action != gateway.ActionFirmwareChunk || c.Offset != int64(got.Len()) || c.Version != "2.0" || c.Size != int64(len(image)) {
+			t.Errorf("unexpected chunk %s at %d", req.Action, c.Offset)
+		}
+		got.Write(c.Data)
+		chunks++
+		if c.Last != (got.Len() == len(image)) {
+			t.Errorf("last flag %v at %d", c.Last, got.Len())
+		}
+		payload, _ := json.Marshal(gateway.CommandStatus{Status: gateway.StatusAccepted})
+		return &gateway.CallResult{Payload: payload}
+	})
+
+	if err := g.StreamFirmware(context.Background(), "CP1", "2.0", int64(len(image)), "sum", bytes.NewReader(image)); err != nil {
+		t.Fatal(err)
+	}
+	if chunks != 4 || !bytes.Equal(got.Bytes(), image) {
+		t.Fatalf("charger got %d chunks, %d bytes", chunks, got.Len())
+	}
+
+	got.Reset()
+	short := image[:gateway.FirmwareChunkSize]
+	if err := g.StreamFirmware(context.Background(), "CP1", "2.0", int64(len(image)), "sum", bytes.NewReader(short)); !errors.Is(err, gateway.ErrFirmwareSize) {
+		t.Errorf("expected ErrFirmwareSize, got %v", err)
+	}
+}
+
+func TestUpdateFirmware(t *testing.T) {
+	g := newTestGateway(t)
+	var got gateway.UpdateFirmwareRequest
+	fakeCharger(t, g, "CP1", gateway.Labels{}, func(req gateway.CallRequest) *gateway.CallResult {
+		json.Unmarshal(req.Payload, &got)
+		return &gateway.CallResult{Payload: json.RawMessage(`{}`)}
+	})
+	err := g.UpdateFirmware(context.Background(), "CP1", gateway.UpdateFirmwareRequest{Location: "http://gw/firmware/2.0"})
+	if err != nil || got.Location != "http://gw/firmware/2.0" || got.RetrieveDate.IsZero() {
+		t.Fatalf("update firmware: %v %+v", err, got)
+	}
+}
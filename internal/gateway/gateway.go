@@ -1,43 +1,147 @@
 package gateway
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/x14n/evgateway/internal/timewheel"
+)
 
 type Gateway struct {
-	mu      sync.RWMutex
-	session map[string]*Session
+	mu       sync.RWMutex // 保护交易和配置
+	sessions *registry
+
+	transactions map[int]*Transaction
+	finished     []int // 已结束的交易 ID，按结束顺序
+	lastTxID     int
+
+	bus *Bus
+
+	inventory   Inventory
+	diagnostics DiagnosticsSink
+	authorizer  Authorizer
+	timers      *timewheel.Wheel
+	callTimeout time.Duration
+
+	nextJobID  atomic.Uint64
+	broadcasts []*BroadcastJob // 最近的广播任务
+}
+
+// Inventory 提供充电桩台账中的分组信息，注册时写入会话
+type Inventory interface {
+	Lookup(chargerID string) (Labels, bool)
 }
 
 func NewGateway() *Gateway {
 	return &Gateway{
-		session: make(map[string]*Session),
+		sessions:     newRegistry(),
+		transactions: make(map[int]*Transaction),
+		bus:          NewBus(),
 	}
 }
 
-func (g *Gateway) AddSession(s *Session) {
+// SetTimers 设置请求超时使用的时间轮，缺省使用 timewheel.Default
+func (g *Gateway) SetTimers(w *timewheel.Wheel) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	g.session[s.ID] = s
+	g.timers = w
 }
 
-func (g *Gateway) GetSession(id string) (*Session, bool) {
+// Timers 返回请求超时使用的时间轮
+func (g *Gateway) Timers() *timewheel.Wheel {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.timers == nil {
+		return timewheel.Default()
+	}
+	return g.timers
+}
+
+// SetCallTimeout 设置 Call 等待应答的时间
+func (g *Gateway) SetCallTimeout(d time.Duration) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	s, ok := g.session[id]
-	return s, ok
+	g.callTimeout = d
 }
 
-func (g *Gateway) RemoveSession(id string) {
+// CallTimeout 返回 Call 等待应答的时间
+func (g *Gateway) CallTimeout() time.Duration {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.callTimeout <= 0 {
+		return DefaultCallTimeout
+	}
+	return g.callTimeout
+}
+
+// SetInventory 设置充电桩台账，之后注册的会话使用新的台账
+func (g *Gateway) SetInventory(inv Inventory) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	delete(g.session, id)
+	g.inventory = inv
 }
 
-func (g *Gateway) ListSessions() []*Session {
+// LookupLabels 在台账中查找充电桩的分组信息
+func (g *Gateway) LookupLabels(chargerID string) (Labels, bool) {
 	g.mu.RLock()
-	defer g.mu.RUnlock()
-	out := make([]*Session, 0, len(g.session))
-	for _, s := range g.session {
-		out = append(out, s)
+	inv := g.inventory
+	g.mu.RUnlock()
+	if inv == nil {
+		return Labels{}, false
 	}
-	return out
+	return inv.Lookup(chargerID)
+}
+
+// AddSession 登记会话并分配连接 ID。会话注册、改变站点或标签后再次调用以更新索引
+func (g *Gateway) AddSession(s *Session) {
+	g.sessions.add(s)
+}
+
+// GetSession 按充电桩 ID 查找会话，同一充电桩有多条连接时返回最新的一条
+func (g *Gateway) GetSession(id string) (*Session, bool) {
+	if id == "" {
+		return nil, false
+	}
+	return g.sessions.charger.get(id)
+}
+
+// Conn 按连接 ID 查找会话，未注册的连接也能找到
+func (g *Gateway) Conn(connID uint64) (*Session, bool) {
+	return g.sessions.conn(connID)
+}
+
+// RemoveSession 删除会话，会话已被删除时返回 false
+func (g *Gateway) RemoveSession(s *Session) bool {
+	return g.sessions.remove(s)
+}
+
+// ListSessions 返回已注册会话的快照，每个充电桩只有最新的一条连接。返回的切片由多个调用方共享，不能修改
+func (g *Gateway) ListSessions() []*Session {
+	return g.sessions.snapshot().sessions
+}
+
+// ListConnections 返回所有连接的快照，包括未注册的连接和已被重连取代的旧连接。返回的切片不能修改
+func (g *Gateway) ListConnections() []*Session {
+	return g.sessions.snapshot().conns
+}
+
+// Count 返回连接数
+func (g *Gateway) Count() int {
+	return int(g.sessions.count.Load())
+}
+
+// SessionsBySite 返回站点下的所有会话
+func (g *Gateway) SessionsBySite(site string) []*Session {
+	return g.sessions.site.get(site)
+}
+
+// SessionsByIP 返回来自同一 IP 的所有会话
+func (g *Gateway) SessionsByIP(ip string) []*Session {
+	return g.sessions.ip.get(ip)
+}
+
+// SessionsByTag 返回带有标签的所有会话
+func (g *Gateway) SessionsByTag(tag string) []*Session {
+	return g.sessions.tag.get(tag)
 }
@@ -0,0 +1,57 @@
+// Package gatewaytest 提供测试用的网关和接在内存管道上的模拟充电桩
+package gatewaytest
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/protocol"
+	"github.com/x14n/evgateway/internal/timewheel"
+	"github.com/x14n/evgateway/internal/transport"
+)
+
+// NewGateway 返回带时间轮的网关，Call 超时为 callTimeout。测试结束时停止时间轮
+func NewGateway(t testing.TB, callTimeout time.Duration) *gateway.Gateway {
+	t.Helper()
+	gw := gateway.NewGateway()
+	w := timewheel.New(time.Millisecond, nil)
+	w.Start()
+	t.Cleanup(w.Stop)
+	gw.SetTimers(w)
+	gw.SetCallTimeout(callTimeout)
+	return gw
+}
+
+// Connect 登记一个充电桩会话并按 reply 应答网关的 CmdCall，其他帧忽略。
+// reply 返回 nil 表示不应答，应答的 ID 由 Connect 填写；reply 为 nil 时所有请求都不应答。
+// 需要站点、标签或固件版本的测试在返回的会话上设置后再调用 AddSession 更新索引。测试结束时断开
+func Connect(t testing.TB, gw *gateway.Gateway, id string, reply func(gateway.CallRequest) *gateway.CallResult) *gateway.Session {
+	t.Helper()
+	server, conn := transport.Pipe()
+	t.Cleanup(func() { conn.Close() })
+	s := &gateway.Session{ID: id, Addr: id, Transport: server}
+	gw.AddSession(s)
+	go func() {
+		for {
+			f, err := conn.ReadFrame()
+			if err != nil {
+				return
+			}
+			if f.Cmd != protocol.CmdCall || reply == nil {
+				continue
+			}
+			var req gateway.CallRequest
+			if err := json.Unmarshal(f.Payload, &req); err != nil {
+				t.Errorf("bad call payload from gateway: %v", err)
+				return
+			}
+			if r := reply(req); r != nil {
+				r.ID = req.ID
+				gw.ResolveCall(s, *r)
+			}
+		}
+	}()
+	return s
+}
@@ -0,0 +1,270 @@
+package gateway
+
+import (
+	"hash/maphash"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const numShards = 64
+
+var shardSeed = maphash.MakeSeed()
+
+// registry 保存所有连接。主表按连接 ID 分片，充电桩 ID、站点、IP 和标签是二级索引，
+// 每个索引按键分片，各自加锁，互不阻塞。
+// ListConnections 和 ListSessions 返回不可变的快照，只在会话增删后第一次读取时重建，遍历时不持有任何锁。
+// 锁的顺序总是连接分片在前、索引分片在后。
+type registry struct {
+	nextID atomic.Uint64
+	count  atomic.Int64
+	conns  [numShards]connShard
+
+	charger uniqueIndex
+	site    multiIndex
+	ip      multiIndex
+	tag     multiIndex
+
+	gen  atomic.Uint64 // 每次增删加一
+	snap atomic.Pointer[snapshot]
+}
+
+type snapshot struct {
+	gen      uint64
+	conns    []*Session // 所有连接
+	sessions []*Session // 已注册且没有被重连取代的连接
+}
+
+type connShard struct {
+	mu sync.RWMutex
+	m  map[uint64]*indexed
+}
+
+// indexed 记录会话当前登记在哪些索引键下，重新索引或删除时据此清理
+type indexed struct {
+	s       *Session
+	charger string
+	site    string
+	ip      string
+	tags    []string
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+	for i := range r.conns {
+		r.conns[i].m = make(map[uint64]*indexed)
+	}
+	r.charger.init()
+	r.site.init()
+	r.ip.init()
+	r.tag.init()
+	return r
+}
+
+func (r *registry) shard(connID uint64) *connShard {
+	return &r.conns[connID%numShards]
+}
+
+// add 登记会话，已登记的会话按当前属性重新索引。
+// 索引在持有连接分片锁时更新，同一连接的 add 和 remove 不会交错
+func (r *registry) add(s *Session) {
+	if s.ConnID == 0 {
+		s.ConnID = r.nextID.Add(1)
+	}
+	next := &indexed{s: s, charger: s.ID, site: s.Site(), ip: hostOf(s.Addr), tags: s.Tags()}
+
+	sh := r.shard(s.ConnID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if prev, ok := sh.m[s.ConnID]; ok {
+		r.unindex(prev)
+	} else {
+		r.count.Add(1)
+	}
+	sh.m[s.ConnID] = next
+	r.index(next)
+	r.gen.Add(1)
+}
+
+// remove 删除会话，会话不存在时返回 false
+func (r *registry) remove(s *Session) bool {
+	sh := r.shard(s.ConnID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	prev, ok := sh.m[s.ConnID]
+	if !ok || prev.s != s {
+		return false
+	}
+	delete(sh.m, s.ConnID)
+	r.unindex(prev)
+	r.count.Add(-1)
+	r.gen.Add(1)
+	return true
+}
+
+func (r *registry) index(e *indexed) {
+	if e.charger != "" {
+		// 同一充电桩的新连接取代旧连接
+		r.charger.set(e.charger, e.s)
+	}
+	if e.site != "" {
+		r.site.add(e.site, e.s)
+	}
+	if e.ip != "" {
+		r.ip.add(e.ip, e.s)
+	}
+	for _, t := range e.tags {
+		r.tag.add(t, e.s)
+	}
+}
+
+func (r *registry) unindex(e *indexed) {
+	if e.charger != "" {
+		r.charger.remove(e.charger, e.s)
+	}
+	if e.site != "" {
+		r.site.remove(e.site, e.s)
+	}
+	if e.ip != "" {
+		r.ip.remove(e.ip, e.s)
+	}
+	for _, t := range e.tags {
+		r.tag.remove(t, e.s)
+	}
+}
+
+func (r *registry) conn(connID uint64) (*Session, bool) {
+	sh := r.shard(connID)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	e, ok := sh.m[connID]
+	if !ok {
+		return nil, false
+	}
+	return e.s, true
+}
+
+// snapshot 返回快照，调用方不能修改其中的切片
+func (r *registry) snapshot() *snapshot {
+	gen := r.gen.Load()
+	if p := r.snap.Load(); p != nil && p.gen == gen {
+		return p
+	}
+	conns := make([]*Session, 0, r.count.Load())
+	for i := range r.conns {
+		sh := &r.conns[i]
+		sh.mu.RLock()
+		for _, e := range sh.m {
+			conns = append(conns, e.s)
+		}
+		sh.mu.RUnlock()
+	}
+	sessions := make([]*Session, 0, len(conns))
+	for _, s := range conns {
+		if s.ID == "" {
+			continue
+		}
+		if cur, ok := r.charger.get(s.ID); ok && cur == s {
+			sessions = append(sessions, s)
+		}
+	}
+	// 重建期间有增删时 gen 已经变化，这份快照不会再被返回
+	p := &snapshot{gen: gen, conns: conns, sessions: sessions}
+	r.snap.Store(p)
+	return p
+}
+
+// uniqueIndex 是一个键只对应一个会话的索引
+type uniqueIndex struct {
+	shards [numShards]struct {
+		mu sync.RWMutex
+		m  map[string]*Session
+	}
+}
+
+func (x *uniqueIndex) init() {
+	for i := range x.shards {
+		x.shards[i].m = make(map[string]*Session)
+	}
+}
+
+func (x *uniqueIndex) set(key string, s *Session) {
+	sh := &x.shards[maphash.String(shardSeed, key)%numShards]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.m[key] = s
+}
+
+// remove 只在键仍指向 s 时删除，已被新连接取代的不动
+func (x *uniqueIndex) remove(key string, s *Session) {
+	sh := &x.shards[maphash.String(shardSeed, key)%numShards]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.m[key] == s {
+		delete(sh.m, key)
+	}
+}
+
+func (x *uniqueIndex) get(key string) (*Session, bool) {
+	sh := &x.shards[maphash.String(shardSeed, key)%numShards]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	s, ok := sh.m[key]
+	return s, ok
+}
+
+// multiIndex 是一个键对应多个会话的索引
+type multiIndex struct {
+	shards [numShards]struct {
+		mu sync.RWMutex
+		m  map[string]map[*Session]struct{}
+	}
+}
+
+func (x *multiIndex) init() {
+	for i := range x.shards {
+		x.shards[i].m = make(map[string]map[*Session]struct{})
+	}
+}
+
+func (x *multiIndex) add(key string, s *Session) {
+	sh := &x.shards[maphash.String(shardSeed, key)%numShards]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	set, ok := sh.m[key]
+	if !ok {
+		set = make(map[*Session]struct{})
+		sh.m[key] = set
+	}
+	set[s] = struct{}{}
+}
+
+func (x *multiIndex) remove(key string, s *Session) {
+	sh := &x.shards[maphash.String(shardSeed, key)%numShards]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	set := sh.m[key]
+	delete(set, s)
+	if len(set) == 0 {
+		delete(sh.m, key)
+	}
+}
+
+func (x *multiIndex) get(key string) []*Session {
+	sh := &x.shards[maphash.String(shardSeed, key)%numShards]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	out := make([]*Session, 0, len(sh.m[key]))
+	for s := range sh.m[key] {
+		out = append(out, s)
+	}
+	return out
+}
+
+// hostOf 取远端地址中的 IP，管道、串口等没有端口的地址原样返回
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,152 @@
+package gateway
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRegistryUnregisteredConnsDoNotCollide(t *testing.T) {
+	g := NewGateway()
+	a := &Session{Addr: "10.0.0.1:4000"}
+	b := &Session{Addr: "10.0.0.1:4001"}
+	g.AddSession(a)
+	g.AddSession(b)
+	if a.ConnID == 0 || a.ConnID == b.ConnID {
+		t.Fatalf("expected distinct connection ids, got %d and %d", a.ConnID, b.ConnID)
+	}
+	if g.Count() != 2 || len(g.ListConnections()) != 2 {
+		t.Fatalf("expected 2 connections, got count %d, list %d", g.Count(), len(g.ListConnections()))
+	}
+	if got := g.ListSessions(); len(got) != 0 {
+		t.Fatalf("unregistered connections listed as sessions: %v", got)
+	}
+	if _, ok := g.GetSession(""); ok {
+		t.Error("unregistered connections must not be found by empty charger id")
+	}
+	if got := g.SessionsByIP("10.0.0.1"); len(got) != 2 {
+		t.Errorf("expected 2 sessions from 10.0.0.1, got %d", len(got))
+	}
+
+	// 注册后再次 AddSession 更新索引
+	a.ID = "CP1"
+	a.SetLabels(Labels{Site: "depot", Tags: []string{"dc", "fast", "dc"}})
+	g.AddSession(a)
+	if s, ok := g.GetSession("CP1"); !ok || s != a {
+		t.Fatal("registered session not indexed by charger id")
+	}
+	if got := g.ListSessions(); len(got) != 1 || got[0] != a {
+		t.Errorf("expected only the registered session listed, got %v", got)
+	}
+	if got := g.SessionsBySite("depot"); len(got) != 1 || got[0] != a {
+		t.Errorf("site index: %v", got)
+	}
+	if got := g.SessionsByTag("fast"); len(got) != 1 {
+		t.Errorf("tag index: %v", got)
+	}
+	if g.Count() != 2 {
+		t.Errorf("reindexing changed the count to %d", g.Count())
+	}
+
+	a.SetLabels(Labels{Site: "depot", Tags: []string{"ac"}})
+	g.AddSession(a)
+	if got := g.SessionsByTag("fast"); len(got) != 0 {
+		t.Errorf("stale tag index: %v", got)
+	}
+
+	if !g.RemoveSession(a) || g.RemoveSession(a) {
+		t.Fatal("RemoveSession should succeed exactly once")
+	}
+	if _, ok := g.GetSession("CP1"); ok {
+		t.Error("removed session still indexed")
+	}
+	if got := g.SessionsBySite("depot"); len(got) != 0 {
+		t.Errorf("removed session still in site index: %v", got)
+	}
+	if s, ok := g.Conn(b.ConnID); !ok || s != b {
+		t.Error("other connection lost")
+	}
+}
+
+func TestRegistryReconnectReplacesChargerIndex(t *testing.T) {
+	g := NewGateway()
+	old := &Session{ID: "CP1", Addr: "a"}
+	cur := &Session{ID: "CP1", Addr: "b"}
+	g.AddSession(old)
+	g.AddSession(cur)
+	if s, _ := g.GetSession("CP1"); s != cur {
+		t.Fatal("newest connection should win")
+	}
+	if got := g.ListSessions(); len(got) != 1 || got[0] != cur {
+		t.Errorf("replaced connection listed as a session: %v", got)
+	}
+	if got := g.ListConnections(); len(got) != 2 {
+		t.Errorf("expected both connections, got %v", got)
+	}
+	// 旧连接断开不影响新连接的索引
+	g.RemoveSession(old)
+	if s, ok := g.GetSession("CP1"); !ok || s != cur {
+		t.Fatal("removing the old connection dropped the new one")
+	}
+}
+
+func TestRegistrySnapshot(t *testing.T) {
+	g := NewGateway()
+	for i := range 100 {
+		g.AddSession(&Session{ID: fmt.Sprintf("CP%d", i)})
+	}
+	first := g.ListSessions()
+	if len(first) != 100 {
+		t.Fatalf("expected 100 sessions, got %d", len(first))
+	}
+	if again := g.ListSessions(); &again[0] != &first[0] {
+		t.Error("unchanged registry should return the cached snapshot")
+	}
+	s, _ := g.GetSession("CP0")
+	g.RemoveSession(s)
+	if len(g.ListSessions()) != 99 || len(first) != 100 {
+		t.Error("snapshot must be rebuilt after a change and old snapshots left intact")
+	}
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	g := NewGateway()
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 500 {
+				s := &Session{ID: fmt.Sprintf("CP%d-%d", w, i), Addr: fmt.Sprintf("10.0.%d.%d:1", w, i%4)}
+				s.SetLabels(Labels{Tags: []string{fmt.Sprintf("w%d", w)}})
+				g.AddSession(s)
+				g.ListSessions()
+				if i%2 == 0 {
+					g.RemoveSession(s)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if g.Count() != 8*250 || len(g.ListSessions()) != 8*250 {
+		t.Fatalf("expected %d sessions, got count %d, list %d", 8*250, g.Count(), len(g.ListSessions()))
+	}
+	if got := g.SessionsByTag("w3"); len(got) != 250 {
+		t.Errorf("expected 250 sessions tagged w3, got %d", len(got))
+	}
+}
+
+func BenchmarkRegistryGetSession(b *testing.B) {
+	g := NewGateway()
+	for i := range 50000 {
+		g.AddSession(&Session{ID: fmt.Sprintf("CP%d", i)})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			g.GetSession(fmt.Sprintf("CP%d", i%50000))
+			i++
+		}
+	})
+}
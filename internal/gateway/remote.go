@@ -0,0 +1,76 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// 远程启停使用的 action，沿用 OCPP 1.6 的命名和负载，OCPP 2.0.1 链路自行转换
+const (
+	ActionRemoteStart = "RemoteStartTransaction"
+	ActionRemoteStop  = "RemoteStopTransaction"
+)
+
+// 充电桩对命令的应答状态
+const (
+	StatusAccepted = "Accepted"
+	StatusRejected = "Rejected"
+)
+
+var (
+	ErrCommandRejected = errors.New("command rejected by charger")
+	ErrNotSupported    = errors.New("command not supported by charger protocol")
+)
+
+// RemoteStartRequest 请求充电桩为 IDTag 开始充电，ConnectorID 为 0 时由充电桩选择枪
+type RemoteStartRequest struct {
+	ConnectorID int    `json:"connectorId,omitempty"`
+	IDTag       string `json:"idTag"`
+}
+
+// RemoteStopRequest 请求充电桩结束交易
+type RemoteStopRequest struct {
+	TransactionID int `json:"transactionId"`
+}
+
+// CommandStatus 是充电桩对命令的应答
+type CommandStatus struct {
+	Status string `json:"status"`
+}
+
+// RemoteStart 让充电桩开始充电。充电桩拒绝时返回 ErrCommandRejected，
+// 交易本身仍由充电桩随后上报的 CmdStartTransaction 建立
+func (g *Gateway) RemoteStart(ctx context.Context, chargerID string, req RemoteStartRequest) (CommandStatus, error) {
+	if req.IDTag == "" {
+		return CommandStatus{}, errors.New("remote start without id tag")
+	}
+	return g.command(ctx, chargerID, ActionRemoteStart, req)
+}
+
+// RemoteStop 让交易所在的充电桩结束充电
+func (g *Gateway) RemoteStop(ctx context.Context, req RemoteStopRequest) (CommandStatus, error) {
+	tx, ok := g.GetTransaction(req.TransactionID)
+	if !ok {
+		return CommandStatus{}, fmt.Errorf("%w: %d", ErrUnknownTransaction, req.TransactionID)
+	}
+	if !tx.Active() {
+		return CommandStatus{}, fmt.Errorf("%w: %d", ErrTransactionStopped, req.TransactionID)
+	}
+	return g.command(ctx, tx.ChargerID, ActionRemoteStop, req)
+}
+
+func (g *Gateway) command(ctx context.Context, chargerID, action string, req any) (CommandStatus, error) {
+	s, ok := g.GetSession(chargerID)
+	if !ok {
+		return CommandStatus{}, fmt.Errorf("%w: %s", ErrChargerOffline, chargerID)
+	}
+	var resp CommandStatus
+	if err := g.Call(ctx, s, action, req, &resp); err != nil {
+		return CommandStatus{}, err
+	}
+	if resp.Status != StatusAccepted {
+		return resp, fmt.Errorf("%w: %s %s", ErrCommandRejected, action, resp.Status)
+	}
+	return resp, nil
+}
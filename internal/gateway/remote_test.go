@@ -0,0 +1,63 @@
+package gateway_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+)
+
+func TestRemoteStartStop(t *testing.T) {
+	g := newTestGateway(t)
+	var got []gateway.CallRequest
+	fakeCharger(t, g, "CP1", gateway.Labels{}, func(req gateway.CallRequest) *gateway.CallResult {
+		got = append(got, req)
+		status := gateway.StatusAccepted
+		if req.Action == gateway.ActionRemoteStart {
+			var r gateway.RemoteStartRequest
+			json.Unmarshal(req.Payload, &r)
+			if r.IDTag == "BLOCKED" {
+				status = gateway.StatusRejected
+			}
+		}
+		payload, _ := json.Marshal(gateway.CommandStatus{Status: status})
+		return &gateway.CallResult{Payload: payload}
+	})
+	fakeCharger(t, g, "CP-SILENT", gateway.Labels{}, func(gateway.CallRequest) *gateway.CallResult { return nil })
+	ctx := context.Background()
+
+	resp, err := g.RemoteStart(ctx, "CP1", gateway.RemoteStartRequest{ConnectorID: 2, IDTag: "TAG1"})
+	if err != nil || resp.Status != gateway.StatusAccepted {
+		t.Fatalf("remote start: %+v %v", resp, err)
+	}
+	if len(got) != 1 || got[0].Action != gateway.ActionRemoteStart || string(got[0].Payload) != `{"connectorId":2,"idTag":"TAG1"}` {
+		t.Fatalf("unexpected call %+v", got)
+	}
+	if _, err := g.RemoteStart(ctx, "CP1", gateway.RemoteStartRequest{IDTag: "BLOCKED"}); !errors.Is(err, gateway.ErrCommandRejected) {
+		t.Errorf("expected ErrCommandRejected, got %v", err)
+	}
+	if _, err := g.RemoteStart(ctx, "CP-OFF", gateway.RemoteStartRequest{IDTag: "TAG1"}); !errors.Is(err, gateway.ErrChargerOffline) {
+		t.Errorf("expected ErrChargerOffline, got %v", err)
+	}
+	if _, err := g.RemoteStart(ctx, "CP-SILENT", gateway.RemoteStartRequest{IDTag: "TAG1"}); !errors.Is(err, gateway.ErrCallTimeout) {
+		t.Errorf("expected ErrCallTimeout, got %v", err)
+	}
+
+	tx := g.StartTransaction("CP1", 2, "TAG1", 0, time.Now())
+	if _, err := g.RemoteStop(ctx, gateway.RemoteStopRequest{TransactionID: tx.ID}); err != nil {
+		t.Fatalf("remote stop: %v", err)
+	}
+	if last := got[len(got)-1]; last.Action != gateway.ActionRemoteStop {
+		t.Errorf("expected %s, got %s", gateway.ActionRemoteStop, last.Action)
+	}
+	g.StopTransaction("CP1", tx.ID, 100, time.Now(), "Remote")
+	if _, err := g.RemoteStop(ctx, gateway.RemoteStopRequest{TransactionID: tx.ID}); !errors.Is(err, gateway.ErrTransactionStopped) {
+		t.Errorf("expected ErrTransactionStopped, got %v", err)
+	}
+	if _, err := g.RemoteStop(ctx, gateway.RemoteStopRequest{TransactionID: 999}); !errors.Is(err, gateway.ErrUnknownTransaction) {
+		t.Errorf("expected ErrUnknownTransaction, got %v", err)
+	}
+}
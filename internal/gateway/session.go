@@ -1,35 +1,312 @@
 package gateway
 
 import (
-	"net"
+	"errors"
+	"reflect"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/x14n/evgateway/internal/protocol"
+	"github.com/x14n/evgateway/internal/transport"
 )
 
+var ErrSessionClosed = errors.New("session closed")
+
+// ChargerInfo 是充电桩注册时上报的固件信息
+type ChargerInfo struct {
+	Vendor   string `json:"vendor,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+}
+
+// Labels 是充电桩台账中配置的分组信息
+type Labels struct {
+	Site     string   `json:"site,omitempty"`
+	Operator string   `json:"operator,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// Traffic 是会话的收发统计。字节数只计帧负载，不含帧头、长度、CRC 和帧尾：
+// 上行是线上收到的负载，下行是交给链路的负载（加密帧为密文，其余为压缩前）；
+// OCPP 连接按整条 WebSocket 消息计
+type Traffic struct {
+	PayloadBytesIn  uint64 `json:"payloadBytesIn"`
+	PayloadBytesOut uint64 `json:"payloadBytesOut"`
+	FramesIn        uint64 `json:"framesIn"`
+	FramesOut       uint64 `json:"framesOut"`
+}
+
+// Metadata 是会话的描述，供管理接口查询
+type Metadata struct {
+	ConnID      uint64      `json:"connId"`
+	ChargerID   string      `json:"chargerId,omitempty"`
+	Addr        string      `json:"addr"`
+	ConnectedAt time.Time   `json:"connectedAt"`
+	LastSeen    time.Time   `json:"lastSeen"`
+	Info        ChargerInfo `json:"info"`
+	Labels      Labels      `json:"labels"`
+	Traffic     Traffic     `json:"traffic"`
+}
+
 type Session struct {
-	ID         string
-	Addr       string
-	Lastseen   time.Time
-	Conn       net.Conn
-	ConnClosed bool
-	mu         sync.Mutex
+	ConnID      uint64 // 连接 ID，AddSession 时分配，在网关内唯一
+	ID          string
+	Addr        string
+	ConnectedAt time.Time
+	Lastseen    time.Time
+	Transport   transport.Transport // 会话所在的链路，TCP、TLS、WebSocket 或 OCPP 连接
+	ConnClosed  bool
+	mu          sync.Mutex
+
+	version     byte   // 注册时协商的协议版本
+	compression string // 注册时协商的压缩算法，空表示不压缩
+	secure      *protocol.SecureChannel
+	nextMsgID   atomic.Uint32  // 下行分片消息的 msgID
+	status      map[string]any // 最近一次上报的状态
+	missed      int            // 上次收到数据后发出的存活探测次数
+	registered  bool           // 已完成注册
+	info        ChargerInfo
+	labels      Labels
+
+	nextCallID atomic.Uint64
+	calls      map[string]chan CallResult // 等待应答的 CmdCall
+	done       chan struct{}              // 链路关闭时关闭，首次调用 Done 时创建
+
+	payloadIn, payloadOut atomic.Uint64
+	framesIn, framesOut   atomic.Uint64
+	writeMu               sync.Mutex
 }
 
 func (s *Session) UpdateLastSeen() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.Lastseen = time.Now()
+	s.missed = 0
+}
+
+// LastSeen 返回最近一次收到数据的时间
+func (s *Session) LastSeen() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Lastseen
+}
+
+// Probed 记录发出一次存活探测，返回收到数据之前已发出的探测次数（不含本次）
+func (s *Session) Probed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.missed++
+	return s.missed - 1
+}
+
+// Negotiate 记录注册时协商出的协议版本和压缩算法
+func (s *Session) Negotiate(version byte, compression string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version = version
+	s.compression = compression
+	s.registered = true
+}
+
+// Info 返回注册时上报的固件信息
+func (s *Session) Info() ChargerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info
+}
+
+// SetInfo 记录注册时上报的固件信息
+func (s *Session) SetInfo(info ChargerInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.info = info
+}
+
+// Labels 返回会话的分组信息
+func (s *Session) Labels() Labels {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.labels
+	l.Tags = slices.Clone(l.Tags)
+	return l
+}
+
+// SetLabels 设置分组信息，需要再次 AddSession 才会更新网关的索引
+func (s *Session) SetLabels(l Labels) {
+	l.Tags = slices.Compact(slices.Sorted(slices.Values(l.Tags)))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labels = l
+}
+
+// Site 返回会话所属的站点
+func (s *Session) Site() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.labels.Site
+}
+
+// Tags 返回会话的标签
+func (s *Session) Tags() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.labels.Tags)
+}
+
+// CountIn 记录收到一帧，payloadBytes 是该帧的负载长度
+func (s *Session) CountIn(payloadBytes int) {
+	s.framesIn.Add(1)
+	s.payloadIn.Add(uint64(payloadBytes))
+}
+
+// Traffic 返回收发统计
+func (s *Session) Traffic() Traffic {
+	return Traffic{
+		PayloadBytesIn:  s.payloadIn.Load(),
+		PayloadBytesOut: s.payloadOut.Load(),
+		FramesIn:        s.framesIn.Load(),
+		FramesOut:       s.framesOut.Load(),
+	}
 }
 
+// Metadata 返回会话当前的描述
+func (s *Session) Metadata() Metadata {
+	s.mu.Lock()
+	m := Metadata{
+		ConnID:      s.ConnID,
+		ChargerID:   s.ID,
+		Addr:        s.Addr,
+		ConnectedAt: s.ConnectedAt,
+		LastSeen:    s.Lastseen,
+		Info:        s.info,
+		Labels:      s.labels,
+	}
+	m.Labels.Tags = slices.Clone(m.Labels.Tags)
+	s.mu.Unlock()
+	m.Traffic = s.Traffic()
+	return m
+}
+
+// Registered 返回会话是否已完成注册
+func (s *Session) Registered() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.registered
+}
+
+// Version 返回会话协商的协议版本，未协商时为 v1
+func (s *Session) Version() byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.version == 0 {
+		return protocol.ProtocolV1
+	}
+	return s.version
+}
+
+// Compression 返回会话协商的压缩算法
+func (s *Session) Compression() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compression
+}
+
+// UpdateStatus 记录上报的状态，返回之前的状态以及是否发生变化
+func (s *Session) UpdateStatus(st map[string]any) (map[string]any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.status
+	s.status = st
+	return prev, prev == nil || !reflect.DeepEqual(prev, st)
+}
+
+// SetSecureChannel 绑定会话的加密通道，之后的下行帧都会加密
+func (s *Session) SetSecureChannel(ch *protocol.SecureChannel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secure = ch
+}
+
+// SecureChannel 返回会话的加密通道，未加密的会话返回 nil
+func (s *Session) SecureChannel() *protocol.SecureChannel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.secure
+}
+
+// Send 按会话协商的版本和压缩算法编码并发送一帧，超过单帧上限的负载会自动分片
+func (s *Session) Send(f *protocol.Frame) error {
+	f.Version = s.Version()
+	f.Compress = s.Compression() == protocol.CompressionDeflate
+	return s.send(f)
+}
+
+// SendVersion 按帧自带的版本发送且不压缩。注册应答要用请求帧的版本，充电桩收到应答前还不知道协商结果
+func (s *Session) SendVersion(f *protocol.Frame) error {
+	f.Compress = false
+	return s.send(f)
+}
+
+func (s *Session) send(f *protocol.Frame) error {
+	s.mu.Lock()
+	closed := s.ConnClosed
+	s.mu.Unlock()
+	if closed {
+		return ErrSessionClosed
+	}
+	frames, err := protocol.Fragment(f, s.nextMsgID.Add(1), protocol.MaxFragmentChunk)
+	if err != nil {
+		return err
+	}
+
+	ch := s.SecureChannel()
+	if ch != nil {
+		for _, frag := range frames {
+			if err := ch.Seal(frag); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 同一消息的分片连续写出，不与其他下行帧交错
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	for _, frag := range frames {
+		if err := s.Transport.WriteFrame(frag); err != nil {
+			return err
+		}
+		s.framesOut.Add(1)
+		s.payloadOut.Add(uint64(len(frag.Payload)))
+	}
+	return nil
+}
+
+// Close 关闭链路并唤醒等待应答的 Call。链路已被对端断开时 Transport.Close 可能报错，会话仍然标记为关闭
 func (s *Session) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.ConnClosed {
 		return nil
 	}
-	if err := s.Conn.Close(); err != nil {
-		return err
-	}
+	err := s.Transport.Close()
 	s.ConnClosed = true
-	return nil
+	if s.done != nil {
+		close(s.done)
+	}
+	return err
+}
+
+// Done 返回链路关闭时关闭的 channel
+func (s *Session) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done == nil {
+		s.done = make(chan struct{})
+		if s.ConnClosed {
+			close(s.done)
+		}
+	}
+	return s.done
 }
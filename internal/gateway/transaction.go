@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+var (
+	ErrUnknownTransaction = errors.New("unknown transaction")
+	ErrTransactionStopped = errors.New("transaction already stopped")
+)
+
+// 结束的交易保留最近多少笔供查询，更早的从内存中移除
+const maxFinishedTransactions = 1000
+
+// Transaction 是一次充电交易
+type Transaction struct {
+	ID          int
+	ChargerID   string
+	ConnectorID int
+	IDTag       string
+	MeterStart  int // Wh
+	MeterStop   int // Wh
+	StartedAt   time.Time
+	StoppedAt   time.Time
+	StopReason  string
+}
+
+// Active 判断交易是否仍在进行
+func (t *Transaction) Active() bool {
+	return t.StoppedAt.IsZero()
+}
+
+// StartTransaction 分配交易 ID 并记录一笔新交易
+func (g *Gateway) StartTransaction(chargerID string, connectorID int, idTag string, meterStart int, at time.Time) *Transaction {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.lastTxID++
+	tx := &Transaction{
+		ID:          g.lastTxID,
+		ChargerID:   chargerID,
+		ConnectorID: connectorID,
+		IDTag:       idTag,
+		MeterStart:  meterStart,
+		StartedAt:   at,
+	}
+	g.transactions[tx.ID] = tx
+	return tx
+}
+
+// StopTransaction 结束充电桩上的交易，返回交易的副本。
+// 其他充电桩的交易按不存在处理，已结束的交易返回 ErrTransactionStopped
+func (g *Gateway) StopTransaction(chargerID string, id int, meterStop int, at time.Time, reason string) (Transaction, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	tx, ok := g.transactions[id]
+	if !ok || tx.ChargerID != chargerID {
+		return Transaction{}, ErrUnknownTransaction
+	}
+	if !tx.Active() {
+		return Transaction{}, ErrTransactionStopped
+	}
+	tx.MeterStop = meterStop
+	tx.StoppedAt = at
+	tx.StopReason = reason
+	g.finished = append(g.finished, id)
+	if len(g.finished) > maxFinishedTransactions {
+		for _, old := range g.finished[:len(g.finished)-maxFinishedTransactions] {
+			delete(g.transactions, old)
+		}
+		g.finished = slices.Delete(g.finished, 0, len(g.finished)-maxFinishedTransactions)
+	}
+	return *tx, nil
+}
+
+// GetTransaction 返回交易的副本
+func (g *Gateway) GetTransaction(id int) (Transaction, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	tx, ok := g.transactions[id]
+	if !ok {
+		return Transaction{}, false
+	}
+	return *tx, true
+}
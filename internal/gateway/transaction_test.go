@@ -0,0 +1,46 @@
+package gateway
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStopTransaction(t *testing.T) {
+	g := NewGateway()
+	tx := g.StartTransaction("CP1", 1, "TAG1", 10, time.Now())
+
+	if _, err := g.StopTransaction("CP2", tx.ID, 50, time.Now(), "Local"); !errors.Is(err, ErrUnknownTransaction) {
+		t.Errorf("expected another charger's stop to fail with ErrUnknownTransaction, got %v", err)
+	}
+	stopped, err := g.StopTransaction("CP1", tx.ID, 100, time.Now(), "Local")
+	if err != nil || stopped.MeterStop != 100 || stopped.StopReason != "Local" {
+		t.Fatalf("stop transaction: %+v %v", stopped, err)
+	}
+	if _, err := g.StopTransaction("CP1", tx.ID, 200, time.Now(), "Remote"); !errors.Is(err, ErrTransactionStopped) {
+		t.Errorf("expected ErrTransactionStopped, got %v", err)
+	}
+	if got, _ := g.GetTransaction(tx.ID); got.MeterStop != 100 || got.StopReason != "Local" {
+		t.Errorf("second stop overwrote the transaction: %+v", got)
+	}
+}
+
+func TestStopTransaction_EvictsFinished(t *testing.T) {
+	g := NewGateway()
+	first := g.StartTransaction("CP1", 1, "TAG1", 0, time.Now())
+	active := g.StartTransaction("CP1", 2, "TAG1", 0, time.Now())
+	g.StopTransaction("CP1", first.ID, 0, time.Now(), "Local")
+	for range maxFinishedTransactions {
+		tx := g.StartTransaction("CP1", 1, "TAG1", 0, time.Now())
+		g.StopTransaction("CP1", tx.ID, 0, time.Now(), "Local")
+	}
+	if _, ok := g.GetTransaction(first.ID); ok {
+		t.Error("oldest finished transaction not evicted")
+	}
+	if _, ok := g.GetTransaction(active.ID); !ok {
+		t.Error("active transaction evicted")
+	}
+	if n := len(g.transactions); n != maxFinishedTransactions+1 {
+		t.Errorf("expected %d transactions kept, got %d", maxFinishedTransactions+1, n)
+	}
+}
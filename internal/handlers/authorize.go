@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+// AuthorizeRequest 是 CmdAuthorize 的负载
+type AuthorizeRequest struct {
+	IDTag string `json:"idTag"`
+}
+
+// AuthorizeResponse 是对 CmdAuthorize 的应答
+type AuthorizeResponse struct {
+	IDTagInfo gateway.IDTagInfo `json:"idTagInfo"`
+}
+
+// HandleAuthorize 查询刷卡的 ID 标签能否充电
+func HandleAuthorize(gw *gateway.Gateway, session *gateway.Session, frame protocol.Frame) error {
+	var req AuthorizeRequest
+	if err := json.Unmarshal(frame.Payload, &req); err != nil {
+		return fmt.Errorf("bad authorize payload: %w", err)
+	}
+	if req.IDTag == "" {
+		return fmt.Errorf("authorize from %s without id tag", session.ID)
+	}
+	info := gw.Authorize(session.ID, req.IDTag)
+	fmt.Printf("[handler] authorize %s on %s: %s\n", req.IDTag, session.ID, info.Status)
+
+	resp, err := json.Marshal(AuthorizeResponse{IDTagInfo: info})
+	if err != nil {
+		return err
+	}
+	return session.Send(protocol.NewFrame(frame.Version, protocol.CmdAuthorize, resp))
+}
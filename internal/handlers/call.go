@@ -0,0 +1,18 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+// HandleCallResult 把充电桩对网关请求的应答交给等待中的调用方
+func HandleCallResult(gw *gateway.Gateway, session *gateway.Session, frame protocol.Frame) error {
+	var r gateway.CallResult
+	if err := json.Unmarshal(frame.Payload, &r); err != nil {
+		return fmt.Errorf("bad call result from %s: %w", session.ID, err)
+	}
+	return gw.ResolveCall(session, r)
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+// HandleDiagnosticsChunk 保存诊断文件的一片并应答。分片在工作池中处理，
+// 写盘不占用会话的读循环，上传期间其他帧照常分发
+func HandleDiagnosticsChunk(gw *gateway.Gateway, session *gateway.Session, frame protocol.Frame) error {
+	var c gateway.DiagnosticsChunk
+	if err := json.Unmarshal(frame.Payload, &c); err != nil {
+		return fmt.Errorf("bad diagnostics chunk from %s: %w", session.ID, err)
+	}
+	ack := gateway.DiagnosticsChunkAck{FileName: c.FileName, Offset: c.Offset, Status: gateway.StatusAccepted}
+	werr := gw.WriteDiagnosticsChunk(session.ID, c)
+	if werr != nil {
+		ack.Status = gateway.StatusRejected
+		ack.Error = werr.Error()
+	}
+	resp, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+	if err := session.Send(protocol.NewFrame(frame.Version, protocol.CmdDiagnosticsChunk, resp)); err != nil {
+		return err
+	}
+	if werr != nil {
+		return fmt.Errorf("diagnostics chunk %s@%d from %s: %w", c.FileName, c.Offset, session.ID, werr)
+	}
+	return nil
+}
@@ -10,5 +10,6 @@ import (
 // HandleErrorResponse 处理错误响应
 func HandleErrorResponse(gw *gateway.Gateway, session *gateway.Session, frame protocol.Frame) error {
 	fmt.Printf("[handler] error from %s: %s\n", session.ID, string(frame.Payload))
+	gw.Emit(gateway.Event{Type: gateway.EventErrorReported, ChargerID: session.ID, Data: jsonOrString(frame.Payload)})
 	return nil
 }
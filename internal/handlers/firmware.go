@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+// FirmwareStatusRequest 是 CmdFirmwareStatus 的负载，状态取值同 OCPP FirmwareStatusNotification
+type FirmwareStatusRequest struct {
+	Status    string `json:"status"`
+	RequestID int    `json:"requestId,omitempty"`
+}
+
+// HandleFirmwareStatus 处理固件更新进度上报
+func HandleFirmwareStatus(gw *gateway.Gateway, session *gateway.Session, frame protocol.Frame) error {
+	var req FirmwareStatusRequest
+	if err := json.Unmarshal(frame.Payload, &req); err != nil {
+		return fmt.Errorf("bad firmware status payload: %w", err)
+	}
+	if req.Status == "" {
+		return fmt.Errorf("firmware status from %s without status", session.ID)
+	}
+	fmt.Printf("[handler] firmware status from %s: %s\n", session.ID, req.Status)
+	gw.Emit(gateway.Event{Type: gateway.EventFirmwareStatus, ChargerID: session.ID, Data: gateway.FirmwareStatusEvent{Status: req.Status, RequestID: req.RequestID}})
+	return nil
+}
@@ -7,9 +7,15 @@ import (
 	"github.com/x14n/evgateway/internal/protocol"
 )
 
+// HandlePing 处理充电桩对存活探测的应答，收到任意帧时服务端已经刷新了会话
+func HandlePing(gw *gateway.Gateway, session *gateway.Session, frame protocol.Frame) error {
+	return nil
+}
+
 // HandleHeartbeat 处理心跳命令
 func HandleHeartbeat(gw *gateway.Gateway, session *gateway.Session, frame protocol.Frame) error {
 	session.UpdateLastSeen()
 	fmt.Println("[handler] heartbeat:", session.ID)
+	gw.Emit(gateway.Event{Type: gateway.EventHeartbeat, ChargerID: session.ID})
 	return nil
 }
@@ -11,4 +11,12 @@ func RegisterAllHandlers(d *gateway.Dispatcher) {
 	d.RegisterHandler(protocol.CmdHeartbeat, HandleHeartbeat)
 	d.RegisterHandler(protocol.CmdStatus, HandleStatusReport)
 	d.RegisterHandler(protocol.CmdError, HandleErrorResponse)
+	d.RegisterHandler(protocol.CmdStartTransaction, HandleStartTransaction)
+	d.RegisterHandler(protocol.CmdStopTransaction, HandleStopTransaction)
+	d.RegisterHandler(protocol.CmdMeterValues, HandleMeterValues)
+	d.RegisterHandler(protocol.CmdPing, HandlePing)
+	d.RegisterHandler(protocol.CmdCallResult, HandleCallResult)
+	d.RegisterHandler(protocol.CmdFirmwareStatus, HandleFirmwareStatus)
+	d.RegisterHandler(protocol.CmdDiagnosticsChunk, HandleDiagnosticsChunk)
+	d.RegisterHandler(protocol.CmdAuthorize, HandleAuthorize)
 }
@@ -1,17 +1,113 @@
 package handlers
 
 import (
+	"encoding/json"
 	"fmt"
+	"slices"
 
 	"github.com/x14n/evgateway/internal/gateway"
 	"github.com/x14n/evgateway/internal/protocol"
 )
 
+// RegisterRequest 新版固件的 JSON 注册负载，旧固件直接发送充电桩 ID
+type RegisterRequest struct {
+	ID          string   `json:"id"`
+	Versions    []int    `json:"versions,omitempty"` // 固件支持的协议版本，缺省为注册帧本身的版本
+	Compression []string `json:"compression,omitempty"`
+	Vendor      string   `json:"vendor,omitempty"`
+	Model       string   `json:"model,omitempty"`
+	Firmware    string   `json:"firmware,omitempty"`
+}
+
+// RegisterResponse 对 JSON 注册的应答
+type RegisterResponse struct {
+	Status      string `json:"status"`
+	Version     byte   `json:"version"`
+	Compression string `json:"compression,omitempty"`
+}
+
+// RegisteredEvent 是注册事件的负载
+type RegisteredEvent struct {
+	Addr        string `json:"addr"`
+	Version     byte   `json:"version"`
+	Compression string `json:"compression,omitempty"`
+}
+
 // HandleRegister 处理注册命令
 func HandleRegister(gw *gateway.Gateway, session *gateway.Session, frame protocol.Frame) error {
-	chargerID := string(frame.Payload)
-	session.ID = chargerID
+	req, isJSON := parseRegister(frame.Payload)
+	if req.ID == "" {
+		return fmt.Errorf("register without charger id from %s", session.Addr)
+	}
+
+	// 加密会话只能以密钥对应的充电桩身份注册
+	if ch := session.SecureChannel(); ch != nil && ch.KeyID() != req.ID {
+		return fmt.Errorf("register as %s over channel keyed for %s", req.ID, ch.KeyID())
+	}
+
+	version, err := negotiateVersion(req, frame.Version)
+	if err != nil {
+		return err
+	}
+	if session.SecureChannel() != nil && !protocol.SupportsFlag(version, protocol.FlagEncrypted) {
+		return fmt.Errorf("negotiated protocol v%d cannot carry encrypted frames for %s", version, req.ID)
+	}
+
+	// 压缩依赖协商版本帧头里的 flags 字节
+	compression := ""
+	if protocol.SupportsFlag(version, protocol.FlagCompressed) && slices.Contains(req.Compression, protocol.CompressionDeflate) {
+		compression = protocol.CompressionDeflate
+	}
+
+	session.ID = req.ID
+	session.Negotiate(version, compression)
+	session.SetInfo(gateway.ChargerInfo{Vendor: req.Vendor, Model: req.Model, Firmware: req.Firmware})
+	if labels, ok := gw.LookupLabels(req.ID); ok {
+		session.SetLabels(labels)
+	}
 	gw.AddSession(session)
-	fmt.Println("[handler] register:", chargerID, "from", session.Addr)
-	return nil
+	fmt.Println("[handler] register:", req.ID, "from", session.Addr)
+
+	// 先发应答再通知订阅者，订阅者下发的命令不会早于注册应答到达充电桩。旧固件不认识应答帧
+	var sendErr error
+	if isJSON {
+		resp, err := json.Marshal(RegisterResponse{Status: "accepted", Version: version, Compression: compression})
+		if err != nil {
+			return err
+		}
+		sendErr = session.SendVersion(protocol.NewFrame(frame.Version, protocol.CmdRegister, resp))
+	}
+	gw.Emit(gateway.Event{Type: gateway.EventSessionRegistered, ChargerID: req.ID, Data: RegisteredEvent{
+		Addr:        session.Addr,
+		Version:     version,
+		Compression: compression,
+	}})
+	return sendErr
+}
+
+// negotiateVersion 在固件声明的版本中选出网关支持的最高版本
+func negotiateVersion(req RegisterRequest, frameVersion byte) (byte, error) {
+	if len(req.Versions) == 0 {
+		return frameVersion, nil
+	}
+	offered := make([]byte, 0, len(req.Versions))
+	for _, v := range req.Versions {
+		if v > 0 && v <= 0xFF {
+			offered = append(offered, byte(v))
+		}
+	}
+	version, ok := protocol.NegotiateVersion(offered)
+	if !ok {
+		return 0, fmt.Errorf("no common protocol version in %v, gateway supports %v", req.Versions, protocol.SupportedVersions())
+	}
+	return version, nil
+}
+
+// parseRegister 解析注册负载，第二个返回值表示是否为 JSON 格式
+func parseRegister(payload []byte) (RegisterRequest, bool) {
+	var req RegisterRequest
+	if len(payload) > 0 && payload[0] == '{' && json.Unmarshal(payload, &req) == nil {
+		return req, true
+	}
+	return RegisterRequest{ID: string(payload)}, false
 }
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/inventory"
+	"github.com/x14n/evgateway/internal/protocol"
+	"github.com/x14n/evgateway/internal/transport"
+)
+
+func TestHandleRegister_NegotiatesCompression(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     byte
+		payload     string
+		compression string
+	}{
+		{"v2 with deflate", protocol.ProtocolV2, `{"id":"CP-1","compression":["deflate"]}`, protocol.CompressionDeflate},
+		{"v2 without deflate", protocol.ProtocolV2, `{"id":"CP-1","compression":["lz4"]}`, ""},
+		{"v1 cannot compress", protocol.ProtocolV1, `{"id":"CP-1","compression":["deflate"]}`, ""},
+		{"v1 frame offering v2", protocol.ProtocolV1, `{"id":"CP-1","versions":[1,2],"compression":["deflate"]}`, protocol.CompressionDeflate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			session := &gateway.Session{Addr: "pipe", Transport: transport.NewConn(server)}
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- HandleRegister(gateway.NewGateway(), session, *protocol.NewFrame(tt.version, protocol.CmdRegister, []byte(tt.payload)))
+			}()
+
+			parser := protocol.NewParser(client)
+			parser.Start()
+			var resp RegisterResponse
+			select {
+			case f := <-parser.Frames():
+				if err := json.Unmarshal(f.Payload, &resp); err != nil {
+					t.Fatalf("bad register response: %v", err)
+				}
+				if f.Version != tt.version || f.Flags != 0 {
+					t.Errorf("expected the reply in the request's version v%d without flags, got v%d flags %#x", tt.version, f.Version, f.Flags)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no register response")
+			}
+			if err := <-errCh; err != nil {
+				t.Fatalf("register: %v", err)
+			}
+			client.Close()
+			parser.Stop()
+
+			if resp.Compression != tt.compression || session.Compression() != tt.compression {
+				t.Errorf("expected compression %q, got response %q session %q", tt.compression, resp.Compression, session.Compression())
+			}
+			if session.ID != "CP-1" {
+				t.Errorf("expected session id CP-1, got %q", session.ID)
+			}
+		})
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		versions []int
+		frame    byte
+		want     byte
+		wantErr  bool
+	}{
+		{nil, protocol.ProtocolV2, protocol.ProtocolV2, false},
+		{[]int{1, 2, 3}, protocol.ProtocolV1, protocol.ProtocolV3, false},
+		{[]int{1, 2, 7}, protocol.ProtocolV1, protocol.ProtocolV2, false},
+		{[]int{7, 300}, protocol.ProtocolV1, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := negotiateVersion(RegisterRequest{ID: "CP-1", Versions: tt.versions}, tt.frame)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("versions %v: got %d, %v; want %d, error %v", tt.versions, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestHandleRegister_LegacyPayload(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	session := &gateway.Session{Addr: "pipe", Transport: transport.NewConn(server)}
+
+	// 旧格式注册不发送应答，因此管道没有读取端也不会阻塞
+	if err := HandleRegister(gateway.NewGateway(), session, *protocol.NewFrame(protocol.ProtocolV1, protocol.CmdRegister, []byte("CP-LEGACY"))); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if session.ID != "CP-LEGACY" || session.Version() != protocol.ProtocolV1 {
+		t.Errorf("unexpected session state: id=%q version=%d", session.ID, session.Version())
+	}
+}
+
+func TestHandleRegister_MetadataAndInventory(t *testing.T) {
+	gw := gateway.NewGateway()
+	inv := inventory.NewStore()
+	inv.Set("CP-META", gateway.Labels{Site: "depot-1", Operator: "acme", Tags: []string{"dc", "fast"}})
+	gw.SetInventory(inv)
+
+	server, charger := transport.Pipe()
+	defer charger.Close()
+	session := &gateway.Session{Addr: "pipe", Transport: server}
+	gw.AddSession(session)
+
+	payload := `{"id":"CP-META","vendor":"Acme","model":"DC-150","firmware":"2.4.1"}`
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- HandleRegister(gw, session, *protocol.NewFrame(protocol.ProtocolV1, protocol.CmdRegister, []byte(payload)))
+	}()
+	if _, err := charger.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	if info := session.Info(); info != (gateway.ChargerInfo{Vendor: "Acme", Model: "DC-150", Firmware: "2.4.1"}) {
+		t.Errorf("unexpected charger info %+v", info)
+	}
+	if got := gw.SessionsByTag("fast"); len(got) != 1 || got[0] != session {
+		t.Fatalf("session not found by inventory tag: %v", got)
+	}
+	if got := gw.SessionsBySite("depot-1"); len(got) != 1 {
+		t.Errorf("session not found by inventory site: %v", got)
+	}
+	m := session.Metadata()
+	if m.Labels.Operator != "acme" || m.Traffic.FramesOut != 1 || m.Traffic.PayloadBytesOut == 0 {
+		t.Errorf("unexpected metadata %+v", m)
+	}
+}
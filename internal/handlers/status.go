@@ -15,5 +15,8 @@ func HandleStatusReport(gw *gateway.Gateway, session *gateway.Session, frame pro
 		return fmt.Errorf("bad status payload: %w", err)
 	}
 	fmt.Printf("[handler] status from %s: %+v\n", session.ID, st)
+	if prev, changed := session.UpdateStatus(st); changed {
+		gw.Emit(gateway.Event{Type: gateway.EventStatusChanged, ChargerID: session.ID, Data: gateway.StatusChangedEvent{Status: st, Previous: prev}})
+	}
 	return nil
 }
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+// StartTransactionRequest 是 CmdStartTransaction 的负载
+type StartTransactionRequest struct {
+	ConnectorID int    `json:"connectorId"`
+	IDTag       string `json:"idTag"`
+	MeterStart  int    `json:"meterStart"`          // Wh
+	Timestamp   string `json:"timestamp,omitempty"` // RFC3339，缺省为网关收到的时间
+}
+
+// StartTransactionResponse 是对 CmdStartTransaction 的应答。交易总是被记录，
+// IDTagInfo 不是 Accepted 时由充电桩决定是否结束充电
+type StartTransactionResponse struct {
+	TransactionID int               `json:"transactionId"`
+	Status        string            `json:"status"`
+	IDTagInfo     gateway.IDTagInfo `json:"idTagInfo"`
+}
+
+// StopTransactionRequest 是 CmdStopTransaction 的负载
+type StopTransactionRequest struct {
+	TransactionID int    `json:"transactionId"`
+	MeterStop     int    `json:"meterStop"` // Wh
+	Timestamp     string `json:"timestamp,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+// MeterValuesRequest 是 CmdMeterValues 的负载
+type MeterValuesRequest struct {
+	ConnectorID   int          `json:"connectorId"`
+	TransactionID int          `json:"transactionId,omitempty"`
+	Samples       []MeterValue `json:"samples"`
+}
+
+// MeterValue 是一个采样值，Measurand 沿用 OCPP 的命名，例如 Power.Active.Import
+type MeterValue struct {
+	Timestamp string  `json:"timestamp,omitempty"`
+	Measurand string  `json:"measurand"`
+	Value     float64 `json:"value"`
+	Unit      string  `json:"unit,omitempty"`
+}
+
+// HandleStartTransaction 处理充电开始，应答中带回分配的交易 ID
+func HandleStartTransaction(gw *gateway.Gateway, session *gateway.Session, frame protocol.Frame) error {
+	var req StartTransactionRequest
+	if err := json.Unmarshal(frame.Payload, &req); err != nil {
+		return fmt.Errorf("bad start transaction payload: %w", err)
+	}
+	tx := gw.StartTransaction(session.ID, req.ConnectorID, req.IDTag, req.MeterStart, parseTimestamp(req.Timestamp))
+	fmt.Printf("[handler] transaction %d started on %s connector %d\n", tx.ID, session.ID, req.ConnectorID)
+	gw.Emit(gateway.Event{Type: gateway.EventTransactionStarted, ChargerID: session.ID, Data: newTransactionEvent(*tx)})
+
+	info := gateway.IDTagInfo{Status: gateway.AuthAccepted}
+	if req.IDTag != "" {
+		info = gw.Authorize(session.ID, req.IDTag)
+	}
+	resp, err := json.Marshal(StartTransactionResponse{TransactionID: tx.ID, Status: "accepted", IDTagInfo: info})
+	if err != nil {
+		return err
+	}
+	return session.Send(protocol.NewFrame(frame.Version, protocol.CmdStartTransaction, resp))
+}
+
+// HandleStopTransaction 处理充电结束
+func HandleStopTransaction(gw *gateway.Gateway, session *gateway.Session, frame protocol.Frame) error {
+	var req StopTransactionRequest
+	if err := json.Unmarshal(frame.Payload, &req); err != nil {
+		return fmt.Errorf("bad stop transaction payload: %w", err)
+	}
+	tx, err := gw.StopTransaction(session.ID, req.TransactionID, req.MeterStop, parseTimestamp(req.Timestamp), req.Reason)
+	if err != nil {
+		return fmt.Errorf("stop transaction %d from %s: %w", req.TransactionID, session.ID, err)
+	}
+	fmt.Printf("[handler] transaction %d stopped on %s, energy %d Wh\n", tx.ID, session.ID, tx.MeterStop-tx.MeterStart)
+	gw.Emit(gateway.Event{Type: gateway.EventTransactionStopped, ChargerID: session.ID, Data: newTransactionEvent(tx)})
+	return nil
+}
+
+// HandleMeterValues 处理周期性的电表采样
+func HandleMeterValues(gw *gateway.Gateway, session *gateway.Session, frame protocol.Frame) error {
+	var req MeterValuesRequest
+	if err := json.Unmarshal(frame.Payload, &req); err != nil {
+		return fmt.Errorf("bad meter values payload: %w", err)
+	}
+	fmt.Printf("[handler] meter values from %s connector %d: %d samples\n", session.ID, req.ConnectorID, len(req.Samples))
+	gw.Emit(gateway.Event{Type: gateway.EventMeterValues, ChargerID: session.ID, Data: req})
+	return nil
+}
+
+// TransactionEvent 是交易开始和结束事件的负载
+type TransactionEvent struct {
+	TransactionID int        `json:"transactionId"`
+	ConnectorID   int        `json:"connectorId"`
+	IDTag         string     `json:"idTag,omitempty"`
+	MeterStart    int        `json:"meterStart"`
+	MeterStop     *int       `json:"meterStop,omitempty"`
+	StartedAt     time.Time  `json:"startedAt"`
+	StoppedAt     *time.Time `json:"stoppedAt,omitempty"`
+	Reason        string     `json:"reason,omitempty"`
+}
+
+func newTransactionEvent(tx gateway.Transaction) TransactionEvent {
+	ev := TransactionEvent{
+		TransactionID: tx.ID,
+		ConnectorID:   tx.ConnectorID,
+		IDTag:         tx.IDTag,
+		MeterStart:    tx.MeterStart,
+		StartedAt:     tx.StartedAt,
+		Reason:        tx.StopReason,
+	}
+	if !tx.Active() {
+		ev.MeterStop = &tx.MeterStop
+		ev.StoppedAt = &tx.StoppedAt
+	}
+	return ev
+}
+
+// jsonOrString 负载是 JSON 时原样保留，否则作为字符串
+func jsonOrString(p []byte) any {
+	if json.Valid(p) {
+		return json.RawMessage(p)
+	}
+	return string(p)
+}
+
+// parseTimestamp 解析 RFC3339 时间，为空或格式错误时使用当前时间
+func parseTimestamp(s string) time.Time {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t
+	}
+	return time.Now()
+}
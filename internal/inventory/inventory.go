@@ -0,0 +1,57 @@
+// Package inventory 加载充电桩台账，为会话提供站点、运营商和标签等分组信息。
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/x14n/evgateway/internal/gateway"
+)
+
+// Store 是线程安全的内存台账，实现 gateway.Inventory
+type Store struct {
+	mu       sync.RWMutex
+	chargers map[string]gateway.Labels
+}
+
+func NewStore() *Store {
+	return &Store{chargers: make(map[string]gateway.Labels)}
+}
+
+func (s *Store) Lookup(chargerID string) (gateway.Labels, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l, ok := s.chargers[chargerID]
+	return l, ok
+}
+
+// Set 设置或替换充电桩的分组信息
+func (s *Store) Set(chargerID string, l gateway.Labels) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chargers[chargerID] = l
+}
+
+// LoadFile 从 JSON 文件加载台账，格式为
+// {"充电桩ID": {"site": "站点", "operator": "运营商", "tags": ["标签"]}}
+func LoadFile(path string) (*Store, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]gateway.Labels
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse inventory file: %w", err)
+	}
+
+	store := NewStore()
+	for id, l := range raw {
+		if id == "" {
+			return nil, fmt.Errorf("inventory entry without charger id")
+		}
+		store.Set(id, l)
+	}
+	return store, nil
+}
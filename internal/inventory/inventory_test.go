@@ -0,0 +1,37 @@
+package inventory
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chargers.json")
+	data := `{
+		"CP1": {"site": "depot-1", "operator": "acme", "tags": ["dc", "fast"]},
+		"CP2": {"site": "depot-2"}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, ok := store.Lookup("CP1")
+	if !ok || l.Site != "depot-1" || l.Operator != "acme" || !slices.Equal(l.Tags, []string{"dc", "fast"}) {
+		t.Errorf("unexpected labels for CP1: %+v", l)
+	}
+	if _, ok := store.Lookup("CP3"); ok {
+		t.Error("unknown charger found")
+	}
+
+	if err := os.WriteFile(path, []byte(`["CP1"]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFile(path); err == nil {
+		t.Error("expected an error for a malformed file")
+	}
+}
@@ -0,0 +1,285 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Broker 是最小的 MQTT 3.1.1 broker：不做鉴权，不保存会话，QoS 最多授予 1，
+// 只按主题保存保留消息。用于测试和没有外部 broker 时的本地联调。
+type Broker struct {
+	mu       sync.Mutex
+	ln       net.Listener
+	clients  map[*brokerConn]struct{}
+	retained map[string][]byte
+	closed   bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		clients:  make(map[*brokerConn]struct{}),
+		retained: make(map[string][]byte),
+	}
+}
+
+// ListenAndServe 在 addr 上监听并服务，直到 Close
+func (b *Broker) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return b.Serve(ln)
+}
+
+// Serve 在已有的监听器上接受客户端连接
+func (b *Broker) Serve(ln net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	b.ln = ln
+	b.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go b.serveConn(conn)
+	}
+}
+
+// Addr 返回监听地址，未开始服务时为空
+func (b *Broker) Addr() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ln == nil {
+		return ""
+	}
+	return b.ln.Addr().String()
+}
+
+// Close 关闭监听器和所有客户端连接
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	ln := b.ln
+	clients := b.clients
+	b.clients = make(map[*brokerConn]struct{})
+	b.mu.Unlock()
+	for c := range clients {
+		c.conn.Close()
+	}
+	if ln != nil {
+		return ln.Close()
+	}
+	return nil
+}
+
+type brokerConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	subs map[string]byte // 过滤器 -> 授予的 QoS
+	next uint16
+}
+
+func (c *brokerConn) write(p *packet) error {
+	data, err := p.encode()
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.conn.Write(data)
+	return err
+}
+
+func (b *Broker) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(DefaultConnectTimeout))
+	p, err := readPacket(r, DefaultMaxPacketSize)
+	if err != nil || p.typ != typeConnect {
+		if errors.Is(err, ErrMalformedPacket) && p != nil && p.typ == typeConnect {
+			(&brokerConn{conn: conn}).write(&packet{typ: typeConnack, returnCode: ConnBadProtocol})
+		}
+		return
+	}
+	c := &brokerConn{conn: conn, subs: make(map[string]byte)}
+	if p.clientID == "" && !p.cleanSession {
+		c.write(&packet{typ: typeConnack, returnCode: ConnIdentifierRejected})
+		return
+	}
+	if err := c.write(&packet{typ: typeConnack, returnCode: ConnAccepted}); err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.clients[c] = struct{}{}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.mu.Unlock()
+	}()
+
+	// 1.5 倍保活间隔内没有任何报文就断开
+	var idle time.Duration
+	if p.keepAlive > 0 {
+		idle = time.Duration(p.keepAlive) * time.Second * 3 / 2
+	}
+	for {
+		if idle > 0 {
+			conn.SetReadDeadline(time.Now().Add(idle))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		p, err := readPacket(r, DefaultMaxPacketSize)
+		if err != nil {
+			return
+		}
+		if err := b.handle(c, p); err != nil {
+			if !errors.Is(err, errDisconnect) {
+				fmt.Printf("[mqtt] broker closing %s: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+var errDisconnect = errors.New("client disconnected")
+
+func (b *Broker) handle(c *brokerConn, p *packet) error {
+	switch p.typ {
+	case typePublish:
+		if err := validTopic(p.topic); err != nil {
+			return err
+		}
+		b.publish(p.topic, p.payload, p.qos, p.retain)
+		if p.qos == 1 {
+			return c.write(&packet{typ: typePuback, packetID: p.packetID})
+		}
+	case typePuback:
+	case typeSubscribe:
+		granted := make([]byte, len(p.filters))
+		var accepted []string
+		c.mu.Lock()
+		for i, f := range p.filters {
+			if validFilter(f) != nil {
+				granted[i] = subackFailure
+				continue
+			}
+			granted[i] = min(p.qoss[i], 1)
+			c.subs[f] = granted[i]
+			accepted = append(accepted, f)
+		}
+		c.mu.Unlock()
+		if err := c.write(&packet{typ: typeSuback, packetID: p.packetID, qoss: granted}); err != nil {
+			return err
+		}
+		b.sendRetained(c, accepted)
+	case typeUnsubscribe:
+		c.mu.Lock()
+		for _, f := range p.filters {
+			delete(c.subs, f)
+		}
+		c.mu.Unlock()
+		return c.write(&packet{typ: typeUnsuback, packetID: p.packetID})
+	case typePingreq:
+		return c.write(&packet{typ: typePingresp})
+	case typeDisconnect:
+		return errDisconnect
+	default:
+		return fmt.Errorf("%w: unexpected type %d from client", ErrMalformedPacket, p.typ)
+	}
+	return nil
+}
+
+// publish 把消息投递给所有匹配的订阅者，QoS 取发布和订阅中较小的一个。
+// 保留消息的负载为空时删除该主题的保留消息。
+func (b *Broker) publish(topic string, payload []byte, qos byte, retain bool) {
+	b.mu.Lock()
+	if retain {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload
+		}
+	}
+	clients := make([]*brokerConn, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.mu.Unlock()
+
+	for _, c := range clients {
+		if granted, ok := c.match(topic); ok {
+			c.send(topic, payload, min(qos, granted), false)
+		}
+	}
+}
+
+// sendRetained 把匹配新订阅的保留消息发给订阅者
+func (b *Broker) sendRetained(c *brokerConn, filters []string) {
+	b.mu.Lock()
+	type msg struct {
+		topic   string
+		payload []byte
+	}
+	var msgs []msg
+	for topic, payload := range b.retained {
+		for _, f := range filters {
+			if Match(f, topic) {
+				msgs = append(msgs, msg{topic, payload})
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+	for _, m := range msgs {
+		granted, _ := c.match(m.topic)
+		c.send(m.topic, m.payload, granted, true)
+	}
+}
+
+// match 返回所有匹配该主题的订阅中最高的 QoS
+func (c *brokerConn) match(topic string) (byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var qos byte
+	found := false
+	for f, q := range c.subs {
+		if Match(f, topic) {
+			found = true
+			qos = max(qos, q)
+		}
+	}
+	return qos, found
+}
+
+// send 下发一条消息；QoS 1 的 PUBACK 不跟踪，broker 不重传
+func (c *brokerConn) send(topic string, payload []byte, qos byte, retain bool) {
+	p := &packet{typ: typePublish, topic: topic, payload: payload, qos: qos, retain: retain}
+	if qos > 0 {
+		c.mu.Lock()
+		c.next++
+		if c.next == 0 {
+			c.next = 1
+		}
+		p.packetID = c.next
+		c.mu.Unlock()
+	}
+	c.write(p)
+}
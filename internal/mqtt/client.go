@@ -0,0 +1,332 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultKeepAlive      = 60 * time.Second
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultAckTimeout     = 10 * time.Second
+	DefaultMaxPacketSize  = 1 << 20
+)
+
+var (
+	ErrClientClosed  = errors.New("mqtt client closed")
+	ErrAckTimeout    = errors.New("mqtt acknowledgement timeout")
+	ErrSubscribeFail = errors.New("mqtt subscription rejected")
+)
+
+// ConnectError 是 broker 拒绝连接时的 CONNACK 返回码
+type ConnectError struct {
+	Code byte
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("mqtt connection refused, return code %d", e.Code)
+}
+
+// Options 配置客户端，零值字段使用缺省值
+type Options struct {
+	ClientID       string
+	Username       string
+	Password       string
+	CleanSession   bool
+	KeepAlive      time.Duration
+	ConnectTimeout time.Duration
+	AckTimeout     time.Duration // QoS 1 发布和订阅等待确认的时间
+}
+
+// Handler 处理订阅收到的消息，在客户端的读 goroutine 中调用，不应长时间阻塞，
+// 也不能同步等待 QoS 1 的发布（PUBACK 要由同一个 goroutine 读取）
+type Handler func(topic string, payload []byte)
+
+type subscription struct {
+	filter  string
+	handler Handler
+}
+
+// Client 是 MQTT 3.1.1 客户端，连接断开后不自动重连，调用方通过 Done 感知
+type Client struct {
+	conn net.Conn
+	opts Options
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint16
+	pending map[uint16]chan *packet
+	subs    []subscription
+	err     error
+
+	done chan struct{}
+	once sync.Once
+}
+
+// Dial 连接 broker 并完成 CONNECT 握手
+func Dial(addr string, opts Options) (*Client, error) {
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = DefaultKeepAlive
+	}
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = DefaultConnectTimeout
+	}
+	if opts.AckTimeout <= 0 {
+		opts.AckTimeout = DefaultAckTimeout
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, opts.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:    conn,
+		opts:    opts,
+		pending: make(map[uint16]chan *packet),
+		done:    make(chan struct{}),
+	}
+
+	connect := &packet{
+		typ:          typeConnect,
+		clientID:     opts.ClientID,
+		username:     opts.Username,
+		password:     opts.Password,
+		hasUsername:  opts.Username != "",
+		hasPassword:  opts.Password != "",
+		cleanSession: opts.CleanSession || opts.ClientID == "",
+		keepAlive:    uint16(opts.KeepAlive / time.Second),
+	}
+	conn.SetDeadline(time.Now().Add(opts.ConnectTimeout))
+	if err := c.write(connect); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	ack, err := readPacket(r, DefaultMaxPacketSize)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ack.typ != typeConnack {
+		conn.Close()
+		return nil, fmt.Errorf("%w: expected CONNACK, got type %d", ErrMalformedPacket, ack.typ)
+	}
+	if ack.returnCode != ConnAccepted {
+		conn.Close()
+		return nil, &ConnectError{Code: ack.returnCode}
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.readLoop(r)
+	go c.keepAlive()
+	return c, nil
+}
+
+// Publish 发布消息；QoS 1 时阻塞到收到 PUBACK
+func (c *Client) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	if err := validTopic(topic); err != nil {
+		return err
+	}
+	if qos > 1 {
+		return fmt.Errorf("qos %d not supported", qos)
+	}
+	p := &packet{typ: typePublish, topic: topic, payload: payload, qos: qos, retain: retain}
+	if qos == 0 {
+		return c.write(p)
+	}
+	_, err := c.roundTrip(p)
+	return err
+}
+
+// Subscribe 订阅主题过滤器，阻塞到收到 SUBACK。同一消息匹配多个订阅时每个处理器都会收到。
+func (c *Client) Subscribe(filter string, qos byte, h Handler) error {
+	if err := validFilter(filter); err != nil {
+		return err
+	}
+	if qos > 1 {
+		qos = 1
+	}
+	// 先登记处理器，避免 SUBACK 之前到达的保留消息丢失
+	c.mu.Lock()
+	c.subs = append(c.subs, subscription{filter: filter, handler: h})
+	c.mu.Unlock()
+
+	ack, err := c.roundTrip(&packet{typ: typeSubscribe, filters: []string{filter}, qoss: []byte{qos}})
+	if err == nil && (len(ack.qoss) != 1 || ack.qoss[0] == subackFailure) {
+		err = fmt.Errorf("%w: %s", ErrSubscribeFail, filter)
+	}
+	if err != nil {
+		c.removeSub(filter)
+	}
+	return err
+}
+
+// Unsubscribe 取消订阅
+func (c *Client) Unsubscribe(filter string) error {
+	c.removeSub(filter)
+	_, err := c.roundTrip(&packet{typ: typeUnsubscribe, filters: []string{filter}})
+	return err
+}
+
+func (c *Client) removeSub(filter string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kept := c.subs[:0]
+	for _, s := range c.subs {
+		if s.filter != filter {
+			kept = append(kept, s)
+		}
+	}
+	c.subs = kept
+}
+
+// Close 发送 DISCONNECT 并关闭连接
+func (c *Client) Close() error {
+	c.write(&packet{typ: typeDisconnect})
+	c.shutdown(ErrClientClosed)
+	return nil
+}
+
+// Done 在连接断开后关闭
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err 返回连接断开的原因
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Client) shutdown(err error) {
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// roundTrip 发送带报文标识的报文并等待对应的确认
+func (c *Client) roundTrip(p *packet) (*packet, error) {
+	ch := make(chan *packet, 1)
+	c.mu.Lock()
+	for {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		if _, busy := c.pending[c.nextID]; !busy {
+			break
+		}
+	}
+	p.packetID = c.nextID
+	c.pending[p.packetID] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, p.packetID)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(p); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(c.opts.AckTimeout)
+	defer timer.Stop()
+	select {
+	case ack := <-ch:
+		return ack, nil
+	case <-timer.C:
+		return nil, ErrAckTimeout
+	case <-c.done:
+		return nil, ErrClientClosed
+	}
+}
+
+func (c *Client) write(p *packet) error {
+	data, err := p.encode()
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.conn.Write(data); err != nil {
+		select {
+		case <-c.done:
+			return ErrClientClosed
+		default:
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *Client) readLoop(r *bufio.Reader) {
+	for {
+		p, err := readPacket(r, DefaultMaxPacketSize)
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+		switch p.typ {
+		case typePublish:
+			c.deliver(p)
+			if p.qos == 1 {
+				c.write(&packet{typ: typePuback, packetID: p.packetID})
+			}
+		case typePuback, typeSuback, typeUnsuback:
+			c.mu.Lock()
+			ch, ok := c.pending[p.packetID]
+			c.mu.Unlock()
+			if ok {
+				select {
+				case ch <- p:
+				default:
+				}
+			}
+		case typePingresp:
+		default:
+			c.shutdown(fmt.Errorf("%w: unexpected type %d from broker", ErrMalformedPacket, p.typ))
+			return
+		}
+	}
+}
+
+func (c *Client) deliver(p *packet) {
+	c.mu.Lock()
+	var handlers []Handler
+	for _, s := range c.subs {
+		if Match(s.filter, p.topic) {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	c.mu.Unlock()
+	for _, h := range handlers {
+		h(p.topic, p.payload)
+	}
+}
+
+// keepAlive 按保活间隔发送 PINGREQ，broker 在 1.5 倍间隔内收不到报文会断开连接
+func (c *Client) keepAlive() {
+	ticker := time.NewTicker(c.opts.KeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.write(&packet{typ: typePingreq}); err != nil {
+				c.shutdown(err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	cases := []*packet{
+		{typ: typeConnect, clientID: "gw", username: "u", password: "p", hasUsername: true, hasPassword: true, cleanSession: true, keepAlive: 30},
+		{typ: typeConnack, returnCode: ConnBadCredentials},
+		{typ: typePublish, topic: "a/b", payload: []byte("hello"), qos: 1, packetID: 7, retain: true},
+		{typ: typePublish, topic: "a/b", payload: bytes.Repeat([]byte{1}, 300)},
+		{typ: typePuback, packetID: 7},
+		{typ: typeSubscribe, packetID: 8, filters: []string{"a/+", "b/#"}, qoss: []byte{0, 1}},
+		{typ: typeSuback, packetID: 8, qoss: []byte{0, subackFailure}},
+		{typ: typeUnsubscribe, packetID: 9, filters: []string{"a/+"}},
+		{typ: typePingreq},
+	}
+	for _, want := range cases {
+		data, err := want.encode()
+		if err != nil {
+			t.Fatalf("encode type %d: %v", want.typ, err)
+		}
+		got, err := readPacket(bufio.NewReader(bytes.NewReader(data)), DefaultMaxPacketSize)
+		if err != nil {
+			t.Fatalf("decode type %d: %v", want.typ, err)
+		}
+		if got.typ != want.typ || got.clientID != want.clientID || got.username != want.username ||
+			got.password != want.password || got.keepAlive != want.keepAlive || got.returnCode != want.returnCode ||
+			got.topic != want.topic || !bytes.Equal(got.payload, want.payload) || got.qos != want.qos ||
+			got.retain != want.retain || got.packetID != want.packetID || len(got.filters) != len(want.filters) ||
+			!bytes.Equal(got.qoss, want.qoss) {
+			t.Errorf("round trip of type %d: got %+v, want %+v", want.typ, got, want)
+		}
+	}
+}
+
+func TestReadPacketTruncated(t *testing.T) {
+	data, _ := (&packet{typ: typeSubscribe, packetID: 1, filters: []string{"a"}, qoss: []byte{0}}).encode()
+	// 剩余长度声明正确，但主题字符串长度越界
+	data[5] = 0xFF
+	if _, err := readPacket(bufio.NewReader(bytes.NewReader(data)), DefaultMaxPacketSize); err == nil {
+		t.Fatal("expected error for truncated packet")
+	}
+	if _, err := readPacket(bufio.NewReader(bytes.NewReader([]byte{0x30, 0x05, 0, 1})), 4); err != ErrPacketTooLarge {
+		t.Fatalf("expected ErrPacketTooLarge, got %v", err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"+/+", "a/b", true},
+		{"+", "$SYS", false},
+		{"#", "$SYS/x", false},
+		{"$SYS/#", "$SYS/x", true},
+		{"a/b", "a/c", false},
+	}
+	for _, c := range cases {
+		if got := Match(c.filter, c.topic); got != c.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", c.filter, c.topic, got, c.want)
+		}
+	}
+	for _, bad := range []string{"", "a/#/b", "a+", "a/b#"} {
+		if validFilter(bad) == nil {
+			t.Errorf("filter %q should be invalid", bad)
+		}
+	}
+}
+
+func startBroker(t *testing.T) *Broker {
+	t.Helper()
+	b := NewBroker()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.Serve(ln)
+	t.Cleanup(func() { b.Close() })
+	for b.Addr() == "" {
+		time.Sleep(time.Millisecond)
+	}
+	return b
+}
+
+func dialTest(t *testing.T, b *Broker, id string) *Client {
+	t.Helper()
+	c, err := Dial(b.Addr(), Options{ClientID: id, AckTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+type message struct {
+	topic   string
+	payload string
+}
+
+func collect(ch chan message) Handler {
+	return func(topic string, payload []byte) {
+		ch <- message{topic, string(payload)}
+	}
+}
+
+func expect(t *testing.T, ch chan message, want message) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %+v", want)
+	}
+}
+
+func TestClientPublishSubscribe(t *testing.T) {
+	b := startBroker(t)
+	sub := dialTest(t, b, "sub")
+	pub := dialTest(t, b, "pub")
+
+	ch := make(chan message, 4)
+	if err := sub.Subscribe("evgw/+/status", 1, collect(ch)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Publish("evgw/CP1/status", []byte("q0"), 0, false); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, ch, message{"evgw/CP1/status", "q0"})
+	if err := pub.Publish("evgw/CP2/status", []byte("q1"), 1, false); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, ch, message{"evgw/CP2/status", "q1"})
+
+	// 不匹配的主题不投递
+	pub.Publish("evgw/CP1/heartbeat", []byte("x"), 1, false)
+	if err := sub.Unsubscribe("evgw/+/status"); err != nil {
+		t.Fatal(err)
+	}
+	pub.Publish("evgw/CP1/status", []byte("after"), 1, false)
+	select {
+	case m := <-ch:
+		t.Fatalf("unexpected delivery %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClientRetained(t *testing.T) {
+	b := startBroker(t)
+	pub := dialTest(t, b, "pub")
+	if err := pub.Publish("evgw/CP1/registered", []byte("r"), 1, true); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := dialTest(t, b, "sub")
+	ch := make(chan message, 1)
+	if err := sub.Subscribe("evgw/#", 0, collect(ch)); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, ch, message{"evgw/CP1/registered", "r"})
+}
+
+func TestClientBrokerGone(t *testing.T) {
+	b := startBroker(t)
+	c := dialTest(t, b, "gone")
+	b.Close()
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("client did not notice the broker closing")
+	}
+	if err := c.Publish("a", nil, 1, false); err == nil {
+		t.Fatal("publish on a closed client should fail")
+	}
+}
+
+func TestBrokerRejectsEmptyIDWithoutCleanSession(t *testing.T) {
+	b := startBroker(t)
+	conn, err := net.Dial("tcp", b.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data, _ := (&packet{typ: typeConnect}).encode()
+	conn.Write(data)
+	p, err := readPacket(bufio.NewReader(conn), DefaultMaxPacketSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.typ != typeConnack || p.returnCode != ConnIdentifierRejected {
+		t.Fatalf("expected identifier rejected, got %+v", p)
+	}
+}
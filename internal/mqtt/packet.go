@@ -0,0 +1,336 @@
+// Package mqtt 实现 MQTT 3.1.1 的客户端和一个最小的 broker。
+// 只支持 QoS 0 和 1，足够网关发布遥测、接收下行命令，broker 用于测试和本地联调。
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 控制报文类型（固定报头高 4 位）
+const (
+	typeConnect     byte = 1
+	typeConnack     byte = 2
+	typePublish     byte = 3
+	typePuback      byte = 4
+	typeSubscribe   byte = 8
+	typeSuback      byte = 9
+	typeUnsubscribe byte = 10
+	typeUnsuback    byte = 11
+	typePingreq     byte = 12
+	typePingresp    byte = 13
+	typeDisconnect  byte = 14
+)
+
+// CONNACK 返回码
+const (
+	ConnAccepted           byte = 0
+	ConnBadProtocol        byte = 1
+	ConnIdentifierRejected byte = 2
+	ConnServerUnavailable  byte = 3
+	ConnBadCredentials     byte = 4
+	ConnNotAuthorized      byte = 5
+)
+
+const (
+	protocolName  = "MQTT"
+	protocolLevel = 4 // 3.1.1
+
+	maxRemainingLength = 268435455
+	subackFailure      = 0x80
+)
+
+var (
+	ErrMalformedPacket = errors.New("malformed mqtt packet")
+	ErrPacketTooLarge  = errors.New("mqtt packet too large")
+)
+
+// packet 是一个解码后的控制报文，字段按报文类型取用
+type packet struct {
+	typ   byte
+	flags byte // 固定报头低 4 位
+
+	// CONNECT
+	clientID     string
+	username     string
+	password     string
+	hasUsername  bool
+	hasPassword  bool
+	cleanSession bool
+	keepAlive    uint16
+
+	// CONNACK
+	sessionPresent bool
+	returnCode     byte
+
+	// PUBLISH
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+	dup     bool
+
+	// PUBLISH(QoS>0)、PUBACK、SUBSCRIBE、SUBACK、UNSUBSCRIBE、UNSUBACK
+	packetID uint16
+
+	// SUBSCRIBE、UNSUBSCRIBE：主题过滤器及请求的 QoS；SUBACK：授予的 QoS
+	filters []string
+	qoss    []byte
+}
+
+// encode 编码报文
+func (p *packet) encode() ([]byte, error) {
+	var body []byte
+	flags := p.flags
+	switch p.typ {
+	case typeConnect:
+		body = appendString(body, protocolName)
+		body = append(body, protocolLevel)
+		var cf byte
+		if p.cleanSession {
+			cf |= 0x02
+		}
+		if p.hasPassword {
+			cf |= 0x40
+		}
+		if p.hasUsername {
+			cf |= 0x80
+		}
+		body = append(body, cf)
+		body = binary.BigEndian.AppendUint16(body, p.keepAlive)
+		body = appendString(body, p.clientID)
+		if p.hasUsername {
+			body = appendString(body, p.username)
+		}
+		if p.hasPassword {
+			body = appendString(body, p.password)
+		}
+	case typeConnack:
+		var sp byte
+		if p.sessionPresent {
+			sp = 1
+		}
+		body = []byte{sp, p.returnCode}
+	case typePublish:
+		flags = p.qos << 1
+		if p.retain {
+			flags |= 0x01
+		}
+		if p.dup {
+			flags |= 0x08
+		}
+		body = appendString(body, p.topic)
+		if p.qos > 0 {
+			body = binary.BigEndian.AppendUint16(body, p.packetID)
+		}
+		body = append(body, p.payload...)
+	case typePuback, typeUnsuback:
+		body = binary.BigEndian.AppendUint16(body, p.packetID)
+	case typeSubscribe:
+		flags = 0x02
+		body = binary.BigEndian.AppendUint16(body, p.packetID)
+		for i, f := range p.filters {
+			body = appendString(body, f)
+			body = append(body, p.qoss[i])
+		}
+	case typeSuback:
+		body = binary.BigEndian.AppendUint16(body, p.packetID)
+		body = append(body, p.qoss...)
+	case typeUnsubscribe:
+		flags = 0x02
+		body = binary.BigEndian.AppendUint16(body, p.packetID)
+		for _, f := range p.filters {
+			body = appendString(body, f)
+		}
+	case typePingreq, typePingresp, typeDisconnect:
+	default:
+		return nil, fmt.Errorf("%w: cannot encode type %d", ErrMalformedPacket, p.typ)
+	}
+	if len(body) > maxRemainingLength {
+		return nil, ErrPacketTooLarge
+	}
+
+	out := make([]byte, 0, 5+len(body))
+	out = append(out, p.typ<<4|flags)
+	out = appendVarint(out, len(body))
+	return append(out, body...), nil
+}
+
+// readPacket 读取并解码一个报文，maxSize 限制剩余长度
+func readPacket(r *bufio.Reader, maxSize int) (*packet, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	n, err := readVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSize {
+		return nil, ErrPacketTooLarge
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	p := &packet{typ: h >> 4, flags: h & 0x0F}
+	d := decoder{buf: body}
+	switch p.typ {
+	case typeConnect:
+		if name := d.string(); name != protocolName || d.byte() != protocolLevel {
+			return p, fmt.Errorf("%w: unsupported protocol %q", ErrMalformedPacket, name)
+		}
+		cf := d.byte()
+		p.cleanSession = cf&0x02 != 0
+		p.hasPassword = cf&0x40 != 0
+		p.hasUsername = cf&0x80 != 0
+		p.keepAlive = d.uint16()
+		p.clientID = d.string()
+		if cf&0x04 != 0 {
+			// 遗嘱消息：不支持，读出后丢弃
+			d.string()
+			d.string()
+		}
+		if p.hasUsername {
+			p.username = d.string()
+		}
+		if p.hasPassword {
+			p.password = d.string()
+		}
+	case typeConnack:
+		p.sessionPresent = d.byte()&0x01 != 0
+		p.returnCode = d.byte()
+	case typePublish:
+		p.qos = (p.flags >> 1) & 0x03
+		p.retain = p.flags&0x01 != 0
+		p.dup = p.flags&0x08 != 0
+		if p.qos > 1 {
+			return p, fmt.Errorf("%w: qos %d not supported", ErrMalformedPacket, p.qos)
+		}
+		p.topic = d.string()
+		if p.qos > 0 {
+			p.packetID = d.uint16()
+		}
+		p.payload = d.rest()
+	case typePuback, typeUnsuback:
+		p.packetID = d.uint16()
+	case typeSubscribe:
+		p.packetID = d.uint16()
+		for d.err == nil && len(d.buf) > 0 {
+			p.filters = append(p.filters, d.string())
+			p.qoss = append(p.qoss, d.byte())
+		}
+		if len(p.filters) == 0 {
+			return p, fmt.Errorf("%w: subscribe without filters", ErrMalformedPacket)
+		}
+	case typeSuback:
+		p.packetID = d.uint16()
+		p.qoss = d.rest()
+	case typeUnsubscribe:
+		p.packetID = d.uint16()
+		for d.err == nil && len(d.buf) > 0 {
+			p.filters = append(p.filters, d.string())
+		}
+	case typePingreq, typePingresp, typeDisconnect:
+	default:
+		return p, fmt.Errorf("%w: unknown type %d", ErrMalformedPacket, p.typ)
+	}
+	if d.err != nil {
+		return p, d.err
+	}
+	return p, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// appendVarint 编码剩余长度，每字节 7 位，最高位表示后面还有字节
+func appendVarint(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func readVarint(r io.ByteReader) (int, error) {
+	n, mult := 0, 1
+	for i := 0; i < 4; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n += int(digit&0x7F) * mult
+		if digit&0x80 == 0 {
+			return n, nil
+		}
+		mult *= 128
+	}
+	return 0, fmt.Errorf("%w: remaining length too long", ErrMalformedPacket)
+}
+
+// decoder 顺序读取报文体，第一次越界后记录错误并返回零值
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) need(n int) bool {
+	if d.err != nil {
+		return false
+	}
+	if len(d.buf) < n {
+		d.err = fmt.Errorf("%w: truncated", ErrMalformedPacket)
+		return false
+	}
+	return true
+}
+
+func (d *decoder) byte() byte {
+	if !d.need(1) {
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if !d.need(2) {
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.buf)
+	d.buf = d.buf[2:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := int(d.uint16())
+	if !d.need(n) {
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+func (d *decoder) rest() []byte {
+	if d.err != nil {
+		return nil
+	}
+	out := d.buf
+	d.buf = nil
+	return out
+}
@@ -0,0 +1,55 @@
+package mqtt
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrBadTopic = errors.New("invalid mqtt topic")
+
+// Match 判断主题是否匹配过滤器，支持单层通配符 + 和多层通配符 #
+func Match(filter, topic string) bool {
+	// $ 开头的系统主题不被以通配符开头的过滤器匹配
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// validFilter 检查通配符的位置：+ 必须独占一层，# 必须独占最后一层
+func validFilter(filter string) error {
+	if filter == "" {
+		return ErrBadTopic
+	}
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		if strings.Contains(l, "#") && (l != "#" || i != len(levels)-1) {
+			return ErrBadTopic
+		}
+		if strings.Contains(l, "+") && l != "+" {
+			return ErrBadTopic
+		}
+	}
+	return nil
+}
+
+// validTopic 检查发布主题不含通配符
+func validTopic(topic string) error {
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return ErrBadTopic
+	}
+	return nil
+}
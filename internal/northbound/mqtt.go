@@ -0,0 +1,320 @@
+// Package northbound 把网关事件发布到后台系统，并把后台下发的命令转给充电桩。
+package northbound
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/mqtt"
+	"github.com/x14n/evgateway/internal/ocpp"
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+const (
+	DefaultTopicPrefix   = "evgw"
+	DefaultEventTopic    = "{prefix}/{charger}/{type}"
+	DefaultCommandTopic  = "{prefix}/+/command"
+	DefaultQueueSize     = 1024
+	DefaultRetryInterval = 5 * time.Second
+)
+
+// Schema 是北向事件、命令和命令结果的 JSON Schema (draft-06)
+//
+//go:embed schema.json
+var Schema []byte
+
+var (
+	ErrUnknownCommand  = errors.New("unknown command")
+	ErrBadCommand      = gateway.ErrBadCommand
+	ErrChargerOffline  = errors.New("charger not connected")
+	ErrBadCommandTopic = errors.New("command topic must contain exactly one + for the charger id")
+)
+
+// 命令名到帧命令字的映射，也可以直接用 cmd 字段给出命令字
+var commands = map[string]byte{
+	"register":          protocol.CmdRegister,
+	"heartbeat":         protocol.CmdHeartbeat,
+	"status":            protocol.CmdStatus,
+	"error":             protocol.CmdError,
+	"start_transaction": protocol.CmdStartTransaction,
+	"stop_transaction":  protocol.CmdStopTransaction,
+	"meter_values":      protocol.CmdMeterValues,
+}
+
+// Config 配置 MQTT 北向接口。主题模板中可以使用 {prefix}、{charger} 和 {type}，
+// {charger} 中的 %、/、+、# 按百分号编码，命令主题里的充电桩 ID 也用同样的编码。
+type Config struct {
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+
+	TopicPrefix  string
+	EventTopic   string            // 事件主题的缺省模板
+	Topics       map[string]string // 按事件类型覆盖主题模板
+	CommandTopic string            // 命令订阅的过滤器，充电桩 ID 所在层用 +
+	QoS          byte
+
+	QueueSize     int           // 待发布事件的缓冲，满了丢弃最新的事件
+	RetryInterval time.Duration // 连接断开后的重连间隔
+}
+
+// Message 是发布到 MQTT 的事件信封
+type Message struct {
+	Type      string    `json:"type"`
+	ChargerID string    `json:"chargerId"`
+	Time      time.Time `json:"time"`
+	Data      any       `json:"data,omitempty"`
+}
+
+// Command 是从命令主题收到的下行命令，command 和 cmd 二选一。
+// cmd 和 payload 与 HTTP API 的广播请求相同，Schema 不允许 action
+type Command struct {
+	ID      string `json:"id"`
+	Command string `json:"command,omitempty"`
+	gateway.CommandRequest
+}
+
+// commandSchema 是 Schema 中的 Command 定义，命令先按它校验再转给充电桩
+var commandSchema = func() *ocpp.Schema {
+	var root ocpp.Schema
+	if err := json.Unmarshal(Schema, &root); err != nil {
+		panic(err)
+	}
+	return &ocpp.Schema{Ref: "#/definitions/Command", Definitions: root.Definitions}
+}()
+
+// CommandResult 发布在 <命令主题>/result 上
+type CommandResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // sent 或 rejected
+	Error  string `json:"error,omitempty"`
+}
+
+// MQTT 把网关事件发布到 MQTT broker，并订阅命令主题把命令转发给充电桩
+type MQTT struct {
+	gw  *gateway.Gateway
+	cfg Config
+	sub *gateway.Subscription
+
+	queue   chan Message
+	results chan published
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+type published struct {
+	topic   string
+	payload []byte
+}
+
+// NewMQTT 创建北向接口并注册网关事件处理器，Start 之前产生的事件也会进入缓冲
+func NewMQTT(gw *gateway.Gateway, cfg Config) (*MQTT, error) {
+	if cfg.TopicPrefix == "" {
+		cfg.TopicPrefix = DefaultTopicPrefix
+	}
+	if cfg.EventTopic == "" {
+		cfg.EventTopic = DefaultEventTopic
+	}
+	if cfg.CommandTopic == "" {
+		cfg.CommandTopic = DefaultCommandTopic
+	}
+	cfg.CommandTopic = strings.ReplaceAll(cfg.CommandTopic, "{prefix}", cfg.TopicPrefix)
+	if strings.Count(cfg.CommandTopic, "+") != 1 || strings.Contains(cfg.CommandTopic, "#") {
+		return nil, ErrBadCommandTopic
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = DefaultRetryInterval
+	}
+
+	m := &MQTT{
+		gw:      gw,
+		cfg:     cfg,
+		queue:   make(chan Message, cfg.QueueSize),
+		results: make(chan published, cfg.QueueSize),
+		stop:    make(chan struct{}),
+	}
+	m.sub = gw.Subscribe(m.enqueue)
+	return m, nil
+}
+
+// Start 连接 broker 并开始发布，连接断开后按 RetryInterval 重连
+func (m *MQTT) Start() {
+	m.wg.Add(1)
+	go m.run()
+}
+
+// Close 取消事件订阅，停止发布并断开连接，缓冲中未发布的事件被丢弃
+func (m *MQTT) Close() {
+	m.sub.Close()
+	m.once.Do(func() { close(m.stop) })
+	m.wg.Wait()
+}
+
+// Topic 按配置的模板生成事件主题，充电桩 ID 经 escapeTopicLevel 转义
+func (m *MQTT) Topic(eventType, chargerID string) string {
+	tmpl, ok := m.cfg.Topics[eventType]
+	if !ok {
+		tmpl = m.cfg.EventTopic
+	}
+	return strings.NewReplacer(
+		"{prefix}", m.cfg.TopicPrefix,
+		"{charger}", escapeTopicLevel(chargerID),
+		"{type}", eventType,
+	).Replace(tmpl)
+}
+
+var (
+	topicEscaper   = strings.NewReplacer("%", "%25", "/", "%2F", "+", "%2B", "#", "%23")
+	topicUnescaper = strings.NewReplacer("%25", "%", "%2F", "/", "%2B", "+", "%23", "#")
+)
+
+// escapeTopicLevel 对充电桩 ID 中的 /、+、# 做百分号编码，ID 只占主题的一层，也不会成为通配符
+func escapeTopicLevel(s string) string {
+	return topicEscaper.Replace(s)
+}
+
+// enqueue 在产生事件的 goroutine 中调用，不能阻塞处理器
+func (m *MQTT) enqueue(e gateway.Event) {
+	select {
+	case m.queue <- Message{Type: e.Type, ChargerID: e.ChargerID, Time: e.Time, Data: e.Data}:
+	default:
+		fmt.Printf("[northbound] queue full, dropping %s event from %s\n", e.Type, e.ChargerID)
+	}
+}
+
+func (m *MQTT) run() {
+	defer m.wg.Done()
+	for {
+		client, err := m.connect()
+		if err != nil {
+			fmt.Printf("[northbound] mqtt connect %s error: %v\n", m.cfg.Broker, err)
+		} else {
+			fmt.Println("[northbound] connected to mqtt broker", m.cfg.Broker)
+			if m.publishLoop(client) {
+				return
+			}
+			fmt.Printf("[northbound] mqtt connection lost: %v\n", client.Err())
+		}
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(m.cfg.RetryInterval):
+		}
+	}
+}
+
+func (m *MQTT) connect() (*mqtt.Client, error) {
+	client, err := mqtt.Dial(m.cfg.Broker, mqtt.Options{
+		ClientID:     m.cfg.ClientID,
+		Username:     m.cfg.Username,
+		Password:     m.cfg.Password,
+		CleanSession: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Subscribe(m.cfg.CommandTopic, m.cfg.QoS, m.onCommand); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// publishLoop 发布缓冲中的事件和命令结果，直到连接断开（返回 false）或 Close（返回 true）。
+// 发布失败的事件不重试，QoS 1 只保证连接正常时的送达。
+func (m *MQTT) publishLoop(client *mqtt.Client) bool {
+	for {
+		var p published
+		select {
+		case <-m.stop:
+			client.Close()
+			return true
+		case <-client.Done():
+			return false
+		case msg := <-m.queue:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				fmt.Printf("[northbound] encode %s event error: %v\n", msg.Type, err)
+				continue
+			}
+			p = published{m.Topic(msg.Type, msg.ChargerID), data}
+		case p = <-m.results:
+		}
+		if err := client.Publish(p.topic, p.payload, m.cfg.QoS, false); err != nil {
+			fmt.Printf("[northbound] publish %s error: %v\n", p.topic, err)
+		}
+	}
+}
+
+// onCommand 在 MQTT 客户端的读 goroutine 中调用，结果交给发布循环发出
+func (m *MQTT) onCommand(topic string, payload []byte) {
+	chargerID := commandCharger(m.cfg.CommandTopic, topic)
+	var cmd Command
+	err := json.Unmarshal(payload, &cmd)
+	if err == nil {
+		if verr := commandSchema.Validate(payload); verr != nil {
+			err = fmt.Errorf("%w: %v", ErrBadCommand, verr)
+		}
+	}
+	if err == nil {
+		err = m.execute(chargerID, cmd)
+	}
+	res := CommandResult{ID: cmd.ID, Status: "sent"}
+	if err != nil {
+		res.Status = "rejected"
+		res.Error = err.Error()
+		fmt.Printf("[northbound] command %q for %s rejected: %v\n", cmd.ID, chargerID, err)
+	}
+	data, _ := json.Marshal(res)
+	select {
+	case m.results <- published{topic + "/result", data}:
+	default:
+		fmt.Printf("[northbound] result queue full, dropping result of %q\n", cmd.ID)
+	}
+}
+
+// execute 把命令编码成帧发给充电桩
+func (m *MQTT) execute(chargerID string, cmd Command) error {
+	if cmd.Command != "" {
+		c, ok := commands[cmd.Command]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownCommand, cmd.Command)
+		}
+		if cmd.Cmd != 0 && cmd.Cmd != c {
+			return fmt.Errorf("%w: command %s conflicts with cmd %d", ErrBadCommand, cmd.Command, cmd.Cmd)
+		}
+		cmd.Cmd = c
+	}
+	frame, err := cmd.Frame()
+	if err != nil {
+		return err
+	}
+	session, ok := m.gw.GetSession(chargerID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrChargerOffline, chargerID)
+	}
+	return session.Send(frame)
+}
+
+// commandCharger 取出主题中与过滤器的 + 对应的那一层并还原转义
+func commandCharger(filter, topic string) string {
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "+" && i < len(ts) {
+			return topicUnescaper.Replace(ts[i])
+		}
+	}
+	return ""
+}
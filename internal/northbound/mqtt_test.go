@@ -0,0 +1,166 @@
+package northbound
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/mqtt"
+	"github.com/x14n/evgateway/internal/ocpp"
+	"github.com/x14n/evgateway/internal/protocol"
+	"github.com/x14n/evgateway/internal/transport"
+)
+
+// schemaFor 取出 schema.json 中的一个定义
+func schemaFor(t *testing.T, def string) *ocpp.Schema {
+	t.Helper()
+	var root ocpp.Schema
+	if err := json.Unmarshal(Schema, &root); err != nil {
+		t.Fatal(err)
+	}
+	return &ocpp.Schema{Ref: "#/definitions/" + def, Definitions: root.Definitions}
+}
+
+type received struct {
+	topic   string
+	payload []byte
+}
+
+func setup(t *testing.T) (*gateway.Gateway, *mqtt.Client, chan received) {
+	t.Helper()
+	b := mqtt.NewBroker()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.Serve(ln)
+	t.Cleanup(func() { b.Close() })
+
+	gw := gateway.NewGateway()
+	nb, err := NewMQTT(gw, Config{Broker: ln.Addr().String(), ClientID: "gw", QoS: 1, RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nb.Start()
+	t.Cleanup(nb.Close)
+
+	backend, err := mqtt.Dial(ln.Addr().String(), mqtt.Options{ClientID: "backend"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	ch := make(chan received, 16)
+	err = backend.Subscribe("evgw/#", 1, func(topic string, payload []byte) {
+		ch <- received{topic, payload}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gw, backend, ch
+}
+
+func next(t *testing.T, ch chan received) received {
+	t.Helper()
+	select {
+	case r := <-ch:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for mqtt message")
+		return received{}
+	}
+}
+
+func TestPublishEvents(t *testing.T) {
+	gw, _, ch := setup(t)
+	event := schemaFor(t, "Event")
+
+	gw.Emit(gateway.Event{Type: gateway.EventStatusChanged, ChargerID: "CP1", Data: map[string]any{"connector": 1, "state": "charging"}})
+	gw.Emit(gateway.Event{Type: gateway.EventHeartbeat, ChargerID: "CP1"})
+
+	for _, want := range []string{"evgw/CP1/status_changed", "evgw/CP1/heartbeat"} {
+		r := next(t, ch)
+		if r.topic != want {
+			t.Fatalf("expected topic %s, got %s", want, r.topic)
+		}
+		if err := event.Validate(r.payload); err != nil {
+			t.Fatalf("%s does not match the schema: %v (%s)", r.topic, err, r.payload)
+		}
+	}
+}
+
+func TestTopicTemplates(t *testing.T) {
+	nb, err := NewMQTT(gateway.NewGateway(), Config{
+		TopicPrefix: "site1",
+		Topics:      map[string]string{gateway.EventErrorReported: "{prefix}/alarms/{charger}"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := nb.Topic(gateway.EventErrorReported, "CP9"); got != "site1/alarms/CP9" {
+		t.Errorf("unexpected error topic %s", got)
+	}
+	if got := nb.Topic(gateway.EventStatusChanged, "CP9"); got != "site1/CP9/status_changed" {
+		t.Errorf("unexpected status topic %s", got)
+	}
+	if got := nb.Topic(gateway.EventStatusChanged, "A/+#%"); got != "site1/A%2F%2B%23%25/status_changed" {
+		t.Errorf("charger id not escaped in topic %s", got)
+	}
+	if got := commandCharger(DefaultCommandTopic, "evgw/A%2F%2B%23%25/command"); got != "A/+#%" {
+		t.Errorf("charger id not unescaped from command topic: %q", got)
+	}
+	if _, err := NewMQTT(gateway.NewGateway(), Config{CommandTopic: "cmd/#"}); err != ErrBadCommandTopic {
+		t.Errorf("expected ErrBadCommandTopic, got %v", err)
+	}
+}
+
+func TestCommandToCharger(t *testing.T) {
+	gw, backend, ch := setup(t)
+	result := schemaFor(t, "CommandResult")
+
+	server, charger := transport.Pipe()
+	defer charger.Close()
+	gw.AddSession(&gateway.Session{ID: "CP1", Addr: "pipe", Transport: server})
+
+	cmd := `{"id":"c1","command":"status","payload":{"query":true}}`
+	if err := backend.Publish("evgw/CP1/command", []byte(cmd), 1, false); err != nil {
+		t.Fatal(err)
+	}
+	f, err := charger.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Cmd != protocol.CmdStatus || string(f.Payload) != `{"query":true}` {
+		t.Fatalf("unexpected frame cmd=%d payload=%s", f.Cmd, f.Payload)
+	}
+
+	backend.Publish("evgw/CP2/command", []byte(`{"id":"c2","cmd":3}`), 1, false)
+	backend.Publish("evgw/CP1/command", []byte(`{"id":"c3","command":"reboot"}`), 1, false)
+	// 格式不对的命令在下发前拒绝，充电桩收不到任何帧
+	backend.Publish("evgw/CP1/command", []byte(`{"id":"c4","cmd":3,"payload":"raw"}`), 1, false)
+	backend.Publish("evgw/CP1/command", []byte(`{"id":"c5","cmd":3,"action":"Reset"}`), 1, false)
+	backend.Publish("evgw/CP1/command", []byte(`{"id":"c6","command":"status","cmd":4}`), 1, false)
+	backend.Publish("evgw/CP1/command", []byte(`{"id":"c7","cmd":3,"payload":null}`), 1, false)
+	backend.Publish("evgw/CP1/command", []byte(`{"id":"c8","command":"heartbeat"}`), 1, false)
+	if f, err := charger.ReadFrame(); err != nil || f.Cmd != protocol.CmdHeartbeat {
+		t.Fatalf("expected only the heartbeat command to reach the charger, got cmd=%d %v", f.Cmd, err)
+	}
+
+	want := map[string]string{"c1": "sent", "c2": "rejected", "c3": "rejected", "c4": "rejected", "c5": "rejected", "c6": "rejected", "c7": "rejected", "c8": "sent"}
+	for len(want) > 0 {
+		r := next(t, ch)
+		if r.topic != "evgw/CP1/command/result" && r.topic != "evgw/CP2/command/result" {
+			continue
+		}
+		if err := result.Validate(r.payload); err != nil {
+			t.Fatalf("result does not match the schema: %v (%s)", err, r.payload)
+		}
+		var res CommandResult
+		json.Unmarshal(r.payload, &res)
+		if want[res.ID] != res.Status {
+			t.Fatalf("command %s: expected %s, got %+v", res.ID, want[res.ID], res)
+		}
+		delete(want, res.ID)
+	}
+}
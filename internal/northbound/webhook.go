@@ -0,0 +1,424 @@
+package northbound
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+)
+
+const (
+	DefaultWebhookTimeout   = 10 * time.Second
+	DefaultWebhookAttempts  = 5
+	DefaultWebhookBackoff   = time.Second
+	DefaultWebhookMaxDelay  = time.Minute
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+// 请求头。签名是 HMAC-SHA256(secret, 时间戳 + "." + 请求体) 的十六进制，前缀 sha256=
+const (
+	HeaderEvent     = "X-Evgw-Event"
+	HeaderDelivery  = "X-Evgw-Delivery"
+	HeaderTimestamp = "X-Evgw-Timestamp"
+	HeaderSignature = "X-Evgw-Signature"
+)
+
+var (
+	ErrRetryQueueFull = errors.New("webhook retry queue full")
+	ErrWebhookClose   = errors.New("webhooks closed")
+)
+
+// WebhookEndpoint 是一个回调地址及其订阅的事件类型，Events 为空表示所有事件
+type WebhookEndpoint struct {
+	URL    string
+	Secret string
+	Events []string
+}
+
+// WebhookConfig 配置回调，零值字段使用缺省值
+type WebhookConfig struct {
+	Endpoints []WebhookEndpoint
+
+	Timeout        time.Duration // 单次请求超时
+	MaxAttempts    int           // 包括第一次在内的最多尝试次数
+	InitialBackoff time.Duration // 第一次重试前的等待，之后每次翻倍
+	MaxBackoff     time.Duration
+	QueueSize      int    // 每个地址待投递事件的缓冲和待重试投递的上限，满了丢弃新事件或写入死信
+	DeadLetterFile string // 最终投递失败的事件按行追加到该文件，为空时只打印日志
+
+	BreakerThreshold int           // 连续失败多少次后熔断
+	BreakerCooldown  time.Duration // 熔断后多久放行一次试探请求
+}
+
+// Sign 计算回调签名，接收方用同样的方法校验 HeaderSignature
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhooks 把网关事件以 JSON POST 到配置的地址。
+// 每个地址有自己的投递 goroutine、重试 goroutine 和熔断器，慢地址不影响其他地址。
+// 订阅 goroutine 只做第一次尝试，失败后的退避重试交给重试 goroutine，不占用事件缓冲；
+// 熔断期间的事件先暂存，冷却期过后用其中一个投递做试探，成功后依次补发。
+type Webhooks struct {
+	cfg    WebhookConfig
+	client *http.Client
+	hooks  []*webhook
+	stop   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+
+	deadMu sync.Mutex
+}
+
+type webhook struct {
+	w       *Webhooks
+	ep      WebhookEndpoint
+	breaker *breaker
+	sub     *gateway.Subscription
+
+	mu      sync.Mutex
+	pending []*delivery // 等待重试或熔断期间暂存的投递
+	wake    chan struct{}
+}
+
+// delivery 是一个事件向一个地址的投递，重试时沿用同一个 ID
+type delivery struct {
+	id       string
+	msg      Message
+	body     []byte
+	attempts int
+	delay    time.Duration // 下一次失败后的退避
+	due      time.Time     // 不早于该时间重试
+}
+
+// DeadLetter 是死信文件中的一行
+type DeadLetter struct {
+	URL      string    `json:"url"`
+	Delivery string    `json:"delivery"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+	Message  Message   `json:"message"`
+}
+
+// NewWebhooks 为每个地址订阅网关事件
+func NewWebhooks(gw *gateway.Gateway, cfg WebhookConfig) *Webhooks {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultWebhookTimeout
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = DefaultWebhookAttempts
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = DefaultWebhookBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultWebhookMaxDelay
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	if cfg.BreakerThreshold <= 0 {
+		cfg.BreakerThreshold = DefaultBreakerThreshold
+	}
+	if cfg.BreakerCooldown <= 0 {
+		cfg.BreakerCooldown = DefaultBreakerCooldown
+	}
+
+	w := &Webhooks{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		stop:   make(chan struct{}),
+	}
+	for _, ep := range cfg.Endpoints {
+		h := &webhook{
+			w:       w,
+			ep:      ep,
+			breaker: &breaker{threshold: cfg.BreakerThreshold, cooldown: cfg.BreakerCooldown},
+			wake:    make(chan struct{}, 1),
+		}
+		w.wg.Add(1)
+		go h.retryLoop()
+		opts := []gateway.SubscribeOption{gateway.Async(cfg.QueueSize)}
+		if len(ep.Events) > 0 {
+			opts = append(opts, gateway.Types(ep.Events...))
+		}
+		h.sub = gw.Subscribe(h.deliver, opts...)
+		w.hooks = append(w.hooks, h)
+	}
+	return w
+}
+
+// Close 取消订阅，等待重试和熔断暂存的投递立即放弃并写入死信
+func (w *Webhooks) Close() {
+	w.once.Do(func() { close(w.stop) })
+	for _, h := range w.hooks {
+		h.sub.Close()
+	}
+	w.wg.Wait()
+	for _, h := range w.hooks {
+		h.mu.Lock()
+		pending := h.pending
+		h.pending = nil
+		h.mu.Unlock()
+		for _, d := range pending {
+			h.fail(d, ErrWebhookClose)
+		}
+	}
+}
+
+// deliver 在地址自己的订阅 goroutine 中调用，只做第一次尝试
+func (h *webhook) deliver(e gateway.Event) {
+	msg := Message{Type: e.Type, ChargerID: e.ChargerID, Time: e.Time, Data: e.Data}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Printf("[webhook] encode %s event error: %v\n", e.Type, err)
+		return
+	}
+	h.attempt(&delivery{id: newDeliveryID(), msg: msg, body: body, delay: h.w.cfg.InitialBackoff})
+}
+
+// attempt 投递一次。熔断时暂存且不计入尝试次数，可以重试的失败按退避放回重试队列
+func (h *webhook) attempt(d *delivery) {
+	if !h.breaker.allow() {
+		h.hold(d)
+		return
+	}
+	d.attempts++
+	retry, err := h.post(d.msg.Type, d.id, d.body)
+	// 不重试的 4xx 说明地址可达，不计入熔断
+	h.breaker.record(err == nil || !retry)
+	// 试探的结果决定暂存的投递何时发出
+	h.signal()
+	if err == nil {
+		return
+	}
+	if !retry || d.attempts >= h.w.cfg.MaxAttempts {
+		h.fail(d, err)
+		return
+	}
+	d.due = time.Now().Add(d.delay)
+	d.delay = min(d.delay*2, h.w.cfg.MaxBackoff)
+	h.hold(d)
+}
+
+// hold 把投递放入重试队列，关闭后或队列满时直接写入死信
+func (h *webhook) hold(d *delivery) {
+	select {
+	case <-h.w.stop:
+		h.fail(d, ErrWebhookClose)
+		return
+	default:
+	}
+	h.mu.Lock()
+	if len(h.pending) >= h.w.cfg.QueueSize {
+		h.mu.Unlock()
+		h.fail(d, ErrRetryQueueFull)
+		return
+	}
+	h.pending = append(h.pending, d)
+	h.mu.Unlock()
+	h.signal()
+}
+
+func (h *webhook) signal() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// retryLoop 按到期时间重试，熔断打开时等到冷却期结束再放行一个试探
+func (h *webhook) retryLoop() {
+	defer h.w.wg.Done()
+	for {
+		d, wait := h.next()
+		if d != nil {
+			h.attempt(d)
+			continue
+		}
+		var timer *time.Timer
+		var fired <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			fired = timer.C
+		}
+		select {
+		case <-h.w.stop:
+			return
+		case <-h.wake:
+		case <-fired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// next 取出最早到期且熔断器允许发出的投递，否则返回需要等待的时间，0 表示等待唤醒
+func (h *webhook) next() (*delivery, time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.pending) == 0 {
+		return nil, 0
+	}
+	i := 0
+	for j, d := range h.pending {
+		if d.due.Before(h.pending[i].due) {
+			i = j
+		}
+	}
+	at := h.pending[i].due
+	open, probing := h.breaker.reopensAt()
+	if probing {
+		return nil, 0
+	}
+	if open.After(at) {
+		at = open
+	}
+	if wait := time.Until(at); wait > 0 {
+		return nil, wait
+	}
+	d := h.pending[i]
+	h.pending = slices.Delete(h.pending, i, i+1)
+	return d, 0
+}
+
+func (h *webhook) fail(d *delivery, err error) {
+	fmt.Printf("[webhook] %s delivery %s to %s failed after %d attempts: %v\n", d.msg.Type, d.id, h.ep.URL, d.attempts, err)
+	h.w.deadLetter(DeadLetter{
+		URL:      h.ep.URL,
+		Delivery: d.id,
+		Attempts: d.attempts,
+		Error:    err.Error(),
+		Time:     time.Now(),
+		Message:  d.msg,
+	})
+}
+
+// post 发送一次请求，返回失败是否值得重试：网络错误、5xx、408 和 429 重试，其他 4xx 不重试
+func (h *webhook) post(eventType, delivery string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, h.ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, eventType)
+	req.Header.Set(HeaderDelivery, delivery)
+	req.Header.Set(HeaderTimestamp, ts)
+	if h.ep.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(h.ep.Secret, ts, body))
+	}
+
+	resp, err := h.w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("http status %d", resp.StatusCode)
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
+
+// deadLetter 把最终失败的投递按行追加到死信文件
+func (w *Webhooks) deadLetter(dl DeadLetter) {
+	if w.cfg.DeadLetterFile == "" {
+		return
+	}
+	line, err := json.Marshal(dl)
+	if err != nil {
+		fmt.Printf("[webhook] encode dead letter error: %v\n", err)
+		return
+	}
+	w.deadMu.Lock()
+	defer w.deadMu.Unlock()
+	f, err := os.OpenFile(w.cfg.DeadLetterFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		fmt.Printf("[webhook] open dead letter file error: %v\n", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		fmt.Printf("[webhook] write dead letter error: %v\n", err)
+	}
+}
+
+func newDeliveryID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// breaker 是每个地址的熔断器：连续失败达到阈值后打开，冷却期过后放行一次试探，
+// 试探成功则关闭，失败则重新打开
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time // 零值表示关闭
+	probing  bool
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// reopensAt 返回熔断器可以放行试探的时间，关闭时为零值；第二个返回值表示试探正在进行
+func (b *breaker) reopensAt() (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return time.Time{}, false
+	}
+	return b.openedAt.Add(b.cooldown), b.probing
+}
+
+func (b *breaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.failures = 0
+		b.openedAt = time.Time{}
+		b.probing = false
+		return
+	}
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
@@ -0,0 +1,314 @@
+package northbound
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func readDeadLetters(t *testing.T, path string) []DeadLetter {
+	t.Helper()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []DeadLetter
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var dl DeadLetter
+		if err := json.Unmarshal(sc.Bytes(), &dl); err != nil {
+			t.Fatalf("bad dead letter line %q: %v", sc.Text(), err)
+		}
+		out = append(out, dl)
+	}
+	return out
+}
+
+func TestWebhookSignedDelivery(t *testing.T) {
+	type delivery struct {
+		event string
+		msg   Message
+	}
+	got := make(chan delivery, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if sig := Sign("s3cret", r.Header.Get(HeaderTimestamp), body); r.Header.Get(HeaderSignature) != sig {
+			t.Errorf("bad signature %q, want %q", r.Header.Get(HeaderSignature), sig)
+		}
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get(HeaderDelivery) == "" {
+			t.Errorf("missing headers: %v", r.Header)
+		}
+		var msg Message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Errorf("bad body %q: %v", body, err)
+		}
+		got <- delivery{r.Header.Get(HeaderEvent), msg}
+	}))
+	defer srv.Close()
+
+	gw := gateway.NewGateway()
+	wh := NewWebhooks(gw, WebhookConfig{Endpoints: []WebhookEndpoint{{
+		URL:    srv.URL,
+		Secret: "s3cret",
+		Events: []string{gateway.EventErrorReported, gateway.EventSessionExpired},
+	}}})
+	defer wh.Close()
+
+	gw.Emit(gateway.Event{Type: gateway.EventHeartbeat, ChargerID: "CP1"})
+	gw.Emit(gateway.Event{Type: gateway.EventErrorReported, ChargerID: "CP1", Data: "overcurrent"})
+	gw.Emit(gateway.Event{Type: gateway.EventSessionExpired, ChargerID: "CP2"})
+
+	for _, want := range []string{gateway.EventErrorReported, gateway.EventSessionExpired} {
+		select {
+		case d := <-got:
+			if d.event != want || d.msg.Type != want {
+				t.Fatalf("expected %s delivery, got %+v", want, d)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+	select {
+	case d := <-got:
+		t.Fatalf("unsubscribed event delivered: %+v", d)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestWebhookRetryThenSucceed(t *testing.T) {
+	var calls atomic.Int32
+	var mu sync.Mutex
+	var stamps []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		stamps = append(stamps, time.Now())
+		mu.Unlock()
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	dead := filepath.Join(t.TempDir(), "dead.jsonl")
+	gw := gateway.NewGateway()
+	wh := NewWebhooks(gw, WebhookConfig{
+		Endpoints:      []WebhookEndpoint{{URL: srv.URL}},
+		InitialBackoff: 10 * time.Millisecond,
+		DeadLetterFile: dead,
+	})
+	defer wh.Close()
+
+	gw.Emit(gateway.Event{Type: gateway.EventErrorReported, ChargerID: "CP1"})
+	waitFor(t, "third attempt", func() bool { return calls.Load() == 3 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	// 退避翻倍：第二次重试前至少等待 20ms
+	if gap := stamps[2].Sub(stamps[1]); gap < 20*time.Millisecond {
+		t.Errorf("second retry after %v, expected exponential backoff", gap)
+	}
+	if dl := readDeadLetters(t, dead); len(dl) != 0 {
+		t.Errorf("unexpected dead letters %+v", dl)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	dead := filepath.Join(t.TempDir(), "dead.jsonl")
+	gw := gateway.NewGateway()
+	wh := NewWebhooks(gw, WebhookConfig{
+		Endpoints:      []WebhookEndpoint{{URL: srv.URL + "/down"}, {URL: srv.URL + "/bad"}},
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		DeadLetterFile: dead,
+	})
+	defer wh.Close()
+
+	gw.Emit(gateway.Event{Type: gateway.EventErrorReported, ChargerID: "CP1", Data: "fault"})
+	waitFor(t, "dead letters", func() bool { return len(readDeadLetters(t, dead)) == 2 })
+
+	attempts := map[string]int{}
+	for _, dl := range readDeadLetters(t, dead) {
+		attempts[dl.URL] = dl.Attempts
+		if dl.Message.ChargerID != "CP1" || dl.Message.Type != gateway.EventErrorReported {
+			t.Errorf("dead letter lost the event: %+v", dl)
+		}
+	}
+	// 5xx 重试到上限，4xx 不重试
+	if attempts[srv.URL+"/down"] != 3 || attempts[srv.URL+"/bad"] != 1 {
+		t.Errorf("unexpected attempts %v", attempts)
+	}
+	if calls.Load() != 4 {
+		t.Errorf("expected 4 requests, got %d", calls.Load())
+	}
+}
+
+func TestWebhookCircuitBreaker(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	dead := filepath.Join(t.TempDir(), "dead.jsonl")
+	gw := gateway.NewGateway()
+	wh := NewWebhooks(gw, WebhookConfig{
+		Endpoints:        []WebhookEndpoint{{URL: srv.URL}},
+		MaxAttempts:      1,
+		DeadLetterFile:   dead,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Hour,
+	})
+
+	for range 4 {
+		gw.Emit(gateway.Event{Type: gateway.EventErrorReported, ChargerID: "CP1"})
+	}
+	waitFor(t, "dead letters", func() bool { return len(readDeadLetters(t, dead)) == 2 })
+	time.Sleep(20 * time.Millisecond)
+	if calls.Load() != 2 {
+		t.Fatalf("breaker should stop requests after 2 failures, got %d", calls.Load())
+	}
+	// 熔断期间的事件暂存而不是直接进死信，关闭时才放弃
+	if dl := readDeadLetters(t, dead); len(dl) != 2 {
+		t.Fatalf("events held by the open breaker went to dead letters: %+v", dl)
+	}
+	wh.Close()
+	dl := readDeadLetters(t, dead)
+	if len(dl) != 4 || dl[3].Attempts != 0 || dl[3].Error != ErrWebhookClose.Error() {
+		t.Errorf("expected held events to be dead-lettered on close, got %+v", dl)
+	}
+}
+
+func TestWebhookHalfOpenProbe(t *testing.T) {
+	var healthy atomic.Bool
+	var calls, delivered atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		delivered.Add(1)
+	}))
+	defer srv.Close()
+
+	dead := filepath.Join(t.TempDir(), "dead.jsonl")
+	gw := gateway.NewGateway()
+	wh := NewWebhooks(gw, WebhookConfig{
+		Endpoints:        []WebhookEndpoint{{URL: srv.URL}},
+		MaxAttempts:      100,
+		InitialBackoff:   time.Millisecond,
+		DeadLetterFile:   dead,
+		BreakerThreshold: 1,
+		BreakerCooldown:  30 * time.Millisecond,
+	})
+	defer wh.Close()
+
+	for range 3 {
+		gw.Emit(gateway.Event{Type: gateway.EventErrorReported, ChargerID: "CP1"})
+	}
+	// 熔断打开后每个冷却期只放行一个试探
+	time.Sleep(100 * time.Millisecond)
+	if n := calls.Load(); n > 5 {
+		t.Errorf("expected one probe per cooldown while open, got %d requests", n)
+	}
+	healthy.Store(true)
+	waitFor(t, "held events delivered after a successful probe", func() bool { return delivered.Load() == 3 })
+	if dl := readDeadLetters(t, dead); len(dl) != 0 {
+		t.Errorf("unexpected dead letters %+v", dl)
+	}
+}
+
+func TestWebhookRetryDoesNotBlockQueue(t *testing.T) {
+	got := make(chan string, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		json.NewDecoder(r.Body).Decode(&msg)
+		if msg.ChargerID == "CP-DOWN" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		got <- msg.ChargerID
+	}))
+	defer srv.Close()
+
+	gw := gateway.NewGateway()
+	wh := NewWebhooks(gw, WebhookConfig{
+		Endpoints:      []WebhookEndpoint{{URL: srv.URL}},
+		InitialBackoff: time.Hour,
+	})
+	defer wh.Close()
+
+	// 第一个事件在退避中等待重试，后面的事件照常投递
+	gw.Emit(gateway.Event{Type: gateway.EventErrorReported, ChargerID: "CP-DOWN"})
+	gw.Emit(gateway.Event{Type: gateway.EventErrorReported, ChargerID: "CP1"})
+	select {
+	case id := <-got:
+		if id != "CP1" {
+			t.Fatalf("unexpected delivery for %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a retrying delivery blocked later events")
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b := &breaker{threshold: 1, cooldown: 10 * time.Millisecond}
+	b.record(false)
+	if b.allow() {
+		t.Fatal("breaker should be open")
+	}
+	time.Sleep(15 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("breaker should let one probe through after the cooldown")
+	}
+	if b.allow() {
+		t.Fatal("only one probe at a time")
+	}
+	b.record(false)
+	if b.allow() {
+		t.Fatal("a failed probe reopens the breaker")
+	}
+	time.Sleep(15 * time.Millisecond)
+	b.allow()
+	b.record(true)
+	if !b.allow() || !b.allow() {
+		t.Fatal("a successful probe closes the breaker")
+	}
+}
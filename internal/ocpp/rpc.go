@@ -0,0 +1,158 @@
+package ocpp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// OCPP-J 消息类型
+const (
+	MessageTypeCall       = 2 // [2, "id", "Action", {payload}]
+	MessageTypeCallResult = 3 // [3, "id", {payload}]
+	MessageTypeCallError  = 4 // [4, "id", "ErrorCode", "description", {details}]
+)
+
+// CALLERROR 错误码（OCPP-J 1.6）
+const (
+	ErrorNotImplemented               = "NotImplemented"
+	ErrorNotSupported                 = "NotSupported"
+	ErrorInternalError                = "InternalError"
+	ErrorProtocolError                = "ProtocolError"
+	ErrorSecurityError                = "SecurityError"
+	ErrorFormationViolation           = "FormationViolation"
+	ErrorPropertyConstraintViolation  = "PropertyConstraintViolation"
+	ErrorOccurenceConstraintViolation = "OccurenceConstraintViolation"
+	ErrorTypeConstraintViolation      = "TypeConstraintViolation"
+	ErrorGenericError                 = "GenericError"
+	maxMessageIDLen                   = 36
+)
+
+// OCPP-J 2.0.1 更正了拼写的错误码
+const (
+	ErrorFormatViolation               = "FormatViolation"
+	ErrorOccurrenceConstraintViolation = "OccurrenceConstraintViolation"
+	ErrorRPCFrameworkError             = "RpcFrameworkError"
+)
+
+var ErrMalformedMessage = errors.New("malformed ocpp message")
+
+// Message 是一条 OCPP-J RPC 消息
+type Message struct {
+	Type    int
+	ID      string
+	Action  string          // 仅 CALL
+	Payload json.RawMessage // CALL 和 CALLRESULT
+
+	ErrorCode        string          // 仅 CALLERROR
+	ErrorDescription string          // 仅 CALLERROR
+	ErrorDetails     json.RawMessage // 仅 CALLERROR
+}
+
+// Error 描述一次需要以 CALLERROR 应答的失败
+type Error struct {
+	Code        string
+	Description string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+// NewError 创建一个 CALLERROR 错误
+func NewError(code, format string, args ...any) *Error {
+	return &Error{Code: code, Description: fmt.Sprintf(format, args...)}
+}
+
+// ParseMessage 解析一条 OCPP-J 消息
+func ParseMessage(data []byte) (*Message, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	if len(raw) < 3 {
+		return nil, fmt.Errorf("%w: too few elements", ErrMalformedMessage)
+	}
+
+	m := &Message{}
+	if err := json.Unmarshal(raw[0], &m.Type); err != nil {
+		return nil, fmt.Errorf("%w: bad message type", ErrMalformedMessage)
+	}
+	if err := json.Unmarshal(raw[1], &m.ID); err != nil || m.ID == "" || len(m.ID) > maxMessageIDLen {
+		return nil, fmt.Errorf("%w: bad message id", ErrMalformedMessage)
+	}
+
+	switch m.Type {
+	case MessageTypeCall:
+		if len(raw) != 4 {
+			return m, fmt.Errorf("%w: call needs 4 elements", ErrMalformedMessage)
+		}
+		if err := json.Unmarshal(raw[2], &m.Action); err != nil || m.Action == "" {
+			return m, fmt.Errorf("%w: bad action", ErrMalformedMessage)
+		}
+		m.Payload = raw[3]
+	case MessageTypeCallResult:
+		if len(raw) != 3 {
+			return m, fmt.Errorf("%w: call result needs 3 elements", ErrMalformedMessage)
+		}
+		m.Payload = raw[2]
+	case MessageTypeCallError:
+		if len(raw) != 5 {
+			return m, fmt.Errorf("%w: call error needs 5 elements", ErrMalformedMessage)
+		}
+		if err := json.Unmarshal(raw[2], &m.ErrorCode); err != nil {
+			return m, fmt.Errorf("%w: bad error code", ErrMalformedMessage)
+		}
+		if err := json.Unmarshal(raw[3], &m.ErrorDescription); err != nil {
+			return m, fmt.Errorf("%w: bad error description", ErrMalformedMessage)
+		}
+		m.ErrorDetails = raw[4]
+	default:
+		return m, fmt.Errorf("%w: unknown message type %d", ErrMalformedMessage, m.Type)
+	}
+	return m, nil
+}
+
+// MarshalJSON 按消息类型编码成 OCPP-J 数组
+func (m *Message) MarshalJSON() ([]byte, error) {
+	payload := m.Payload
+	if len(payload) == 0 {
+		payload = json.RawMessage("{}")
+	}
+	switch m.Type {
+	case MessageTypeCall:
+		return json.Marshal([]any{m.Type, m.ID, m.Action, payload})
+	case MessageTypeCallResult:
+		return json.Marshal([]any{m.Type, m.ID, payload})
+	case MessageTypeCallError:
+		details := m.ErrorDetails
+		if len(details) == 0 {
+			details = json.RawMessage("{}")
+		}
+		return json.Marshal([]any{m.Type, m.ID, m.ErrorCode, m.ErrorDescription, details})
+	}
+	return nil, fmt.Errorf("unknown message type %d", m.Type)
+}
+
+// NewCall 创建 CALL 消息
+func NewCall(id, action string, payload any) (*Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Type: MessageTypeCall, ID: id, Action: action, Payload: data}, nil
+}
+
+// NewCallResult 创建 CALLRESULT 消息
+func NewCallResult(id string, payload any) (*Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Type: MessageTypeCallResult, ID: id, Payload: data}, nil
+}
+
+// NewCallError 创建 CALLERROR 消息
+func NewCallError(id string, e *Error) *Message {
+	return &Message{Type: MessageTypeCallError, ID: id, ErrorCode: e.Code, ErrorDescription: e.Description}
+}
@@ -0,0 +1,199 @@
+package ocpp
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// 校验失败的类别，对应 OCPP 2.0.1 的 CALLERROR 错误码
+const (
+	violationFormat     = "format"     // 不是合法的 JSON
+	violationType       = "type"       // 字段类型不符
+	violationOccurrence = "occurrence" // 缺少必填字段或出现未定义的字段
+	violationProperty   = "property"   // 取值不符合约束（枚举、长度、范围）
+)
+
+//go:embed schemas
+var schemaFS embed.FS
+
+// Schema 是 OCPP 官方 JSON Schema (draft-06) 中用到的子集
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Definitions          map[string]*Schema `json:"definitions,omitempty"`
+}
+
+// ValidationError 描述负载不符合 Schema 的位置和原因
+type ValidationError struct {
+	Kind string
+	Path string
+	Msg  string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Msg
+	}
+	return e.Path + ": " + e.Msg
+}
+
+// loadSchemas 加载 schemas/<dir> 下的所有 Schema，键为去掉扩展名的文件名
+func loadSchemas(dir string) (map[string]*Schema, error) {
+	entries, err := schemaFS.ReadDir(path.Join("schemas", dir))
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]*Schema, len(entries))
+	for _, e := range entries {
+		data, err := schemaFS.ReadFile(path.Join("schemas", dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var s Schema
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("schema %s: %w", e.Name(), err)
+		}
+		out[strings.TrimSuffix(e.Name(), ".json")] = &s
+	}
+	return out, nil
+}
+
+// Validate 校验 JSON 负载
+func (s *Schema) Validate(payload []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return &ValidationError{Kind: violationFormat, Msg: err.Error()}
+	}
+	return s.validate(s, v, "")
+}
+
+func (s *Schema) validate(root *Schema, v any, at string) error {
+	if s.Ref != "" {
+		name, ok := strings.CutPrefix(s.Ref, "#/definitions/")
+		def := root.Definitions[name]
+		if !ok || def == nil {
+			return fmt.Errorf("unresolved schema ref %s", s.Ref)
+		}
+		return def.validate(root, v, at)
+	}
+
+	fail := func(kind, format string, args ...any) error {
+		return &ValidationError{Kind: kind, Path: at, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fail(violationType, "expected object")
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return fail(violationOccurrence, "missing required property %s", name)
+			}
+		}
+		for name, value := range obj {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fail(violationOccurrence, "unexpected property %s", name)
+				}
+				continue
+			}
+			if err := prop.validate(root, value, join(at, name)); err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return fail(violationType, "expected array")
+		}
+		if s.MinItems != nil && len(arr) < *s.MinItems {
+			return fail(violationOccurrence, "expected at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(arr) > *s.MaxItems {
+			return fail(violationOccurrence, "expected at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range arr {
+				if err := s.Items.validate(root, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fail(violationType, "expected string")
+		}
+		if s.MaxLength != nil && utf8.RuneCountInString(str) > *s.MaxLength {
+			return fail(violationProperty, "longer than %d characters", *s.MaxLength)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fail(violationProperty, "not a date-time")
+			}
+		}
+	case "integer", "number":
+		num, ok := v.(json.Number)
+		if !ok {
+			return fail(violationType, "expected %s", s.Type)
+		}
+		f, err := num.Float64()
+		if err != nil {
+			return fail(violationType, "bad number %s", num)
+		}
+		if s.Type == "integer" && f != math.Trunc(f) {
+			return fail(violationType, "expected integer")
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return fail(violationProperty, "less than minimum %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fail(violationProperty, "greater than maximum %v", *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fail(violationType, "expected boolean")
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				return nil
+			}
+		}
+		return fail(violationProperty, "value %v not in enum", v)
+	}
+	return nil
+}
+
+func join(at, name string) string {
+	if at == "" {
+		return name
+	}
+	return at + "." + name
+}
@@ -0,0 +1,568 @@
+package ocpp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/internal/credential"
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/handlers"
+	"github.com/x14n/evgateway/internal/protocol"
+	"github.com/x14n/evgateway/internal/timewheel"
+	"github.com/x14n/evgateway/internal/ws"
+)
+
+const (
+	SubprotocolOCPP16  = "ocpp1.6"
+	SubprotocolOCPP201 = "ocpp2.0.1"
+
+	DefaultHeartbeatInterval = 60 * time.Second
+	DefaultCallTimeout       = 30 * time.Second
+)
+
+// OCPP 安全配置（OCPP 2.0.1 Part 2 A00，1.6 安全白皮书相同）
+const (
+	SecurityProfileNone       = 0 // 不认证，仅用于测试环境
+	SecurityProfileBasicAuth  = 1 // HTTP 基本认证
+	SecurityProfileTLSBasic   = 2 // TLS + HTTP 基本认证
+	SecurityProfileClientCert = 3 // TLS 客户端证书
+)
+
+var (
+	ErrNoMapping      = errors.New("no ocpp mapping for command")
+	ErrNotConnected   = errors.New("charger not connected over ocpp")
+	ErrNotSupported   = gateway.ErrNotSupported // 充电桩的 OCPP 版本不支持该命令
+	ErrConnClosed     = errors.New("ocpp connection closed")
+	ErrUnauthorized   = errors.New("ocpp authentication failed")
+	errNoSchemaForMsg = errors.New("no schema for message")
+)
+
+// actionHandler 处理一个 CALL，返回 CALLRESULT 的负载；返回 *Error 时应答 CALLERROR
+type actionHandler func(c *conn, payload json.RawMessage) (any, error)
+
+// versionProfile 描述一个 OCPP 版本：支持的动作、消息 Schema 和错误码拼写
+type versionProfile struct {
+	actions map[string]actionHandler
+	schemas map[string]*Schema // 为 nil 时不做 Schema 校验
+
+	formatViolation     string
+	occurrenceViolation string
+}
+
+var profiles = map[string]*versionProfile{
+	SubprotocolOCPP16: {
+		actions:             v16Actions,
+		formatViolation:     ErrorFormationViolation,
+		occurrenceViolation: ErrorOccurenceConstraintViolation,
+	},
+	SubprotocolOCPP201: {
+		actions:             v201Actions,
+		schemas:             mustLoadSchemas("v201"),
+		formatViolation:     ErrorFormatViolation,
+		occurrenceViolation: ErrorOccurrenceConstraintViolation,
+	},
+}
+
+func mustLoadSchemas(dir string) map[string]*Schema {
+	s, err := loadSchemas(dir)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Server 是 OCPP-J WebSocket 前端，把 OCPP 消息映射到与二进制协议相同的会话和处理器上。
+// 充电桩通过 ws://host/ocpp/{chargePointId} 接入，Sec-WebSocket-Protocol 决定 OCPP 版本。
+type Server struct {
+	Gateway           *gateway.Gateway
+	Dispatcher        *gateway.Dispatcher
+	HeartbeatInterval time.Duration    // BootNotification 应答中下发的心跳间隔
+	CallTimeout       time.Duration    // 网关发起的 CALL 等待应答的时间
+	Timers            *timewheel.Wheel // CALL 超时使用的时间轮
+
+	SecurityProfile int
+	Passwords       credential.PasswordStore // 安全配置 1、2 使用
+	TLSConfig       *tls.Config              // 安全配置 2、3 使用，配置 3 需要校验客户端证书
+
+	sub *gateway.Subscription
+
+	mu    sync.RWMutex
+	conns map[string]*conn
+	txIDs map[string]int              // 2.0.1 充电桩生成的交易 ID（充电桩 ID/交易 ID）到网关交易 ID 的映射
+	txKey map[int]string              // txIDs 的反向索引
+	rpts  map[string][]ReportDataType // 2.0.1 NotifyReport 上报的变量
+}
+
+func NewServer(gw *gateway.Gateway, dispatcher *gateway.Dispatcher) *Server {
+	s := &Server{
+		Gateway:           gw,
+		Dispatcher:        dispatcher,
+		HeartbeatInterval: DefaultHeartbeatInterval,
+		CallTimeout:       DefaultCallTimeout,
+		Timers:            timewheel.Default(),
+		conns:             make(map[string]*conn),
+		txIDs:             make(map[string]int),
+		txKey:             make(map[int]string),
+		rpts:              make(map[string][]ReportDataType),
+	}
+	// 交易无论以何种方式结束都删除映射
+	s.sub = gw.Subscribe(func(e gateway.Event) {
+		if tx, ok := e.Data.(handlers.TransactionEvent); ok {
+			s.unbindTx(tx.TransactionID)
+		}
+	}, gateway.Types(gateway.EventTransactionStopped))
+	return s
+}
+
+// Close 取消服务器的事件订阅，服务器不再使用时调用
+func (s *Server) Close() {
+	s.sub.Close()
+}
+
+// ListenAndServe 在 addr 上监听 OCPP WebSocket 连接，配置了 TLSConfig 时使用 wss
+func (s *Server) ListenAndServe(addr string) error {
+	fmt.Println("OCPP server listen at :", addr)
+	if s.TLSConfig != nil {
+		hs := &http.Server{Addr: addr, Handler: s, TLSConfig: s.TLSConfig}
+		return hs.ListenAndServeTLS("", "")
+	}
+	return http.ListenAndServe(addr, s)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := path.Base(r.URL.Path)
+	if id == "" || id == "/" || id == "." {
+		http.Error(w, "missing charge point id", http.StatusNotFound)
+		return
+	}
+	if err := s.authenticate(r, id); err != nil {
+		fmt.Printf("[ocpp] reject %s from %s: %v\n", id, r.RemoteAddr, err)
+		w.Header().Set("WWW-Authenticate", `Basic realm="ocpp"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// 按客户端给出的顺序选择第一个支持的版本
+	wsConn, err := ws.Upgrade(w, r, []string{SubprotocolOCPP201, SubprotocolOCPP16})
+	if err != nil {
+		fmt.Printf("[ocpp] upgrade %s from %s failed: %v\n", id, r.RemoteAddr, err)
+		return
+	}
+
+	c := &conn{
+		srv:     s,
+		ws:      wsConn,
+		version: wsConn.Subprotocol(),
+		profile: profiles[wsConn.Subprotocol()],
+		pending: make(map[string]chan *Message),
+		done:    make(chan struct{}),
+	}
+	connected := time.Now()
+	c.session = &gateway.Session{
+		ID:          id,
+		Addr:        wsConn.RemoteAddr().String(),
+		Transport:   c,
+		ConnectedAt: connected,
+		Lastseen:    connected,
+	}
+	wsConn.OnPong = func([]byte) { c.session.UpdateLastSeen() }
+
+	s.mu.Lock()
+	if old, ok := s.conns[id]; ok {
+		// 同一充电桩重连时关闭旧连接
+		old.ws.Close()
+	}
+	s.conns[id] = c
+	s.mu.Unlock()
+
+	s.Gateway.AddSession(c.session)
+	fmt.Printf("[ocpp] %s connected from %s (%s)\n", id, c.session.Addr, c.version)
+	s.Gateway.Emit(gateway.Event{Type: gateway.EventSessionConnected, ChargerID: id, Data: gateway.SessionConnectedEvent{Addr: c.session.Addr}})
+
+	c.serve()
+}
+
+// authenticate 按安全配置校验充电桩身份
+func (s *Server) authenticate(r *http.Request, id string) error {
+	switch s.SecurityProfile {
+	case SecurityProfileNone:
+		return nil
+	case SecurityProfileBasicAuth, SecurityProfileTLSBasic:
+		if s.SecurityProfile == SecurityProfileTLSBasic && r.TLS == nil {
+			return fmt.Errorf("%w: profile 2 requires tls", ErrUnauthorized)
+		}
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != id {
+			return fmt.Errorf("%w: basic auth user must be the charge point id", ErrUnauthorized)
+		}
+		if s.Passwords == nil || !s.Passwords.CheckPassword(id, pass) {
+			return fmt.Errorf("%w: bad password", ErrUnauthorized)
+		}
+		return nil
+	case SecurityProfileClientCert:
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return fmt.Errorf("%w: profile 3 requires a verified client certificate", ErrUnauthorized)
+		}
+		if cn := r.TLS.VerifiedChains[0][0].Subject.CommonName; cn != id {
+			return fmt.Errorf("%w: certificate issued to %s", ErrUnauthorized, cn)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unknown security profile %d", ErrUnauthorized, s.SecurityProfile)
+}
+
+// Call 向充电桩发起 CALL 并等待应答，resp 为 nil 时丢弃应答负载
+func (s *Server) Call(ctx context.Context, chargerID, action string, req, resp any) error {
+	s.mu.RLock()
+	c, ok := s.conns[chargerID]
+	s.mu.RUnlock()
+	if !ok {
+		return ErrNotConnected
+	}
+	return c.call(ctx, action, req, resp)
+}
+
+// Version 返回充电桩连接使用的 OCPP 子协议
+func (s *Server) Version(chargerID string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.conns[chargerID]
+	if !ok {
+		return "", false
+	}
+	return c.version, true
+}
+
+// removeConn 注销连接，连接已被同一充电桩的重连替换时返回 false
+func (s *Server) removeConn(c *conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[c.session.ID] != c {
+		return false
+	}
+	delete(s.conns, c.session.ID)
+	return true
+}
+
+// conn 是一条 OCPP 连接。OCPP 规定同一方向同时只有一个未应答的 CALL，
+// 因此充电桩发来的 CALL 在连接的 goroutine 中同步分发，处理器通过 Session.Send 发出的应答帧会被截获。
+type conn struct {
+	srv     *Server
+	ws      *ws.Conn
+	session *gateway.Session
+	version string
+	profile *versionProfile
+
+	mu        sync.Mutex
+	capturing bool
+	replyCmd  byte
+	reply     *protocol.Frame
+
+	callMu    sync.Mutex   // 网关发起的 CALL 串行执行
+	bootMu    sync.RWMutex // 处理 BootNotification 时持有写锁，注册事件触发的 CALL 等应答发出后再发
+	pending   map[string]chan *Message
+	lastID    int
+	requestID int // 2.0.1 RequestStartTransaction 的 remoteStartId、UpdateFirmware 的 requestId
+	done      chan struct{}
+}
+
+func (c *conn) serve() {
+	defer func() {
+		close(c.done)
+		c.ws.Close()
+		// 被重连取代的旧连接也要从网关删除，只是不再发出断开事件
+		c.srv.Gateway.RemoveSession(c.session)
+		if c.srv.removeConn(c) {
+			c.srv.Gateway.Emit(gateway.Event{Type: gateway.EventSessionClosed, ChargerID: c.session.ID, Data: gateway.SessionClosedEvent{Addr: c.session.Addr}})
+		}
+		fmt.Printf("[ocpp] %s disconnected\n", c.session.ID)
+	}()
+
+	for {
+		op, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.session.CountIn(len(data))
+		if op != ws.OpText {
+			fmt.Printf("[ocpp] %s sent non-text message, ignored\n", c.session.ID)
+			continue
+		}
+		c.session.UpdateLastSeen()
+
+		msg, err := ParseMessage(data)
+		if err != nil {
+			// 能识别出 CALL 的 ID 时按规范回 CALLERROR，否则只能丢弃
+			if msg != nil && msg.Type == MessageTypeCall {
+				c.send(NewCallError(msg.ID, NewError(c.profile.formatViolation, "%v", err)))
+			}
+			fmt.Printf("[ocpp] %s bad message: %v\n", c.session.ID, err)
+			continue
+		}
+
+		switch msg.Type {
+		case MessageTypeCall:
+			c.handleCall(msg)
+		default:
+			c.resolve(msg)
+		}
+	}
+}
+
+func (c *conn) handleCall(msg *Message) {
+	if msg.Action == "BootNotification" {
+		c.bootMu.Lock()
+		defer c.bootMu.Unlock()
+	}
+	handler, ok := c.profile.actions[msg.Action]
+	if !ok {
+		c.send(NewCallError(msg.ID, NewError(ErrorNotImplemented, "action %s not implemented", msg.Action)))
+		return
+	}
+	if err := c.validate(msg.Action+"Request", msg.Payload); err != nil {
+		c.send(NewCallError(msg.ID, c.validationError(err)))
+		return
+	}
+
+	result, err := handler(c, msg.Payload)
+	if err != nil {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = NewError(ErrorInternalError, "%v", err)
+		}
+		fmt.Printf("[ocpp] %s %s failed: %v\n", c.session.ID, msg.Action, err)
+		c.send(NewCallError(msg.ID, rpcErr))
+		return
+	}
+
+	resp, err := NewCallResult(msg.ID, result)
+	if err != nil {
+		c.send(NewCallError(msg.ID, NewError(ErrorInternalError, "%v", err)))
+		return
+	}
+	c.send(resp)
+}
+
+// call 向充电桩发起 CALL，请求和应答都按版本的 Schema 校验
+func (c *conn) call(ctx context.Context, action string, req, resp any) error {
+	// 充电桩收到 BootNotification 应答前不能收到网关的 CALL
+	c.bootMu.RLock()
+	c.bootMu.RUnlock()
+	c.callMu.Lock()
+	defer c.callMu.Unlock()
+
+	c.mu.Lock()
+	c.lastID++
+	id := "gw-" + strconv.Itoa(c.lastID)
+	ch := make(chan *Message, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	msg, err := NewCall(id, action, req)
+	if err != nil {
+		return err
+	}
+	if err := c.validate(action+"Request", msg.Payload); err != nil && !errors.Is(err, errNoSchemaForMsg) {
+		return fmt.Errorf("invalid %s request: %w", action, err)
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := c.ws.WriteMessage(ws.OpText, data); err != nil {
+		return err
+	}
+
+	timeout := make(chan struct{})
+	timer := c.srv.Timers.AfterFunc(c.srv.CallTimeout, func() { close(timeout) })
+	defer timer.Stop()
+	select {
+	case m := <-ch:
+		if m.Type == MessageTypeCallError {
+			return &Error{Code: m.ErrorCode, Description: m.ErrorDescription}
+		}
+		if err := c.validate(action+"Response", m.Payload); err != nil && !errors.Is(err, errNoSchemaForMsg) {
+			return fmt.Errorf("invalid %s response: %w", action, err)
+		}
+		if resp == nil {
+			return nil
+		}
+		return json.Unmarshal(m.Payload, resp)
+	case <-timeout:
+		return fmt.Errorf("%s to %s: %w", action, c.session.ID, context.DeadlineExceeded)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return ErrConnClosed
+	}
+}
+
+// resolve 把 CALLRESULT/CALLERROR 交给等待中的 call
+func (c *conn) resolve(msg *Message) {
+	c.mu.Lock()
+	ch, ok := c.pending[msg.ID]
+	c.mu.Unlock()
+	if !ok {
+		fmt.Printf("[ocpp] %s unexpected response %s\n", c.session.ID, msg.ID)
+		return
+	}
+	select {
+	case ch <- msg:
+	default: // 重复的应答
+	}
+}
+
+// validate 按 Schema 校验负载；1.6 没有 Schema，总是通过
+func (c *conn) validate(name string, payload json.RawMessage) error {
+	if c.profile.schemas == nil {
+		return nil
+	}
+	schema, ok := c.profile.schemas[name]
+	if !ok {
+		return errNoSchemaForMsg
+	}
+	return schema.Validate(payload)
+}
+
+func (c *conn) validationError(err error) *Error {
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		return NewError(ErrorNotImplemented, "%v", err)
+	}
+	switch verr.Kind {
+	case violationFormat:
+		return NewError(c.profile.formatViolation, "%v", err)
+	case violationType:
+		return NewError(ErrorTypeConstraintViolation, "%v", err)
+	case violationOccurrence:
+		return NewError(c.profile.occurrenceViolation, "%v", err)
+	}
+	return NewError(ErrorPropertyConstraintViolation, "%v", err)
+}
+
+func (c *conn) send(msg *Message) {
+	data, err := json.Marshal(msg)
+	if err == nil {
+		err = c.ws.WriteMessage(ws.OpText, data)
+	}
+	if err != nil {
+		fmt.Printf("[ocpp] %s send failed: %v\n", c.session.ID, err)
+	}
+}
+
+// dispatch 把 OCPP 请求转成二进制协议的帧交给处理器，返回处理器发出的应答帧（可能为 nil）
+func (c *conn) dispatch(cmd byte, payload any) (*protocol.Frame, error) {
+	var data []byte
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	c.capturing, c.replyCmd, c.reply = true, cmd, nil
+	c.mu.Unlock()
+
+	err := c.srv.Dispatcher.Handle(c.srv.Gateway, c.session, *protocol.NewFrame(protocol.ProtocolV1, cmd, data))
+
+	c.mu.Lock()
+	reply := c.reply
+	c.capturing, c.reply = false, nil
+	c.mu.Unlock()
+	return reply, err
+}
+
+// authorize 经 CmdAuthorize 查询 ID 标签，与二进制协议的充电桩使用同一个处理器
+func (c *conn) authorize(idTag string) (gateway.IDTagInfo, error) {
+	reply, err := c.dispatch(protocol.CmdAuthorize, handlers.AuthorizeRequest{IDTag: idTag})
+	if err != nil {
+		return gateway.IDTagInfo{}, err
+	}
+	var resp handlers.AuthorizeResponse
+	if reply == nil || json.Unmarshal(reply.Payload, &resp) != nil {
+		return gateway.IDTagInfo{}, NewError(ErrorInternalError, "no authorization result")
+	}
+	return resp.IDTagInfo, nil
+}
+
+// WriteFrame 实现 transport.Transport，截获当前 CALL 的应答帧
+func (c *conn) WriteFrame(f *protocol.Frame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capturing && f.Cmd == c.replyCmd && c.reply == nil {
+		reply := *f
+		c.reply = &reply
+		return nil
+	}
+	// 网关的存活探测用 WebSocket ping 代替，pong 会刷新会话
+	if f.Cmd == protocol.CmdPing {
+		return c.ws.Ping(nil)
+	}
+	return fmt.Errorf("%w: %d", ErrNoMapping, f.Cmd)
+}
+
+// Call 实现 gateway.Caller，网关的请求直接作为 OCPP CALL 发出，CALLERROR 转换为 gateway.CallError
+func (c *conn) Call(ctx context.Context, action string, req, resp any) error {
+	if action == gateway.ActionFirmwareChunk {
+		// OCPP 充电桩只能按 UpdateFirmware 给出的地址自行下载
+		return fmt.Errorf("%w: %s", ErrNotSupported, action)
+	}
+	if r, ok := req.(gateway.GetDiagnosticsRequest); ok && r.Location == "" {
+		// OCPP 充电桩不能经 WebSocket 上传文件，必须给出上传地址
+		return fmt.Errorf("%w: %s without location", ErrNotSupported, action)
+	}
+	if c.version == SubprotocolOCPP201 {
+		if action == gateway.ActionGetLocalListVersion {
+			return c.v201GetLocalListVersion(ctx, resp)
+		}
+		var err error
+		if action, req, err = c.v201Request(action, req); err != nil {
+			return err
+		}
+	}
+	return callError(c.call(ctx, action, req, resp))
+}
+
+// callError 把充电桩的 CALLERROR 转换为 gateway.CallError
+func callError(err error) error {
+	var callErr *Error
+	if errors.As(err, &callErr) {
+		return &gateway.CallError{Code: callErr.Code, Description: callErr.Description}
+	}
+	return err
+}
+
+// ReadFrame 实现 transport.Transport。OCPP 连接由 serve 读取 JSON 消息，不提供帧。
+func (c *conn) ReadFrame() (protocol.Frame, error) {
+	return protocol.Frame{}, ErrNoMapping
+}
+
+func (c *conn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *conn) RemoteAddr() string {
+	return c.ws.RemoteAddr().String()
+}
+
+// decode 解析 CALL 负载，失败时返回该版本的格式错误
+func (c *conn) decode(payload json.RawMessage, v any) error {
+	if err := json.Unmarshal(payload, v); err != nil {
+		return NewError(c.profile.formatViolation, "%v", err)
+	}
+	return nil
+}
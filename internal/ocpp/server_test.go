@@ -0,0 +1,301 @@
+package ocpp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/handlers"
+	"github.com/x14n/evgateway/internal/ws"
+)
+
+// testClient 是一个模拟 OCPP 充电桩
+type testClient struct {
+	t      *testing.T
+	conn   *ws.Conn
+	nextID int
+}
+
+func startServer(t *testing.T) (*gateway.Gateway, *httptest.Server) {
+	t.Helper()
+	gw := gateway.NewGateway()
+	d := gateway.NewDispatcher()
+	handlers.RegisterAllHandlers(d)
+
+	s := NewServer(gw, d)
+	t.Cleanup(s.Close)
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return gw, srv
+}
+
+func dial(t *testing.T, srv *httptest.Server, id string, protocols ...string) *testClient {
+	t.Helper()
+	conn, err := ws.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ocpp/"+id, protocols)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn}
+}
+
+// call 发送 CALL 并等待对应的应答
+func (c *testClient) call(action string, payload any) *Message {
+	c.t.Helper()
+	c.nextID++
+	id := strconv.Itoa(c.nextID)
+	msg, err := NewCall(id, action, payload)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.sendRaw(msg)
+
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		c.t.Fatalf("%s: read response: %v", action, err)
+	}
+	resp, err := ParseMessage(data)
+	if err != nil {
+		c.t.Fatalf("%s: bad response %s: %v", action, data, err)
+	}
+	if resp.ID != id {
+		c.t.Fatalf("%s: expected response id %s, got %s", action, id, resp.ID)
+	}
+	return resp
+}
+
+func (c *testClient) sendRaw(v any) {
+	c.t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.conn.WriteMessage(ws.OpText, data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func expectResult(t *testing.T, msg *Message, v any) {
+	t.Helper()
+	if msg.Type != MessageTypeCallResult {
+		t.Fatalf("expected CALLRESULT, got %d %s %s", msg.Type, msg.ErrorCode, msg.ErrorDescription)
+	}
+	if v != nil {
+		if err := json.Unmarshal(msg.Payload, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOCPP16_ChargingSession(t *testing.T) {
+	gw, srv := startServer(t)
+	c := dial(t, srv, "CP-16", SubprotocolOCPP16)
+
+	var boot v16BootNotificationConf
+	expectResult(t, c.call("BootNotification", v16BootNotificationReq{ChargePointVendor: "ACME", ChargePointModel: "AC22"}), &boot)
+	if boot.Status != "Accepted" || boot.Interval != int(DefaultHeartbeatInterval/time.Second) {
+		t.Errorf("unexpected boot conf: %+v", boot)
+	}
+	if _, ok := gw.GetSession("CP-16"); !ok {
+		t.Fatal("ocpp charger not registered in gateway")
+	}
+
+	var hb v16HeartbeatConf
+	expectResult(t, c.call("Heartbeat", struct{}{}), &hb)
+	if _, err := time.Parse(time.RFC3339, hb.CurrentTime); err != nil {
+		t.Errorf("bad heartbeat time %q", hb.CurrentTime)
+	}
+
+	expectResult(t, c.call("StatusNotification", v16StatusNotificationReq{ConnectorID: 1, ErrorCode: "NoError", Status: "Preparing"}), nil)
+
+	var start v16StartTransactionConf
+	expectResult(t, c.call("StartTransaction", v16StartTransactionReq{ConnectorID: 1, IDTag: "TAG1", MeterStart: 1000, Timestamp: now()}), &start)
+	if start.TransactionID == 0 || start.IDTagInfo.Status != "Accepted" {
+		t.Fatalf("unexpected start conf: %+v", start)
+	}
+
+	expectResult(t, c.call("MeterValues", map[string]any{
+		"connectorId":   1,
+		"transactionId": start.TransactionID,
+		"meterValue": []any{map[string]any{
+			"timestamp":    now(),
+			"sampledValue": []any{map[string]any{"value": "7200", "measurand": "Power.Active.Import", "unit": "W"}},
+		}},
+	}), nil)
+
+	expectResult(t, c.call("StopTransaction", v16StopTransactionReq{TransactionID: start.TransactionID, MeterStop: 5000, Timestamp: now()}), nil)
+	tx, ok := gw.GetTransaction(start.TransactionID)
+	if !ok || tx.Active() || tx.MeterStop-tx.MeterStart != 4000 {
+		t.Errorf("unexpected transaction state: %+v", tx)
+	}
+}
+
+func TestOCPP16_Errors(t *testing.T) {
+	_, srv := startServer(t)
+	c := dial(t, srv, "CP-ERR", SubprotocolOCPP16)
+
+	tests := []struct {
+		action  string
+		payload any
+		code    string
+	}{
+		{"DataTransfer", struct{}{}, ErrorNotImplemented},
+		{"BootNotification", []int{1}, ErrorFormationViolation},
+		{"BootNotification", struct{}{}, ErrorOccurenceConstraintViolation},
+		{"StopTransaction", v16StopTransactionReq{TransactionID: 999}, ErrorPropertyConstraintViolation},
+	}
+	for _, tt := range tests {
+		resp := c.call(tt.action, tt.payload)
+		if resp.Type != MessageTypeCallError || resp.ErrorCode != tt.code {
+			t.Errorf("%s: expected CALLERROR %s, got %d %s", tt.action, tt.code, resp.Type, resp.ErrorCode)
+		}
+	}
+}
+
+func TestOCPP_CallAfterBootResponse(t *testing.T) {
+	gw, srv := startServer(t)
+	done := make(chan error, 1)
+	sub := gw.Subscribe(func(e gateway.Event) {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			s, _ := gw.GetSession(e.ChargerID)
+			var resp map[string]any
+			done <- gw.Call(ctx, s, "GetConfiguration", map[string]any{}, &resp)
+		}()
+		// 给订阅者的 CALL 留出抢在 BootNotification 应答之前发出的时间
+		time.Sleep(50 * time.Millisecond)
+	}, gateway.Types(gateway.EventSessionRegistered))
+	defer sub.Close()
+
+	c := dial(t, srv, "CP-BOOT", SubprotocolOCPP16)
+	expectResult(t, c.call("BootNotification", v16BootNotificationReq{ChargePointVendor: "ACME", ChargePointModel: "AC22"}), nil)
+
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ParseMessage(data)
+	if err != nil || msg.Type != MessageTypeCall || msg.Action != "GetConfiguration" {
+		t.Fatalf("expected GetConfiguration call, got %s %v", data, err)
+	}
+	resp, _ := NewCallResult(msg.ID, map[string]any{"configurationKey": []any{}})
+	c.sendRaw(resp)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOCPP_ReconnectThenClose(t *testing.T) {
+	gw, srv := startServer(t)
+	closed := make(chan gateway.Event, 4)
+	sub := gw.Subscribe(func(e gateway.Event) { closed <- e }, gateway.Types(gateway.EventSessionClosed))
+	defer sub.Close()
+
+	old := dial(t, srv, "CP-L", SubprotocolOCPP16)
+	expectResult(t, old.call("BootNotification", v16BootNotificationReq{ChargePointVendor: "ACME", ChargePointModel: "AC22"}), nil)
+	c := dial(t, srv, "CP-L", SubprotocolOCPP16)
+	expectResult(t, c.call("BootNotification", v16BootNotificationReq{ChargePointVendor: "ACME", ChargePointModel: "AC22"}), nil)
+
+	// 被取代的旧连接和当前连接先后断开，网关中不应留下任何连接
+	old.conn.Close()
+	c.conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for gw.Count() != 0 || len(gw.ListConnections()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("connections left after close: count %d, %d listed", gw.Count(), len(gw.ListConnections()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no session_closed event for the current connection")
+	}
+	select {
+	case e := <-closed:
+		t.Errorf("replaced connection emitted %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestOCPP_RequiresSubprotocol(t *testing.T) {
+	_, srv := startServer(t)
+	if _, err := ws.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ocpp/CP-X", []string{"ocpp1.5"}); err == nil {
+		t.Fatal("expected handshake to fail without a supported subprotocol")
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+		typ     int
+	}{
+		{`[2,"1","Heartbeat",{}]`, false, MessageTypeCall},
+		{`[3,"1",{"currentTime":"x"}]`, false, MessageTypeCallResult},
+		{`[4,"1","NotImplemented","",{}]`, false, MessageTypeCallError},
+		{`[2,"1","Heartbeat"]`, true, MessageTypeCall},
+		{`[5,"1",{}]`, true, 5},
+		{`{"a":1}`, true, 0},
+		{`[2,"",  "Heartbeat",{}]`, true, 0},
+	}
+	for _, tt := range tests {
+		m, err := ParseMessage([]byte(tt.in))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error %v", tt.in, err)
+		}
+		if !tt.wantErr && m.Type != tt.typ {
+			t.Errorf("%s: expected type %d, got %d", tt.in, tt.typ, m.Type)
+		}
+	}
+}
+
+// tagList 是测试用的鉴权，不在表中的标签为 Invalid
+type tagList map[string]gateway.IDTagInfo
+
+func (l tagList) Authorize(chargerID, idTag string) gateway.IDTagInfo {
+	if info, ok := l[idTag]; ok {
+		return info
+	}
+	return gateway.IDTagInfo{Status: gateway.AuthInvalid}
+}
+
+func TestOCPP16_Authorize(t *testing.T) {
+	gw, srv := startServer(t)
+	gw.SetAuthorizer(tagList{
+		"CARD1": {Status: gateway.AuthAccepted, ParentIDTag: "FLEET"},
+		"CARD2": {Status: gateway.AuthBlocked},
+	})
+	c := dial(t, srv, "CP-16", SubprotocolOCPP16)
+	expectResult(t, c.call("BootNotification", v16BootNotificationReq{ChargePointVendor: "ACME", ChargePointModel: "AC22"}), nil)
+
+	var conf v16IDTagConf
+	expectResult(t, c.call("Authorize", v16AuthorizeReq{IDTag: "CARD1"}), &conf)
+	if conf.IDTagInfo == nil || conf.IDTagInfo.Status != gateway.AuthAccepted || conf.IDTagInfo.ParentIDTag != "FLEET" {
+		t.Fatalf("unexpected authorize conf %+v", conf.IDTagInfo)
+	}
+	expectResult(t, c.call("Authorize", v16AuthorizeReq{IDTag: "NOPE"}), &conf)
+	if conf.IDTagInfo.Status != gateway.AuthInvalid {
+		t.Errorf("expected Invalid for an unknown tag, got %+v", conf.IDTagInfo)
+	}
+
+	// 被禁用的标签仍然记录交易，由充电桩结束充电
+	var start v16StartTransactionConf
+	expectResult(t, c.call("StartTransaction", v16StartTransactionReq{ConnectorID: 1, IDTag: "CARD2", Timestamp: now()}), &start)
+	if start.TransactionID == 0 || start.IDTagInfo.Status != gateway.AuthBlocked {
+		t.Fatalf("unexpected start conf %+v", start)
+	}
+	conf = v16IDTagConf{}
+	expectResult(t, c.call("StopTransaction", v16StopTransactionReq{IDTag: "CARD1", TransactionID: start.TransactionID, Timestamp: now()}), &conf)
+	if conf.IDTagInfo == nil || conf.IDTagInfo.Status != gateway.AuthAccepted {
+		t.Errorf("expected idTagInfo in the stop conf, got %+v", conf.IDTagInfo)
+	}
+}
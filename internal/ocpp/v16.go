@@ -0,0 +1,278 @@
+package ocpp
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/handlers"
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+// OCPP 1.6J 中由充电桩发起的消息，映射到二进制协议的命令上
+var v16Actions = map[string]actionHandler{
+	"BootNotification":   v16BootNotification,
+	"Heartbeat":          v16Heartbeat,
+	"StatusNotification": v16StatusNotification,
+	"StartTransaction":   v16StartTransaction,
+	"StopTransaction":    v16StopTransaction,
+	"MeterValues":        v16MeterValues,
+	"Authorize":          v16Authorize,
+
+	"FirmwareStatusNotification": v16FirmwareStatusNotification,
+}
+
+type v16BootNotificationReq struct {
+	ChargePointVendor       string `json:"chargePointVendor"`
+	ChargePointModel        string `json:"chargePointModel"`
+	ChargePointSerialNumber string `json:"chargePointSerialNumber,omitempty"`
+	FirmwareVersion         string `json:"firmwareVersion,omitempty"`
+}
+
+type v16BootNotificationConf struct {
+	Status      string `json:"status"`
+	CurrentTime string `json:"currentTime"`
+	Interval    int    `json:"interval"`
+}
+
+type v16HeartbeatConf struct {
+	CurrentTime string `json:"currentTime"`
+}
+
+type v16StatusNotificationReq struct {
+	ConnectorID     int    `json:"connectorId"`
+	ErrorCode       string `json:"errorCode"`
+	Status          string `json:"status"`
+	Info            string `json:"info,omitempty"`
+	Timestamp       string `json:"timestamp,omitempty"`
+	VendorID        string `json:"vendorId,omitempty"`
+	VendorErrorCode string `json:"vendorErrorCode,omitempty"`
+}
+
+type v16StartTransactionReq struct {
+	ConnectorID   int    `json:"connectorId"`
+	IDTag         string `json:"idTag"`
+	MeterStart    int    `json:"meterStart"`
+	ReservationID int    `json:"reservationId,omitempty"`
+	Timestamp     string `json:"timestamp"`
+}
+
+type v16StartTransactionConf struct {
+	IDTagInfo     gateway.IDTagInfo `json:"idTagInfo"`
+	TransactionID int               `json:"transactionId"`
+}
+
+type v16AuthorizeReq struct {
+	IDTag string `json:"idTag"`
+}
+
+// v16IDTagConf 是 Authorize 和 StopTransaction 的应答，StopTransaction 没有 idTag 时不带 idTagInfo
+type v16IDTagConf struct {
+	IDTagInfo *gateway.IDTagInfo `json:"idTagInfo,omitempty"`
+}
+
+type v16StopTransactionReq struct {
+	IDTag         string `json:"idTag,omitempty"`
+	MeterStop     int    `json:"meterStop"`
+	Timestamp     string `json:"timestamp"`
+	TransactionID int    `json:"transactionId"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+type v16MeterValuesReq struct {
+	ConnectorID   int             `json:"connectorId"`
+	TransactionID int             `json:"transactionId,omitempty"`
+	MeterValue    []v16MeterValue `json:"meterValue"`
+}
+
+type v16MeterValue struct {
+	Timestamp    string            `json:"timestamp"`
+	SampledValue []v16SampledValue `json:"sampledValue"`
+}
+
+type v16SampledValue struct {
+	Value     string `json:"value"`
+	Measurand string `json:"measurand,omitempty"`
+	Unit      string `json:"unit,omitempty"`
+}
+
+func v16BootNotification(c *conn, payload json.RawMessage) (any, error) {
+	var req v16BootNotificationReq
+	if err := c.decode(payload, &req); err != nil {
+		return nil, err
+	}
+	if req.ChargePointVendor == "" || req.ChargePointModel == "" {
+		return nil, NewError(ErrorOccurenceConstraintViolation, "chargePointVendor and chargePointModel are required")
+	}
+
+	conf := v16BootNotificationConf{
+		Status:      "Accepted",
+		CurrentTime: now(),
+		Interval:    int(c.srv.HeartbeatInterval / time.Second),
+	}
+	reply, err := c.dispatch(protocol.CmdRegister, handlers.RegisterRequest{
+		ID:       c.session.ID,
+		Vendor:   req.ChargePointVendor,
+		Model:    req.ChargePointModel,
+		Firmware: req.FirmwareVersion,
+	})
+	if err != nil {
+		conf.Status = "Rejected"
+		return conf, nil
+	}
+	if reply != nil {
+		var resp handlers.RegisterResponse
+		if json.Unmarshal(reply.Payload, &resp) == nil && resp.Status != "accepted" {
+			conf.Status = "Rejected"
+		}
+	}
+	return conf, nil
+}
+
+func v16Heartbeat(c *conn, payload json.RawMessage) (any, error) {
+	if _, err := c.dispatch(protocol.CmdHeartbeat, nil); err != nil {
+		return nil, err
+	}
+	return v16HeartbeatConf{CurrentTime: now()}, nil
+}
+
+func v16StatusNotification(c *conn, payload json.RawMessage) (any, error) {
+	var req v16StatusNotificationReq
+	if err := c.decode(payload, &req); err != nil {
+		return nil, err
+	}
+	if req.Status == "" || req.ErrorCode == "" {
+		return nil, NewError(ErrorOccurenceConstraintViolation, "status and errorCode are required")
+	}
+
+	if _, err := c.dispatch(protocol.CmdStatus, req); err != nil {
+		return nil, err
+	}
+	// 故障状态同时作为错误上报
+	if req.ErrorCode != "NoError" {
+		if _, err := c.dispatch(protocol.CmdError, req); err != nil {
+			return nil, err
+		}
+	}
+	return struct{}{}, nil
+}
+
+func v16StartTransaction(c *conn, payload json.RawMessage) (any, error) {
+	var req v16StartTransactionReq
+	if err := c.decode(payload, &req); err != nil {
+		return nil, err
+	}
+	if req.IDTag == "" {
+		return nil, NewError(ErrorOccurenceConstraintViolation, "idTag is required")
+	}
+
+	reply, err := c.dispatch(protocol.CmdStartTransaction, handlers.StartTransactionRequest{
+		ConnectorID: req.ConnectorID,
+		IDTag:       req.IDTag,
+		MeterStart:  req.MeterStart,
+		Timestamp:   req.Timestamp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var resp handlers.StartTransactionResponse
+	if reply == nil || json.Unmarshal(reply.Payload, &resp) != nil {
+		return nil, NewError(ErrorInternalError, "no transaction id assigned")
+	}
+	return v16StartTransactionConf{
+		IDTagInfo:     resp.IDTagInfo,
+		TransactionID: resp.TransactionID,
+	}, nil
+}
+
+func v16StopTransaction(c *conn, payload json.RawMessage) (any, error) {
+	var req v16StopTransactionReq
+	if err := c.decode(payload, &req); err != nil {
+		return nil, err
+	}
+
+	_, err := c.dispatch(protocol.CmdStopTransaction, handlers.StopTransactionRequest{
+		TransactionID: req.TransactionID,
+		MeterStop:     req.MeterStop,
+		Timestamp:     req.Timestamp,
+		Reason:        req.Reason,
+	})
+	if err != nil {
+		return nil, NewError(ErrorPropertyConstraintViolation, "%v", err)
+	}
+	var conf v16IDTagConf
+	if req.IDTag != "" {
+		info, err := c.authorize(req.IDTag)
+		if err != nil {
+			return nil, err
+		}
+		conf.IDTagInfo = &info
+	}
+	return conf, nil
+}
+
+func v16Authorize(c *conn, payload json.RawMessage) (any, error) {
+	var req v16AuthorizeReq
+	if err := c.decode(payload, &req); err != nil {
+		return nil, err
+	}
+	if req.IDTag == "" {
+		return nil, NewError(ErrorOccurenceConstraintViolation, "idTag is required")
+	}
+	info, err := c.authorize(req.IDTag)
+	if err != nil {
+		return nil, err
+	}
+	return v16IDTagConf{IDTagInfo: &info}, nil
+}
+
+func v16MeterValues(c *conn, payload json.RawMessage) (any, error) {
+	var req v16MeterValuesReq
+	if err := c.decode(payload, &req); err != nil {
+		return nil, err
+	}
+
+	out := handlers.MeterValuesRequest{ConnectorID: req.ConnectorID, TransactionID: req.TransactionID}
+	for _, mv := range req.MeterValue {
+		for _, sv := range mv.SampledValue {
+			value, err := strconv.ParseFloat(sv.Value, 64)
+			if err != nil {
+				return nil, NewError(ErrorTypeConstraintViolation, "sampled value %q is not a number", sv.Value)
+			}
+			measurand := sv.Measurand
+			if measurand == "" {
+				measurand = "Energy.Active.Import.Register" // OCPP 1.6 的缺省测量项
+			}
+			out.Samples = append(out.Samples, handlers.MeterValue{
+				Timestamp: mv.Timestamp,
+				Measurand: measurand,
+				Value:     value,
+				Unit:      sv.Unit,
+			})
+		}
+	}
+
+	if _, err := c.dispatch(protocol.CmdMeterValues, out); err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+func v16FirmwareStatusNotification(c *conn, payload json.RawMessage) (any, error) {
+	var req handlers.FirmwareStatusRequest
+	if err := c.decode(payload, &req); err != nil {
+		return nil, err
+	}
+	if req.Status == "" {
+		return nil, NewError(ErrorOccurenceConstraintViolation, "status is required")
+	}
+	if _, err := c.dispatch(protocol.CmdFirmwareStatus, req); err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,772 @@
+package ocpp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/handlers"
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+// OCPP 2.0.1 中由充电桩发起的消息。负载已按 schemas/v201 校验，处理器只做语义映射。
+var v201Actions = map[string]actionHandler{
+	"BootNotification":           v201BootNotification,
+	"Heartbeat":                  v201Heartbeat,
+	"StatusNotification":         v201StatusNotification,
+	"TransactionEvent":           v201TransactionEvent,
+	"NotifyReport":               v201NotifyReport,
+	"SecurityEventNotification":  v201SecurityEventNotification,
+	"FirmwareStatusNotification": v201FirmwareStatusNotification,
+	"Authorize":                  v201Authorize,
+}
+
+// ComponentType 标识设备模型中的组件
+type ComponentType struct {
+	Name     string    `json:"name"`
+	Instance string    `json:"instance,omitempty"`
+	EVSE     *EVSEType `json:"evse,omitempty"`
+}
+
+// VariableType 标识组件上的变量
+type VariableType struct {
+	Name     string `json:"name"`
+	Instance string `json:"instance,omitempty"`
+}
+
+type EVSEType struct {
+	ID          int `json:"id"`
+	ConnectorID int `json:"connectorId,omitempty"`
+}
+
+// SetVariableData 是 SetVariables 中的一项
+type SetVariableData struct {
+	AttributeType  string        `json:"attributeType,omitempty"`
+	AttributeValue string        `json:"attributeValue"`
+	Component      ComponentType `json:"component"`
+	Variable       VariableType  `json:"variable"`
+}
+
+// SetVariableResult 是充电桩对一项 SetVariableData 的结果，AttributeStatus 为 Accepted、Rejected 等
+type SetVariableResult struct {
+	AttributeType   string        `json:"attributeType,omitempty"`
+	AttributeStatus string        `json:"attributeStatus"`
+	Component       ComponentType `json:"component"`
+	Variable        VariableType  `json:"variable"`
+}
+
+// GetVariableData 是 GetVariables 中的一项
+type GetVariableData struct {
+	AttributeType string        `json:"attributeType,omitempty"`
+	Component     ComponentType `json:"component"`
+	Variable      VariableType  `json:"variable"`
+}
+
+// GetVariableResult 是充电桩对一项 GetVariableData 的结果
+type GetVariableResult struct {
+	AttributeStatus string        `json:"attributeStatus"`
+	AttributeType   string        `json:"attributeType,omitempty"`
+	AttributeValue  string        `json:"attributeValue,omitempty"`
+	Component       ComponentType `json:"component"`
+	Variable        VariableType  `json:"variable"`
+}
+
+// ReportDataType 是 NotifyReport 上报的一个变量
+type ReportDataType struct {
+	Component         ComponentType       `json:"component"`
+	Variable          VariableType        `json:"variable"`
+	VariableAttribute []VariableAttribute `json:"variableAttribute"`
+}
+
+type VariableAttribute struct {
+	Type       string `json:"type,omitempty"`
+	Value      string `json:"value,omitempty"`
+	Mutability string `json:"mutability,omitempty"`
+}
+
+type v201BootNotificationReq struct {
+	Reason          string `json:"reason"`
+	ChargingStation struct {
+		Model           string `json:"model"`
+		VendorName      string `json:"vendorName"`
+		SerialNumber    string `json:"serialNumber,omitempty"`
+		FirmwareVersion string `json:"firmwareVersion,omitempty"`
+	} `json:"chargingStation"`
+}
+
+type v201BootNotificationResp struct {
+	CurrentTime string `json:"currentTime"`
+	Interval    int    `json:"interval"`
+	Status      string `json:"status"`
+}
+
+type v201HeartbeatResp struct {
+	CurrentTime string `json:"currentTime"`
+}
+
+type v201StatusNotificationReq struct {
+	Timestamp       string `json:"timestamp"`
+	ConnectorStatus string `json:"connectorStatus"`
+	EVSEID          int    `json:"evseId"`
+	ConnectorID     int    `json:"connectorId"`
+}
+
+type v201TransactionEventReq struct {
+	EventType       string              `json:"eventType"`
+	Timestamp       string              `json:"timestamp"`
+	TriggerReason   string              `json:"triggerReason"`
+	SeqNo           int                 `json:"seqNo"`
+	MeterValue      []v201MeterValue    `json:"meterValue,omitempty"`
+	TransactionInfo v201TransactionInfo `json:"transactionInfo"`
+	EVSE            *EVSEType           `json:"evse,omitempty"`
+	IDToken         *v201IDToken        `json:"idToken,omitempty"`
+}
+
+type v201TransactionInfo struct {
+	TransactionID string `json:"transactionId"`
+	ChargingState string `json:"chargingState,omitempty"`
+	StoppedReason string `json:"stoppedReason,omitempty"`
+}
+
+type v201IDToken struct {
+	IDToken string `json:"idToken"`
+	Type    string `json:"type"`
+}
+
+type v201MeterValue struct {
+	Timestamp    string             `json:"timestamp"`
+	SampledValue []v201SampledValue `json:"sampledValue"`
+}
+
+type v201SampledValue struct {
+	Value         float64 `json:"value"`
+	Measurand     string  `json:"measurand,omitempty"`
+	UnitOfMeasure *struct {
+		Unit       string `json:"unit,omitempty"`
+		Multiplier int    `json:"multiplier,omitempty"`
+	} `json:"unitOfMeasure,omitempty"`
+}
+
+type v201IDTokenInfo struct {
+	Status              string       `json:"status"`
+	CacheExpiryDateTime string       `json:"cacheExpiryDateTime,omitempty"`
+	GroupIDToken        *v201IDToken `json:"groupIdToken,omitempty"`
+}
+
+type v201AuthorizeReq struct {
+	IDToken v201IDToken `json:"idToken"`
+}
+
+type v201AuthorizeResp struct {
+	IDTokenInfo v201IDTokenInfo `json:"idTokenInfo"`
+}
+
+type v201TransactionEventResp struct {
+	IDTokenInfo *v201IDTokenInfo `json:"idTokenInfo,omitempty"`
+}
+
+type v201NotifyReportReq struct {
+	RequestID  int              `json:"requestId"`
+	SeqNo      int              `json:"seqNo"`
+	Tbc        bool             `json:"tbc,omitempty"`
+	ReportData []ReportDataType `json:"reportData,omitempty"`
+}
+
+type v201SecurityEventNotificationReq struct {
+	Type      string `json:"type"`
+	Timestamp string `json:"timestamp"`
+	TechInfo  string `json:"techInfo,omitempty"`
+}
+
+func v201BootNotification(c *conn, payload json.RawMessage) (any, error) {
+	var req v201BootNotificationReq
+	if err := c.decode(payload, &req); err != nil {
+		return nil, err
+	}
+
+	resp := v201BootNotificationResp{
+		CurrentTime: now(),
+		Interval:    int(c.srv.HeartbeatInterval / time.Second),
+		Status:      "Accepted",
+	}
+	reply, err := c.dispatch(protocol.CmdRegister, handlers.RegisterRequest{
+		ID:       c.session.ID,
+		Vendor:   req.ChargingStation.VendorName,
+		Model:    req.ChargingStation.Model,
+		Firmware: req.ChargingStation.FirmwareVersion,
+	})
+	if err != nil {
+		resp.Status = "Rejected"
+		return resp, nil
+	}
+	if reply != nil {
+		var r handlers.RegisterResponse
+		if json.Unmarshal(reply.Payload, &r) == nil && r.Status != "accepted" {
+			resp.Status = "Rejected"
+		}
+	}
+	return resp, nil
+}
+
+func v201Heartbeat(c *conn, payload json.RawMessage) (any, error) {
+	if _, err := c.dispatch(protocol.CmdHeartbeat, nil); err != nil {
+		return nil, err
+	}
+	return v201HeartbeatResp{CurrentTime: now()}, nil
+}
+
+func v201StatusNotification(c *conn, payload json.RawMessage) (any, error) {
+	var req v201StatusNotificationReq
+	if err := c.decode(payload, &req); err != nil {
+		return nil, err
+	}
+	if _, err := c.dispatch(protocol.CmdStatus, req); err != nil {
+		return nil, err
+	}
+	// 2.0.1 没有 errorCode 字段，Faulted 即视为故障上报
+	if req.ConnectorStatus == "Faulted" {
+		if _, err := c.dispatch(protocol.CmdError, req); err != nil {
+			return nil, err
+		}
+	}
+	return struct{}{}, nil
+}
+
+// v201TransactionEvent 把 Started/Updated/Ended 映射到交易开始、计量和结束。
+// 充电桩生成的字符串交易 ID 在网关内换成整数 ID；
+// 未见过 Started 的交易（例如网关重启后）在第一次出现时隐式开始。
+func v201TransactionEvent(c *conn, payload json.RawMessage) (any, error) {
+	var req v201TransactionEventReq
+	if err := c.decode(payload, &req); err != nil {
+		return nil, err
+	}
+
+	key := c.session.ID + "/" + req.TransactionInfo.TransactionID
+	c.srv.mu.RLock()
+	txID, known := c.srv.txIDs[key]
+	c.srv.mu.RUnlock()
+
+	energy, hasEnergy := energyWh(req.MeterValue)
+	var resp v201TransactionEventResp
+	if req.IDToken != nil {
+		info := gateway.IDTagInfo{Status: gateway.AuthAccepted}
+		if req.IDToken.IDToken != "" {
+			var err error
+			if info, err = c.authorize(req.IDToken.IDToken); err != nil {
+				return nil, err
+			}
+		}
+		resp.IDTokenInfo = v201TokenInfo(info)
+	}
+
+	if !known {
+		id, err := c.startTransaction(&req, int(energy))
+		if err != nil {
+			return nil, err
+		}
+		txID = id
+		c.srv.bindTx(key, txID)
+	}
+
+	switch req.EventType {
+	case "Started":
+		return resp, nil
+	case "Updated":
+		if len(req.MeterValue) == 0 {
+			return resp, nil
+		}
+		mv := handlers.MeterValuesRequest{ConnectorID: evseID(req.EVSE), TransactionID: txID, Samples: samples(req.MeterValue)}
+		if _, err := c.dispatch(protocol.CmdMeterValues, mv); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	// Ended
+	stop := handlers.StopTransactionRequest{
+		TransactionID: txID,
+		Timestamp:     req.Timestamp,
+		Reason:        req.TransactionInfo.StoppedReason,
+	}
+	if hasEnergy {
+		stop.MeterStop = int(energy)
+	} else if tx, ok := c.srv.Gateway.GetTransaction(txID); ok {
+		stop.MeterStop = tx.MeterStart
+	}
+	if _, err := c.dispatch(protocol.CmdStopTransaction, stop); err != nil {
+		return nil, NewError(ErrorPropertyConstraintViolation, "%v", err)
+	}
+	return resp, nil
+}
+
+func (c *conn) startTransaction(req *v201TransactionEventReq, meterStart int) (int, error) {
+	start := handlers.StartTransactionRequest{
+		ConnectorID: evseID(req.EVSE),
+		MeterStart:  meterStart,
+		Timestamp:   req.Timestamp,
+	}
+	if req.IDToken != nil {
+		start.IDTag = req.IDToken.IDToken
+	}
+	reply, err := c.dispatch(protocol.CmdStartTransaction, start)
+	if err != nil {
+		return 0, err
+	}
+	var resp handlers.StartTransactionResponse
+	if reply == nil || json.Unmarshal(reply.Payload, &resp) != nil {
+		return 0, NewError(ErrorInternalError, "no transaction id assigned")
+	}
+	return resp.TransactionID, nil
+}
+
+func v201NotifyReport(c *conn, payload json.RawMessage) (any, error) {
+	var req v201NotifyReportReq
+	if err := c.decode(payload, &req); err != nil {
+		return nil, err
+	}
+	c.srv.mu.Lock()
+	// seqNo 为 0 表示新报告的第一段
+	if req.SeqNo == 0 {
+		c.srv.rpts[c.session.ID] = nil
+	}
+	c.srv.rpts[c.session.ID] = append(c.srv.rpts[c.session.ID], req.ReportData...)
+	c.srv.mu.Unlock()
+	return struct{}{}, nil
+}
+
+func v201SecurityEventNotification(c *conn, payload json.RawMessage) (any, error) {
+	var req v201SecurityEventNotificationReq
+	if err := c.decode(payload, &req); err != nil {
+		return nil, err
+	}
+	fmt.Printf("[ocpp] security event from %s: %s %s\n", c.session.ID, req.Type, req.TechInfo)
+	return struct{}{}, nil
+}
+
+func v201FirmwareStatusNotification(c *conn, payload json.RawMessage) (any, error) {
+	var req handlers.FirmwareStatusRequest
+	if err := c.decode(payload, &req); err != nil {
+		return nil, err
+	}
+	if _, err := c.dispatch(protocol.CmdFirmwareStatus, req); err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+func v201Authorize(c *conn, payload json.RawMessage) (any, error) {
+	var req v201AuthorizeReq
+	if err := c.decode(payload, &req); err != nil {
+		return nil, err
+	}
+	info := gateway.IDTagInfo{Status: gateway.AuthAccepted}
+	if req.IDToken.IDToken != "" {
+		var err error
+		if info, err = c.authorize(req.IDToken.IDToken); err != nil {
+			return nil, err
+		}
+	}
+	return v201AuthorizeResp{IDTokenInfo: *v201TokenInfo(info)}, nil
+}
+
+// v201TokenInfo 把鉴权结果转换为 2.0.1 的 IdTokenInfo，分组用 Central 类型的标识
+func v201TokenInfo(info gateway.IDTagInfo) *v201IDTokenInfo {
+	out := &v201IDTokenInfo{Status: info.Status}
+	if info.ExpiryDate != nil {
+		out.CacheExpiryDateTime = info.ExpiryDate.UTC().Format(time.RFC3339)
+	}
+	if info.ParentIDTag != "" {
+		out.GroupIDToken = &v201IDToken{IDToken: info.ParentIDTag, Type: "Central"}
+	}
+	return out
+}
+
+type v201RequestStartTransactionReq struct {
+	IDToken       v201IDToken `json:"idToken"`
+	RemoteStartID int         `json:"remoteStartId"`
+	EVSEID        int         `json:"evseId,omitempty"`
+}
+
+type v201RequestStopTransactionReq struct {
+	TransactionID string `json:"transactionId"`
+}
+
+type v201Firmware struct {
+	Location         string `json:"location"`
+	RetrieveDateTime string `json:"retrieveDateTime"`
+}
+
+type v201LogParameters struct {
+	RemoteLocation  string `json:"remoteLocation"`
+	OldestTimestamp string `json:"oldestTimestamp,omitempty"`
+	LatestTimestamp string `json:"latestTimestamp,omitempty"`
+}
+
+type v201GetLogReq struct {
+	LogType       string            `json:"logType"`
+	RequestID     int               `json:"requestId"`
+	Log           v201LogParameters `json:"log"`
+	Retries       int               `json:"retries,omitempty"`
+	RetryInterval int               `json:"retryInterval,omitempty"`
+}
+
+type v201AuthorizationData struct {
+	IDToken     v201IDToken      `json:"idToken"`
+	IDTokenInfo *v201IDTokenInfo `json:"idTokenInfo,omitempty"`
+}
+
+type v201SendLocalListReq struct {
+	VersionNumber          int                     `json:"versionNumber"`
+	UpdateType             string                  `json:"updateType"`
+	LocalAuthorizationList []v201AuthorizationData `json:"localAuthorizationList,omitempty"`
+}
+
+type v201ChargingSchedule struct {
+	ID                     int                              `json:"id"`
+	StartSchedule          string                           `json:"startSchedule,omitempty"`
+	Duration               int                              `json:"duration,omitempty"`
+	ChargingRateUnit       string                           `json:"chargingRateUnit"`
+	ChargingSchedulePeriod []gateway.ChargingSchedulePeriod `json:"chargingSchedulePeriod"`
+	MinChargingRate        float64                          `json:"minChargingRate,omitempty"`
+}
+
+type v201ChargingProfile struct {
+	ID                     int                    `json:"id"`
+	StackLevel             int                    `json:"stackLevel"`
+	ChargingProfilePurpose string                 `json:"chargingProfilePurpose"`
+	ChargingProfileKind    string                 `json:"chargingProfileKind"`
+	RecurrencyKind         string                 `json:"recurrencyKind,omitempty"`
+	ValidFrom              string                 `json:"validFrom,omitempty"`
+	ValidTo                string                 `json:"validTo,omitempty"`
+	TransactionID          string                 `json:"transactionId,omitempty"`
+	ChargingSchedule       []v201ChargingSchedule `json:"chargingSchedule"`
+}
+
+type v201SetChargingProfileReq struct {
+	EVSEID          int                 `json:"evseId"`
+	ChargingProfile v201ChargingProfile `json:"chargingProfile"`
+}
+
+type v201ClearChargingProfileCriteria struct {
+	EVSEID                 *int   `json:"evseId,omitempty"`
+	ChargingProfilePurpose string `json:"chargingProfilePurpose,omitempty"`
+	StackLevel             *int   `json:"stackLevel,omitempty"`
+}
+
+type v201ClearChargingProfileReq struct {
+	ChargingProfileID       *int                              `json:"chargingProfileId,omitempty"`
+	ChargingProfileCriteria *v201ClearChargingProfileCriteria `json:"chargingProfileCriteria,omitempty"`
+}
+
+type v201UpdateFirmwareReq struct {
+	RequestID     int          `json:"requestId"`
+	Firmware      v201Firmware `json:"firmware"`
+	Retries       int          `json:"retries,omitempty"`
+	RetryInterval int          `json:"retryInterval,omitempty"`
+}
+
+// v201Request 把网关按 1.6 命名的请求转换为 2.0.1 的 action 和负载，不需要转换的原样返回
+func (c *conn) v201Request(action string, req any) (string, any, error) {
+	switch action {
+	case gateway.ActionRemoteStart:
+		var r gateway.RemoteStartRequest
+		if err := convert(req, &r); err != nil {
+			return "", nil, err
+		}
+		return "RequestStartTransaction", v201RequestStartTransactionReq{
+			IDToken:       v201IDToken{IDToken: r.IDTag, Type: "Central"},
+			RemoteStartID: c.nextRequestID(),
+			EVSEID:        r.ConnectorID,
+		}, nil
+	case gateway.ActionRemoteStop:
+		var r gateway.RemoteStopRequest
+		if err := convert(req, &r); err != nil {
+			return "", nil, err
+		}
+		txID, ok := c.srv.chargerTxID(c.session.ID, r.TransactionID)
+		if !ok {
+			return "", nil, fmt.Errorf("%w: %d on %s", gateway.ErrUnknownTransaction, r.TransactionID, c.session.ID)
+		}
+		return "RequestStopTransaction", v201RequestStopTransactionReq{TransactionID: txID}, nil
+	case gateway.ActionUpdateFirmware:
+		var r gateway.UpdateFirmwareRequest
+		if err := convert(req, &r); err != nil {
+			return "", nil, err
+		}
+		return "UpdateFirmware", v201UpdateFirmwareReq{
+			RequestID:     c.nextRequestID(),
+			Firmware:      v201Firmware{Location: r.Location, RetrieveDateTime: r.RetrieveDate.UTC().Format(time.RFC3339)},
+			Retries:       r.Retries,
+			RetryInterval: r.RetryInterval,
+		}, nil
+	case gateway.ActionGetDiagnostics:
+		var r gateway.GetDiagnosticsRequest
+		if err := convert(req, &r); err != nil {
+			return "", nil, err
+		}
+		log := v201LogParameters{RemoteLocation: r.Location}
+		if r.StartTime != nil {
+			log.OldestTimestamp = r.StartTime.UTC().Format(time.RFC3339)
+		}
+		if r.StopTime != nil {
+			log.LatestTimestamp = r.StopTime.UTC().Format(time.RFC3339)
+		}
+		return "GetLog", v201GetLogReq{
+			LogType:       "DiagnosticsLog",
+			RequestID:     c.nextRequestID(),
+			Log:           log,
+			Retries:       r.Retries,
+			RetryInterval: r.RetryInterval,
+		}, nil
+	case gateway.ActionSendLocalList:
+		var r gateway.SendLocalListRequest
+		if err := convert(req, &r); err != nil {
+			return "", nil, err
+		}
+		out := v201SendLocalListReq{VersionNumber: r.ListVersion, UpdateType: r.UpdateType}
+		for _, d := range r.LocalAuthorizationList {
+			// 1.6 的列表不区分标签类型，按 RFID 卡下发
+			item := v201AuthorizationData{IDToken: v201IDToken{IDToken: d.IDTag, Type: "ISO14443"}}
+			if d.IDTagInfo != nil {
+				item.IDTokenInfo = v201TokenInfo(*d.IDTagInfo)
+			}
+			out.LocalAuthorizationList = append(out.LocalAuthorizationList, item)
+		}
+		return action, out, nil
+	case gateway.ActionSetChargingProfile:
+		var r gateway.SetChargingProfileRequest
+		if err := convert(req, &r); err != nil {
+			return "", nil, err
+		}
+		p, err := c.v201ChargingProfile(r.CsChargingProfiles)
+		if err != nil {
+			return "", nil, err
+		}
+		return action, v201SetChargingProfileReq{EVSEID: r.ConnectorID, ChargingProfile: p}, nil
+	case gateway.ActionClearChargingProfile:
+		var r gateway.ClearChargingProfileRequest
+		if err := convert(req, &r); err != nil {
+			return "", nil, err
+		}
+		out := v201ClearChargingProfileReq{ChargingProfileID: r.ID}
+		if r.ConnectorID != nil || r.ChargingProfilePurpose != "" || r.StackLevel != nil {
+			out.ChargingProfileCriteria = &v201ClearChargingProfileCriteria{
+				EVSEID:                 r.ConnectorID,
+				ChargingProfilePurpose: v201Purpose(r.ChargingProfilePurpose),
+				StackLevel:             r.StackLevel,
+			}
+		}
+		return action, out, nil
+	case gateway.ActionGetConfiguration, gateway.ActionChangeConfiguration:
+		// 2.0.1 的配置按组件和变量组织，使用 GetVariables 和 SetVariables
+		return "", nil, fmt.Errorf("%w: %s", ErrNotSupported, action)
+	}
+	return action, req, nil
+}
+
+// v201ChargingProfile 转换充电曲线：整桩上限改名为 ChargingStationMaxProfile，交易 ID 换成充电桩的交易 ID
+func (c *conn) v201ChargingProfile(p gateway.ChargingProfile) (v201ChargingProfile, error) {
+	out := v201ChargingProfile{
+		ID:                     p.ChargingProfileID,
+		StackLevel:             p.StackLevel,
+		ChargingProfilePurpose: v201Purpose(p.ChargingProfilePurpose),
+		ChargingProfileKind:    p.ChargingProfileKind,
+		RecurrencyKind:         p.RecurrencyKind,
+		ValidFrom:              rfc3339(p.ValidFrom),
+		ValidTo:                rfc3339(p.ValidTo),
+	}
+	if p.TransactionID != 0 {
+		txID, ok := c.srv.chargerTxID(c.session.ID, p.TransactionID)
+		if !ok {
+			return v201ChargingProfile{}, fmt.Errorf("%w: %d on %s", gateway.ErrUnknownTransaction, p.TransactionID, c.session.ID)
+		}
+		out.TransactionID = txID
+	}
+	s := p.ChargingSchedule
+	out.ChargingSchedule = []v201ChargingSchedule{{
+		ID:                     p.ChargingProfileID,
+		StartSchedule:          rfc3339(s.StartSchedule),
+		Duration:               s.Duration,
+		ChargingRateUnit:       s.ChargingRateUnit,
+		ChargingSchedulePeriod: s.ChargingSchedulePeriod,
+		MinChargingRate:        s.MinChargingRate,
+	}}
+	return out, nil
+}
+
+// v201Purpose 转换充电曲线的用途，2.0.1 中整桩上限改名为 ChargingStationMaxProfile
+func v201Purpose(purpose string) string {
+	if purpose == gateway.PurposeChargePointMax {
+		return "ChargingStationMaxProfile"
+	}
+	return purpose
+}
+
+func rfc3339(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// v201GetLocalListVersion 读取列表版本，2.0.1 的应答字段为 versionNumber
+func (c *conn) v201GetLocalListVersion(ctx context.Context, resp any) error {
+	var r struct {
+		VersionNumber int `json:"versionNumber"`
+	}
+	if err := callError(c.call(ctx, gateway.ActionGetLocalListVersion, struct{}{}, &r)); err != nil {
+		return err
+	}
+	if resp == nil {
+		return nil
+	}
+	return convert(gateway.GetLocalListVersionResponse{ListVersion: r.VersionNumber}, resp)
+}
+
+// nextRequestID 分配 RequestStartTransaction、UpdateFirmware 等请求的 ID
+func (c *conn) nextRequestID() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requestID++
+	return c.requestID
+}
+
+func (s *Server) bindTx(key string, txID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.txIDs[key] = txID
+	s.txKey[txID] = key
+}
+
+func (s *Server) unbindTx(txID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.txKey[txID]; ok {
+		delete(s.txIDs, key)
+		delete(s.txKey, txID)
+	}
+}
+
+// chargerTxID 反查网关交易 ID 对应的充电桩交易 ID，交易不在该充电桩上时返回 false
+func (s *Server) chargerTxID(chargerID string, txID int) (string, bool) {
+	s.mu.RLock()
+	key, ok := s.txKey[txID]
+	s.mu.RUnlock()
+	if !ok {
+		return "", false
+	}
+	return strings.CutPrefix(key, chargerID+"/")
+}
+
+// convert 把任意请求（结构体或 JSON）转换为 v
+func convert(req, v any) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// SetVariables 向 OCPP 2.0.1 充电桩下发变量
+func (s *Server) SetVariables(ctx context.Context, chargerID string, data []SetVariableData) ([]SetVariableResult, error) {
+	if v, ok := s.Version(chargerID); ok && v != SubprotocolOCPP201 {
+		return nil, ErrNotSupported
+	}
+	var resp struct {
+		SetVariableResult []SetVariableResult `json:"setVariableResult"`
+	}
+	req := map[string]any{"setVariableData": data}
+	if err := s.Call(ctx, chargerID, "SetVariables", req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.SetVariableResult, nil
+}
+
+// GetVariables 读取 OCPP 2.0.1 充电桩的变量
+func (s *Server) GetVariables(ctx context.Context, chargerID string, data []GetVariableData) ([]GetVariableResult, error) {
+	if v, ok := s.Version(chargerID); ok && v != SubprotocolOCPP201 {
+		return nil, ErrNotSupported
+	}
+	var resp struct {
+		GetVariableResult []GetVariableResult `json:"getVariableResult"`
+	}
+	req := map[string]any{"getVariableData": data}
+	if err := s.Call(ctx, chargerID, "GetVariables", req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.GetVariableResult, nil
+}
+
+// Report 返回充电桩最近一次 NotifyReport 上报的变量
+func (s *Server) Report(chargerID string) []ReportDataType {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]ReportDataType(nil), s.rpts[chargerID]...)
+}
+
+// energyWh 取最后一个 Energy.Active.Import.Register 采样，换算为 Wh
+func energyWh(mvs []v201MeterValue) (float64, bool) {
+	var (
+		wh    float64
+		found bool
+	)
+	for _, mv := range mvs {
+		for _, sv := range mv.SampledValue {
+			if measurand(sv) != "Energy.Active.Import.Register" {
+				continue
+			}
+			value, unit := scaled(sv)
+			if unit == "kWh" {
+				value *= 1000
+			}
+			wh, found = value, true
+		}
+	}
+	return wh, found
+}
+
+func samples(mvs []v201MeterValue) []handlers.MeterValue {
+	var out []handlers.MeterValue
+	for _, mv := range mvs {
+		for _, sv := range mv.SampledValue {
+			value, unit := scaled(sv)
+			out = append(out, handlers.MeterValue{
+				Timestamp: mv.Timestamp,
+				Measurand: measurand(sv),
+				Value:     value,
+				Unit:      unit,
+			})
+		}
+	}
+	return out
+}
+
+// scaled 应用 unitOfMeasure 的 10 次幂倍率，缺省单位为 Wh
+func scaled(sv v201SampledValue) (float64, string) {
+	if sv.UnitOfMeasure == nil {
+		return sv.Value, "Wh"
+	}
+	unit := sv.UnitOfMeasure.Unit
+	if unit == "" {
+		unit = "Wh"
+	}
+	return sv.Value * math.Pow10(sv.UnitOfMeasure.Multiplier), unit
+}
+
+func measurand(sv v201SampledValue) string {
+	if sv.Measurand == "" {
+		return "Energy.Active.Import.Register" // 2.0.1 的缺省测量项
+	}
+	return sv.Measurand
+}
+
+func evseID(e *EVSEType) int {
+	if e == nil {
+		return 0
+	}
+	return e.ID
+}
@@ -0,0 +1,553 @@
+package ocpp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/credential"
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/handlers"
+	"github.com/x14n/evgateway/internal/ws"
+)
+
+func startServer201(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	d := gateway.NewDispatcher()
+	handlers.RegisterAllHandlers(d)
+	s := NewServer(gateway.NewGateway(), d)
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+// waitVersion 等待服务端登记连接：客户端握手完成时服务端可能尚未登记
+func waitVersion(t *testing.T, s *Server, id string) string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if v, ok := s.Version(id); ok {
+			return v
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%s never connected", id)
+	return ""
+}
+
+func (s *Server) txID(chargerID, txID string) (int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.txIDs[chargerID+"/"+txID]
+	return id, ok
+}
+
+func boot201(t *testing.T, c *testClient) {
+	t.Helper()
+	var resp v201BootNotificationResp
+	expectResult(t, c.call("BootNotification", map[string]any{
+		"reason":          "PowerUp",
+		"chargingStation": map[string]any{"model": "M1", "vendorName": "V"},
+	}), &resp)
+	if resp.Status != "Accepted" {
+		t.Fatalf("boot status %s", resp.Status)
+	}
+}
+
+func TestOCPP201_TransactionLifecycle(t *testing.T) {
+	s, srv := startServer201(t)
+	c := dial(t, srv, "CP-201", SubprotocolOCPP201)
+	if v := waitVersion(t, s, "CP-201"); v != SubprotocolOCPP201 {
+		t.Fatalf("expected %s, got %q", SubprotocolOCPP201, v)
+	}
+	boot201(t, c)
+	expectResult(t, c.call("Heartbeat", map[string]any{}), nil)
+	expectResult(t, c.call("StatusNotification", map[string]any{
+		"timestamp": "2024-01-01T00:00:00Z", "connectorStatus": "Occupied", "evseId": 1, "connectorId": 1,
+	}), nil)
+
+	event := func(eventType string, kwh float64) map[string]any {
+		return map[string]any{
+			"eventType":       eventType,
+			"timestamp":       "2024-01-01T00:00:00Z",
+			"triggerReason":   "Authorized",
+			"seqNo":           0,
+			"transactionInfo": map[string]any{"transactionId": "tx-abc"},
+			"evse":            map[string]any{"id": 1},
+			"idToken":         map[string]any{"idToken": "TAG1", "type": "ISO14443"},
+			"meterValue": []any{map[string]any{
+				"timestamp": "2024-01-01T00:00:00Z",
+				"sampledValue": []any{map[string]any{
+					"value":         kwh,
+					"measurand":     "Energy.Active.Import.Register",
+					"unitOfMeasure": map[string]any{"unit": "kWh"},
+				}},
+			}},
+		}
+	}
+	var resp v201TransactionEventResp
+	expectResult(t, c.call("TransactionEvent", event("Started", 1.5)), &resp)
+	if resp.IDTokenInfo == nil || resp.IDTokenInfo.Status != "Accepted" {
+		t.Fatalf("expected accepted id token, got %+v", resp)
+	}
+	txID, _ := s.txID("CP-201", "tx-abc")
+	tx, ok := s.Gateway.GetTransaction(txID)
+	if !ok || tx.MeterStart != 1500 || tx.IDTag != "TAG1" {
+		t.Fatalf("unexpected transaction %+v", tx)
+	}
+
+	if id, ok := s.chargerTxID("CP-201", txID); !ok || id != "tx-abc" {
+		t.Errorf("reverse lookup: %q %v", id, ok)
+	}
+	if _, ok := s.chargerTxID("CP-OTHER", txID); ok {
+		t.Error("reverse lookup must not match another charger")
+	}
+
+	expectResult(t, c.call("TransactionEvent", event("Updated", 2)), nil)
+	expectResult(t, c.call("TransactionEvent", event("Ended", 3.25)), nil)
+	tx, _ = s.Gateway.GetTransaction(txID)
+	if tx.Active() || tx.MeterStop != 3250 {
+		t.Fatalf("expected stopped transaction at 3250 Wh, got %+v", tx)
+	}
+	if _, ok := s.txID("CP-201", "tx-abc"); ok {
+		t.Fatal("transaction id mapping should be released")
+	}
+	if _, ok := s.chargerTxID("CP-201", txID); ok {
+		t.Fatal("reverse mapping should be released")
+	}
+
+	// 不经 Ended 结束的交易也释放映射
+	s.bindTx("CP-201/tx-lost", 999)
+	s.Gateway.Emit(gateway.Event{Type: gateway.EventTransactionStopped, ChargerID: "CP-201", Data: handlers.TransactionEvent{TransactionID: 999}})
+	if _, ok := s.txID("CP-201", "tx-lost"); ok {
+		t.Fatal("mapping kept after the transaction stopped")
+	}
+}
+
+func TestOCPP201_SchemaViolations(t *testing.T) {
+	_, srv := startServer201(t)
+	c := dial(t, srv, "CP-201", SubprotocolOCPP201)
+
+	tests := []struct {
+		name    string
+		action  string
+		payload any
+		code    string
+	}{
+		{"missing field", "BootNotification", map[string]any{"reason": "PowerUp"}, ErrorOccurrenceConstraintViolation},
+		{"wrong type", "BootNotification", map[string]any{"reason": 1, "chargingStation": map[string]any{"model": "M", "vendorName": "V"}}, ErrorTypeConstraintViolation},
+		{"bad enum", "BootNotification", map[string]any{"reason": "Bored", "chargingStation": map[string]any{"model": "M", "vendorName": "V"}}, ErrorPropertyConstraintViolation},
+		{"extra property", "Heartbeat", map[string]any{"foo": 1}, ErrorOccurrenceConstraintViolation},
+		{"unknown action", "DataTransfer", map[string]any{}, ErrorNotImplemented},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := c.call(tt.action, tt.payload)
+			if resp.Type != MessageTypeCallError || resp.ErrorCode != tt.code {
+				t.Fatalf("expected %s, got %d %s %s", tt.code, resp.Type, resp.ErrorCode, resp.ErrorDescription)
+			}
+		})
+	}
+}
+
+func TestOCPP201_SetGetVariables(t *testing.T) {
+	s, srv := startServer201(t)
+	c := dial(t, srv, "CP-201", SubprotocolOCPP201)
+	boot201(t, c)
+
+	// 模拟充电桩：应答网关发起的 CALL
+	go func() {
+		for {
+			_, data, err := c.conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, err := ParseMessage(data)
+			if err != nil || msg.Type != MessageTypeCall {
+				continue
+			}
+			var result any
+			switch msg.Action {
+			case "SetVariables":
+				result = map[string]any{"setVariableResult": []any{map[string]any{
+					"attributeStatus": "Accepted",
+					"component":       map[string]any{"name": "OCPPCommCtrlr"},
+					"variable":        map[string]any{"name": "HeartbeatInterval"},
+				}}}
+			case "GetVariables":
+				result = map[string]any{"getVariableResult": []any{map[string]any{
+					"attributeStatus": "Accepted",
+					"attributeValue":  "30",
+					"component":       map[string]any{"name": "OCPPCommCtrlr"},
+					"variable":        map[string]any{"name": "HeartbeatInterval"},
+				}}}
+			}
+			resp, _ := NewCallResult(msg.ID, result)
+			c.sendRaw(resp)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	component := ComponentType{Name: "OCPPCommCtrlr"}
+	variable := VariableType{Name: "HeartbeatInterval"}
+
+	set, err := s.SetVariables(ctx, "CP-201", []SetVariableData{{AttributeValue: "30", Component: component, Variable: variable}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set) != 1 || set[0].AttributeStatus != "Accepted" {
+		t.Fatalf("unexpected set result %+v", set)
+	}
+
+	got, err := s.GetVariables(ctx, "CP-201", []GetVariableData{{Component: component, Variable: variable}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].AttributeValue != "30" {
+		t.Fatalf("unexpected get result %+v", got)
+	}
+
+	if _, err := s.GetVariables(ctx, "CP-missing", nil); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+}
+
+func TestOCPP201_NotSupportedOn16(t *testing.T) {
+	s, srv := startServer201(t)
+	dial(t, srv, "CP-16", SubprotocolOCPP16)
+	waitVersion(t, s, "CP-16")
+	if _, err := s.GetVariables(context.Background(), "CP-16", nil); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestOCPP_SubprotocolPreference(t *testing.T) {
+	s, srv := startServer201(t)
+	dial(t, srv, "CP-A", SubprotocolOCPP16, SubprotocolOCPP201)
+	dial(t, srv, "CP-B", SubprotocolOCPP201, SubprotocolOCPP16)
+	if v := waitVersion(t, s, "CP-A"); v != SubprotocolOCPP16 {
+		t.Fatalf("CP-A: expected %s, got %s", SubprotocolOCPP16, v)
+	}
+	if v := waitVersion(t, s, "CP-B"); v != SubprotocolOCPP201 {
+		t.Fatalf("CP-B: expected %s, got %s", SubprotocolOCPP201, v)
+	}
+}
+
+func TestOCPP_BasicAuth(t *testing.T) {
+	s, srv := startServer201(t)
+	passwords := credential.NewMemoryStore()
+	passwords.SetPassword("CP-1", "secret")
+	s.SecurityProfile = SecurityProfileBasicAuth
+	s.Passwords = passwords
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	tests := []struct {
+		name     string
+		userinfo string
+		ok       bool
+	}{
+		{"valid", "CP-1:secret@", true},
+		{"wrong password", "CP-1:nope@", false},
+		{"user is not charger id", "CP-2:secret@", false},
+		{"no credentials", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := ws.Dial("ws://"+tt.userinfo+host+"/ocpp/CP-1", []string{SubprotocolOCPP201})
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+				return
+			}
+			if !errors.Is(err, ws.ErrBadHandshake) || !strings.Contains(err.Error(), "401") {
+				t.Fatalf("expected 401 handshake failure, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	schemas, err := loadSchemas("v201")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := schemas["StatusNotificationRequest"]
+
+	tests := []struct {
+		payload string
+		kind    string
+	}{
+		{`{"timestamp":"2024-01-01T00:00:00Z","connectorStatus":"Available","evseId":1,"connectorId":1}`, ""},
+		{`{"timestamp":"2024-01-01T00:00:00Z","connectorStatus":"Available","evseId":1.5,"connectorId":1}`, violationType},
+		{`{"timestamp":"yesterday","connectorStatus":"Available","evseId":1,"connectorId":1}`, violationProperty},
+		{`{"timestamp":"2024-01-01T00:00:00Z","evseId":1,"connectorId":1}`, violationOccurrence},
+		{`{"timestamp":`, violationFormat},
+	}
+	for _, tt := range tests {
+		err := s.Validate([]byte(tt.payload))
+		if tt.kind == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.payload, err)
+			}
+			continue
+		}
+		var verr *ValidationError
+		if !errors.As(err, &verr) || verr.Kind != tt.kind {
+			t.Errorf("%s: expected %s violation, got %v", tt.payload, tt.kind, err)
+		}
+	}
+}
+
+func TestOCPP201_RemoteStartStop(t *testing.T) {
+	s, srv := startServer201(t)
+	c := dial(t, srv, "CP-201", SubprotocolOCPP201)
+	boot201(t, c)
+	expectResult(t, c.call("TransactionEvent", map[string]any{
+		"eventType":       "Started",
+		"timestamp":       "2024-01-01T00:00:00Z",
+		"triggerReason":   "RemoteStart",
+		"seqNo":           0,
+		"transactionInfo": map[string]any{"transactionId": "tx-remote"},
+		"evse":            map[string]any{"id": 1},
+	}), nil)
+	txID, _ := s.txID("CP-201", "tx-remote")
+
+	calls := make(chan *Message, 2)
+	go func() {
+		for {
+			_, data, err := c.conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, err := ParseMessage(data)
+			if err != nil || msg.Type != MessageTypeCall {
+				continue
+			}
+			calls <- msg
+			resp, _ := NewCallResult(msg.ID, map[string]any{"status": "Accepted"})
+			c.sendRaw(resp)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := s.Gateway.RemoteStart(ctx, "CP-201", gateway.RemoteStartRequest{ConnectorID: 1, IDTag: "TAG9"}); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-calls
+	var start v201RequestStartTransactionReq
+	json.Unmarshal(msg.Payload, &start)
+	if msg.Action != "RequestStartTransaction" || start.IDToken.IDToken != "TAG9" || start.EVSEID != 1 || start.RemoteStartID == 0 {
+		t.Fatalf("unexpected start call %s %s", msg.Action, msg.Payload)
+	}
+
+	if _, err := s.Gateway.RemoteStop(ctx, gateway.RemoteStopRequest{TransactionID: txID}); err != nil {
+		t.Fatal(err)
+	}
+	msg = <-calls
+	var stop v201RequestStopTransactionReq
+	json.Unmarshal(msg.Payload, &stop)
+	if msg.Action != "RequestStopTransaction" || stop.TransactionID != "tx-remote" {
+		t.Fatalf("unexpected stop call %s %s", msg.Action, msg.Payload)
+	}
+}
+
+func TestOCPP201_SetChargingProfile(t *testing.T) {
+	s, srv := startServer201(t)
+	c := dial(t, srv, "CP-201", SubprotocolOCPP201)
+	boot201(t, c)
+	expectResult(t, c.call("TransactionEvent", map[string]any{
+		"eventType":       "Started",
+		"timestamp":       "2024-01-01T00:00:00Z",
+		"triggerReason":   "CablePluggedIn",
+		"seqNo":           0,
+		"transactionInfo": map[string]any{"transactionId": "tx-limit"},
+		"evse":            map[string]any{"id": 2},
+	}), nil)
+	txID, _ := s.txID("CP-201", "tx-limit")
+
+	calls := make(chan *Message, 1)
+	go func() {
+		for {
+			_, data, err := c.conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, err := ParseMessage(data)
+			if err != nil || msg.Type != MessageTypeCall {
+				continue
+			}
+			calls <- msg
+			resp, _ := NewCallResult(msg.ID, map[string]any{"status": "Accepted"})
+			c.sendRaw(resp)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	p := gateway.ChargingProfile{
+		ChargingProfileID:      7,
+		TransactionID:          txID,
+		ChargingProfilePurpose: gateway.PurposeTx,
+		ChargingProfileKind:    gateway.KindRelative,
+		ChargingSchedule: gateway.ChargingSchedule{
+			ChargingRateUnit:       gateway.RateUnitW,
+			ChargingSchedulePeriod: []gateway.ChargingSchedulePeriod{{Limit: 3700}},
+		},
+	}
+	if _, err := s.Gateway.SetChargingProfile(ctx, "CP-201", 2, p); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-calls
+	var req v201SetChargingProfileReq
+	json.Unmarshal(msg.Payload, &req)
+	if msg.Action != "SetChargingProfile" || req.EVSEID != 2 || req.ChargingProfile.TransactionID != "tx-limit" ||
+		len(req.ChargingProfile.ChargingSchedule) != 1 || req.ChargingProfile.ChargingSchedule[0].ChargingSchedulePeriod[0].Limit != 3700 {
+		t.Fatalf("unexpected profile call %s %s", msg.Action, msg.Payload)
+	}
+
+	p.TransactionID = txID + 100
+	if _, err := s.Gateway.SetChargingProfile(ctx, "CP-201", 2, p); !errors.Is(err, gateway.ErrUnknownTransaction) {
+		t.Errorf("expected ErrUnknownTransaction, got %v", err)
+	}
+}
+
+func TestOCPP201_Firmware(t *testing.T) {
+	s, srv := startServer201(t)
+	c := dial(t, srv, "CP-201", SubprotocolOCPP201)
+	boot201(t, c)
+
+	events := make(chan gateway.Event, 1)
+	sub := s.Gateway.Subscribe(func(e gateway.Event) { events <- e }, gateway.Types(gateway.EventFirmwareStatus))
+	defer sub.Close()
+	expectResult(t, c.call("FirmwareStatusNotification", map[string]any{"status": "Installing", "requestId": 3}), nil)
+	select {
+	case e := <-events:
+		if st, _ := e.Data.(gateway.FirmwareStatusEvent); e.ChargerID != "CP-201" || st.Status != "Installing" || st.RequestID != 3 {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no firmware status event")
+	}
+	if msg := c.call("FirmwareStatusNotification", map[string]any{"status": "Bogus"}); msg.Type != MessageTypeCallError {
+		t.Errorf("expected a schema violation for an unknown status, got %d", msg.Type)
+	}
+
+	calls := make(chan *Message, 1)
+	go func() {
+		for {
+			_, data, err := c.conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, err := ParseMessage(data)
+			if err != nil || msg.Type != MessageTypeCall {
+				continue
+			}
+			calls <- msg
+			resp, _ := NewCallResult(msg.ID, map[string]any{"status": "Accepted"})
+			c.sendRaw(resp)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Gateway.UpdateFirmware(ctx, "CP-201", gateway.UpdateFirmwareRequest{Location: "http://gw/firmware/2.0"}); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-calls
+	var req v201UpdateFirmwareReq
+	json.Unmarshal(msg.Payload, &req)
+	if msg.Action != "UpdateFirmware" || req.Firmware.Location != "http://gw/firmware/2.0" || req.RequestID == 0 {
+		t.Fatalf("unexpected update call %s %s", msg.Action, msg.Payload)
+	}
+	if err := s.Gateway.StreamFirmware(ctx, "CP-201", "2.0", 1, "sum", strings.NewReader("x")); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported for streaming over OCPP, got %v", err)
+	}
+}
+
+func TestOCPP201_AuthorizeAndLocalList(t *testing.T) {
+	s, srv := startServer201(t)
+	expiry := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Gateway.SetAuthorizer(tagList{
+		"CARD1": {Status: gateway.AuthAccepted, ParentIDTag: "FLEET", ExpiryDate: &expiry},
+		"CARD2": {Status: gateway.AuthBlocked},
+	})
+	c := dial(t, srv, "CP-201", SubprotocolOCPP201)
+	boot201(t, c)
+
+	var resp v201AuthorizeResp
+	expectResult(t, c.call("Authorize", map[string]any{"idToken": map[string]any{"idToken": "CARD1", "type": "ISO14443"}}), &resp)
+	info := resp.IDTokenInfo
+	if info.Status != "Accepted" || info.GroupIDToken == nil || info.GroupIDToken.IDToken != "FLEET" || info.CacheExpiryDateTime != "2030-01-01T00:00:00Z" {
+		t.Fatalf("unexpected authorize response %+v", info)
+	}
+	if msg := c.call("Authorize", map[string]any{"idToken": map[string]any{"idToken": "CARD1"}}); msg.Type != MessageTypeCallError {
+		t.Errorf("expected a schema violation without token type, got %d", msg.Type)
+	}
+	var ev v201TransactionEventResp
+	expectResult(t, c.call("TransactionEvent", map[string]any{
+		"eventType":       "Started",
+		"timestamp":       now(),
+		"triggerReason":   "Authorized",
+		"seqNo":           0,
+		"transactionInfo": map[string]any{"transactionId": "T1"},
+		"evse":            map[string]any{"id": 1},
+		"idToken":         map[string]any{"idToken": "CARD2", "type": "ISO14443"},
+	}), &ev)
+	if ev.IDTokenInfo == nil || ev.IDTokenInfo.Status != "Blocked" {
+		t.Errorf("expected a blocked token in the transaction event response, got %+v", ev.IDTokenInfo)
+	}
+
+	calls := make(chan *Message, 2)
+	go func() {
+		for {
+			_, data, err := c.conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, err := ParseMessage(data)
+			if err != nil || msg.Type != MessageTypeCall {
+				continue
+			}
+			calls <- msg
+			var result any = map[string]any{"status": "Accepted"}
+			if msg.Action == "GetLocalListVersion" {
+				result = map[string]any{"versionNumber": 3}
+			}
+			resp, _ := NewCallResult(msg.ID, result)
+			c.sendRaw(resp)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if v, err := s.Gateway.GetLocalListVersion(ctx, "CP-201"); err != nil || v != 3 {
+		t.Fatalf("local list version: %d %v", v, err)
+	}
+	<-calls
+	_, err := s.Gateway.SendLocalList(ctx, "CP-201", gateway.SendLocalListRequest{
+		ListVersion: 4,
+		UpdateType:  gateway.UpdateDifferential,
+		LocalAuthorizationList: []gateway.AuthorizationData{
+			{IDTag: "CARD1", IDTagInfo: &gateway.IDTagInfo{Status: gateway.AuthAccepted, ParentIDTag: "FLEET"}},
+			{IDTag: "CARD9"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-calls
+	var req v201SendLocalListReq
+	json.Unmarshal(msg.Payload, &req)
+	list := req.LocalAuthorizationList
+	if msg.Action != "SendLocalList" || req.VersionNumber != 4 || len(list) != 2 ||
+		list[0].IDToken.Type != "ISO14443" || list[0].IDTokenInfo.GroupIDToken.IDToken != "FLEET" || list[1].IDTokenInfo != nil {
+		t.Fatalf("unexpected local list call %s %s", msg.Action, msg.Payload)
+	}
+}
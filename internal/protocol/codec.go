@@ -0,0 +1,209 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"slices"
+	"sync"
+)
+
+// v1: header(2) + version(1) + cmd(1) + length(4) +Payload(N)+ crc(2) + tail(2)
+// v2: header(2) + version(1) + cmd(1) + flags(1) + length(4) +Payload(N)+ crc(2) + tail(2)
+// v3: 同 v2，额外支持加密负载
+
+// Codec 负责某一协议版本的帧编解码，帧头和版本字节的位置在所有版本中保持不变
+type Codec interface {
+	// Version 返回该编解码器处理的版本号
+	Version() byte
+	// Flags 返回该版本支持的帧标志位，v1 不支持任何标志位
+	Flags() byte
+	// Encode 把帧原样写入 w，不做压缩或加密
+	Encode(w io.Writer, f *Frame) error
+	// Decode 从以帧头开始的 buf 中解析一帧，返回帧和消耗的字节数；
+	// 数据不足时返回 ErrNeedMoreData
+	Decode(buf []byte, maxPayload uint32) (*Frame, int, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{}
+)
+
+func init() {
+	RegisterCodec(frameCodec{version: ProtocolV1})
+	RegisterCodec(frameCodec{version: ProtocolV2, flags: FlagCompressed | FlagFragment})
+	RegisterCodec(frameCodec{version: ProtocolV3, flags: FlagCompressed | FlagFragment | FlagEncrypted})
+}
+
+// RegisterCodec 注册或替换某个版本的编解码器
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Version()] = c
+}
+
+// LookupCodec 按版本查找编解码器
+func LookupCodec(version byte) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[version]
+	return c, ok
+}
+
+// SupportedVersions 返回已注册的版本号，按升序排列
+func SupportedVersions() []byte {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	out := make([]byte, 0, len(codecs))
+	for v := range codecs {
+		out = append(out, v)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// NegotiateVersion 在双方都支持的版本中选出最高的一个
+func NegotiateVersion(offered []byte) (byte, bool) {
+	best, ok := byte(0), false
+	for _, v := range offered {
+		if _, registered := LookupCodec(v); registered && (!ok || v > best) {
+			best, ok = v, true
+		}
+	}
+	return best, ok
+}
+
+// SupportsFlag 判断某个版本是否支持指定的帧标志位
+func SupportsFlag(version, flag byte) bool {
+	c, ok := LookupCodec(version)
+	return ok && c.Flags()&flag == flag
+}
+
+// frameCodec 是 0xAA55 帧格式的编解码器，flags 为 0 时帧头不带 flags 字节
+type frameCodec struct {
+	version byte
+	flags   byte
+}
+
+func (c frameCodec) Version() byte { return c.version }
+func (c frameCodec) Flags() byte   { return c.flags }
+
+func (c frameCodec) hasFlagsByte() bool {
+	return c.flags != 0
+}
+
+func (c frameCodec) Encode(w io.Writer, f *Frame) error {
+	var buf bytes.Buffer
+
+	//header
+	if err := write(&buf, FrameHeader); err != nil {
+		return err
+	}
+
+	// write version and cmd
+	if err := write(&buf, c.version); err != nil {
+		return err
+	}
+	if err := write(&buf, f.Cmd); err != nil {
+		return err
+	}
+	if c.hasFlagsByte() {
+		if err := write(&buf, f.Flags); err != nil {
+			return err
+		}
+	}
+
+	// Length of payload
+	if err := write(&buf, uint32(len(f.Payload))); err != nil {
+		return err
+	}
+
+	//payload
+	if len(f.Payload) > 0 {
+		if err := write(&buf, f.Payload); err != nil {
+			return err
+		}
+	}
+
+	if err := write(&buf, CRC16CCITT(c.crcInput(f.Cmd, f.Flags, f.Payload))); err != nil {
+		return err
+	}
+
+	//tail
+	if err := write(&buf, FrameTail); err != nil {
+		return err
+	}
+	return write(w, buf.Bytes())
+}
+
+func (c frameCodec) Decode(buf []byte, maxPayload uint32) (*Frame, int, error) {
+	if len(buf) < DefaultMinFrameSize {
+		return nil, 0, ErrNeedMoreData
+	}
+
+	cmd := buf[3]
+
+	// v2 及以上在 cmd 之后多一个 flags 字节
+	var flags byte
+	lengthPos := 2 + 1 + 1
+	if c.hasFlagsByte() {
+		if len(buf) < DefaultMinFrameSize+1 {
+			return nil, 0, ErrNeedMoreData
+		}
+		flags = buf[lengthPos]
+		lengthPos++
+	}
+	length := binary.BigEndian.Uint32(buf[lengthPos : lengthPos+4])
+
+	if length > maxPayload {
+		return nil, 0, PayloadTooLargeError
+	}
+
+	payloadStart := lengthPos + 4
+	totalLen := payloadStart + int(length) + 2 + 2
+
+	if len(buf) < totalLen {
+		return nil, 0, ErrNeedMoreData
+	}
+
+	// 校验tail
+	tailPos := payloadStart + int(length) + 2
+	tail := binary.BigEndian.Uint16(buf[tailPos : tailPos+2])
+	if tail != FrameTail {
+		return nil, 0, ErrInvalidTail
+	}
+
+	payload := make([]byte, length)
+	copy(payload, buf[payloadStart:payloadStart+int(length)])
+
+	//crc
+	crcPos := payloadStart + int(length)
+	readCRC := binary.BigEndian.Uint16(buf[crcPos : crcPos+2])
+	if readCRC != CRC16CCITT(c.crcInput(cmd, flags, payload)) {
+		return nil, 0, ErrCRCMismatch
+	}
+
+	// 不认识的标志位说明对端实现有误，整帧丢弃
+	if flags&^c.flags != 0 {
+		return nil, totalLen, ErrUnsupportedFlags
+	}
+
+	return &Frame{
+		Version: c.version,
+		Cmd:     cmd,
+		Flags:   flags,
+		Payload: payload,
+	}, totalLen, nil
+}
+
+// crcInput 拼出 CRC 覆盖的数据 (version|cmd|[flags]|len|payload)
+func (c frameCodec) crcInput(cmd, flags byte, payload []byte) []byte {
+	crcData := make([]byte, 0, 1+1+1+4+len(payload))
+	crcData = append(crcData, c.version, cmd)
+	if c.hasFlagsByte() {
+		crcData = append(crcData, flags)
+	}
+	crcData = binary.BigEndian.AppendUint32(crcData, uint32(len(payload)))
+	return append(crcData, payload...)
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSupportedVersions(t *testing.T) {
+	want := []byte{ProtocolV1, ProtocolV2, ProtocolV3}
+	if got := SupportedVersions(); !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if SupportsFlag(ProtocolV1, FlagCompressed) || !SupportsFlag(ProtocolV2, FlagFragment) || SupportsFlag(ProtocolV2, FlagEncrypted) {
+		t.Error("unexpected flag support per version")
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		offered []byte
+		want    byte
+		ok      bool
+	}{
+		{[]byte{1}, ProtocolV1, true},
+		{[]byte{1, 2}, ProtocolV2, true},
+		{[]byte{3, 1, 2}, ProtocolV3, true},
+		{[]byte{2, 9}, ProtocolV2, true},
+		{[]byte{9}, 0, false},
+		{nil, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := NegotiateVersion(tt.offered)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("NegotiateVersion(%v) = %d, %v; want %d, %v", tt.offered, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestPacke_RejectsUnsupported(t *testing.T) {
+	if err := NewFrame(9, CmdStatus, nil).Packe(&errorWriter{}); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	f := &Frame{Version: ProtocolV1, Cmd: CmdStatus, Flags: FlagFragment}
+	if err := f.Packe(&errorWriter{}); err == nil {
+		t.Error("expected error for flags on a v1 frame")
+	}
+}
+
+func TestDecode_RejectsUnknownFlags(t *testing.T) {
+	v2, _ := LookupCodec(ProtocolV2)
+	var data []byte
+	data = binary.BigEndian.AppendUint16(data, FrameHeader)
+	data = append(data, ProtocolV2, CmdStatus, FlagEncrypted)
+	data = binary.BigEndian.AppendUint32(data, 0)
+	data = binary.BigEndian.AppendUint16(data, CRC16CCITT(v2.(frameCodec).crcInput(CmdStatus, FlagEncrypted, nil)))
+	data = binary.BigEndian.AppendUint16(data, FrameTail)
+
+	frames, errs := scan(data)
+	if len(frames) != 0 || len(errs) != 1 || !errors.Is(errs[0], ErrUnsupportedFlags) {
+		t.Fatalf("expected ErrUnsupportedFlags, got frames %v errors %v", frames, errs)
+	}
+}
+
+func TestUnpack(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewFrame(ProtocolV2, CmdStatus, []byte("one")).Packe(&buf); err != nil {
+		t.Fatal(err)
+	}
+	one := buf.Bytes()
+
+	f, err := Unpack(one, DefaultMaxPayloadSize)
+	if err != nil || f.Cmd != CmdStatus || string(f.Payload) != "one" {
+		t.Fatalf("Unpack = %+v, %v", f, err)
+	}
+
+	two := append(append([]byte(nil), one...), one...)
+	for name, data := range map[string][]byte{
+		"truncated":  one[:len(one)-1],
+		"two frames": two,
+		"garbage":    []byte("garbage"),
+		"no header":  one[1:],
+	} {
+		if _, err := Unpack(data, DefaultMaxPayloadSize); !errors.Is(err, ErrMalformedDatagram) {
+			t.Errorf("%s: expected ErrMalformedDatagram, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// compressPayload 使用 deflate 压缩负载
+func compressPayload(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressPayload 解压负载，解压后超过 limit 字节视为压缩炸弹
+func decompressPayload(payload []byte, limit int) ([]byte, error) {
+	zr := flate.NewReader(bytes.NewReader(payload))
+	defer zr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompress payload: %w", err)
+	}
+	if len(out) > limit {
+		return nil, ErrDecompressedTooLarge
+	}
+	return out, nil
+}
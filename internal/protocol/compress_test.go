@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompress_RoundTripAboveThreshold(t *testing.T) {
+	payload := []byte(`{"meter":[` + strings.Repeat(`{"v":230.1,"a":16.0},`, 100) + `{}]}`)
+	f := &Frame{Version: ProtocolV2, Cmd: CmdStatus, Payload: payload, Compress: true}
+	wire := encode(t, f)
+
+	if len(wire) >= len(payload) {
+		t.Errorf("expected compressed wire frame smaller than payload, got %d >= %d", len(wire), len(payload))
+	}
+	if wire[4]&FlagCompressed == 0 {
+		t.Errorf("expected compressed flag on wire, flags=%08b", wire[4])
+	}
+
+	frames, errs := scan(wire)
+	if len(errs) != 0 || len(frames) != 1 {
+		t.Fatalf("expected one frame, got %d frames, errors %v", len(frames), errs)
+	}
+	if !bytes.Equal(frames[0].Payload, payload) {
+		t.Errorf("payload not restored after decompression")
+	}
+	if frames[0].Flags&FlagCompressed != 0 {
+		t.Errorf("compressed flag should be cleared after decompression")
+	}
+}
+
+func TestCompress_SkippedBelowThresholdAndForV1(t *testing.T) {
+	small := bytes.Repeat([]byte("a"), CompressThreshold-1)
+	big := bytes.Repeat([]byte("a"), CompressThreshold*2)
+
+	tests := []struct {
+		name  string
+		frame *Frame
+	}{
+		{"below threshold", &Frame{Version: ProtocolV2, Cmd: CmdStatus, Payload: small, Compress: true}},
+		{"v1 frame", &Frame{Version: ProtocolV1, Cmd: CmdStatus, Payload: big, Compress: true}},
+		{"not negotiated", &Frame{Version: ProtocolV2, Cmd: CmdStatus, Payload: big}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wire := encode(t, tt.frame)
+			if !bytes.Contains(wire, tt.frame.Payload) {
+				t.Errorf("expected payload to be sent uncompressed")
+			}
+			frames, _ := scan(wire)
+			if len(frames) != 1 || !bytes.Equal(frames[0].Payload, tt.frame.Payload) {
+				t.Errorf("round trip failed: %+v", frames)
+			}
+		})
+	}
+}
+
+func TestCompress_DecompressionBombRejected(t *testing.T) {
+	bomb, err := compressPayload(make([]byte, DefaultMaxPayloadSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v2, _ := LookupCodec(ProtocolV2)
+	var data []byte
+	data = binary.BigEndian.AppendUint16(data, FrameHeader)
+	data = append(data, ProtocolV2, CmdStatus, FlagCompressed)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(bomb)))
+	data = append(data, bomb...)
+	data = binary.BigEndian.AppendUint16(data, CRC16CCITT(v2.(frameCodec).crcInput(CmdStatus, FlagCompressed, bomb)))
+	data = binary.BigEndian.AppendUint16(data, FrameTail)
+
+	next := *NewFrame(ProtocolV2, CmdHeartbeat, nil)
+	frames, errs := scan(append(data, encode(t, &next)...))
+	if len(errs) != 1 || !errors.Is(errs[0], ErrDecompressedTooLarge) {
+		t.Fatalf("expected ErrDecompressedTooLarge, got %v", errs)
+	}
+	if len(frames) != 1 || !sameFrame(frames[0], next) {
+		t.Fatalf("expected the following frame to survive, got %+v", frames)
+	}
+}
@@ -0,0 +1,307 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"testing/quick"
+)
+
+// encode 把帧编码成线上字节
+func encode(t testing.TB, f *Frame) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := f.Packe(&buf); err != nil {
+		t.Fatalf("pack frame: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// scan 在内存中解析 data，返回解析出的帧和遇到的全部解析错误
+func scan(data []byte) ([]Frame, []error) {
+	var frames []Frame
+	var errs []error
+
+	p := NewParser(nil)
+	p.buf = append(p.buf, data...)
+	for {
+		frame, consumed, err := p.tryParse()
+		if err != nil {
+			if errors.Is(err, ErrNeedMoreData) {
+				return frames, errs
+			}
+			errs = append(errs, err)
+			if consumed > 0 {
+				p.consumeBufferByte(consumed)
+				continue
+			}
+			p.handleParseError(err)
+			continue
+		}
+		if frame != nil {
+			frames = append(frames, *frame)
+		}
+		if consumed == 0 {
+			return frames, errs
+		}
+		p.consumeBufferByte(consumed)
+	}
+}
+
+// collect 通过完整的 Parser 读循环从 r 中读出全部帧
+func collect(r io.Reader) []Frame {
+	p := NewParser(r)
+	p.Start()
+	var frames []Frame
+	for f := range p.Frames() {
+		frames = append(frames, f)
+	}
+	p.Stop()
+	return frames
+}
+
+// splitReader 先返回 data[:at]，再返回剩余部分
+type splitReader struct {
+	parts [][]byte
+}
+
+func (s *splitReader) Read(b []byte) (int, error) {
+	for len(s.parts) > 0 && len(s.parts[0]) == 0 {
+		s.parts = s.parts[1:]
+	}
+	if len(s.parts) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, s.parts[0])
+	s.parts[0] = s.parts[0][n:]
+	return n, nil
+}
+
+// randomPayload 生成不含 0xAA 的负载，避免随机数据中意外出现帧头
+func randomPayload(r *rand.Rand, n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(r.Intn(0xAA))
+	}
+	return p
+}
+
+func sameFrame(a, b Frame) bool {
+	return a.Version == b.Version && a.Cmd == b.Cmd && a.Flags == b.Flags && bytes.Equal(a.Payload, b.Payload)
+}
+
+func TestProperty_RoundTrip(t *testing.T) {
+	versions := SupportedVersions()
+	prop := func(v uint8, cmd byte, payload []byte) bool {
+		f := NewFrame(versions[int(v)%len(versions)], cmd, payload)
+		frames, errs := scan(encode(t, f))
+		return len(errs) == 0 && len(frames) == 1 && sameFrame(frames[0], *f)
+	}
+	if err := quick.Check(prop, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProperty_ResyncAfterGarbage(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	want := *NewFrame(1, CmdStatus, []byte(`{"soc":42}`))
+	wire := encode(t, &want)
+
+	for i := 0; i < 200; i++ {
+		garbage := randomPayload(r, r.Intn(64))
+		data := append(append([]byte{}, garbage...), wire...)
+
+		frames, _ := scan(data)
+		if len(frames) != 1 || !sameFrame(frames[0], want) {
+			t.Fatalf("garbage %x: expected one frame, got %+v", garbage, frames)
+		}
+	}
+}
+
+func TestProperty_SplitAtEveryBoundary(t *testing.T) {
+	want := []Frame{
+		*NewFrame(1, CmdRegister, []byte("CP-0001")),
+		*NewFrame(1, CmdHeartbeat, nil),
+		*NewFrame(1, CmdStatus, []byte(`{"status":"idle"}`)),
+	}
+	var wire []byte
+	for i := range want {
+		wire = append(wire, encode(t, &want[i])...)
+	}
+
+	check := func(name string, got []Frame) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("%s: expected %d frames, got %d", name, len(want), len(got))
+		}
+		for i := range want {
+			if !sameFrame(got[i], want[i]) {
+				t.Fatalf("%s: frame %d: expected %+v, got %+v", name, i, want[i], got[i])
+			}
+		}
+	}
+
+	for at := 0; at <= len(wire); at++ {
+		r := &splitReader{parts: [][]byte{
+			append([]byte{}, wire[:at]...),
+			append([]byte{}, wire[at:]...),
+		}}
+		check("split at "+strconv.Itoa(at), collect(r))
+	}
+	check("one byte reads", collect(iotest.OneByteReader(bytes.NewReader(wire))))
+}
+
+func TestProperty_OversizedPayload(t *testing.T) {
+	f := NewFrame(1, CmdStatus, make([]byte, DefaultMaxPayloadSize+1))
+	if err := f.Packe(io.Discard); !errors.Is(err, PayloadTooLargeError) {
+		t.Fatalf("expected PayloadTooLargeError from Packe, got %v", err)
+	}
+
+	next := *NewFrame(1, CmdHeartbeat, nil)
+	for _, length := range []uint32{DefaultMaxPayloadSize + 1, 1 << 31, 0xFFFFFFFF} {
+		var data []byte
+		data = binary.BigEndian.AppendUint16(data, FrameHeader)
+		data = append(data, 1, CmdStatus)
+		data = binary.BigEndian.AppendUint32(data, length)
+		data = append(data, 0, 0, 0, 0)
+		data = append(data, encode(t, &next)...)
+
+		frames, errs := scan(data)
+		if len(errs) == 0 || !errors.Is(errs[0], PayloadTooLargeError) {
+			t.Fatalf("length %d: expected PayloadTooLargeError, got %v", length, errs)
+		}
+		if len(frames) != 1 || !sameFrame(frames[0], next) {
+			t.Fatalf("length %d: expected the following frame to survive, got %+v", length, frames)
+		}
+	}
+}
+
+func TestProperty_CRCCorruption(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 20; i++ {
+		f := NewFrame(1, CmdStatus, randomPayload(r, 1+r.Intn(32)))
+		wire := encode(t, f)
+		next := *NewFrame(1, CmdHeartbeat, nil)
+
+		// 翻转帧头之后、帧尾之前的每一位：损坏的帧绝不能被交付
+		for pos := 2; pos < len(wire)-2; pos++ {
+			for bit := 0; bit < 8; bit++ {
+				bad := append([]byte{}, wire...)
+				bad[pos] ^= 1 << bit
+				if bad[pos] == 0xAA {
+					continue
+				}
+				frames, _ := scan(append(bad, encode(t, &next)...))
+				for _, got := range frames {
+					if !sameFrame(got, next) {
+						t.Fatalf("flip byte %d bit %d: corrupted frame delivered: %+v", pos, bit, got)
+					}
+				}
+			}
+		}
+	}
+}
+
+// golden 是 testdata/golden 中一个用例的期望结果
+type golden struct {
+	wire   []byte
+	frames []Frame
+	errors []string
+}
+
+func loadGolden(t testing.TB, path string) golden {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var g golden
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		switch key {
+		case "wire":
+			g.wire, err = hex.DecodeString(strings.ReplaceAll(value, " ", ""))
+			if err != nil {
+				t.Fatalf("%s: bad wire: %v", path, err)
+			}
+		case "frame":
+			fields := strings.Fields(value)
+			if len(fields) != 3 {
+				t.Fatalf("%s: bad frame line %q", path, line)
+			}
+			version, _ := strconv.Atoi(fields[0])
+			cmd, _ := strconv.Atoi(fields[1])
+			var payload []byte
+			if fields[2] != "-" {
+				if payload, err = hex.DecodeString(fields[2]); err != nil {
+					t.Fatalf("%s: bad payload: %v", path, err)
+				}
+			}
+			g.frames = append(g.frames, Frame{Version: byte(version), Cmd: byte(cmd), Payload: payload})
+		case "error":
+			g.errors = append(g.errors, value)
+		default:
+			t.Fatalf("%s: unknown key %q", path, key)
+		}
+	}
+	return g
+}
+
+func goldenFiles(t testing.TB) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join("testdata", "golden", "*.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestGoldenFrames(t *testing.T) {
+	for _, path := range goldenFiles(t) {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".golden"), func(t *testing.T) {
+			g := loadGolden(t, path)
+
+			frames, errs := scan(g.wire)
+			var errStrs []string
+			for _, err := range errs {
+				errStrs = append(errStrs, err.Error())
+			}
+			if !reflect.DeepEqual(errStrs, g.errors) {
+				t.Errorf("expected errors %q, got %q", g.errors, errStrs)
+			}
+			if len(frames) != len(g.frames) {
+				t.Fatalf("expected %d frames, got %d", len(g.frames), len(frames))
+			}
+			for i := range frames {
+				if !sameFrame(frames[i], g.frames[i]) {
+					t.Errorf("frame %d: expected %+v, got %+v", i, g.frames[i], frames[i])
+				}
+			}
+
+			// 完整读循环（逐字节读取）必须得到同样的帧
+			streamed := collect(iotest.OneByteReader(bytes.NewReader(g.wire)))
+			if len(streamed) != len(frames) {
+				t.Fatalf("streaming parser: expected %d frames, got %d", len(frames), len(streamed))
+			}
+		})
+	}
+}
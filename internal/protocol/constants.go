@@ -10,6 +10,28 @@ const (
 	DefaultMaxPayloadSize = 64 * 1024 //64kb
 
 	ReadBufSize = 4096 // Size of the read buffer for the parser
+
+	// 负载不小于该字节数时才尝试压缩
+	CompressThreshold = 512
+)
+
+// protocol versions
+const (
+	ProtocolV1 byte = 1 // 原始帧格式，无 flags 字节
+	ProtocolV2 byte = 2 // 在 cmd 之后增加 flags 字节
+	ProtocolV3 byte = 3 // 帧格式同 v2，支持 AES-GCM 加密负载
+)
+
+// frame flags (v2+)
+const (
+	FlagCompressed byte = 1 << 0 // 负载经过 deflate 压缩
+	FlagEncrypted  byte = 1 << 1 // 负载经过 AES-GCM 加密 (v3+)
+	FlagFragment   byte = 1 << 2 // 负载是大消息的一个分片
+)
+
+// 注册时可协商的压缩算法
+const (
+	CompressionDeflate = "deflate"
 )
 
 // cmd commands
@@ -18,4 +40,19 @@ const (
 	CmdHeartbeat byte = 2 // Heartbeat signal
 	CmdStatus    byte = 3 // Status update
 	CmdError     byte = 4 // Error message
+
+	CmdStartTransaction byte = 5 // Charging transaction started
+	CmdStopTransaction  byte = 6 // Charging transaction stopped
+	CmdMeterValues      byte = 7 // Periodic meter samples
+
+	CmdAck  byte = 8  // 数据报确认，负载为被确认数据报的序号（仅 UDP）
+	CmdPoll byte = 9  // RS-485 桥接轮询，充电桩没有数据时原样应答
+	CmdPing byte = 10 // 网关探测空闲会话，充电桩原样应答
+
+	CmdCall       byte = 11 // 网关下发的请求，JSON 负载带 id 和 action，充电桩必须应答 CmdCallResult
+	CmdCallResult byte = 12 // 充电桩对 CmdCall 的应答，id 与请求相同
+
+	CmdFirmwareStatus   byte = 13 // 充电桩上报固件下载和安装的进度
+	CmdDiagnosticsChunk byte = 14 // 充电桩上传诊断文件的一片，网关以同一命令应答
+	CmdAuthorize        byte = 15 // 充电桩查询 ID 标签能否充电，网关以同一命令应答
 )
@@ -0,0 +1,212 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// 加密负载格式 (FlagEncrypted，v3 起支持):
+// keyIDLen(1) + keyID(N) + counter(8) + nonce(12) + ciphertext(M) + tag(16)
+//
+// version|cmd|flags|keyID|counter 作为附加数据参与认证，
+// 压缩在加密之前完成，FlagCompressed 描述的是解密后的明文。
+
+const (
+	nonceSize     = 12
+	counterSize   = 8
+	maxKeyIDSize  = 255
+	replayWindowN = 64 // 重放窗口可容忍的乱序帧数量
+)
+
+// SecureChannel 保存一个充电桩的会话密钥、发送计数器和重放窗口
+type SecureChannel struct {
+	keyID  string
+	aead   cipher.AEAD
+	mu     sync.Mutex
+	sendCt uint64
+	replay ReplayWindow
+}
+
+// NewSecureChannel 使用 AES-128/256 密钥创建加密通道
+func NewSecureChannel(keyID string, key []byte) (*SecureChannel, error) {
+	if keyID == "" || len(keyID) > maxKeyIDSize {
+		return nil, fmt.Errorf("invalid key id length %d", len(keyID))
+	}
+	if len(key) != 16 && len(key) != 32 {
+		return nil, fmt.Errorf("invalid aes key length %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecureChannel{keyID: keyID, aead: aead}, nil
+}
+
+// KeyID 返回通道绑定的密钥 ID（即充电桩 ID）
+func (c *SecureChannel) KeyID() string {
+	return c.keyID
+}
+
+// Seal 原地加密帧负载，需要时先压缩，调用后 Packe 不会再压缩
+func (c *SecureChannel) Seal(f *Frame) error {
+	codec, ok := LookupCodec(f.Version)
+	if !ok || codec.Flags()&FlagEncrypted == 0 {
+		return ErrEncryptionVersion
+	}
+
+	plain, flags, err := f.wirePayload(codec)
+	if err != nil {
+		return err
+	}
+	flags |= FlagEncrypted
+
+	c.mu.Lock()
+	c.sendCt++
+	counter := c.sendCt
+	c.mu.Unlock()
+
+	header := make([]byte, 0, 1+len(c.keyID)+counterSize+nonceSize)
+	header = append(header, byte(len(c.keyID)))
+	header = append(header, c.keyID...)
+	header = binary.BigEndian.AppendUint64(header, counter)
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	out := append(header, nonce...)
+	out = c.aead.Seal(out, nonce, plain, additionalData(f.Version, f.Cmd, flags, header))
+	if len(out) > DefaultMaxPayloadSize {
+		return PayloadTooLargeError
+	}
+
+	f.Payload = out
+	f.Flags = flags
+	f.Compress = false
+	return nil
+}
+
+// Open 原地解密帧负载并校验计数器，重放或乱序超出窗口的帧返回 ErrReplayedFrame
+func (c *SecureChannel) Open(f *Frame) error {
+	if f.Flags&FlagEncrypted == 0 {
+		return ErrNotEncrypted
+	}
+	if !SupportsFlag(f.Version, FlagEncrypted) {
+		return ErrEncryptionVersion
+	}
+
+	keyID, rest, err := splitKeyID(f.Payload)
+	if err != nil {
+		return err
+	}
+	if keyID != c.keyID {
+		return ErrKeyIDMismatch
+	}
+	if len(rest) < counterSize+nonceSize+c.aead.Overhead() {
+		return ErrMalformedEnvelope
+	}
+	header := f.Payload[:len(f.Payload)-len(rest)+counterSize]
+	counter := binary.BigEndian.Uint64(rest[:counterSize])
+	nonce := rest[counterSize : counterSize+nonceSize]
+	sealed := rest[counterSize+nonceSize:]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.replay.Check(counter) {
+		return ErrReplayedFrame
+	}
+	plain, err := c.aead.Open(nil, nonce, sealed, additionalData(f.Version, f.Cmd, f.Flags, header))
+	if err != nil {
+		return ErrDecryptFailed
+	}
+	// 认证通过后才推进窗口，伪造帧不能挤掉合法计数
+	c.replay.Accept(counter)
+
+	flags := f.Flags &^ FlagEncrypted
+	if flags&FlagCompressed != 0 {
+		if plain, err = decompressPayload(plain, DefaultMaxPayloadSize); err != nil {
+			return err
+		}
+		flags &^= FlagCompressed
+	}
+	f.Payload = plain
+	f.Flags = flags
+	return nil
+}
+
+// EnvelopeKeyID 从加密帧负载中取出明文携带的密钥 ID，用于查找密钥
+func EnvelopeKeyID(f Frame) (string, error) {
+	if f.Flags&FlagEncrypted == 0 {
+		return "", ErrNotEncrypted
+	}
+	keyID, _, err := splitKeyID(f.Payload)
+	return keyID, err
+}
+
+func splitKeyID(payload []byte) (string, []byte, error) {
+	if len(payload) < 1 {
+		return "", nil, ErrMalformedEnvelope
+	}
+	n := int(payload[0])
+	if n == 0 || len(payload) < 1+n {
+		return "", nil, ErrMalformedEnvelope
+	}
+	return string(payload[1 : 1+n]), payload[1+n:], nil
+}
+
+func additionalData(version, cmd, flags byte, header []byte) []byte {
+	ad := make([]byte, 0, 3+len(header))
+	ad = append(ad, version, cmd, flags)
+	return append(ad, header...)
+}
+
+// ReplayWindow 是基于滑动位图的重放检测窗口（类似 IPsec）
+type ReplayWindow struct {
+	highest uint64 // 已接受的最大计数器
+	bitmap  uint64 // 第 i 位表示 highest-i 是否已接受
+}
+
+// Check 判断计数器是否可以接受，不修改窗口
+func (w *ReplayWindow) Check(counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+	if counter > w.highest {
+		return true
+	}
+	diff := w.highest - counter
+	if diff >= replayWindowN {
+		return false
+	}
+	return w.bitmap&(1<<diff) == 0
+}
+
+// Behind 判断计数器是否已落到窗口之外，这样的计数器 Check 总是返回 false
+func (w *ReplayWindow) Behind(counter uint64) bool {
+	return counter < w.highest && w.highest-counter >= replayWindowN
+}
+
+// Accept 记录已接受的计数器，调用前需先 Check
+func (w *ReplayWindow) Accept(counter uint64) {
+	if counter > w.highest {
+		shift := counter - w.highest
+		if shift >= replayWindowN {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.highest = counter
+		return
+	}
+	w.bitmap |= 1 << (w.highest - counter)
+}
@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, 32)
+
+func newTestChannels(t *testing.T) (*SecureChannel, *SecureChannel) {
+	t.Helper()
+	tx, err := NewSecureChannel("CP-1", testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rx, err := NewSecureChannel("CP-1", testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx, rx
+}
+
+// sealAndParse 加密后经过线上编码和解析，模拟真实收发
+func sealAndParse(t *testing.T, tx *SecureChannel, f *Frame) Frame {
+	t.Helper()
+	if err := tx.Seal(f); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	frames, errs := scan(encode(t, f))
+	if len(errs) != 0 || len(frames) != 1 {
+		t.Fatalf("expected one frame, got %d frames, errors %v", len(frames), errs)
+	}
+	return frames[0]
+}
+
+func TestSecureChannel_RoundTrip(t *testing.T) {
+	tx, rx := newTestChannels(t)
+	payload := []byte(`{"status":"charging"}`)
+
+	got := sealAndParse(t, tx, NewFrame(ProtocolV3, CmdStatus, append([]byte{}, payload...)))
+	if bytes.Contains(got.Payload, payload) {
+		t.Fatal("payload sent in clear")
+	}
+	if id, err := EnvelopeKeyID(got); err != nil || id != "CP-1" {
+		t.Fatalf("expected key id CP-1, got %q (%v)", id, err)
+	}
+	if err := rx.Open(&got); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if !bytes.Equal(got.Payload, payload) || got.Flags != 0 {
+		t.Errorf("unexpected plaintext frame: %+v", got)
+	}
+}
+
+func TestSecureChannel_CompressedRoundTrip(t *testing.T) {
+	tx, rx := newTestChannels(t)
+	payload := []byte(strings.Repeat(`{"v":230.1,"a":16.0},`, 100))
+
+	f := &Frame{Version: ProtocolV3, Cmd: CmdStatus, Payload: append([]byte{}, payload...), Compress: true}
+	got := sealAndParse(t, tx, f)
+	if got.Flags&FlagCompressed == 0 || len(got.Payload) >= len(payload) {
+		t.Fatalf("expected payload to be compressed before encryption, flags=%08b len=%d", got.Flags, len(got.Payload))
+	}
+	if err := rx.Open(&got); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if !bytes.Equal(got.Payload, payload) || got.Flags != 0 {
+		t.Errorf("unexpected plaintext frame: flags=%08b", got.Flags)
+	}
+}
+
+func TestSecureChannel_RejectsReplay(t *testing.T) {
+	tx, rx := newTestChannels(t)
+
+	var sealed []Frame
+	for i := 0; i < 3; i++ {
+		sealed = append(sealed, sealAndParse(t, tx, NewFrame(ProtocolV3, CmdHeartbeat, nil)))
+	}
+	clone := func(f Frame) Frame {
+		f.Payload = append([]byte{}, f.Payload...)
+		return f
+	}
+
+	// 乱序但在窗口内的帧可以接受，重复的帧必须拒绝
+	for _, i := range []int{0, 2, 1} {
+		f := clone(sealed[i])
+		if err := rx.Open(&f); err != nil {
+			t.Fatalf("frame %d: open: %v", i, err)
+		}
+	}
+	for i := range sealed {
+		f := clone(sealed[i])
+		if err := rx.Open(&f); !errors.Is(err, ErrReplayedFrame) {
+			t.Fatalf("frame %d: expected ErrReplayedFrame, got %v", i, err)
+		}
+	}
+}
+
+func TestSecureChannel_RejectsTampering(t *testing.T) {
+	tx, rx := newTestChannels(t)
+	f := sealAndParse(t, tx, NewFrame(ProtocolV3, CmdStatus, []byte("x")))
+
+	tampered := f
+	tampered.Cmd = CmdError
+	tampered.Payload = append([]byte{}, f.Payload...)
+	if err := rx.Open(&tampered); !errors.Is(err, ErrDecryptFailed) {
+		t.Fatalf("expected ErrDecryptFailed for modified cmd, got %v", err)
+	}
+
+	// 篡改失败的帧不能占用计数器，原始帧仍然可以解密
+	if err := rx.Open(&f); err != nil {
+		t.Fatalf("open original: %v", err)
+	}
+
+	other, _ := NewSecureChannel("CP-2", testKey)
+	f2 := sealAndParse(t, tx, NewFrame(ProtocolV3, CmdStatus, []byte("y")))
+	if err := other.Open(&f2); !errors.Is(err, ErrKeyIDMismatch) {
+		t.Fatalf("expected ErrKeyIDMismatch, got %v", err)
+	}
+}
+
+func TestSecureChannel_RequiresV3(t *testing.T) {
+	tx, _ := newTestChannels(t)
+	if err := tx.Seal(NewFrame(ProtocolV2, CmdStatus, []byte("x"))); !errors.Is(err, ErrEncryptionVersion) {
+		t.Fatalf("expected ErrEncryptionVersion, got %v", err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w ReplayWindow
+	accept := func(c uint64) bool {
+		if !w.Check(c) {
+			return false
+		}
+		w.Accept(c)
+		return true
+	}
+
+	if accept(0) {
+		t.Error("counter 0 must be rejected")
+	}
+	if !accept(100) || accept(100) {
+		t.Error("counter 100 must be accepted exactly once")
+	}
+	if !accept(100-replayWindowN+1) || accept(100-replayWindowN) {
+		t.Error("window edge handled incorrectly")
+	}
+	if !accept(1000) || accept(100) {
+		t.Error("counters behind a large jump must be rejected")
+	}
+}
@@ -8,4 +8,36 @@ var (
 	ErrNeedMoreData = errors.New("need more data to parse frame")
 
 	ErrCRCMismatch = errors.New("crc mismatch")
+
+	ErrInvalidTail = errors.New("invalid frame tail")
+
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+	ErrUnsupportedFlags = errors.New("frame flags not supported by protocol version")
+
+	ErrDecompressedTooLarge = errors.New("decompressed payload exceeds maximum allowed size")
+
+	ErrEncryptionVersion = errors.New("encrypted frames require protocol v3")
+
+	ErrNotEncrypted = errors.New("frame is not encrypted")
+
+	ErrMalformedEnvelope = errors.New("malformed encrypted payload")
+
+	ErrKeyIDMismatch = errors.New("encryption key id mismatch")
+
+	ErrDecryptFailed = errors.New("payload decryption failed")
+
+	ErrReplayedFrame = errors.New("replayed frame")
+
+	ErrMalformedDatagram = errors.New("datagram is not exactly one frame")
+
+	ErrFragmentVersion = errors.New("fragmented frames require protocol v2")
+
+	ErrMalformedFragment = errors.New("malformed fragment")
+
+	ErrTooManyFragments = errors.New("payload needs more than 65535 fragments")
+
+	ErrMessageTooLarge = errors.New("message exceeds maximum reassembled size")
+
+	ErrReassemblyOverflow = errors.New("reassembly buffer full")
 )
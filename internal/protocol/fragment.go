@@ -0,0 +1,225 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/internal/timewheel"
+)
+
+// 分片负载格式 (FlagFragment，v2 起支持):
+// msgID(4) + index(2) + count(2) + chunk(N)
+//
+// 同一消息的所有分片使用相同的 msgID 和 cmd，index 从 0 开始。
+
+const (
+	fragmentHeaderSize = 4 + 2 + 2
+
+	// 单个分片携带的最大数据量，为分片头和加密信封预留空间
+	MaxFragmentChunk = DefaultMaxPayloadSize - fragmentHeaderSize - 512
+
+	// 重组后单条消息的最大长度
+	MaxMessageSize = 16 * 1024 * 1024
+
+	DefaultReassemblyTimeout  = 30 * time.Second
+	DefaultReassemblyMaxBytes = 32 * 1024 * 1024
+)
+
+// Fragment 把大负载拆成若干分片帧，负载不超过 chunkSize 时原样返回
+func Fragment(f *Frame, msgID uint32, chunkSize int) ([]*Frame, error) {
+	if len(f.Payload) <= chunkSize {
+		return []*Frame{f}, nil
+	}
+	if !SupportsFlag(f.Version, FlagFragment) {
+		return nil, ErrFragmentVersion
+	}
+	if chunkSize <= 0 || chunkSize > MaxFragmentChunk {
+		return nil, fmt.Errorf("invalid fragment chunk size %d", chunkSize)
+	}
+	if len(f.Payload) > MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	// 分片头里的数量只有 16 位，超出后会回绕成错误的数量
+	count := (len(f.Payload) + chunkSize - 1) / chunkSize
+	if count > math.MaxUint16 {
+		return nil, ErrTooManyFragments
+	}
+	frames := make([]*Frame, 0, count)
+	for i := 0; i < count; i++ {
+		chunk := f.Payload[i*chunkSize : min((i+1)*chunkSize, len(f.Payload))]
+
+		payload := make([]byte, 0, fragmentHeaderSize+len(chunk))
+		payload = binary.BigEndian.AppendUint32(payload, msgID)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(i))
+		payload = binary.BigEndian.AppendUint16(payload, uint16(count))
+		payload = append(payload, chunk...)
+
+		frames = append(frames, &Frame{
+			Version:  f.Version,
+			Cmd:      f.Cmd,
+			Flags:    f.Flags | FlagFragment,
+			Payload:  payload,
+			Compress: f.Compress,
+		})
+	}
+	return frames, nil
+}
+
+// Reassembler 按会话缓存分片并重组成完整的帧，可以并发调用
+type Reassembler struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	maxBytes int
+	buffered int
+	pending  map[uint32]*partialMessage
+	now      func() time.Time
+
+	// Timers 不为空时每条未收齐的消息在时间轮上挂一个到期定时器，
+	// 为空时在每次 Add 和 Expire 时扫描全部缓存
+	Timers *timewheel.Wheel
+}
+
+type partialMessage struct {
+	cmd      byte
+	version  byte
+	flags    byte
+	chunks   [][]byte
+	received int
+	size     int
+	deadline time.Time
+	timer    *timewheel.Timer
+}
+
+// NewReassembler 创建重组缓冲，timeout 为单条消息最长等待时间，maxBytes 为缓存上限
+func NewReassembler(timeout time.Duration, maxBytes int) *Reassembler {
+	return &Reassembler{
+		timeout:  timeout,
+		maxBytes: maxBytes,
+		pending:  make(map[uint32]*partialMessage),
+		now:      time.Now,
+	}
+}
+
+// Add 加入一帧；非分片帧原样返回，分片帧在收齐前返回 nil
+func (r *Reassembler) Add(f Frame) (*Frame, error) {
+	if f.Flags&FlagFragment == 0 {
+		return &f, nil
+	}
+	if len(f.Payload) < fragmentHeaderSize {
+		return nil, ErrMalformedFragment
+	}
+	msgID := binary.BigEndian.Uint32(f.Payload[0:4])
+	index := int(binary.BigEndian.Uint16(f.Payload[4:6]))
+	count := int(binary.BigEndian.Uint16(f.Payload[6:8]))
+	chunk := f.Payload[fragmentHeaderSize:]
+	if count == 0 || index >= count {
+		return nil, ErrMalformedFragment
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if r.Timers == nil {
+		r.expire(now)
+	}
+
+	msg, ok := r.pending[msgID]
+	if !ok {
+		msg = &partialMessage{
+			cmd:      f.Cmd,
+			version:  f.Version,
+			flags:    f.Flags &^ FlagFragment,
+			chunks:   make([][]byte, count),
+			deadline: now.Add(r.timeout),
+		}
+		r.pending[msgID] = msg
+		if r.Timers != nil {
+			msg.timer = r.Timers.AfterFunc(r.timeout, func() { r.timedOut(msgID, msg) })
+		}
+	}
+	if len(msg.chunks) != count || msg.cmd != f.Cmd {
+		r.drop(msgID)
+		return nil, ErrMalformedFragment
+	}
+	if msg.chunks[index] != nil {
+		// 重复的分片直接忽略
+		return nil, nil
+	}
+	if msg.size+len(chunk) > MaxMessageSize {
+		r.drop(msgID)
+		return nil, ErrMessageTooLarge
+	}
+	if r.buffered+len(chunk) > r.maxBytes {
+		r.drop(msgID)
+		return nil, ErrReassemblyOverflow
+	}
+
+	msg.chunks[index] = chunk
+	msg.received++
+	msg.size += len(chunk)
+	r.buffered += len(chunk)
+	if msg.received < count {
+		return nil, nil
+	}
+
+	payload := make([]byte, 0, msg.size)
+	for _, c := range msg.chunks {
+		payload = append(payload, c...)
+	}
+	r.drop(msgID)
+	return &Frame{
+		Version: msg.version,
+		Cmd:     msg.cmd,
+		Flags:   msg.flags,
+		Payload: payload,
+	}, nil
+}
+
+// Expire 丢弃超时未收齐的消息，返回丢弃的数量
+func (r *Reassembler) Expire() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.expire(r.now())
+}
+
+// Buffered 返回当前缓存的字节数
+func (r *Reassembler) Buffered() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buffered
+}
+
+func (r *Reassembler) expire(now time.Time) int {
+	n := 0
+	for id, msg := range r.pending {
+		if now.After(msg.deadline) {
+			r.drop(id)
+			n++
+		}
+	}
+	return n
+}
+
+// timedOut 由时间轮调用，消息已经收齐或被丢弃时什么也不做
+func (r *Reassembler) timedOut(msgID uint32, msg *partialMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending[msgID] == msg {
+		r.drop(msgID)
+	}
+}
+
+func (r *Reassembler) drop(msgID uint32) {
+	if msg, ok := r.pending[msgID]; ok {
+		if msg.timer != nil {
+			msg.timer.Stop()
+		}
+		r.buffered -= msg.size
+		delete(r.pending, msgID)
+	}
+}
@@ -0,0 +1,176 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/timewheel"
+)
+
+func TestFragment_SmallPayloadUnchanged(t *testing.T) {
+	f := NewFrame(ProtocolV2, CmdStatus, []byte("small"))
+	frames, err := Fragment(f, 1, MaxFragmentChunk)
+	if err != nil || len(frames) != 1 || frames[0] != f {
+		t.Fatalf("expected the frame itself, got %v (%v)", frames, err)
+	}
+}
+
+func TestFragment_RequiresV2(t *testing.T) {
+	f := NewFrame(ProtocolV1, CmdStatus, make([]byte, 100))
+	if _, err := Fragment(f, 1, 10); !errors.Is(err, ErrFragmentVersion) {
+		t.Fatalf("expected ErrFragmentVersion, got %v", err)
+	}
+}
+
+func TestFragment_TooManyFragments(t *testing.T) {
+	f := NewFrame(ProtocolV2, CmdStatus, make([]byte, 1<<16))
+	if _, err := Fragment(f, 1, 1); !errors.Is(err, ErrTooManyFragments) {
+		t.Fatalf("expected ErrTooManyFragments, got %v", err)
+	}
+	if frames, err := Fragment(f, 1, 2); err != nil || len(frames) != 1<<15 {
+		t.Fatalf("expected %d fragments, got %d (%v)", 1<<15, len(frames), err)
+	}
+}
+
+func TestFragment_ReassembleOverWire(t *testing.T) {
+	payload := make([]byte, 3*DefaultMaxPayloadSize+123)
+	rand.New(rand.NewSource(3)).Read(payload)
+
+	tx, rx := newTestChannels(t)
+	frames, err := Fragment(NewFrame(ProtocolV3, CmdStatus, payload), 7, MaxFragmentChunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 4 {
+		t.Fatalf("expected 4 fragments, got %d", len(frames))
+	}
+
+	// 分片逐个加密、编码，乱序到达
+	var wire [][]byte
+	for _, f := range frames {
+		if err := tx.Seal(f); err != nil {
+			t.Fatal(err)
+		}
+		wire = append(wire, encode(t, f))
+	}
+	rand.New(rand.NewSource(4)).Shuffle(len(wire), func(i, j int) { wire[i], wire[j] = wire[j], wire[i] })
+
+	r := NewReassembler(time.Minute, DefaultReassemblyMaxBytes)
+	var whole *Frame
+	for i, w := range wire {
+		parsed, errs := scan(w)
+		if len(errs) != 0 || len(parsed) != 1 {
+			t.Fatalf("fragment %d: parse failed: %v", i, errs)
+		}
+		if err := rx.Open(&parsed[0]); err != nil {
+			t.Fatalf("fragment %d: open: %v", i, err)
+		}
+		got, err := r.Add(parsed[0])
+		if err != nil {
+			t.Fatalf("fragment %d: add: %v", i, err)
+		}
+		if i < len(wire)-1 && got != nil {
+			t.Fatalf("message completed early at fragment %d", i)
+		}
+		whole = got
+	}
+	if whole == nil {
+		t.Fatal("message not reassembled")
+	}
+	if whole.Cmd != CmdStatus || whole.Flags != 0 || !bytes.Equal(whole.Payload, payload) {
+		t.Errorf("unexpected reassembled frame: cmd=%d flags=%08b len=%d", whole.Cmd, whole.Flags, len(whole.Payload))
+	}
+	if r.Buffered() != 0 {
+		t.Errorf("expected empty buffer after reassembly, got %d bytes", r.Buffered())
+	}
+}
+
+func TestReassembler_Timeout(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewReassembler(10*time.Second, DefaultReassemblyMaxBytes)
+	r.now = func() time.Time { return now }
+
+	frames, _ := Fragment(NewFrame(ProtocolV2, CmdStatus, make([]byte, 30)), 1, 10)
+	if got, err := r.Add(*frames[0]); got != nil || err != nil {
+		t.Fatalf("unexpected result: %v %v", got, err)
+	}
+
+	now = now.Add(11 * time.Second)
+	if n := r.Expire(); n != 1 || r.Buffered() != 0 {
+		t.Fatalf("expected 1 expired message and empty buffer, got %d, %d bytes", n, r.Buffered())
+	}
+
+	// 超时后迟到的分片不能拼出完整消息
+	for _, f := range frames[1:] {
+		if got, _ := r.Add(*f); got != nil {
+			t.Fatal("late fragments must not complete an expired message")
+		}
+	}
+}
+
+func TestReassembler_TimeoutOnWheel(t *testing.T) {
+	clock := timewheel.NewFakeClock(time.Unix(0, 0))
+	wheel := timewheel.New(time.Second, clock)
+	wheel.Start()
+	defer wheel.Stop()
+	r := NewReassembler(10*time.Second, DefaultReassemblyMaxBytes)
+	r.Timers = wheel
+
+	frames, _ := Fragment(NewFrame(ProtocolV2, CmdStatus, make([]byte, 30)), 1, 10)
+	r.Add(*frames[0])
+	clock.Advance(9 * time.Second)
+	if r.Buffered() == 0 {
+		t.Fatal("message dropped before its deadline")
+	}
+	clock.Advance(2 * time.Second)
+	if r.Buffered() != 0 || wheel.Len() != 0 {
+		t.Fatalf("expected the wheel to drop the message, got %d bytes and %d timers", r.Buffered(), wheel.Len())
+	}
+
+	// 收齐的消息要取消定时器
+	frames, _ = Fragment(NewFrame(ProtocolV2, CmdStatus, make([]byte, 30)), 2, 10)
+	for _, f := range frames {
+		r.Add(*f)
+	}
+	if wheel.Len() != 0 {
+		t.Fatalf("completed message left %d timers", wheel.Len())
+	}
+}
+
+func TestReassembler_MemoryCap(t *testing.T) {
+	r := NewReassembler(time.Minute, 25)
+
+	a, _ := Fragment(NewFrame(ProtocolV2, CmdStatus, make([]byte, 40)), 1, 20)
+	b, _ := Fragment(NewFrame(ProtocolV2, CmdStatus, make([]byte, 40)), 2, 20)
+
+	if _, err := r.Add(*a[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Add(*b[0]); !errors.Is(err, ErrReassemblyOverflow) {
+		t.Fatalf("expected ErrReassemblyOverflow, got %v", err)
+	}
+	if got, err := r.Add(*a[1]); err == nil || got != nil {
+		// a 还差 20 字节，缓存 20+20 超过上限
+		t.Fatalf("expected overflow for second half of a, got %v %v", got, err)
+	}
+	if r.Buffered() != 0 {
+		t.Errorf("expected buffer drained after overflow, got %d", r.Buffered())
+	}
+}
+
+func TestReassembler_RejectsMalformed(t *testing.T) {
+	r := NewReassembler(time.Minute, DefaultReassemblyMaxBytes)
+	bad := []Frame{
+		{Version: ProtocolV2, Cmd: CmdStatus, Flags: FlagFragment, Payload: []byte{0, 0}},
+		{Version: ProtocolV2, Cmd: CmdStatus, Flags: FlagFragment, Payload: []byte{0, 0, 0, 1, 0, 2, 0, 2}},
+		{Version: ProtocolV2, Cmd: CmdStatus, Flags: FlagFragment, Payload: []byte{0, 0, 0, 1, 0, 0, 0, 0}},
+	}
+	for i, f := range bad {
+		if _, err := r.Add(f); !errors.Is(err, ErrMalformedFragment) {
+			t.Errorf("case %d: expected ErrMalformedFragment, got %v", i, err)
+		}
+	}
+}
@@ -3,15 +3,19 @@ package protocol
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
-// header(2) + version(1) + cmd(1) + length(4) +Payload(N)+ crc(2) + tail(2)
-
 type Frame struct {
 	Version byte
 	Cmd     byte
+	Flags   byte // 帧标志位，仅 v2 及以上版本在线上携带
 	Payload []byte
+
+	// Compress 为 true 时，Packe 会在负载超过 CompressThreshold 时压缩负载，
+	// 由会话根据注册时协商的结果设置
+	Compress bool
 }
 
 func NewFrame(version byte, cmd byte, payload []byte) *Frame {
@@ -23,72 +27,70 @@ func NewFrame(version byte, cmd byte, payload []byte) *Frame {
 }
 
 // pack to make Frame into io.Write (BigEndian)
+// 帧格式由 Version 对应的 Codec 决定
 func (f *Frame) Packe(w io.Writer) error {
+	codec, ok := LookupCodec(f.Version)
+	if !ok {
+		return ErrUnsupportedVersion
+	}
+
 	//check if the payload size is within limits
-	payloadLength := uint32(len(f.Payload))
-	if payloadLength > DefaultMaxPayloadSize {
+	if len(f.Payload) > DefaultMaxPayloadSize {
 		return PayloadTooLargeError
 	}
 
-	//header
-	if err := write(w, FrameHeader); err != nil {
+	payload, flags, err := f.wirePayload(codec)
+	if err != nil {
 		return err
 	}
-
-	// write version and cmd
-	if err := write(w, f.Version); err != nil {
-		return err
+	if flags&^codec.Flags() != 0 {
+		return fmt.Errorf("protocol v%d does not support flags %08b", f.Version, flags)
 	}
 
-	// Length of payload
-	if err := write(w, payloadLength); err != nil {
-		return err
-	}
+	return codec.Encode(w, &Frame{
+		Version: f.Version,
+		Cmd:     f.Cmd,
+		Flags:   flags,
+		Payload: payload,
+	})
+}
 
-	//payload
-	if payloadLength > 0 {
-		if err := write(w, f.Payload); err != nil {
-			return err
-		}
+// wirePayload 返回实际写到线上的负载和标志位
+func (f *Frame) wirePayload(codec Codec) ([]byte, byte, error) {
+	// 加密帧已经在 Seal 中压缩过
+	if f.Flags&FlagEncrypted != 0 {
+		return f.Payload, f.Flags, nil
 	}
-
-	// CRC calc on (version|cmd|len|payload)
-	crcData := make([]byte, 0, 1+1+4+len(f.Payload))
-	crcData = append(crcData, f.Version, f.Cmd)
-	lenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBuf, payloadLength)
-	crcData = append(crcData, lenBuf...)
-	crcData = append(crcData, f.Payload...)
-
-	crc := CRC16CCITT(crcData)
-	if err := binary.Write(w, binary.BigEndian, crc); err != nil {
-		return err
+	flags := f.Flags &^ FlagCompressed
+	if !f.Compress || codec.Flags()&FlagCompressed == 0 || len(f.Payload) < CompressThreshold {
+		return f.Payload, flags, nil
 	}
-
-	//tail
-	if err := write(w, FrameTail); err != nil {
-		return err
+	compressed, err := compressPayload(f.Payload)
+	if err != nil {
+		return nil, 0, err
 	}
-	return nil
-
+	// 压缩后没有变小就按原样发送
+	if len(compressed) >= len(f.Payload) {
+		return f.Payload, flags, nil
+	}
+	return compressed, flags | FlagCompressed, nil
 }
 
-//	if err := binary.Write(w, binary.BigEndian, FrameHeader); err != nil {
-//
-// return err
-// }
+// write 以大端序写入 data，[]byte 原样写入
 func write(w io.Writer, data any) error {
+	if w == nil {
+		return errors.New("nil writer")
+	}
 	switch v := data.(type) {
 	case []byte:
 		_, err := w.Write(v)
 		return err
 	default:
-		if err := binary.Write(w, binary.BigEndian, data); err != nil {
-			return err
+		if binary.Size(data) <= 0 {
+			return errors.New("unsupported type for write")
 		}
+		return binary.Write(w, binary.BigEndian, data)
 	}
-
-	return errors.New("unsupported type for write")
 }
 
 func CRC16CCITT(data []byte) uint16 {
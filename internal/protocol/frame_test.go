@@ -72,19 +72,13 @@ func TestWrite(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			var buf bytes.Buffer
-			writer := tt.writer
-			if writer == nil {
-				writer = &buf
-			}
-
-			err := write(writer, tt.input)
+			err := write(tt.writer, tt.input)
 
 			if (err != nil) != tt.expectErr {
 				t.Fatalf("expected error: %v, got: %v", tt.expectErr, err)
 			}
 
-			if !tt.expectErr && writer == &buf && !bytes.Equal(buf.Bytes(), tt.expected) {
+			if buf, ok := tt.writer.(*bytes.Buffer); ok && !tt.expectErr && !bytes.Equal(buf.Bytes(), tt.expected) {
 				t.Errorf("expected output: %v, got: %v", tt.expected, buf.Bytes())
 			}
 		})
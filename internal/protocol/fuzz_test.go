@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"testing/iotest"
+)
+
+// 模糊测试发现的问题输入，修复后请整理成 testdata/golden 下的黄金帧用例，
+// 黄金帧同时作为下面两个模糊测试的种子语料。
+
+func FuzzParser(f *testing.F) {
+	for _, path := range goldenFiles(f) {
+		f.Add(loadGolden(f, path).wire)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frames, _ := scan(data)
+
+		for _, frame := range frames {
+			// 不支持压缩的版本，重新编码后必须原样出现在输入中
+			if !SupportsFlag(frame.Version, FlagCompressed) && !bytes.Contains(data, encode(t, &frame)) {
+				t.Fatalf("frame %+v not present in input", frame)
+			}
+			again, _ := scan(encode(t, &frame))
+			if len(again) != 1 || !sameFrame(again[0], frame) {
+				t.Fatalf("frame %+v does not survive re-encoding", frame)
+			}
+		}
+
+		streamed := collect(iotest.OneByteReader(bytes.NewReader(data)))
+		if len(streamed) != len(frames) {
+			t.Fatalf("streaming parser: expected %d frames, got %d", len(frames), len(streamed))
+		}
+		for i := range frames {
+			if !sameFrame(streamed[i], frames[i]) {
+				t.Fatalf("frame %d: expected %+v, got %+v", i, frames[i], streamed[i])
+			}
+		}
+	})
+}
+
+func FuzzFrameRoundTrip(f *testing.F) {
+	f.Add(ProtocolV1, CmdRegister, []byte("CP-0001"), false)
+	f.Add(ProtocolV1, CmdHeartbeat, []byte{}, false)
+	f.Add(ProtocolV2, CmdStatus, bytes.Repeat([]byte(`{"a":1}`), 100), true)
+	f.Add(byte(0xAA), byte(0x55), []byte{0xAA, 0x55, 0x55, 0xAA}, true)
+
+	f.Fuzz(func(t *testing.T, version, cmd byte, payload []byte, compress bool) {
+		frame := NewFrame(version, cmd, payload)
+		frame.Compress = compress
+
+		var buf bytes.Buffer
+		err := frame.Packe(&buf)
+		if _, ok := LookupCodec(version); !ok {
+			if !errors.Is(err, ErrUnsupportedVersion) {
+				t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+			}
+			return
+		}
+		if len(payload) > DefaultMaxPayloadSize {
+			if !errors.Is(err, PayloadTooLargeError) {
+				t.Fatalf("expected PayloadTooLargeError, got %v", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("pack frame: %v", err)
+		}
+
+		frames, errs := scan(buf.Bytes())
+		if len(errs) != 0 || len(frames) != 1 || !sameFrame(frames[0], *frame) {
+			t.Fatalf("round trip: expected %+v, got %+v (errors %v)", *frame, frames, errs)
+		}
+	})
+}
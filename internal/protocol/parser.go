@@ -38,12 +38,16 @@ func (p *Parser) Errors() <-chan error {
 	return p.errCh
 }
 
-func (p *Parser) handleParseError(err error) {
-	// 报告错误（非堵塞）
+// reportError 报告错误（非堵塞）
+func (p *Parser) reportError(err error) {
 	select {
 	case p.errCh <- err:
 	default:
 	}
+}
+
+func (p *Parser) handleParseError(err error) {
+	p.reportError(err)
 
 	//重同步策略：在剩余的缓冲区中查找下一个帧头
 	next := -1
@@ -75,12 +79,15 @@ func (p *Parser) Start() {
 
 func (p *Parser) loop() {
 	defer p.wg.Done()
+	defer close(p.framesCh)
 	readBuf := make([]byte, p.readBufSize)
 	for {
 		if p.parseFrames() {
 			return
 		}
 		if p.readMoreDat(readBuf) {
+			// 读取结束前把最后一批数据也解析掉
+			p.parseFrames()
 			return
 		}
 		if p.checkQuit() {
@@ -92,53 +99,52 @@ func (p *Parser) loop() {
 func (p *Parser) checkQuit() bool {
 	select {
 	case <-p.quit:
-		close(p.framesCh)
 		return true
 	default:
 		return false
 	}
 }
 
-// 从reader中曲度数据到缓冲区
+// 从reader中读取数据到缓冲区，返回 true 表示数据源已结束
 func (p *Parser) readMoreDat(readBuf []byte) bool {
 	n, err := p.r.Read(readBuf)
 	if n > 0 {
 		p.buf = append(p.buf, readBuf[:n]...)
 	}
 	if err != nil {
-		if err == io.EOF {
-			close(p.framesCh)
-			return true
-		}
-
-		// 其他错误处理
-		select {
-		case p.errCh <- err:
-		default:
+		if err != io.EOF {
+			p.reportError(err)
 		}
-		close(p.framesCh)
 		return true
 	}
 	return false
 }
 
+// 解析缓冲区中所有完整的帧，返回 true 表示解析器已被停止
 func (p *Parser) parseFrames() bool {
 	for {
 		frame, consumed, err := p.tryParse()
 		if err != nil {
+			if errors.Is(err, ErrNeedMoreData) {
+				return false
+			}
+			// 帧边界明确的错误直接丢弃整帧，否则重新同步
+			if consumed > 0 {
+				p.reportError(err)
+				p.consumeBufferByte(consumed)
+				continue
+			}
 			p.handleParseError(err)
 			continue
 		}
-		if consumed > 0 && frame != nil {
-			if p.sendFrame(*frame) {
-				return true // 发送失败，退出解析
-			}
-			p.consumeBufferByte(consumed)
-			continue
+		if frame != nil && p.sendFrame(*frame) {
+			return true
 		}
-		break
+		if consumed == 0 {
+			return false
+		}
+		p.consumeBufferByte(consumed)
 	}
-	return false
 }
 
 func (p *Parser) sendFrame(frame Frame) bool {
@@ -146,7 +152,6 @@ func (p *Parser) sendFrame(frame Frame) bool {
 	case p.framesCh <- frame:
 		return false
 	case <-p.quit:
-		close(p.framesCh)
 		return true
 	}
 }
@@ -187,57 +192,48 @@ func (p *Parser) tryParse() (*Frame, int, error) {
 		return nil, headIdx, nil
 	}
 
-	//现在 buf[0:2] 是帧头
-	if len(p.buf) < DefaultMinFrameSize {
-		return nil, 0, errors.New("frame too short")
+	//现在 buf[0:2] 是帧头，buf[2] 是版本号
+	if len(p.buf) < 3 {
+		return nil, 0, ErrNeedMoreData
 	}
-
-	version := p.buf[2]
-	cmd := p.buf[3]
-	length := binary.BigEndian.Uint32(p.buf[4:8])
-
-	if length > p.maxPayload {
-		return nil, 0, errors.New("payload too large")
+	codec, ok := LookupCodec(p.buf[2])
+	if !ok {
+		return nil, 0, ErrUnsupportedVersion
 	}
 
-	totalLen := int(2 + 1 + 1 + 4 + length + 2 + 2)
+	return decodeFrame(codec, p.buf, p.maxPayload)
+}
 
-	if len(p.buf) < totalLen {
-		return nil, 0, errors.New("data not enough for full frame")
+func decodeFrame(codec Codec, buf []byte, maxPayload uint32) (*Frame, int, error) {
+	frame, totalLen, err := codec.Decode(buf, maxPayload)
+	if err != nil {
+		return nil, totalLen, err
 	}
 
-	// 校验tail
-	tailPos := 2 + 1 + 1 + 4 + int(length) + 2
-	tail := binary.BigEndian.Uint16(p.buf[tailPos : tailPos+2])
-	if tail != FrameTail {
-		return nil, 0, errors.New("invalid frame tail")
+	// 帧本身完整有效，解压失败时直接丢弃整帧；加密帧在解密后才解压
+	if frame.Flags&FlagCompressed != 0 && frame.Flags&FlagEncrypted == 0 {
+		plain, err := decompressPayload(frame.Payload, int(maxPayload))
+		if err != nil {
+			return nil, totalLen, err
+		}
+		frame.Payload = plain
+		frame.Flags &^= FlagCompressed
 	}
+	return frame, totalLen, nil
+}
 
-	payloadStart := 2 + 1 + 1 + 4
-	payload := make([]byte, length)
-	copy(payload, p.buf[payloadStart:payloadStart+int(length)])
-
-	//crc
-
-	crcPos := payloadStart + int(length)
-	readCRC := binary.BigEndian.Uint16(p.buf[crcPos : crcPos+2])
-
-	crcData := make([]byte, 0, 1+1+4+len(payload))
-	crcData = append(crcData, version, cmd)
-	lenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBuf, length)
-	crcData = append(crcData, lenBuf...)
-	crcData = append(crcData, payload...)
-
-	expCRC := CRC16CCITT(crcData)
-	if readCRC != expCRC {
-		return nil, 0, ErrCRCMismatch
+// Unpack 解析恰好包含一帧的缓冲，例如一个 UDP 数据报；不足一帧或有多余字节都视为错误
+func Unpack(buf []byte, maxPayload uint32) (*Frame, error) {
+	if len(buf) < 3 || binary.BigEndian.Uint16(buf) != FrameHeader {
+		return nil, ErrMalformedDatagram
 	}
-
-	frame := &Frame{
-		Version: version,
-		Cmd:     cmd,
-		Payload: payload,
+	codec, ok := LookupCodec(buf[2])
+	if !ok {
+		return nil, ErrUnsupportedVersion
 	}
-	return frame, totalLen, nil
+	frame, n, err := decodeFrame(codec, buf, maxPayload)
+	if errors.Is(err, ErrNeedMoreData) || err == nil && n != len(buf) {
+		return nil, ErrMalformedDatagram
+	}
+	return frame, err
 }
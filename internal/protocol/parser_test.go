@@ -51,44 +51,3 @@ func TestTryParse_ValidFrame(t *testing.T) {
 		t.Errorf("unexpected payload: %s", string(frame.Payload))
 	}
 }
-
-//
-// func TestTryParse(t *testing.T) {
-// 	tests := []struct {
-// 		name        string
-// 		buf         []byte
-// 		expected    *Frame
-// 		expectedLen int
-// 		expectErr   error
-// 	}{
-// 		{
-// 			name:        "Valid frame",
-// 			buf:         []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05},
-// 			expected:    &Frame{Version: 1, Cmd: 2, Payload: []byte{0x03, 0x04, 0x05}},
-// 			expectedLen: 6,
-// 			expectErr:   nil,
-// 		},
-// 		{
-// 			name:        "Incomplete frame",
-// 			buf:         []byte{0x00, 0x01},
-// 			expected:    nil,
-// 			expectedLen: 2,
-// 			expectErr:   ErrNeedMoreData,
-// 		},
-// 	}
-// 	for _, tt := range tests {
-// 		t.Run(tt.name, func(t *testing.T) {
-// 			p := &Parser{buf: tt.buf}
-// 			frame, length, err := p.tryParse()
-// 			if !errors.Is(err, tt.expectErr) {
-// 				t.Errorf("expected error %v, got %v", tt.expectErr, err)
-// 			}
-// 			if frame != nil && *frame != *tt.expected {
-// 				t.Errorf("expected frame %v, got %v", tt.expected, frame)
-// 			}
-// 			if length != tt.expectedLen {
-// 				t.Errorf("expected length %d, got %d", tt.expectedLen, length)
-// 			}
-// 		})
-// 	}
-// }
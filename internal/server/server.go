@@ -1,92 +1,247 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/x14n/evgateway/internal/api"
+	"github.com/x14n/evgateway/internal/auth"
+	"github.com/x14n/evgateway/internal/chargerconfig"
+	"github.com/x14n/evgateway/internal/chargingprofile"
 	"github.com/x14n/evgateway/internal/config"
+	"github.com/x14n/evgateway/internal/credential"
+	"github.com/x14n/evgateway/internal/diagnostics"
+	"github.com/x14n/evgateway/internal/firmware"
 	"github.com/x14n/evgateway/internal/gateway"
 	"github.com/x14n/evgateway/internal/handlers"
+	"github.com/x14n/evgateway/internal/inventory"
+	"github.com/x14n/evgateway/internal/northbound"
+	"github.com/x14n/evgateway/internal/ocpp"
 	"github.com/x14n/evgateway/internal/protocol"
+	"github.com/x14n/evgateway/internal/smartcharging"
+	"github.com/x14n/evgateway/internal/timewheel"
+	"github.com/x14n/evgateway/internal/transport"
 	"github.com/x14n/evgateway/utils"
 	"github.com/x14n/evgateway/version"
 )
 
 type Server struct {
-	Addr       string
-	Gateway    *gateway.Gateway
-	Dispatcher *gateway.Dispatcher
-	Workerpool *WorkerPool
+	Addr        string
+	Gateway     *gateway.Gateway
+	Dispatcher  *gateway.Dispatcher
+	Workerpool  *WorkerPool
+	Credentials credential.Store // 加密帧使用的密钥，为 nil 时拒绝所有加密帧
+
+	ReassemblyTimeout  time.Duration
+	ReassemblyMaxBytes int
+
+	KeepAlive net.KeepAliveConfig // TCP 和 TLS 监听器上每个连接的 keepalive
+
+	Timers          *timewheel.Wheel // 注册超时和分片重组超时使用的时间轮
+	RegisterTimeout time.Duration    // 连接建立后必须在此时间内完成注册，否则断开
+
+	// 加密通道按密钥 ID 保存，计数器和重放窗口跨连接保留，重连后不能重放旧连接上截获的帧
+	channelsMu sync.Mutex
+	channels   map[string]*secureChannel
 }
 
+type secureChannel struct {
+	key []byte
+	ch  *protocol.SecureChannel
+}
+
+const DefaultRegisterTimeout = 30 * time.Second
+
 func NewServer(addr string, gw *gateway.Gateway, dispatcher *gateway.Dispatcher, wp *WorkerPool) *Server {
 	return &Server{
 		Addr:       addr,
 		Gateway:    gw,
 		Dispatcher: dispatcher,
 		Workerpool: wp,
+
+		ReassemblyTimeout:  protocol.DefaultReassemblyTimeout,
+		ReassemblyMaxBytes: protocol.DefaultReassemblyMaxBytes,
+
+		KeepAlive: transport.DefaultKeepAlive,
+
+		Timers:          timewheel.Default(),
+		RegisterTimeout: DefaultRegisterTimeout,
 	}
 }
 
 func (s *Server) ListenAndServer() error {
-	ln, err := net.Listen("tcp", s.Addr)
+	ln, err := transport.ListenTCPKeepAlive(s.Addr, s.KeepAlive)
 	if err != nil {
 		fmt.Printf("tcp listen error: %v\n", err)
 		return err
 	}
 	fmt.Println("TCPServer listen at :", s.Addr)
+	return s.Serve(ln)
+}
 
+// Serve 在任意 Listener 上接受充电桩连接，直到监听器关闭
+func (s *Server) Serve(ln transport.Listener) error {
 	for {
-		conn, err := ln.Accept()
+		t, err := ln.Accept()
 		if err != nil {
-			fmt.Printf("tcp accept error %v", err)
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, transport.ErrListenerClosed) {
+				return err
+			}
+			fmt.Printf("accept error on %s: %v\n", ln.Addr(), err)
 			continue
 		}
-		fmt.Printf("New connection from %s\n", conn.RemoteAddr().String())
+		fmt.Printf("New connection from %s\n", t.RemoteAddr())
 
+		now := time.Now()
 		session := &gateway.Session{
-			ID:       "",
-			Addr:     conn.RemoteAddr().String(),
-			Conn:     conn,
-			Lastseen: time.Now(),
+			ID:          "",
+			Addr:        t.RemoteAddr(),
+			Transport:   t,
+			ConnectedAt: now,
+			Lastseen:    now,
 		}
 
 		s.Gateway.AddSession(session)
+		s.Gateway.Emit(gateway.Event{Type: gateway.EventSessionConnected, Data: gateway.SessionConnectedEvent{Addr: session.Addr}})
 
-		go handleConnect(conn, session, s)
+		go handleConnect(t, session, s)
 	}
 }
 
-func handleConnect(conn net.Conn, session *gateway.Session, srv *Server) {
+func handleConnect(t transport.Transport, session *gateway.Session, srv *Server) {
+	// 迟迟不注册的连接占着资源，到期关闭链路，读循环随之退出
+	deadline := srv.Timers.AfterFunc(srv.RegisterTimeout, func() {
+		if !session.Registered() {
+			fmt.Printf("session %s not registered within %v, closing\n", session.Addr, srv.RegisterTimeout)
+			t.Close()
+		}
+	})
 	defer func() {
-		conn.Close()
-		srv.Gateway.RemoveSession(session.ID)
+		deadline.Stop()
+		session.Close()
+		srv.Gateway.RemoveSession(session)
 		fmt.Printf("Connection closed for session %s\n", session.ID)
+		if session.ID != "" {
+			srv.Gateway.Emit(gateway.Event{Type: gateway.EventSessionClosed, ChargerID: session.ID, Data: gateway.SessionClosedEvent{Addr: session.Addr}})
+		}
 	}()
 
-	parser := protocol.NewParser(conn)
-	parser.Start()
-	defer parser.Stop()
+	// 分片在分发前重组，处理器只会看到完整的消息
+	reassembler := protocol.NewReassembler(srv.ReassemblyTimeout, srv.ReassemblyMaxBytes)
+	reassembler.Timers = srv.Timers
 
 	for {
-		select {
-		case frame, ok := <-parser.Frames():
-			if !ok {
-				fmt.Printf("may parser closed for session %s\n", session.ID)
-				return
+		frame, err := t.ReadFrame()
+		if err != nil {
+			var frameErr *transport.FrameError
+			if errors.As(err, &frameErr) {
+				fmt.Printf("connect parser error %v\n", err)
+				srv.rejectFrame(session, 0, err)
+				continue
+			}
+			if err != io.EOF {
+				fmt.Printf("read error for session %s: %v\n", session.ID, err)
 			}
+			return
+		}
 
-			srv.Workerpool.Submit(func() {
-				srv.Dispatcher.Dispatch(srv.Gateway, session, frame)
-			})
+		// 任何完整的帧都说明充电桩还活着，存活探测据此判断
+		session.UpdateLastSeen()
+		session.CountIn(len(frame.Payload))
 
-		case err := <-parser.Errors():
-			fmt.Printf("connect parser error %v", err)
+		if err := srv.openFrame(session, &frame); err != nil {
+			fmt.Printf("drop frame from %s: %v\n", session.Addr, err)
+			srv.rejectFrame(session, frame.Cmd, err)
+			continue
 		}
+
+		whole, err := reassembler.Add(frame)
+		if err != nil {
+			fmt.Printf("drop fragment from %s: %v\n", session.Addr, err)
+			srv.rejectFrame(session, frame.Cmd, err)
+			continue
+		}
+		if whole == nil {
+			continue
+		}
+		frame = *whole
+
+		srv.Workerpool.Submit(func() {
+			srv.Dispatcher.Dispatch(srv.Gateway, session, frame)
+		})
 	}
 }
 
+func (s *Server) rejectFrame(session *gateway.Session, cmd byte, reason error) {
+	s.Gateway.Emit(gateway.Event{Type: gateway.EventFrameRejected, ChargerID: session.ID, Data: gateway.FrameRejectedEvent{
+		Addr:   session.Addr,
+		Cmd:    cmd,
+		Reason: reason.Error(),
+	}})
+}
+
+// openFrame 在分发前解密加密帧，处理器只会看到明文负载
+func (s *Server) openFrame(session *gateway.Session, frame *protocol.Frame) error {
+	ch := session.SecureChannel()
+	if frame.Flags&protocol.FlagEncrypted == 0 {
+		// 建立加密通道后不允许降级为明文
+		if ch != nil {
+			return fmt.Errorf("plaintext frame on encrypted session %s", ch.KeyID())
+		}
+		return nil
+	}
+
+	if ch == nil {
+		keyID, err := protocol.EnvelopeKeyID(*frame)
+		if err != nil {
+			return err
+		}
+		if session.ID != "" && session.ID != keyID {
+			return protocol.ErrKeyIDMismatch
+		}
+		if s.Credentials == nil {
+			return fmt.Errorf("no credential store for encrypted frame from %s", keyID)
+		}
+		key, ok := s.Credentials.Key(keyID)
+		if !ok {
+			return fmt.Errorf("no key for charger %s", keyID)
+		}
+		if ch, err = s.secureChannel(keyID, key); err != nil {
+			return err
+		}
+		session.SetSecureChannel(ch)
+	}
+	return ch.Open(frame)
+}
+
+// secureChannel 返回密钥 ID 的加密通道。密钥更换后重建通道，旧密钥加密的帧本来就无法解密
+func (s *Server) secureChannel(keyID string, key []byte) (*protocol.SecureChannel, error) {
+	s.channelsMu.Lock()
+	defer s.channelsMu.Unlock()
+	if c, ok := s.channels[keyID]; ok && bytes.Equal(c.key, key) {
+		return c.ch, nil
+	}
+	ch, err := protocol.NewSecureChannel(keyID, key)
+	if err != nil {
+		return nil, err
+	}
+	if s.channels == nil {
+		s.channels = make(map[string]*secureChannel)
+	}
+	s.channels[keyID] = &secureChannel{key: bytes.Clone(key), ch: ch}
+	return ch, nil
+}
+
 func Run() {
 
 	fmt.Printf("[gateway] starting EV Gateway v%s\n", version.Version)
@@ -94,6 +249,14 @@ func Run() {
 	cfg := config.LoadConfig()
 
 	gw := gateway.NewGateway()
+	if cfg.InventoryFile != "" {
+		inv, err := inventory.LoadFile(cfg.InventoryFile)
+		if err != nil {
+			fmt.Printf("load inventory error: %v\n", err)
+			return
+		}
+		gw.SetInventory(inv)
+	}
 
 	dispatcher := gateway.NewDispatcher()
 	handlers.RegisterAllHandlers(dispatcher)
@@ -102,12 +265,316 @@ func Run() {
 	wp.Start(cfg.WorkerPoolSize)
 	defer wp.Stop()
 
-	// 启动定时清理过期会话
-	utils.StartSessionCleaner(gw, cfg.HeatbeatTTL)
+	// 所有会话的注册、存活、下行命令和分片重组超时共用一个时间轮
+	timers := timewheel.New(cfg.TimerTick, nil)
+	timers.Start()
+	defer timers.Stop()
+	gw.SetTimers(timers)
+	gw.SetCallTimeout(cfg.CallTimeout)
+
+	// 主动探测空闲会话，连续多次没有应答的判定为断线
+	stopProber := utils.StartLivenessProber(gw, timers, utils.ProbeConfig{
+		Interval:  cfg.ProbeInterval,
+		Idle:      cfg.HeatbeatTTL,
+		MaxMissed: cfg.ProbeMaxMissed,
+	})
+	defer stopProber()
+
+	if cfg.MQTTBroker != "" {
+		nb, err := northbound.NewMQTT(gw, northbound.Config{
+			Broker:      cfg.MQTTBroker,
+			ClientID:    cfg.MQTTClientID,
+			Username:    cfg.MQTTUsername,
+			Password:    cfg.MQTTPassword,
+			TopicPrefix: cfg.MQTTTopicPrefix,
+			QoS:         cfg.MQTTQoS,
+		})
+		if err != nil {
+			fmt.Printf("mqtt northbound config error: %v\n", err)
+			return
+		}
+		nb.Start()
+		defer nb.Close()
+	}
+
+	if len(cfg.Webhooks) > 0 {
+		endpoints := make([]northbound.WebhookEndpoint, 0, len(cfg.Webhooks))
+		for _, wh := range cfg.Webhooks {
+			endpoints = append(endpoints, northbound.WebhookEndpoint{URL: wh.URL, Secret: wh.Secret, Events: wh.Events})
+		}
+		webhooks := northbound.NewWebhooks(gw, northbound.WebhookConfig{
+			Endpoints:      endpoints,
+			DeadLetterFile: cfg.WebhookDeadLetterFile,
+		})
+		defer webhooks.Close()
+	}
+
+	// 充电桩每次注册后核对配置，修正与期望不一致的项
+	var confMgr *chargerconfig.Manager
+	if cfg.DesiredConfFile != "" {
+		store, err := chargerconfig.LoadStore(cfg.DesiredConfFile)
+		if err != nil {
+			fmt.Printf("load desired config error: %v\n", err)
+			return
+		}
+		confMgr = chargerconfig.NewManager(gw, store)
+		defer confMgr.Close()
+	}
+
+	// 固件仓库和分批发布，FirmwareAddr 为充电桩提供镜像下载
+	var fwMgr *firmware.Manager
+	if cfg.FirmwareDir != "" {
+		repo, err := firmware.OpenRepository(cfg.FirmwareDir)
+		if err != nil {
+			fmt.Printf("open firmware repository error: %v\n", err)
+			return
+		}
+		fwMgr = firmware.NewManager(gw, repo)
+		fwMgr.BaseURL = cfg.FirmwareBaseURL
+		defer fwMgr.Close()
+		if cfg.FirmwareAddr != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/firmware/", http.StripPrefix("/firmware", repo))
+			go func() {
+				fmt.Println("firmware download listen at :", cfg.FirmwareAddr)
+				if err := http.ListenAndServe(cfg.FirmwareAddr, mux); err != nil {
+					fmt.Printf("firmware download server error: %v\n", err)
+				}
+			}()
+		}
+	}
+
+	// 充电桩经现有连接上传的诊断文件
+	var diag *diagnostics.Store
+	if cfg.DiagnosticsDir != "" {
+		var err error
+		if diag, err = diagnostics.NewStore(gw, cfg.DiagnosticsDir); err != nil {
+			fmt.Printf("open diagnostics store error: %v\n", err)
+			return
+		}
+	}
+
+	// 按标签表回答刷卡鉴权，并把本地鉴权列表同步到充电桩
+	var authMgr *auth.Manager
+	if cfg.TokenFile != "" {
+		store, err := auth.LoadStore(cfg.TokenFile)
+		if err != nil {
+			fmt.Printf("load token file error: %v\n", err)
+			return
+		}
+		authMgr = auth.NewManager(gw, store)
+		defer authMgr.Close()
+	}
+
+	// 按站点容量给充电中的枪分配功率
+	var scMgr *smartcharging.Manager
+	if cfg.SiteFile != "" {
+		store, err := smartcharging.LoadStore(cfg.SiteFile)
+		if err != nil {
+			fmt.Printf("load site file error: %v\n", err)
+			return
+		}
+		scMgr = smartcharging.NewManager(gw, store)
+		defer scMgr.Close()
+	}
+
+	// 按时段的充电曲线，负载均衡站点内的充电桩由负载均衡下发限值
+	var profMgr *chargingprofile.Manager
+	if cfg.ChargingProfileFile != "" {
+		store, err := chargingprofile.LoadStore(cfg.ChargingProfileFile)
+		if err != nil {
+			fmt.Printf("load charging profile file error: %v\n", err)
+			return
+		}
+		profMgr = chargingprofile.NewManager(gw, store)
+		defer profMgr.Close()
+		if scMgr != nil {
+			profMgr.Delegate = scMgr
+			scMgr.Limiter = profMgr
+		}
+	}
+
+	if cfg.APIAddr != "" {
+		apiSrv := api.NewServer(gw)
+		apiSrv.Token = cfg.APIToken
+		apiSrv.Config = confMgr
+		apiSrv.Firmware = fwMgr
+		apiSrv.Diagnostics = diag
+		apiSrv.Auth = authMgr
+		apiSrv.SmartCharging = scMgr
+		apiSrv.Profiles = profMgr
+		go func() {
+			if err := apiSrv.ListenAndServe(cfg.APIAddr); err != nil {
+				fmt.Printf("api server error: %v\n", err)
+			}
+		}()
+	}
+
+	// OCPP 充电桩与二进制协议的充电桩共用同一个 Gateway
+	if cfg.OCPPAddr != "" {
+		ocppSrv := ocpp.NewServer(gw, dispatcher)
+		defer ocppSrv.Close()
+		ocppSrv.HeartbeatInterval = cfg.HeatbeatTTL / 2
+		ocppSrv.Timers = timers
+		if err := configureOCPPSecurity(ocppSrv, cfg); err != nil {
+			fmt.Printf("ocpp security config error: %v\n", err)
+			return
+		}
+		go func() {
+			if err := ocppSrv.ListenAndServe(cfg.OCPPAddr); err != nil {
+				fmt.Printf("ocpp server error: %v\n", err)
+			}
+		}()
+	}
 
 	srv := NewServer(cfg.Addr, gw, dispatcher, wp)
+	srv.ReassemblyTimeout = cfg.ReassemblyTimeout
+	srv.ReassemblyMaxBytes = cfg.ReassemblyMaxBytes
+	srv.Timers = timers
+	srv.RegisterTimeout = cfg.RegisterTimeout
+	srv.KeepAlive = net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     cfg.TCPKeepAliveIdle,
+		Interval: cfg.TCPKeepAliveInterval,
+		Count:    cfg.TCPKeepAliveCount,
+	}
+	if cfg.CredentialFile != "" {
+		store, err := credential.LoadFile(cfg.CredentialFile)
+		if err != nil {
+			fmt.Printf("load credentials error: %v\n", err)
+			return
+		}
+		srv.Credentials = store
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := serveExtraListeners(ctx, srv, cfg); err != nil {
+		fmt.Printf("listen error: %v\n", err)
+		return
+	}
 
 	if err := srv.ListenAndServer(); err != nil {
 		fmt.Printf("server error: %v\n", err)
 	}
 }
+
+// configureOCPPSecurity 按配置加载 OCPP 安全配置需要的口令和证书
+func configureOCPPSecurity(s *ocpp.Server, cfg *config.Config) error {
+	s.SecurityProfile = cfg.OCPPSecurityProfile
+	if cfg.OCPPSecurityProfile == ocpp.SecurityProfileNone {
+		fmt.Printf("[ocpp] WARNING: security profile 0, chargers connect without authentication\n")
+	}
+	if cfg.OCPPPasswordFile != "" {
+		store, err := credential.LoadPasswordFile(cfg.OCPPPasswordFile)
+		if err != nil {
+			return err
+		}
+		s.Passwords = store
+	} else if cfg.OCPPSecurityProfile == ocpp.SecurityProfileBasicAuth || cfg.OCPPSecurityProfile == ocpp.SecurityProfileTLSBasic {
+		fmt.Printf("[ocpp] WARNING: security profile %d without a password file, every charger will be rejected\n", cfg.OCPPSecurityProfile)
+	}
+	if cfg.OCPPSecurityProfile < ocpp.SecurityProfileTLSBasic {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.OCPPTLSCert, cfg.OCPPTLSKey)
+	if err != nil {
+		return err
+	}
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.OCPPSecurityProfile == ocpp.SecurityProfileClientCert {
+		pem, err := os.ReadFile(cfg.OCPPClientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", cfg.OCPPClientCA)
+		}
+		s.TLSConfig.ClientCAs = pool
+		s.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+// serveExtraListeners 按配置在 TLS、WebSocket、UDP 和 RS-485 桥接上提供与 TCP 相同的二进制协议
+func serveExtraListeners(ctx context.Context, srv *Server, cfg *config.Config) error {
+	if cfg.TLSAddr != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return err
+		}
+		ln, err := transport.ListenTLSKeepAlive(cfg.TLSAddr, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, srv.KeepAlive)
+		if err != nil {
+			return err
+		}
+		fmt.Println("TLSServer listen at :", cfg.TLSAddr)
+		go srv.Serve(ln)
+	}
+	if cfg.WSAddr != "" {
+		ln := transport.NewWebSocketListener(cfg.WSAddr)
+		go func() {
+			if err := http.ListenAndServe(cfg.WSAddr, ln); err != nil {
+				fmt.Printf("websocket listen error: %v\n", err)
+				ln.Close()
+			}
+		}()
+		fmt.Println("WebSocketServer listen at :", cfg.WSAddr)
+		go srv.Serve(ln)
+	}
+	if cfg.UDPAddr != "" {
+		ln, err := transport.ListenUDP(cfg.UDPAddr, transport.UDPConfig{Ack: cfg.UDPAck, IdleTimeout: cfg.HeatbeatTTL})
+		if err != nil {
+			return err
+		}
+		fmt.Println("UDPServer listen at :", ln.Addr())
+		go srv.Serve(ln)
+	}
+	for _, conv := range cfg.Bridges {
+		go srv.ServeBridge(ctx, conv.Addr, transport.BridgeConfig{Addresses: conv.Addresses})
+	}
+	return nil
+}
+
+const (
+	bridgeRetryMin = time.Second
+	bridgeRetryMax = time.Minute
+)
+
+// ServeBridge 连接串口转换器并在总线上提供二进制协议。转换器连不上或链路断开后按指数退避重连，
+// ctx 结束时关闭链路并返回
+func (s *Server) ServeBridge(ctx context.Context, addr string, cfg transport.BridgeConfig) {
+	dialer := net.Dialer{KeepAliveConfig: s.KeepAlive}
+	delay := bridgeRetryMin
+	for {
+		c, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			bridge, err := transport.NewBridge(transport.NewConn(c), cfg)
+			if err != nil {
+				c.Close()
+				fmt.Printf("RS-485 bridge to %s: %v\n", addr, err)
+				return
+			}
+			fmt.Printf("RS-485 bridge to %s polling addresses %v\n", addr, cfg.Addresses)
+			delay = bridgeRetryMin
+			stop := context.AfterFunc(ctx, func() { bridge.Close() })
+			s.Serve(bridge)
+			stop()
+			bridge.Close()
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Printf("RS-485 bridge to %s lost, reconnecting in %v\n", addr, delay)
+		} else if ctx.Err() == nil {
+			fmt.Printf("dial rs-485 converter %s: %v, retrying in %v\n", addr, err, delay)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, bridgeRetryMax)
+	}
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/credential"
+	"github.com/x14n/evgateway/internal/diagnostics"
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/handlers"
+	"github.com/x14n/evgateway/internal/protocol"
+	"github.com/x14n/evgateway/internal/timewheel"
+	"github.com/x14n/evgateway/internal/transport"
+)
+
+// startPipeServer 在内存管道上启动完整的服务端，不经过网络
+func startPipeServer(t *testing.T) (*Server, *transport.PipeListener) {
+	t.Helper()
+	d := gateway.NewDispatcher()
+	handlers.RegisterAllHandlers(d)
+	wp := NewWorkerPool(2)
+	wp.Start(2)
+	t.Cleanup(wp.Stop)
+
+	srv := NewServer("pipe", gateway.NewGateway(), d, wp)
+	ln := transport.NewPipeListener()
+	go srv.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return srv, ln
+}
+
+func TestServe_RegisterOverPipe(t *testing.T) {
+	srv, ln := startPipeServer(t)
+	client, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	req := `{"id":"CP-PIPE","versions":[1,2,3],"compression":["deflate"]}`
+	if err := client.WriteFrame(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdRegister, []byte(req))); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := client.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp handlers.RegisterResponse
+	if err := json.Unmarshal(f.Payload, &resp); err != nil {
+		t.Fatalf("bad register response %q: %v", f.Payload, err)
+	}
+	if resp.Status != "accepted" || resp.Version != protocol.ProtocolV3 {
+		t.Fatalf("unexpected register response %+v", resp)
+	}
+	if f.Version != protocol.ProtocolV1 || f.Flags != 0 {
+		t.Errorf("expected the reply in the request's version v1 without flags, got v%d flags %#x", f.Version, f.Flags)
+	}
+
+	session, ok := srv.Gateway.GetSession("CP-PIPE")
+	if !ok {
+		t.Fatal("session not registered")
+	}
+	if session.Addr != "pipe-1" {
+		t.Errorf("expected session addr pipe-1, got %q", session.Addr)
+	}
+
+	client.Close()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := srv.Gateway.GetSession("CP-PIPE"); !ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("session not removed after the transport closed")
+}
+
+func TestServe_BridgeSubSessions(t *testing.T) {
+	d := gateway.NewDispatcher()
+	handlers.RegisterAllHandlers(d)
+	wp := NewWorkerPool(2)
+	wp.Start(2)
+	defer wp.Stop()
+	srv := NewServer("bridge", gateway.NewGateway(), d, wp)
+
+	gwSide, busSide := transport.Pipe()
+	defer busSide.Close()
+	bridge, err := transport.NewBridge(gwSide, transport.BridgeConfig{Addresses: []byte{1, 2}, ResponseTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bridge.Close()
+	go srv.Serve(bridge)
+
+	// 总线另一端：两台充电桩被轮询到时各发一次注册，之后只回 CmdPoll
+	go func() {
+		registered := map[byte]bool{}
+		for {
+			f, err := busSide.ReadFrame()
+			if err != nil {
+				return
+			}
+			addr := f.Payload[0]
+			reply := protocol.NewFrame(protocol.ProtocolV1, protocol.CmdPoll, []byte{addr})
+			if !registered[addr] {
+				registered[addr] = true
+				reply = protocol.NewFrame(protocol.ProtocolV1, protocol.CmdRegister, append([]byte{addr}, "CP-BUS-"+string('0'+addr)...))
+			}
+			busSide.WriteFrame(reply)
+		}
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s1, ok1 := srv.Gateway.GetSession("CP-BUS-1")
+		s2, ok2 := srv.Gateway.GetSession("CP-BUS-2")
+		if ok1 && ok2 {
+			if s1.Addr != "pipe#1" || s2.Addr != "pipe#2" {
+				t.Fatalf("unexpected sub-session addresses %q %q", s1.Addr, s2.Addr)
+			}
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("chargers behind the bridge never registered")
+}
+
+func TestServeBridge_Reconnect(t *testing.T) {
+	srv, _ := startPipeServer(t)
+	conv, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conv.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		srv.ServeBridge(ctx, conv.Addr().String(), transport.BridgeConfig{Addresses: []byte{1}, ResponseTimeout: 20 * time.Millisecond})
+		close(done)
+	}()
+	polled := func() transport.Transport {
+		t.Helper()
+		conv.(*net.TCPListener).SetDeadline(time.Now().Add(3 * time.Second))
+		c, err := conv.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		link := transport.NewConn(c)
+		f, err := link.ReadFrame()
+		if err != nil || f.Cmd != protocol.CmdPoll {
+			t.Fatalf("expected a poll from the bridge, got %+v %v", f, err)
+		}
+		return link
+	}
+
+	// 转换器断开后网关重新连上并继续轮询
+	polled().Close()
+	link := polled()
+	defer link.Close()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("bridge did not stop on shutdown")
+	}
+	for {
+		if _, err := link.ReadFrame(); err != nil {
+			break
+		}
+	}
+}
+
+func TestServe_LifecycleEvents(t *testing.T) {
+	srv, ln := startPipeServer(t)
+	events := make(chan gateway.Event, 8)
+	srv.Gateway.Subscribe(func(e gateway.Event) { events <- e }, gateway.Async(8))
+
+	client, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	expect := func(want string) gateway.Event {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.Type != want {
+				t.Fatalf("expected %s, got %s", want, e.Type)
+			}
+			return e
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+			return gateway.Event{}
+		}
+	}
+
+	expect(gateway.EventSessionConnected)
+	client.WriteFrame(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdRegister, []byte("CP-EV")))
+	if e := expect(gateway.EventSessionRegistered); e.ChargerID != "CP-EV" {
+		t.Fatalf("unexpected registration %+v", e)
+	}
+	client.WriteFrame(protocol.NewFrame(protocol.ProtocolV1, 0x7F, nil))
+	if e := expect(gateway.EventFrameRejected); e.Data.(gateway.FrameRejectedEvent).Cmd != 0x7F {
+		t.Fatalf("unexpected rejection %+v", e.Data)
+	}
+}
+
+func TestOpenFrame_ReplayAcrossReconnect(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	store := credential.NewMemoryStore()
+	store.SetKey("CP-SEC", key)
+	srv := &Server{Credentials: store}
+
+	ch, err := protocol.NewSecureChannel("CP-SEC", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seal := func() *protocol.Frame {
+		f := protocol.NewFrame(protocol.ProtocolV3, protocol.CmdRegister, []byte("CP-SEC"))
+		if err := ch.Seal(f); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	// Open 原地解密，每次交给 openFrame 一份副本
+	open := func(session *gateway.Session, f *protocol.Frame) error {
+		c := *f
+		c.Payload = bytes.Clone(f.Payload)
+		return srv.openFrame(session, &c)
+	}
+	captured := seal()
+
+	if err := open(&gateway.Session{Addr: "first"}, captured); err != nil {
+		t.Fatal(err)
+	}
+
+	// 攻击者在新连接上重放截获的帧
+	second := &gateway.Session{Addr: "second"}
+	if err := open(second, captured); !errors.Is(err, protocol.ErrReplayedFrame) {
+		t.Fatalf("expected the replay to be rejected, got %v", err)
+	}
+
+	// 充电桩自己重连时计数器继续递增，可以正常解密
+	if err := open(second, seal()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServe_RegisterDeadline(t *testing.T) {
+	d := gateway.NewDispatcher()
+	handlers.RegisterAllHandlers(d)
+	wp := NewWorkerPool(2)
+	wp.Start(2)
+	defer wp.Stop()
+
+	clock := timewheel.NewFakeClock(time.Now())
+	wheel := timewheel.New(time.Second, clock)
+	wheel.Start()
+	defer wheel.Stop()
+	srv := NewServer("pipe", gateway.NewGateway(), d, wp)
+	srv.Timers = wheel
+	ln := transport.NewPipeListener()
+	go srv.Serve(ln)
+	defer ln.Close()
+
+	idle, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	registered, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registered.Close()
+	req := `{"id":"CP-DEADLINE","versions":[1]}`
+	if err := registered.WriteFrame(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdRegister, []byte(req))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registered.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	// 两个连接的注册定时器都挂上之后再推进时间
+	for wheel.Len() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(DefaultRegisterTimeout + time.Second)
+	if _, err := idle.ReadFrame(); err == nil {
+		t.Fatal("expected the unregistered connection to be closed")
+	}
+	if _, ok := srv.Gateway.GetSession("CP-DEADLINE"); !ok {
+		t.Fatal("registered session was closed by the deadline")
+	}
+}
+
+func TestServe_DiagnosticsUpload(t *testing.T) {
+	srv, ln := startPipeServer(t)
+	store, err := diagnostics.NewStore(srv.Gateway, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	heartbeats := make(chan struct{}, 4)
+	srv.Gateway.Subscribe(func(gateway.Event) { heartbeats <- struct{}{} }, gateway.Types(gateway.EventHeartbeat))
+
+	client, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.WriteFrame(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdRegister, []byte(`{"id":"CP-DIAG","versions":[1]}`)))
+	if _, err := client.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+
+	requested := make(chan error, 1)
+	go func() {
+		_, err := store.Request(context.Background(), "CP-DIAG", nil, nil)
+		requested <- err
+	}()
+	f, err := client.ReadFrame()
+	if err != nil || f.Cmd != protocol.CmdCall {
+		t.Fatalf("expected GetDiagnostics call, got %+v %v", f, err)
+	}
+	var call gateway.CallRequest
+	json.Unmarshal(f.Payload, &call)
+	result, _ := json.Marshal(gateway.CallResult{ID: call.ID, Payload: json.RawMessage(`{"fileName":"diag.log"}`)})
+	client.WriteFrame(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdCallResult, result))
+	if err := <-requested; err != nil {
+		t.Fatal(err)
+	}
+
+	// 上传过程中穿插心跳，心跳不必等上传结束就能处理
+	chunks := []gateway.DiagnosticsChunk{
+		{FileName: "diag.log", Offset: 0, Data: []byte("line 1\n")},
+		{FileName: "diag.log", Offset: 7, Data: []byte("line 2\n"), Last: true},
+	}
+	for _, c := range chunks {
+		payload, _ := json.Marshal(c)
+		client.WriteFrame(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdDiagnosticsChunk, payload))
+		client.WriteFrame(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdHeartbeat, nil))
+		select {
+		case <-heartbeats:
+		case <-time.After(time.Second):
+			t.Fatal("heartbeat not handled during the upload")
+		}
+	}
+	for range chunks {
+		f, err := client.ReadFrame()
+		if err != nil || f.Cmd != protocol.CmdDiagnosticsChunk {
+			t.Fatalf("expected chunk ack, got %+v %v", f, err)
+		}
+		var ack gateway.DiagnosticsChunkAck
+		if json.Unmarshal(f.Payload, &ack); ack.Status != gateway.StatusAccepted {
+			t.Fatalf("chunk rejected: %+v", ack)
+		}
+	}
+
+	files, err := store.Files("CP-DIAG")
+	if err != nil || len(files) != 1 || files[0].Size != 14 {
+		t.Fatalf("unexpected files %+v %v", files, err)
+	}
+}
@@ -0,0 +1,92 @@
+package smartcharging
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// powerStep 是限值的粒度，限值向下取整但不低于最小功率，限值之和不会超过容量
+const powerStep = 100
+
+// connKey 标识一把枪
+type connKey struct {
+	ChargerID   string
+	ConnectorID int
+}
+
+// demand 是一把正在充电的枪，Want 是估计的需求，介于最小功率和 Max 之间
+type demand struct {
+	Key      connKey
+	Max      float64
+	Want     float64
+	Priority int
+	Started  time.Time
+}
+
+// allocate 按站点策略把 capacity 分给各枪，返回每把枪的限值。容量不够每枪最小功率时，
+// 排在后面的枪限值为 0，即暂停充电。equal 策略下排序只决定谁被暂停。
+// Max 低于最小功率的枪无法充电，限值为 0
+func allocate(site Site, capacity float64, ds []demand) map[connKey]float64 {
+	minPower := site.minPower()
+	out := make(map[connKey]float64, len(ds))
+	order := slices.DeleteFunc(slices.Clone(ds), func(d demand) bool {
+		if d.Max < minPower {
+			out[d.Key] = 0
+			return true
+		}
+		return false
+	})
+	slices.SortFunc(order, func(a, b demand) int {
+		if site.strategy() == StrategyPriority && a.Priority != b.Priority {
+			return cmp.Compare(b.Priority, a.Priority)
+		}
+		if c := a.Started.Compare(b.Started); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.Key.ChargerID, b.Key.ChargerID); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key.ConnectorID, b.Key.ConnectorID)
+	})
+
+	n := 0
+	if capacity >= minPower {
+		n = min(len(order), int(capacity/minPower))
+	}
+	for _, d := range order[n:] {
+		out[d.Key] = 0
+	}
+	admitted := order[:n]
+	for i := range admitted {
+		admitted[i].Want = min(max(admitted[i].Want, minPower), admitted[i].Max)
+	}
+
+	remaining := capacity
+	if site.strategy() == StrategyEqual {
+		// 需求小的先拿，用不完的份额留给后面的枪
+		slices.SortStableFunc(admitted, func(a, b demand) int { return cmp.Compare(a.Want, b.Want) })
+		for i, d := range admitted {
+			share := remaining / float64(n-i)
+			limit := max(floorStep(min(d.Want, share)), minPower)
+			out[d.Key] = limit
+			remaining -= limit
+		}
+		return out
+	}
+
+	// 先保证每枪最小功率，剩余的按顺序分配
+	remaining -= float64(n) * minPower
+	for _, d := range admitted {
+		limit := max(floorStep(minPower+min(d.Want-minPower, remaining)), minPower)
+		out[d.Key] = limit
+		remaining -= limit - minPower
+	}
+	return out
+}
+
+func floorStep(p float64) float64 {
+	return math.Floor(p/powerStep) * powerStep
+}
@@ -0,0 +1,493 @@
+package smartcharging
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/handlers"
+	"github.com/x14n/evgateway/internal/timewheel"
+	"github.com/x14n/evgateway/utils"
+)
+
+// ProfileIDBase 是负载均衡下发的充电曲线 ID，缺省曲线用该值，交易曲线为该值加枪号
+const ProfileIDBase = 1000
+
+// DefaultRetryDelay 是下发失败后重新分配的等待时间
+const DefaultRetryDelay = 5 * time.Second
+
+// MeasurandPower 是计量数据中的有功功率
+const MeasurandPower = "Power.Active.Import"
+
+const (
+	minIncrease = 500 // W，小于该值的提高不下发，避免计量抖动导致频繁下发
+	busyRatio   = 0.9 // 计量功率达到限值的该比例，视为车辆还能用更多功率
+)
+
+// connector 是一把正在充电的枪
+type connector struct {
+	site    string
+	txID    int
+	started time.Time
+	limit   float64 // 充电桩已确认的限值
+	applied bool
+	power   float64 // 最近一次计量的功率
+	metered bool
+	err     string // 最近一次下发的错误
+}
+
+// want 估计枪的需求。车辆用不满限值时按实际功率留出余量，其余情况按最大功率
+func (c *connector) want(maxPower float64) float64 {
+	if !c.metered || !c.applied || c.power >= busyRatio*c.limit {
+		return maxPower
+	}
+	return min(maxPower, c.power*1.1+minIncrease)
+}
+
+// ConnectorStatus 是一把枪的分配情况，Limit 在充电桩确认前为空
+type ConnectorStatus struct {
+	ChargerID     string   `json:"chargerId"`
+	ConnectorID   int      `json:"connectorId"`
+	TransactionID int      `json:"transactionId"`
+	Limit         *float64 `json:"limit,omitempty"`
+	Power         *float64 `json:"power,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// SiteStatus 是站点的配置和当前分配，Allocated 为已确认限值之和，Power 为计量功率之和
+type SiteStatus struct {
+	Site       Site              `json:"site"`
+	Allocated  float64           `json:"allocated"`
+	Power      float64           `json:"power"`
+	Connectors []ConnectorStatus `json:"connectors"`
+}
+
+// Limiter 给出枪在某一时刻的限值，例如按时段设置的充电曲线，没有限值时返回 false
+type Limiter interface {
+	Limit(chargerID string, connectorID int, at time.Time) (float64, bool)
+}
+
+// Manager 跟踪各站点正在充电的枪，在交易开始、结束和负载变化时重新分配站点容量，
+// 以交易充电曲线下发到充电桩。充电桩注册时先下发限值为 0 的缺省曲线，新交易在分到功率前不充电。
+// 下发时先降后升，降低的限值都确认后才提高其他枪，站点功率在调整过程中也不超过容量
+type Manager struct {
+	RetryDelay time.Duration
+	Limiter    Limiter // 设置后每枪的功率不超过 Limiter 给出的限值
+
+	gw    *gateway.Gateway
+	store *Store
+	sub   *gateway.Subscription
+
+	mu       sync.Mutex
+	conns    map[connKey]*connector
+	defaults map[string]bool // 已确认限值为 0 的缺省曲线的充电桩
+	runs     utils.Coalescer // 分配期间又有变化，结束后再分配一次
+	retries  map[string]*timewheel.Timer
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewManager 订阅注册、交易和计量事件
+func NewManager(gw *gateway.Gateway, store *Store) *Manager {
+	m := &Manager{
+		RetryDelay: DefaultRetryDelay,
+		gw:         gw,
+		store:      store,
+		conns:      make(map[connKey]*connector),
+		defaults:   make(map[string]bool),
+		retries:    make(map[string]*timewheel.Timer),
+	}
+	m.sub = gw.Subscribe(m.onEvent, gateway.Types(
+		gateway.EventSessionRegistered,
+		gateway.EventTransactionStarted,
+		gateway.EventTransactionStopped,
+		gateway.EventMeterValues,
+	))
+	return m
+}
+
+// Close 取消订阅和待执行的重试，并等待进行中的分配结束
+func (m *Manager) Close() {
+	m.sub.Close()
+	m.mu.Lock()
+	m.closed = true
+	for _, t := range m.retries {
+		t.Stop()
+	}
+	clear(m.retries)
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// spawn 在后台执行 f，关闭后不再执行
+func (m *Manager) spawn(f func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		f()
+	}()
+}
+
+// Store 返回站点配置
+func (m *Manager) Store() *Store {
+	return m.store
+}
+
+// PutSite 保存站点配置，向站点内在线的充电桩下发缺省曲线并重新分配
+func (m *Manager) PutSite(site Site) error {
+	if err := m.store.Put(site); err != nil {
+		return err
+	}
+	m.spawn(func() {
+		ctx := context.Background()
+		for _, s := range m.gw.SessionsBySite(site.ID) {
+			m.pushDefault(ctx, s.ID, 0)
+		}
+		m.Rebalance(ctx, site.ID)
+	})
+	return nil
+}
+
+// DeleteSite 删除站点配置，站点内的充电桩恢复为最大功率
+func (m *Manager) DeleteSite(id string) error {
+	site, ok := m.store.Get(id)
+	if !ok {
+		return ErrUnknownSite
+	}
+	if err := m.store.Delete(id); err != nil {
+		return err
+	}
+	m.spawn(func() {
+		ctx := context.Background()
+		for _, s := range m.gw.SessionsBySite(id) {
+			m.pushDefault(ctx, s.ID, site.maxPower(s.ID))
+		}
+		m.mu.Lock()
+		var changes []change
+		for k, c := range m.conns {
+			if c.site == id {
+				changes = append(changes, change{key: k, txID: c.txID, limit: site.maxPower(k.ChargerID)})
+			}
+		}
+		m.mu.Unlock()
+		m.push(ctx, changes)
+	})
+	return nil
+}
+
+// Manages 判断充电桩所在的站点是否由负载均衡管理
+func (m *Manager) Manages(chargerID string) bool {
+	_, ok := m.store.Get(m.siteOf(chargerID))
+	return ok
+}
+
+// LimitChanged 在 Limiter 给出的限值变化时调用，重新分配充电桩所在的站点
+func (m *Manager) LimitChanged(chargerID string) {
+	site := m.siteOf(chargerID)
+	if _, ok := m.store.Get(site); ok {
+		m.spawn(func() { m.Rebalance(context.Background(), site) })
+	}
+}
+
+// siteOf 返回充电桩所属的站点，离线时查台账
+func (m *Manager) siteOf(chargerID string) string {
+	if s, ok := m.gw.GetSession(chargerID); ok {
+		return s.Site()
+	}
+	labels, _ := m.gw.LookupLabels(chargerID)
+	return labels.Site
+}
+
+func (m *Manager) onEvent(e gateway.Event) {
+	var site string
+	switch e.Type {
+	case gateway.EventSessionRegistered:
+		site = m.siteOf(e.ChargerID)
+		if _, ok := m.store.Get(site); !ok {
+			return
+		}
+		// 充电桩重连后不确定上面的曲线，全部重新下发
+		m.mu.Lock()
+		delete(m.defaults, e.ChargerID)
+		for k, c := range m.conns {
+			if k.ChargerID == e.ChargerID {
+				c.applied = false
+			}
+		}
+		m.mu.Unlock()
+		m.spawn(func() {
+			m.pushDefault(context.Background(), e.ChargerID, 0)
+			m.Rebalance(context.Background(), site)
+		})
+		return
+	case gateway.EventTransactionStarted:
+		tx, ok := e.Data.(handlers.TransactionEvent)
+		if site = m.siteOf(e.ChargerID); !ok || site == "" {
+			return
+		}
+		m.mu.Lock()
+		// 缺省曲线已确认时新交易不充电，分到的功率按提高下发
+		m.conns[connKey{e.ChargerID, tx.ConnectorID}] = &connector{
+			site:    site,
+			txID:    tx.TransactionID,
+			started: tx.StartedAt,
+			applied: m.defaults[e.ChargerID],
+		}
+		m.mu.Unlock()
+	case gateway.EventTransactionStopped:
+		tx, ok := e.Data.(handlers.TransactionEvent)
+		if !ok {
+			return
+		}
+		key := connKey{e.ChargerID, tx.ConnectorID}
+		m.mu.Lock()
+		c := m.conns[key]
+		if c == nil || c.txID != tx.TransactionID {
+			m.mu.Unlock()
+			return
+		}
+		delete(m.conns, key)
+		site = c.site
+		m.mu.Unlock()
+	case gateway.EventMeterValues:
+		mv, ok := e.Data.(handlers.MeterValuesRequest)
+		if !ok {
+			return
+		}
+		power, ok := activePower(mv.Samples)
+		if !ok {
+			return
+		}
+		m.mu.Lock()
+		c := m.conns[connKey{e.ChargerID, mv.ConnectorID}]
+		if c == nil {
+			m.mu.Unlock()
+			return
+		}
+		c.power, c.metered = power, true
+		site = c.site
+		m.mu.Unlock()
+	}
+	if _, ok := m.store.Get(site); ok {
+		m.spawn(func() { m.Rebalance(context.Background(), site) })
+	}
+}
+
+// activePower 返回最后一个有功功率采样，单位换算为 W
+func activePower(samples []handlers.MeterValue) (float64, bool) {
+	for _, s := range slices.Backward(samples) {
+		if s.Measurand != MeasurandPower {
+			continue
+		}
+		if s.Unit == "kW" {
+			return s.Value * 1000, true
+		}
+		return s.Value, true
+	}
+	return 0, false
+}
+
+// Rebalance 重新分配站点容量并下发。同一站点已有分配在进行时返回 false，
+// 进行中的分配结束后会再分配一次
+func (m *Manager) Rebalance(ctx context.Context, siteID string) (bool, error) {
+	var err error
+	ok := m.runs.Do(ctx, siteID, func() {
+		err = m.rebalance(ctx, siteID)
+		if err != nil {
+			m.mu.Lock()
+			m.retryLater(siteID)
+			m.mu.Unlock()
+		}
+	})
+	return ok, err
+}
+
+// retryLater 在 RetryDelay 后重新分配站点，调用方持锁
+func (m *Manager) retryLater(siteID string) {
+	if m.closed || m.retries[siteID] != nil {
+		return
+	}
+	m.retries[siteID] = m.gw.Timers().AfterFunc(m.RetryDelay, func() {
+		m.mu.Lock()
+		delete(m.retries, siteID)
+		m.mu.Unlock()
+		m.spawn(func() { m.Rebalance(context.Background(), siteID) })
+	})
+}
+
+// change 是一把枪要下发的限值
+type change struct {
+	key   connKey
+	txID  int
+	limit float64
+}
+
+func (m *Manager) rebalance(ctx context.Context, siteID string) error {
+	site, ok := m.store.Get(siteID)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	m.mu.Lock()
+	capacity := site.Capacity
+	var ds []demand
+	for k, c := range m.conns {
+		if c.site != siteID {
+			continue
+		}
+		if _, online := m.gw.GetSession(k.ChargerID); !online {
+			// 离线的充电桩收不到新的限值，按最后确认的限值预留
+			if c.applied {
+				capacity -= c.limit
+			}
+			continue
+		}
+		maxPower := site.maxPower(k.ChargerID)
+		if m.Limiter != nil {
+			if limit, ok := m.Limiter.Limit(k.ChargerID, k.ConnectorID, now); ok {
+				maxPower = min(maxPower, limit)
+			}
+		}
+		ds = append(ds, demand{
+			Key:      k,
+			Max:      maxPower,
+			Want:     c.want(maxPower),
+			Priority: site.Chargers[k.ChargerID].Priority,
+			Started:  c.started,
+		})
+	}
+	var decreases, increases []change
+	for k, limit := range allocate(site, capacity, ds) {
+		c := m.conns[k]
+		ch := change{key: k, txID: c.txID, limit: limit}
+		switch {
+		case !c.applied || limit < c.limit:
+			decreases = append(decreases, ch)
+		case limit-c.limit >= minIncrease || (c.limit == 0 && limit > 0):
+			increases = append(increases, ch)
+		}
+	}
+	m.mu.Unlock()
+
+	if err := m.push(ctx, decreases); err != nil {
+		// 降低没有全部确认，提高可能让站点超过容量
+		return err
+	}
+	return m.push(ctx, increases)
+}
+
+// push 并行下发交易曲线，充电桩确认后记录限值
+func (m *Manager) push(ctx context.Context, changes []change) error {
+	errs := make([]error, len(changes))
+	var wg sync.WaitGroup
+	for i, ch := range changes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := profile(ProfileIDBase+ch.key.ConnectorID, gateway.PurposeTx, ch.limit)
+			p.TransactionID = ch.txID
+			_, err := m.gw.SetChargingProfile(ctx, ch.key.ChargerID, ch.key.ConnectorID, p)
+			m.mu.Lock()
+			if c := m.conns[ch.key]; c != nil && c.txID == ch.txID {
+				if err == nil {
+					c.limit, c.applied, c.err = ch.limit, true, ""
+				} else {
+					c.err = err.Error()
+				}
+			}
+			m.mu.Unlock()
+			if err != nil {
+				fmt.Printf("[smartcharging] set limit %.0fW on %s/%d error: %v\n", ch.limit, ch.key.ChargerID, ch.key.ConnectorID, err)
+				errs[i] = err
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// pushDefault 下发整桩的缺省曲线，新交易在分到功率前按该限值充电
+func (m *Manager) pushDefault(ctx context.Context, chargerID string, limit float64) {
+	p := profile(ProfileIDBase, gateway.PurposeTxDefault, limit)
+	_, err := m.gw.SetChargingProfile(ctx, chargerID, 0, p)
+	if err != nil {
+		fmt.Printf("[smartcharging] set default limit on %s error: %v\n", chargerID, err)
+	}
+	m.mu.Lock()
+	if err == nil && limit == 0 {
+		m.defaults[chargerID] = true
+	} else {
+		delete(m.defaults, chargerID)
+	}
+	m.mu.Unlock()
+}
+
+// profile 生成限值恒定的充电曲线
+func profile(id int, purpose string, limit float64) gateway.ChargingProfile {
+	return gateway.ChargingProfile{
+		ChargingProfileID:      id,
+		ChargingProfilePurpose: purpose,
+		ChargingProfileKind:    gateway.KindRelative,
+		ChargingSchedule: gateway.ChargingSchedule{
+			ChargingRateUnit:       gateway.RateUnitW,
+			ChargingSchedulePeriod: []gateway.ChargingSchedulePeriod{{Limit: limit}},
+		},
+	}
+}
+
+// Status 返回站点的配置和当前分配
+func (m *Manager) Status(siteID string) (SiteStatus, bool) {
+	site, ok := m.store.Get(siteID)
+	if !ok {
+		return SiteStatus{}, false
+	}
+	return m.status(site), true
+}
+
+// Statuses 按站点 ID 排序返回所有站点的分配
+func (m *Manager) Statuses() []SiteStatus {
+	var out []SiteStatus
+	for _, site := range m.store.List() {
+		out = append(out, m.status(site))
+	}
+	return out
+}
+
+func (m *Manager) status(site Site) SiteStatus {
+	st := SiteStatus{Site: site, Connectors: []ConnectorStatus{}}
+	m.mu.Lock()
+	for k, c := range m.conns {
+		if c.site != site.ID {
+			continue
+		}
+		cs := ConnectorStatus{ChargerID: k.ChargerID, ConnectorID: k.ConnectorID, TransactionID: c.txID, Error: c.err}
+		if limit := c.limit; c.applied {
+			cs.Limit = &limit
+			st.Allocated += limit
+		}
+		if power := c.power; c.metered {
+			cs.Power = &power
+			st.Power += power
+		}
+		st.Connectors = append(st.Connectors, cs)
+	}
+	m.mu.Unlock()
+	slices.SortFunc(st.Connectors, func(a, b ConnectorStatus) int {
+		if c := strings.Compare(a.ChargerID, b.ChargerID); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ConnectorID, b.ConnectorID)
+	})
+	return st
+}
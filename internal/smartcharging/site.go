@@ -0,0 +1,194 @@
+// Package smartcharging 按站点的电网接入容量给正在充电的枪分配功率，
+// 在交易开始、结束和负载变化时向充电桩下发充电曲线。
+package smartcharging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/x14n/evgateway/utils"
+)
+
+// 分配策略
+const (
+	StrategyEqual     = "equal"      // 平均分配，车辆用不完的功率分给其他枪
+	StrategyPriority  = "priority"   // 按充电桩优先级分配，同级先到先得
+	StrategyFirstCome = "first_come" // 先开始充电的先分配
+)
+
+// 每枪缺省的功率范围，单位 W
+const (
+	DefaultMinPower = 1380  // 单相 6A，低于该功率车辆无法充电
+	DefaultMaxPower = 22000 // 三相 32A
+)
+
+var (
+	ErrBadSite     = errors.New("bad site")
+	ErrUnknownSite = errors.New("unknown site")
+)
+
+// Site 是一个站点的电网接入容量，站点内的充电桩由台账中的 site 确定。功率单位为 W
+type Site struct {
+	ID       string                   `json:"id"`
+	Capacity float64                  `json:"capacity"`
+	Strategy string                   `json:"strategy,omitempty"` // 缺省为 equal
+	MinPower float64                  `json:"minPower,omitempty"` // 每枪的最小充电功率，分不到时暂停充电
+	MaxPower float64                  `json:"maxPower,omitempty"` // 每枪的最大功率
+	Chargers map[string]ChargerLimits `json:"chargers,omitempty"` // 按充电桩 ID 覆盖
+}
+
+// ChargerLimits 覆盖单个充电桩的最大功率和优先级，优先级大的先分配
+type ChargerLimits struct {
+	MaxPower float64 `json:"maxPower,omitempty"`
+	Priority int     `json:"priority,omitempty"`
+}
+
+func (s Site) strategy() string {
+	if s.Strategy == "" {
+		return StrategyEqual
+	}
+	return s.Strategy
+}
+
+func (s Site) minPower() float64 {
+	if s.MinPower <= 0 {
+		return DefaultMinPower
+	}
+	return s.MinPower
+}
+
+// maxPower 返回充电桩每枪的最大功率
+func (s Site) maxPower(chargerID string) float64 {
+	if c := s.Chargers[chargerID]; c.MaxPower > 0 {
+		return c.MaxPower
+	}
+	if s.MaxPower > 0 {
+		return s.MaxPower
+	}
+	return DefaultMaxPower
+}
+
+func (s Site) validate() error {
+	switch {
+	case s.ID == "":
+		return fmt.Errorf("%w: id is required", ErrBadSite)
+	case s.Capacity <= 0:
+		return fmt.Errorf("%w: capacity must be positive", ErrBadSite)
+	case s.MinPower < 0 || s.MaxPower < 0:
+		return fmt.Errorf("%w: negative power", ErrBadSite)
+	}
+	switch s.strategy() {
+	case StrategyEqual, StrategyPriority, StrategyFirstCome:
+	default:
+		return fmt.Errorf("%w: unknown strategy %q", ErrBadSite, s.Strategy)
+	}
+	for id := range s.Chargers {
+		if s.maxPower(id) < s.minPower() {
+			return fmt.Errorf("%w: max power of %s below min power", ErrBadSite, id)
+		}
+	}
+	if s.maxPower("") < s.minPower() {
+		return fmt.Errorf("%w: max power below min power", ErrBadSite)
+	}
+	return nil
+}
+
+// Store 保存站点配置。设置了文件时每次修改都写回文件
+type Store struct {
+	path string
+
+	mu    sync.RWMutex
+	sites map[string]Site
+}
+
+// NewStore 创建只在内存中的站点配置
+func NewStore() *Store {
+	return &Store{sites: make(map[string]Site)}
+}
+
+// LoadStore 从 JSON 文件加载站点配置，格式为站点的数组，文件不存在时为空
+func LoadStore(path string) (*Store, error) {
+	s := NewStore()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sites []Site
+	if err := json.Unmarshal(data, &sites); err != nil {
+		return nil, fmt.Errorf("parse site file: %w", err)
+	}
+	for _, site := range sites {
+		if err := site.validate(); err != nil {
+			return nil, err
+		}
+		s.sites[site.ID] = site
+	}
+	return s, nil
+}
+
+// Get 返回站点配置
+func (s *Store) Get(id string) (Site, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	site, ok := s.sites[id]
+	return site, ok
+}
+
+// List 按 ID 排序返回所有站点
+func (s *Store) List() []Site {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return sortedSites(s.sites)
+}
+
+func sortedSites(sites map[string]Site) []Site {
+	out := make([]Site, 0, len(sites))
+	for _, site := range sites {
+		out = append(out, site)
+	}
+	slices.SortFunc(out, func(a, b Site) int { return strings.Compare(a.ID, b.ID) })
+	return out
+}
+
+// Put 新增或替换站点
+func (s *Store) Put(site Site) error {
+	if err := site.validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sites := maps.Clone(s.sites)
+	sites[site.ID] = site
+	return s.save(sites)
+}
+
+// Delete 删除站点，之后不再管理站点内的功率
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sites[id]; !ok {
+		return ErrUnknownSite
+	}
+	sites := maps.Clone(s.sites)
+	delete(sites, id)
+	return s.save(sites)
+}
+
+// save 把修改后的副本写回文件，成功后才替换内存中的站点，写失败时保持原状。调用方持锁
+func (s *Store) save(sites map[string]Site) error {
+	if err := utils.SaveJSON(s.path, sortedSites(sites)); err != nil {
+		return err
+	}
+	s.sites = sites
+	return nil
+}
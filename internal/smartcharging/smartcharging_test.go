@@ -0,0 +1,336 @@
+package smartcharging
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/gateway/gatewaytest"
+	"github.com/x14n/evgateway/internal/handlers"
+)
+
+func TestAllocate(t *testing.T) {
+	t0 := time.Now()
+	d := func(id string, want float64, priority, started int) demand {
+		return demand{
+			Key:      connKey{id, 1},
+			Max:      11000,
+			Want:     want,
+			Priority: priority,
+			Started:  t0.Add(time.Duration(started) * time.Second),
+		}
+	}
+	for _, tc := range []struct {
+		name     string
+		strategy string
+		capacity float64
+		demands  []demand
+		want     map[string]float64
+	}{
+		{"equal", StrategyEqual, 10000,
+			[]demand{d("A", 11000, 0, 0), d("B", 11000, 0, 1), d("C", 11000, 0, 2)},
+			map[string]float64{"A": 3300, "B": 3300, "C": 3400}},
+		{"equal leftover", StrategyEqual, 10000,
+			[]demand{d("A", 2000, 0, 0), d("B", 11000, 0, 1), d("C", 11000, 0, 2)},
+			map[string]float64{"A": 2000, "B": 4000, "C": 4000}},
+		{"equal paused", StrategyEqual, 4000,
+			[]demand{d("A", 11000, 0, 2), d("B", 11000, 0, 0), d("C", 11000, 0, 1)},
+			map[string]float64{"A": 0, "B": 2000, "C": 2000}},
+		{"below min", StrategyEqual, 1000,
+			[]demand{d("A", 11000, 0, 0)},
+			map[string]float64{"A": 0}},
+		{"limited below min", StrategyEqual, 10000,
+			[]demand{d("A", 11000, 0, 0), {Key: connKey{"B", 1}, Max: 1000, Want: 1000}},
+			map[string]float64{"A": 10000, "B": 0}},
+		{"priority", StrategyPriority, 10000,
+			[]demand{d("A", 11000, 1, 0), d("B", 11000, 2, 1), d("C", 11000, 1, 2)},
+			map[string]float64{"A": 1400, "B": 7200, "C": 1400}},
+		{"first come", StrategyFirstCome, 10000,
+			[]demand{d("A", 11000, 0, 1), d("B", 3000, 0, 0)},
+			map[string]float64{"A": 7000, "B": 3000}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			site := Site{ID: "S1", Capacity: tc.capacity, Strategy: tc.strategy}
+			got := allocate(site, tc.capacity, tc.demands)
+			var sum float64
+			for id, want := range tc.want {
+				if got[connKey{id, 1}] != want {
+					t.Errorf("%s: expected %.0f, got %.0f", id, want, got[connKey{id, 1}])
+				}
+				sum += got[connKey{id, 1}]
+			}
+			if sum > tc.capacity {
+				t.Errorf("allocated %.0f over capacity %.0f", sum, tc.capacity)
+			}
+		})
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sites.json")
+	s, err := LoadStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(Site{ID: "S1", Capacity: 50000, Strategy: "random"}); err == nil {
+		t.Error("expected an unknown strategy to be rejected")
+	}
+	if err := s.Put(Site{ID: "S1", Capacity: 50000, MaxPower: 1000}); err == nil {
+		t.Error("expected max power below min power to be rejected")
+	}
+	if err := s.Put(Site{ID: "S1", Capacity: 50000, Chargers: map[string]ChargerLimits{"CP1": {Priority: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if site, ok := reloaded.Get("S1"); !ok || site.Chargers["CP1"].Priority != 1 {
+		t.Fatalf("site not persisted: %+v", reloaded.List())
+	}
+}
+
+// sim 模拟一个站点，充电桩按收到的充电曲线限制功率，车辆取需求和限值中较小的功率
+type sim struct {
+	t        *testing.T
+	gw       *gateway.Gateway
+	capacity float64
+
+	mu       sync.Mutex
+	chargers map[string]*simCharger
+	peak     float64
+}
+
+type simCharger struct {
+	defaultLimit float64 // 缺省曲线的限值，负数表示没有缺省曲线
+	conns        [2]simConnector
+}
+
+type simConnector struct {
+	txID   int // 0 表示空闲
+	demand float64
+	limit  float64 // 交易曲线的限值，负数表示没有交易曲线
+}
+
+func (c *simCharger) draw(i int) float64 {
+	conn := c.conns[i]
+	if conn.txID == 0 {
+		return 0
+	}
+	limit := conn.limit
+	if limit < 0 {
+		limit = c.defaultLimit
+	}
+	if limit < 0 {
+		return conn.demand
+	}
+	return min(conn.demand, limit)
+}
+
+// check 计算站点总功率，调用方持锁
+func (s *sim) check() {
+	var total float64
+	for _, c := range s.chargers {
+		for i := range c.conns {
+			total += c.draw(i)
+		}
+	}
+	if total > s.peak {
+		s.peak = total
+	}
+	if total > s.capacity {
+		s.t.Errorf("site draws %.0fW over capacity %.0fW", total, s.capacity)
+	}
+}
+
+func (s *sim) connect(id string) {
+	c := &simCharger{defaultLimit: -1}
+	s.mu.Lock()
+	s.chargers[id] = c
+	s.mu.Unlock()
+
+	session := gatewaytest.Connect(s.t, s.gw, id, func(req gateway.CallRequest) *gateway.CallResult {
+		var r gateway.SetChargingProfileRequest
+		json.Unmarshal(req.Payload, &r)
+		p := r.CsChargingProfiles
+		limit := p.ChargingSchedule.ChargingSchedulePeriod[0].Limit
+		s.mu.Lock()
+		switch p.ChargingProfilePurpose {
+		case gateway.PurposeTxDefault:
+			c.defaultLimit = limit
+		case gateway.PurposeTx:
+			if conn := &c.conns[r.ConnectorID-1]; conn.txID == p.TransactionID {
+				conn.limit = limit
+			}
+		}
+		s.check()
+		s.mu.Unlock()
+		payload, _ := json.Marshal(gateway.CommandStatus{Status: gateway.StatusAccepted})
+		return &gateway.CallResult{Payload: payload}
+	})
+	session.SetLabels(gateway.Labels{Site: "S1"})
+	s.gw.AddSession(session)
+	s.gw.Emit(gateway.Event{Type: gateway.EventSessionRegistered, ChargerID: id})
+}
+
+func (s *sim) start(id string, i int, demand float64) {
+	tx := s.gw.StartTransaction(id, i+1, "CARD", 0, time.Now())
+	s.mu.Lock()
+	s.chargers[id].conns[i] = simConnector{txID: tx.ID, demand: demand, limit: -1}
+	s.check()
+	s.mu.Unlock()
+	s.gw.Emit(gateway.Event{Type: gateway.EventTransactionStarted, ChargerID: id, Data: handlers.TransactionEvent{
+		TransactionID: tx.ID, ConnectorID: i + 1, StartedAt: tx.StartedAt,
+	}})
+}
+
+func (s *sim) stop(id string, i int) {
+	s.mu.Lock()
+	txID := s.chargers[id].conns[i].txID
+	s.chargers[id].conns[i] = simConnector{}
+	s.mu.Unlock()
+	tx, _ := s.gw.StopTransaction(id, txID, 0, time.Now(), "Local")
+	s.gw.Emit(gateway.Event{Type: gateway.EventTransactionStopped, ChargerID: id, Data: handlers.TransactionEvent{
+		TransactionID: txID, ConnectorID: i + 1, StartedAt: tx.StartedAt,
+	}})
+}
+
+func (s *sim) setDemand(id string, i int, demand float64) {
+	s.mu.Lock()
+	s.chargers[id].conns[i].demand = demand
+	s.check()
+	s.mu.Unlock()
+}
+
+// meter 上报所有充电中的枪的功率
+func (s *sim) meter() {
+	type sample struct {
+		id    string
+		conn  int
+		txID  int
+		power float64
+	}
+	var samples []sample
+	s.mu.Lock()
+	for id, c := range s.chargers {
+		for i := range c.conns {
+			if c.conns[i].txID != 0 {
+				samples = append(samples, sample{id, i + 1, c.conns[i].txID, c.draw(i)})
+			}
+		}
+	}
+	s.mu.Unlock()
+	for _, v := range samples {
+		s.gw.Emit(gateway.Event{Type: gateway.EventMeterValues, ChargerID: v.id, Data: handlers.MeterValuesRequest{
+			ConnectorID: v.conn, TransactionID: v.txID,
+			Samples: []handlers.MeterValue{{Measurand: MeasurandPower, Value: v.power / 1000, Unit: "kW"}},
+		}})
+	}
+}
+
+// settled 判断所有充电中的枪都已收到限值，并返回站点总功率
+func (s *sim) settled(m *Manager) (bool, float64) {
+	st, _ := m.Status("S1")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	active, total := 0, 0.0
+	for _, c := range s.chargers {
+		if c.defaultLimit != 0 {
+			return false, 0
+		}
+		for i := range c.conns {
+			if c.conns[i].txID == 0 {
+				continue
+			}
+			active++
+			total += c.draw(i)
+			if c.conns[i].limit < 0 {
+				return false, 0
+			}
+		}
+	}
+	for _, cs := range st.Connectors {
+		if cs.Limit == nil {
+			return false, 0
+		}
+	}
+	return len(st.Connectors) == active, total
+}
+
+func TestSimulation(t *testing.T) {
+	for _, strategy := range []string{StrategyEqual, StrategyPriority, StrategyFirstCome} {
+		t.Run(strategy, func(t *testing.T) {
+			gw := gatewaytest.NewGateway(t, time.Second)
+
+			const capacity = 15000 // 12 把枪，最多 10 把同时充电
+			store := NewStore()
+			site := Site{ID: "S1", Capacity: capacity, Strategy: strategy, MaxPower: 11000,
+				Chargers: map[string]ChargerLimits{"CP1": {Priority: 5}, "CP2": {Priority: 1, MaxPower: 7400}}}
+			if err := store.Put(site); err != nil {
+				t.Fatal(err)
+			}
+			m := NewManager(gw, store)
+			m.RetryDelay = 10 * time.Millisecond
+			defer m.Close()
+
+			s := &sim{t: t, gw: gw, capacity: capacity, chargers: make(map[string]*simCharger)}
+			var ids []string
+			for i := range 6 {
+				id := fmt.Sprintf("CP%d", i+1)
+				ids = append(ids, id)
+				s.connect(id)
+			}
+			waitSettled(t, s, m)
+
+			rng := rand.New(rand.NewPCG(1, 2))
+			for range 300 {
+				id, i := ids[rng.IntN(len(ids))], rng.IntN(2)
+				s.mu.Lock()
+				idle := s.chargers[id].conns[i].txID == 0
+				s.mu.Unlock()
+				switch {
+				case idle:
+					s.start(id, i, float64(2000+rng.IntN(9000)))
+				case rng.IntN(3) == 0:
+					s.stop(id, i)
+				default:
+					s.setDemand(id, i, float64(2000+rng.IntN(9000)))
+				}
+				s.meter()
+				time.Sleep(time.Millisecond)
+			}
+			total := waitSettled(t, s, m)
+
+			st, _ := m.Status("S1")
+			if st.Allocated > capacity {
+				t.Errorf("allocated %.0fW over capacity", st.Allocated)
+			}
+			if total > capacity || s.peak > capacity {
+				t.Errorf("site drew %.0fW at the end and %.0fW at peak", total, s.peak)
+			}
+			if s.peak < capacity/2 {
+				t.Errorf("capacity barely used: peak %.0fW", s.peak)
+			}
+		})
+	}
+}
+
+func waitSettled(t *testing.T, s *sim, m *Manager) float64 {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if ok, total := s.settled(m); ok {
+			return total
+		}
+		if time.Now().After(deadline) {
+			st, _ := m.Status("S1")
+			t.Fatalf("allocation did not settle: %+v", st)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
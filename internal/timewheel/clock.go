@@ -0,0 +1,104 @@
+package timewheel
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock 是时间轮的时间源，测试中用 FakeClock 代替真实时间
+type Clock interface {
+	Now() time.Time
+	// Tick 每隔 d 调用一次 f，返回停止函数
+	Tick(d time.Duration, f func(now time.Time)) (stop func())
+}
+
+// RealClock 使用系统时间
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) Tick(d time.Duration, f func(now time.Time)) func() {
+	ticker := time.NewTicker(d)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				f(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// FakeClock 只在 Advance 时前进，Tick 的回调在 Advance 的 goroutine 中按时间顺序同步调用
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	every   time.Duration
+	next    time.Time
+	f       func(time.Time)
+	stopped bool
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Tick(d time.Duration, f func(now time.Time)) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{every: d, next: c.now.Add(d), f: f}
+	c.tickers = append(c.tickers, t)
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		t.stopped = true
+	}
+}
+
+// Advance 把时间向前推进 d，期间到期的 Tick 回调都会依次执行完再返回
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		live := c.tickers[:0]
+		for _, t := range c.tickers {
+			if !t.stopped {
+				live = append(live, t)
+			}
+		}
+		c.tickers = live
+		sort.SliceStable(live, func(i, j int) bool { return live[i].next.Before(live[j].next) })
+		if len(live) == 0 || live[0].next.After(end) {
+			break
+		}
+		t := live[0]
+		now := t.next
+		c.now = now
+		t.next = now.Add(t.every)
+		// 回调中可能调用 Now 或 Tick，解锁后执行
+		c.mu.Unlock()
+		t.f(now)
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
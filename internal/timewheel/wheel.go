@@ -0,0 +1,268 @@
+// Package timewheel 实现分层时间轮，为大量会话的超时提供 O(1) 的添加、取消和重置。
+//
+// 第 0 层每个槽是一个 tick，第 i 层每个槽覆盖 64^i 个 tick；
+// 低层转完一圈时把高层对应槽中的定时器重新放入低层（级联），到期的定时器在第 0 层触发。
+package timewheel
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	slotBits  = 6
+	numSlots  = 1 << slotBits
+	slotMask  = numSlots - 1
+	numLevels = 5
+
+	// maxTicks 是能直接表示的最长延迟，更长的延迟按此截断，到期时重新计算
+	maxTicks = 1<<(slotBits*numLevels) - 1
+
+	DefaultTick = 10 * time.Millisecond
+)
+
+// Wheel 是分层时间轮。定时器回调在推进时间轮的 goroutine 中依次调用，不应阻塞；
+// 回调中可以添加、停止或重置定时器。
+type Wheel struct {
+	tick  time.Duration
+	clock Clock
+	start time.Time
+
+	mu      sync.Mutex
+	current int64 // 下一个要处理的 tick
+	slots   [numLevels][numSlots]Timer
+	levels  [numLevels]int // 每层的定时器数，用于跳过空转的 tick
+	count   int
+	stop    func()
+}
+
+// Timer 是时间轮上的一个定时器
+type Timer struct {
+	w          *Wheel
+	f          func()
+	expires    int64 // 到期的 tick
+	level      int
+	prev, next *Timer // 所在槽的双向链表，未挂在轮上时为 nil
+}
+
+// New 创建时间轮，tick 是精度，clock 为空时使用系统时间。需要调用 Start 才会走动。
+func New(tick time.Duration, clock Clock) *Wheel {
+	if tick <= 0 {
+		tick = DefaultTick
+	}
+	if clock == nil {
+		clock = RealClock{}
+	}
+	w := &Wheel{tick: tick, clock: clock, start: clock.Now()}
+	for l := range w.slots {
+		for s := range w.slots[l] {
+			head := &w.slots[l][s]
+			head.prev, head.next = head, head
+		}
+	}
+	return w
+}
+
+var (
+	defaultOnce  sync.Once
+	defaultWheel *Wheel
+)
+
+// Default 返回进程共享的时间轮，精度 DefaultTick，首次调用时启动
+func Default() *Wheel {
+	defaultOnce.Do(func() {
+		defaultWheel = New(DefaultTick, nil)
+		defaultWheel.Start()
+	})
+	return defaultWheel
+}
+
+// Start 按 tick 间隔推进时间轮
+func (w *Wheel) Start() {
+	stop := w.clock.Tick(w.tick, w.Advance)
+	w.mu.Lock()
+	w.stop = stop
+	w.mu.Unlock()
+}
+
+// Stop 停止推进，未到期的定时器不会再触发
+func (w *Wheel) Stop() {
+	w.mu.Lock()
+	stop := w.stop
+	w.stop = nil
+	w.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// Now 返回时间轮所用时钟的当前时间
+func (w *Wheel) Now() time.Time {
+	return w.clock.Now()
+}
+
+// Len 返回等待中的定时器数量
+func (w *Wheel) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.count
+}
+
+// AfterFunc 在 d 之后调用 f，精度为一个 tick，不会早于 d 触发
+func (w *Wheel) AfterFunc(d time.Duration, f func()) *Timer {
+	t := &Timer{w: w, f: f}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.schedule(t, d)
+	return t
+}
+
+// Stop 取消定时器，定时器已触发或已取消时返回 false
+func (t *Timer) Stop() bool {
+	w := t.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t.next == nil {
+		return false
+	}
+	w.unlink(t)
+	return true
+}
+
+// Reset 把定时器改为 d 之后触发，返回定时器此前是否还在等待
+func (t *Timer) Reset(d time.Duration) bool {
+	w := t.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	active := t.next != nil
+	if active {
+		w.unlink(t)
+	}
+	w.schedule(t, d)
+	return active
+}
+
+// Advance 处理截至 now 的所有 tick，到期的回调在返回前依次调用。
+// Start 会自动调用；不 Start 时可以手动推进，便于测试。
+func (w *Wheel) Advance(now time.Time) {
+	target := int64(now.Sub(w.start) / w.tick)
+	for {
+		w.mu.Lock()
+		if next := w.nextBusy(); next > w.current {
+			w.current = min(next, target+1)
+		}
+		if w.current > target {
+			w.mu.Unlock()
+			return
+		}
+		due := w.step()
+		w.mu.Unlock()
+		for _, t := range due {
+			t.f()
+		}
+	}
+}
+
+// step 处理 current 这个 tick，返回到期的定时器，调用方持锁
+func (w *Wheel) step() []*Timer {
+	// 第 0 层转完一圈，依次把上层对应槽级联下来
+	for l := 1; l < numLevels; l++ {
+		if (w.current>>(slotBits*(l-1)))&slotMask != 0 {
+			break
+		}
+		w.cascade(l, int((w.current>>(slotBits*l))&slotMask))
+	}
+
+	head := &w.slots[0][w.current&slotMask]
+	var due []*Timer
+	for t := head.next; t != head; {
+		next := t.next
+		w.unlink(t)
+		if t.expires > w.current {
+			// 超过 maxTicks 被截断的定时器，重新放回
+			w.insert(t)
+		} else {
+			due = append(due, t)
+		}
+		t = next
+	}
+	w.current++
+	return due
+}
+
+// nextBusy 返回从 current 起第一个需要处理的 tick：第 0 层有定时器的槽，或者需要级联的边界。
+// 低层全空时直接跳到最低非空层的下一个级联边界。
+func (w *Wheel) nextBusy() int64 {
+	if w.count == 0 {
+		return math.MaxInt64
+	}
+	if w.levels[0] > 0 {
+		for t := w.current; ; t++ {
+			head := &w.slots[0][t&slotMask]
+			if t&slotMask == 0 || head.next != head {
+				return t
+			}
+		}
+	}
+	for l := 1; l < numLevels; l++ {
+		if w.levels[l] > 0 {
+			span := int64(1) << (slotBits * l)
+			return (w.current + span - 1) / span * span
+		}
+	}
+	return math.MaxInt64
+}
+
+func (w *Wheel) cascade(level, slot int) {
+	head := &w.slots[level][slot]
+	for t := head.next; t != head; {
+		next := t.next
+		w.unlink(t)
+		w.insert(t)
+		t = next
+	}
+}
+
+// schedule 计算到期 tick 并挂到轮上，调用方持锁
+func (w *Wheel) schedule(t *Timer, d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	deadline := w.clock.Now().Add(d)
+	// 向上取整，保证不早于 deadline 触发
+	t.expires = int64((deadline.Sub(w.start) + w.tick - 1) / w.tick)
+	w.insert(t)
+}
+
+func (w *Wheel) insert(t *Timer) {
+	delta := t.expires - w.current
+	if delta > maxTicks {
+		delta = maxTicks
+	}
+	expires := w.current + delta
+	level := 0
+	if delta < 0 {
+		// 已经过期，下一个 tick 触发
+		expires = w.current
+	}
+	for level < numLevels-1 && delta >= 1<<(slotBits*(level+1)) {
+		level++
+	}
+	head := &w.slots[level][(expires>>(slotBits*level))&slotMask]
+	t.level = level
+	t.prev = head.prev
+	t.next = head
+	head.prev.next = t
+	head.prev = t
+	w.levels[level]++
+	w.count++
+}
+
+func (w *Wheel) unlink(t *Timer) {
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev, t.next = nil, nil
+	w.levels[t.level]--
+	w.count--
+}
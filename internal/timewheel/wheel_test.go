@@ -0,0 +1,163 @@
+package timewheel
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newFake(tick time.Duration) (*Wheel, *FakeClock) {
+	clock := NewFakeClock(epoch)
+	w := New(tick, clock)
+	w.Start()
+	return w, clock
+}
+
+func TestWheelFiresInOrderNeverEarly(t *testing.T) {
+	w, clock := newFake(time.Millisecond)
+	defer w.Stop()
+
+	// 覆盖第 0 层到第 2 层以及级联边界
+	delays := []time.Duration{0, time.Millisecond, 63 * time.Millisecond, 64 * time.Millisecond, 65 * time.Millisecond,
+		4095 * time.Millisecond, 4096 * time.Millisecond, 4097 * time.Millisecond, 5 * time.Minute}
+	rng := rand.New(rand.NewSource(1))
+	for range 200 {
+		delays = append(delays, time.Duration(rng.Int63n(int64(6*time.Minute))))
+	}
+
+	type firing struct {
+		want time.Duration
+		at   time.Time
+	}
+	var fired []firing
+	for _, d := range delays {
+		d := d
+		w.AfterFunc(d, func() { fired = append(fired, firing{d, clock.Now()}) })
+	}
+	if w.Len() != len(delays) {
+		t.Fatalf("expected %d pending timers, got %d", len(delays), w.Len())
+	}
+
+	clock.Advance(6 * time.Minute)
+	if len(fired) != len(delays) {
+		t.Fatalf("expected %d firings, got %d", len(delays), len(fired))
+	}
+	for i, f := range fired {
+		late := f.at.Sub(epoch) - f.want
+		if late < 0 || late > time.Millisecond {
+			t.Errorf("timer for %v fired at %v", f.want, f.at.Sub(epoch))
+		}
+		if i > 0 && fired[i-1].want > f.want+time.Millisecond {
+			t.Errorf("timer for %v fired before %v", fired[i-1].want, f.want)
+		}
+	}
+	if w.Len() != 0 {
+		t.Errorf("expected an empty wheel, got %d", w.Len())
+	}
+}
+
+func TestWheelStopAndReset(t *testing.T) {
+	w, clock := newFake(10 * time.Millisecond)
+	defer w.Stop()
+
+	var fired []string
+	a := w.AfterFunc(100*time.Millisecond, func() { fired = append(fired, "a") })
+	b := w.AfterFunc(100*time.Millisecond, func() { fired = append(fired, "b") })
+	if !a.Stop() || a.Stop() {
+		t.Fatal("Stop should succeed exactly once")
+	}
+
+	clock.Advance(90 * time.Millisecond)
+	// 心跳式重置：每次都推迟到期时间
+	if !b.Reset(100 * time.Millisecond) {
+		t.Fatal("Reset of a pending timer should report it was active")
+	}
+	clock.Advance(90 * time.Millisecond)
+	if len(fired) != 0 {
+		t.Fatalf("timers fired too early: %v", fired)
+	}
+	clock.Advance(20 * time.Millisecond)
+	if len(fired) != 1 || fired[0] != "b" {
+		t.Fatalf("expected only b, got %v", fired)
+	}
+	if b.Stop() {
+		t.Fatal("Stop after firing should return false")
+	}
+
+	// 已触发的定时器可以重新启用
+	b.Reset(10 * time.Millisecond)
+	clock.Advance(10 * time.Millisecond)
+	if len(fired) != 2 {
+		t.Fatalf("expected b to fire again, got %v", fired)
+	}
+}
+
+func TestWheelRescheduleFromCallback(t *testing.T) {
+	w, clock := newFake(10 * time.Millisecond)
+	defer w.Stop()
+
+	n := 0
+	var tm *Timer
+	tm = w.AfterFunc(50*time.Millisecond, func() {
+		n++
+		if n < 3 {
+			tm.Reset(50 * time.Millisecond)
+		}
+	})
+	clock.Advance(time.Second)
+	if n != 3 {
+		t.Fatalf("expected 3 firings, got %d", n)
+	}
+}
+
+func TestWheelBeyondRange(t *testing.T) {
+	// 不 Start，手动推进：空转的 tick 被跳过，几十亿个 tick 也能瞬间走完
+	clock := NewFakeClock(epoch)
+	w := New(time.Millisecond, clock)
+
+	// 超过 64^5 个 tick 的延迟被截断后重新计算，仍按时触发
+	d := time.Duration(3*maxTicks+1000) * time.Millisecond
+	fired := false
+	w.AfterFunc(d, func() { fired = true })
+	clock.Advance(d - time.Millisecond)
+	w.Advance(clock.Now())
+	if fired {
+		t.Fatal("long timer fired early")
+	}
+	clock.Advance(time.Millisecond)
+	w.Advance(clock.Now())
+	if !fired {
+		t.Fatal("long timer did not fire")
+	}
+}
+
+func TestWheelRealClock(t *testing.T) {
+	w := New(time.Millisecond, nil)
+	w.Start()
+	defer w.Stop()
+	done := make(chan time.Time, 1)
+	start := time.Now()
+	w.AfterFunc(20*time.Millisecond, func() { done <- time.Now() })
+	select {
+	case at := <-done:
+		if at.Sub(start) < 20*time.Millisecond {
+			t.Fatalf("fired after %v", at.Sub(start))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timer never fired")
+	}
+}
+
+func BenchmarkWheelSchedule(b *testing.B) {
+	w := New(10*time.Millisecond, NewFakeClock(epoch))
+	timers := make([]*Timer, 50000)
+	for i := range timers {
+		timers[i] = w.AfterFunc(time.Duration(i)*time.Millisecond, func() {})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		timers[i%len(timers)].Reset(90 * time.Second)
+	}
+}
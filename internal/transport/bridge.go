@@ -0,0 +1,296 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+const (
+	DefaultBridgeResponseTimeout = 200 * time.Millisecond
+	DefaultBridgePollInterval    = 100 * time.Millisecond
+
+	bridgeQueueSize = 64
+)
+
+var (
+	ErrBridgeQueueFull = errors.New("bridge downlink queue full")
+	ErrBadBusAddress   = errors.New("bad rs-485 bus address")
+)
+
+// BridgeConfig 配置 RS-485 桥接。ResponseTimeout 是每个地址轮到后等待应答的时间，
+// PollInterval 是两轮轮询之间的间隔。
+type BridgeConfig struct {
+	Addresses       []byte
+	ResponseTimeout time.Duration
+	PollInterval    time.Duration
+}
+
+// Bridge 把串口转 TCP 转换器上的一条链路拆成多个充电桩的子链路，实现 Listener。
+// 总线上每帧负载的第一个字节是充电桩的总线地址（位于压缩之内、加密信封之外），
+// 子链路收发的帧不含地址字节。RS-485 是半双工主从总线：网关按地址轮流发送排队的下行帧，
+// 没有下行帧时发送 CmdPoll，充电桩只在轮到自己时应答，没有数据时回 CmdPoll。
+type Bridge struct {
+	t   Transport
+	cfg BridgeConfig
+
+	mu      sync.Mutex
+	subs    map[byte]*busTransport
+	accept  chan Transport
+	replies chan byte
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewBridge 在链路 t 上启动轮询，cfg 中为零的时间使用缺省值
+func NewBridge(t Transport, cfg BridgeConfig) (*Bridge, error) {
+	if len(cfg.Addresses) == 0 {
+		return nil, fmt.Errorf("%w: no addresses", ErrBadBusAddress)
+	}
+	if cfg.ResponseTimeout <= 0 {
+		cfg.ResponseTimeout = DefaultBridgeResponseTimeout
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultBridgePollInterval
+	}
+
+	b := &Bridge{
+		t:       t,
+		cfg:     cfg,
+		subs:    make(map[byte]*busTransport, len(cfg.Addresses)),
+		accept:  make(chan Transport, len(cfg.Addresses)),
+		replies: make(chan byte, len(cfg.Addresses)),
+		done:    make(chan struct{}),
+	}
+	for _, addr := range cfg.Addresses {
+		if _, dup := b.subs[addr]; dup {
+			return nil, fmt.Errorf("%w: duplicate address %d", ErrBadBusAddress, addr)
+		}
+		sub := newBusTransport(b, addr)
+		b.subs[addr] = sub
+		b.accept <- sub
+	}
+	go b.readLoop()
+	go b.pollLoop()
+	return b, nil
+}
+
+func (b *Bridge) Accept() (Transport, error) {
+	select {
+	case t := <-b.accept:
+		return t, nil
+	case <-b.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close 关闭底层链路和所有子链路
+func (b *Bridge) Close() error {
+	var err error
+	b.once.Do(func() {
+		close(b.done)
+		err = b.t.Close()
+		b.mu.Lock()
+		for _, sub := range b.subs {
+			sub.shutdown()
+		}
+		b.mu.Unlock()
+	})
+	return err
+}
+
+func (b *Bridge) Addr() string {
+	return b.t.RemoteAddr()
+}
+
+func (b *Bridge) sub(addr byte) *busTransport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subs[addr]
+}
+
+// release 在子链路被关闭后为该地址换上新的子链路，地址上的充电桩可以重新注册
+func (b *Bridge) release(old *busTransport) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[old.addr] != old {
+		return
+	}
+	select {
+	case <-b.done:
+		return
+	default:
+	}
+	sub := newBusTransport(b, old.addr)
+	b.subs[old.addr] = sub
+	b.accept <- sub
+}
+
+func (b *Bridge) readLoop() {
+	defer b.Close()
+	for {
+		f, err := b.t.ReadFrame()
+		if err != nil {
+			var frameErr *FrameError
+			if errors.As(err, &frameErr) {
+				fmt.Printf("[bridge] %s: %v\n", b.Addr(), err)
+				continue
+			}
+			return
+		}
+		if len(f.Payload) == 0 {
+			fmt.Printf("[bridge] %s: frame without bus address\n", b.Addr())
+			continue
+		}
+		addr := f.Payload[0]
+		f.Payload = f.Payload[1:]
+		sub := b.sub(addr)
+		if sub == nil {
+			fmt.Printf("[bridge] %s: frame from unknown bus address %d\n", b.Addr(), addr)
+			continue
+		}
+		if f.Cmd != protocol.CmdPoll {
+			sub.deliver(f)
+		}
+		select {
+		case b.replies <- addr:
+		default:
+		}
+	}
+}
+
+func (b *Bridge) pollLoop() {
+	for {
+		for _, addr := range b.cfg.Addresses {
+			if !b.poll(addr) {
+				return
+			}
+		}
+		select {
+		case <-time.After(b.cfg.PollInterval):
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// poll 把地址的排队帧（或一个 CmdPoll）发到总线上并等待应答，返回 false 表示桥接已关闭
+func (b *Bridge) poll(addr byte) bool {
+	sub := b.sub(addr)
+	if sub == nil {
+		return true
+	}
+	frames := sub.drain()
+	if len(frames) == 0 {
+		frames = []*protocol.Frame{protocol.NewFrame(protocol.ProtocolV1, protocol.CmdPoll, nil)}
+	}
+	for _, f := range frames {
+		out := *f
+		out.Payload = append([]byte{addr}, f.Payload...)
+		if err := b.t.WriteFrame(&out); err != nil {
+			fmt.Printf("[bridge] %s: write to bus address %d failed: %v\n", b.Addr(), addr, err)
+			b.Close()
+			return false
+		}
+	}
+
+	timeout := time.NewTimer(b.cfg.ResponseTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case got := <-b.replies:
+			if got == addr {
+				return true
+			}
+			// 上一轮超时后迟到的应答
+		case <-timeout.C:
+			return true
+		case <-b.done:
+			return false
+		}
+	}
+}
+
+// busTransport 是总线上一个地址的子链路
+type busTransport struct {
+	b    *Bridge
+	addr byte
+
+	inbox chan protocol.Frame
+	done  chan struct{}
+	once  sync.Once
+
+	mu     sync.Mutex
+	outbox []*protocol.Frame
+}
+
+func newBusTransport(b *Bridge, addr byte) *busTransport {
+	return &busTransport{
+		b:     b,
+		addr:  addr,
+		inbox: make(chan protocol.Frame, bridgeQueueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+func (t *busTransport) deliver(f protocol.Frame) {
+	select {
+	case t.inbox <- f:
+	case <-t.done:
+	default:
+		fmt.Printf("[bridge] bus address %d inbox full, dropping frame\n", t.addr)
+	}
+}
+
+func (t *busTransport) drain() []*protocol.Frame {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := t.outbox
+	t.outbox = nil
+	return out
+}
+
+func (t *busTransport) ReadFrame() (protocol.Frame, error) {
+	select {
+	case f := <-t.inbox:
+		return f, nil
+	case <-t.done:
+		return protocol.Frame{}, io.EOF
+	}
+}
+
+// WriteFrame 把帧排入下行队列，轮到该地址时才发到总线上
+func (t *busTransport) WriteFrame(f *protocol.Frame) error {
+	select {
+	case <-t.done:
+		return ErrListenerClosed
+	default:
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.outbox) >= bridgeQueueSize {
+		return ErrBridgeQueueFull
+	}
+	frame := *f
+	frame.Payload = append([]byte(nil), f.Payload...)
+	t.outbox = append(t.outbox, &frame)
+	return nil
+}
+
+func (t *busTransport) Close() error {
+	t.shutdown()
+	t.b.release(t)
+	return nil
+}
+
+func (t *busTransport) shutdown() {
+	t.once.Do(func() { close(t.done) })
+}
+
+func (t *busTransport) RemoteAddr() string {
+	return fmt.Sprintf("%s#%d", t.b.t.RemoteAddr(), t.addr)
+}
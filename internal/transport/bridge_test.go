@@ -0,0 +1,208 @@
+package transport
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+// fakeBus 模拟转换器后面的多台充电桩：只在被轮询时应答，有排队的上行帧就发出一帧，否则回 CmdPoll
+type fakeBus struct {
+	t Transport
+
+	mu       sync.Mutex
+	uplink   map[byte][]*protocol.Frame
+	received map[byte][]protocol.Frame
+	polls    []byte
+}
+
+func newFakeBus(t Transport) *fakeBus {
+	bus := &fakeBus{
+		t:        t,
+		uplink:   make(map[byte][]*protocol.Frame),
+		received: make(map[byte][]protocol.Frame),
+	}
+	go bus.run()
+	return bus
+}
+
+func (bus *fakeBus) queue(addr byte, f *protocol.Frame) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.uplink[addr] = append(bus.uplink[addr], f)
+}
+
+func (bus *fakeBus) run() {
+	for {
+		f, err := bus.t.ReadFrame()
+		if err != nil {
+			return
+		}
+		addr := f.Payload[0]
+
+		bus.mu.Lock()
+		bus.polls = append(bus.polls, addr)
+		if f.Cmd != protocol.CmdPoll {
+			f.Payload = f.Payload[1:]
+			bus.received[addr] = append(bus.received[addr], f)
+		}
+		reply := protocol.NewFrame(protocol.ProtocolV1, protocol.CmdPoll, nil)
+		if q := bus.uplink[addr]; len(q) > 0 {
+			reply, bus.uplink[addr] = q[0], q[1:]
+		}
+		bus.mu.Unlock()
+
+		out := *reply
+		out.Payload = append([]byte{addr}, reply.Payload...)
+		if bus.t.WriteFrame(&out) != nil {
+			return
+		}
+	}
+}
+
+func (bus *fakeBus) snapshot() ([]byte, map[byte][]protocol.Frame) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	received := make(map[byte][]protocol.Frame, len(bus.received))
+	for k, v := range bus.received {
+		received[k] = append([]protocol.Frame(nil), v...)
+	}
+	return append([]byte(nil), bus.polls...), received
+}
+
+func startBridge(t *testing.T, addrs ...byte) (*Bridge, *fakeBus, map[byte]Transport) {
+	t.Helper()
+	gwSide, busSide := Pipe()
+	bus := newFakeBus(busSide)
+	b, err := NewBridge(gwSide, BridgeConfig{Addresses: addrs, ResponseTimeout: 50 * time.Millisecond, PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		b.Close()
+		busSide.Close()
+	})
+
+	subs := make(map[byte]Transport)
+	for range addrs {
+		sub, err := b.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs[sub.(*busTransport).addr] = sub
+	}
+	return b, bus, subs
+}
+
+func TestBridge_DemuxAndRoundRobin(t *testing.T) {
+	_, bus, subs := startBridge(t, 1, 2, 3)
+	if subs[2].RemoteAddr() != "pipe#2" {
+		t.Errorf("unexpected sub-link address %q", subs[2].RemoteAddr())
+	}
+
+	bus.queue(2, protocol.NewFrame(protocol.ProtocolV1, protocol.CmdHeartbeat, []byte("from-2")))
+	bus.queue(3, protocol.NewFrame(protocol.ProtocolV1, protocol.CmdStatus, []byte("from-3")))
+
+	if f := readFrame(t, subs[2]); f.Cmd != protocol.CmdHeartbeat || string(f.Payload) != "from-2" {
+		t.Fatalf("address 2 got %+v", f)
+	}
+	if f := readFrame(t, subs[3]); f.Cmd != protocol.CmdStatus || string(f.Payload) != "from-3" {
+		t.Fatalf("address 3 got %+v", f)
+	}
+
+	if err := subs[1].WriteFrame(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdRegister, []byte("to-1"))); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		polls, received := bus.snapshot()
+		if len(received[1]) == 1 {
+			if string(received[1][0].Payload) != "to-1" || len(received[2]) != 0 {
+				t.Fatalf("unexpected downlink %+v", received)
+			}
+			// 轮询严格按地址顺序循环
+			for i, addr := range polls {
+				if want := byte(i%3 + 1); addr != want {
+					t.Fatalf("poll %d went to %d, want %d (%v)", i, addr, want, polls)
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("downlink frame never reached the bus")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBridge_SilentAddressDoesNotStallBus(t *testing.T) {
+	gwSide, busSide := Pipe()
+	b, err := NewBridge(gwSide, BridgeConfig{Addresses: []byte{1, 2}, ResponseTimeout: 20 * time.Millisecond, PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	defer busSide.Close()
+
+	// 只有地址 2 应答，地址 1 掉线
+	polled := make(chan byte, 16)
+	go func() {
+		for {
+			f, err := busSide.ReadFrame()
+			if err != nil {
+				return
+			}
+			polled <- f.Payload[0]
+			if f.Payload[0] == 2 {
+				busSide.WriteFrame(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdPoll, []byte{2}))
+			}
+		}
+	}()
+	seen := map[byte]int{}
+	for seen[1] < 2 || seen[2] < 2 {
+		select {
+		case addr := <-polled:
+			seen[addr]++
+		case <-time.After(time.Second):
+			t.Fatalf("bus stalled, polls so far %v", seen)
+		}
+	}
+}
+
+func TestBridge_SubLinkReleasedOnClose(t *testing.T) {
+	b, _, subs := startBridge(t, 7)
+	subs[7].Close()
+	if _, err := subs[7].ReadFrame(); err == nil {
+		t.Fatal("expected closed sub-link to return an error")
+	}
+	again, err := b.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.(*busTransport).addr != 7 || again == subs[7] {
+		t.Fatal("expected a fresh sub-link for address 7")
+	}
+
+	b.Close()
+	if _, err := b.Accept(); !errors.Is(err, ErrListenerClosed) {
+		t.Fatalf("expected ErrListenerClosed, got %v", err)
+	}
+	if _, err := again.ReadFrame(); err == nil {
+		t.Fatal("expected sub-link to close with the bridge")
+	}
+}
+
+func TestNewBridge_RejectsBadAddresses(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+	if _, err := NewBridge(a, BridgeConfig{}); !errors.Is(err, ErrBadBusAddress) {
+		t.Fatalf("expected ErrBadBusAddress for no addresses, got %v", err)
+	}
+	if _, err := NewBridge(a, BridgeConfig{Addresses: []byte{1, 1}}); !errors.Is(err, ErrBadBusAddress) {
+		t.Fatalf("expected ErrBadBusAddress for duplicates, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package transport
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Pipe 返回一对相连的内存 Transport，用于不经过网络的端到端测试
+func Pipe() (Transport, Transport) {
+	a, b := net.Pipe()
+	return NewConn(a), NewConn(b)
+}
+
+// PipeListener 是内存中的 Listener，Dial 得到的 Transport 与 Accept 得到的一端相连
+type PipeListener struct {
+	conns chan Transport
+	done  chan struct{}
+	once  sync.Once
+	next  atomic.Int64
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns: make(chan Transport),
+		done:  make(chan struct{}),
+	}
+}
+
+// Dial 建立一条到监听器的连接，阻塞到服务端 Accept
+func (l *PipeListener) Dial() (Transport, error) {
+	a, b := net.Pipe()
+	name := "pipe-" + strconv.FormatInt(l.next.Add(1), 10)
+	server := newStream(a, a, a, name)
+	select {
+	case l.conns <- server:
+		return newStream(b, b, b, "pipe-listener"), nil
+	case <-l.done:
+		server.Close()
+		b.Close()
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *PipeListener) Accept() (Transport, error) {
+	select {
+	case t := <-l.conns:
+		return t, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *PipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *PipeListener) Addr() string {
+	return "pipe"
+}
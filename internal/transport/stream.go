@@ -0,0 +1,147 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+// stream 在字节流上按 0xAA55 帧收发，TCP、TLS、内存管道和 WebSocket 共用
+type stream struct {
+	parser  *protocol.Parser
+	w       io.Writer
+	closer  io.Closer
+	addr    string
+	writeMu sync.Mutex
+	once    sync.Once
+}
+
+func newStream(r io.Reader, w io.Writer, closer io.Closer, addr string) *stream {
+	s := &stream{
+		parser: protocol.NewParser(r),
+		w:      w,
+		closer: closer,
+		addr:   addr,
+	}
+	s.parser.Start()
+	return s
+}
+
+// NewConn 把 net.Conn（TCP、TLS 或 net.Pipe）包装成 Transport
+func NewConn(c net.Conn) Transport {
+	return newStream(c, c, c, c.RemoteAddr().String())
+}
+
+func (s *stream) ReadFrame() (protocol.Frame, error) {
+	// 解析器先报告错误再送出后续的帧，优先取错误以保持顺序
+	select {
+	case err := <-s.parser.Errors():
+		return protocol.Frame{}, &FrameError{Err: err}
+	default:
+	}
+	select {
+	case f, ok := <-s.parser.Frames():
+		if !ok {
+			return protocol.Frame{}, io.EOF
+		}
+		return f, nil
+	case err := <-s.parser.Errors():
+		return protocol.Frame{}, &FrameError{Err: err}
+	}
+}
+
+func (s *stream) WriteFrame(f *protocol.Frame) error {
+	var buf bytes.Buffer
+	if err := f.Packe(&buf); err != nil {
+		return err
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+func (s *stream) Close() error {
+	var err error
+	s.once.Do(func() {
+		// 先关闭底层连接让解析器的 Read 返回，再等待解析器退出
+		err = s.closer.Close()
+		s.parser.Stop()
+	})
+	return err
+}
+
+func (s *stream) RemoteAddr() string {
+	return s.addr
+}
+
+// DialTCP 连接 addr 上的 TCP 服务，主要用于测试和模拟充电桩
+func DialTCP(addr string) (Transport, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(c), nil
+}
+
+// netListener 把 net.Listener 的连接包装成 Transport
+type netListener struct {
+	ln net.Listener
+}
+
+// DefaultKeepAlive 是监听器缺省的 TCP keepalive：开启，参数取系统缺省值
+var DefaultKeepAlive = net.KeepAliveConfig{Enable: true}
+
+// ListenTCP 在 addr 上监听明文 TCP
+func ListenTCP(addr string) (Listener, error) {
+	return ListenTCPKeepAlive(addr, DefaultKeepAlive)
+}
+
+// ListenTCPKeepAlive 在 addr 上监听明文 TCP，每个连接按 ka 设置 TCP keepalive
+func ListenTCPKeepAlive(addr string, ka net.KeepAliveConfig) (Listener, error) {
+	ln, err := listenKeepAlive(addr, ka)
+	if err != nil {
+		return nil, err
+	}
+	return &netListener{ln: ln}, nil
+}
+
+// ListenTLS 在 addr 上监听 TLS，握手在第一次读写时进行
+func ListenTLS(addr string, cfg *tls.Config) (Listener, error) {
+	return ListenTLSKeepAlive(addr, cfg, DefaultKeepAlive)
+}
+
+// ListenTLSKeepAlive 同 ListenTLS，每个连接按 ka 设置 TCP keepalive
+func ListenTLSKeepAlive(addr string, cfg *tls.Config, ka net.KeepAliveConfig) (Listener, error) {
+	ln, err := listenKeepAlive(addr, ka)
+	if err != nil {
+		return nil, err
+	}
+	return &netListener{ln: tls.NewListener(ln, cfg)}, nil
+}
+
+func listenKeepAlive(addr string, ka net.KeepAliveConfig) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAliveConfig: ka}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+func (l *netListener) Accept() (Transport, error) {
+	c, err := l.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(c), nil
+}
+
+func (l *netListener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *netListener) Addr() string {
+	return l.ln.Addr().String()
+}
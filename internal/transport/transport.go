@@ -0,0 +1,43 @@
+// Package transport 把会话与具体的链路解耦：TCP、TLS、WebSocket 和内存管道
+// 都以 Transport 的形式交给服务端和处理器，处理器不再关心帧来自哪种连接。
+package transport
+
+import (
+	"errors"
+
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+var ErrListenerClosed = errors.New("transport listener closed")
+
+// Transport 是一条能收发协议帧的链路
+type Transport interface {
+	// ReadFrame 阻塞读取下一帧；链路关闭后返回 io.EOF，
+	// 单帧解析失败返回 *FrameError，调用者可以继续读取
+	ReadFrame() (protocol.Frame, error)
+	// WriteFrame 编码并发送一帧，帧的版本、标志和加密由调用者决定
+	WriteFrame(f *protocol.Frame) error
+	Close() error
+	// RemoteAddr 返回对端标识，用于日志和会话的 Addr
+	RemoteAddr() string
+}
+
+// Listener 接受新的 Transport
+type Listener interface {
+	Accept() (Transport, error)
+	Close() error
+	Addr() string
+}
+
+// FrameError 表示一帧解析失败，链路本身仍然可用
+type FrameError struct {
+	Err error
+}
+
+func (e *FrameError) Error() string {
+	return "bad frame: " + e.Err.Error()
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,194 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/protocol"
+	"github.com/x14n/evgateway/internal/ws"
+)
+
+func readFrame(t *testing.T, tr Transport) protocol.Frame {
+	t.Helper()
+	type result struct {
+		f   protocol.Frame
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		f, err := tr.ReadFrame()
+		ch <- result{f, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.f
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for frame")
+	}
+	return protocol.Frame{}
+}
+
+// roundTrip 验证两端可以互相收发帧
+func roundTrip(t *testing.T, a, b Transport) {
+	t.Helper()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- a.WriteFrame(protocol.NewFrame(protocol.ProtocolV2, protocol.CmdHeartbeat, []byte("ping")))
+	}()
+	f := readFrame(t, b)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if f.Cmd != protocol.CmdHeartbeat || string(f.Payload) != "ping" {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+
+	go func() {
+		errCh <- b.WriteFrame(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdStatus, []byte("pong")))
+	}()
+	f = readFrame(t, a)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if f.Cmd != protocol.CmdStatus || string(f.Payload) != "pong" {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	a, b := Pipe()
+	roundTrip(t, a, b)
+
+	a.Close()
+	if _, err := b.ReadFrame(); err != io.EOF {
+		t.Fatalf("expected io.EOF after peer close, got %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 重复关闭是安全的
+	b.Close()
+}
+
+func TestPipeListener(t *testing.T) {
+	ln := NewPipeListener()
+	accepted := make(chan Transport, 1)
+	go func() {
+		tr, err := ln.Accept()
+		if err == nil {
+			accepted <- tr
+		}
+	}()
+	client, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	defer client.Close()
+	defer server.Close()
+	if server.RemoteAddr() != "pipe-1" {
+		t.Errorf("unexpected remote addr %q", server.RemoteAddr())
+	}
+	roundTrip(t, client, server)
+
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, ErrListenerClosed) {
+		t.Fatalf("expected ErrListenerClosed, got %v", err)
+	}
+	if _, err := ln.Dial(); !errors.Is(err, ErrListenerClosed) {
+		t.Fatalf("expected ErrListenerClosed, got %v", err)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	ln, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan Transport, 1)
+	go func() {
+		tr, err := ln.Accept()
+		if err == nil {
+			accepted <- tr
+		}
+	}()
+	client, err := DialTCP(ln.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	defer client.Close()
+	defer server.Close()
+	roundTrip(t, client, server)
+}
+
+func TestStream_BadFrameIsRecoverable(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	var buf bytes.Buffer
+	protocol.NewFrame(protocol.ProtocolV1, protocol.CmdHeartbeat, []byte("x")).Packe(&buf)
+	bad := append([]byte(nil), buf.Bytes()...)
+	bad[len(bad)-3] ^= 0xFF // 破坏 CRC
+	go a.(*stream).w.Write(append(bad, buf.Bytes()...))
+
+	_, err := b.ReadFrame()
+	var frameErr *FrameError
+	if !errors.As(err, &frameErr) || !errors.Is(err, protocol.ErrCRCMismatch) {
+		t.Fatalf("expected FrameError wrapping ErrCRCMismatch, got %v", err)
+	}
+	if f := readFrame(t, b); string(f.Payload) != "x" {
+		t.Fatalf("expected the valid frame after the bad one, got %+v", f)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	ln := NewWebSocketListener("test")
+	srv := httptest.NewServer(ln)
+	defer srv.Close()
+	defer ln.Close()
+
+	accepted := make(chan Transport, 1)
+	go func() {
+		tr, err := ln.Accept()
+		if err == nil {
+			accepted <- tr
+		}
+	}()
+	conn, err := ws.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewWebSocket(conn)
+	server := <-accepted
+	defer client.Close()
+	defer server.Close()
+	roundTrip(t, client, server)
+
+	// 一帧跨多条二进制消息，中间夹杂的文本消息被忽略
+	var buf bytes.Buffer
+	protocol.NewFrame(protocol.ProtocolV1, protocol.CmdRegister, []byte("split")).Packe(&buf)
+	data := buf.Bytes()
+	conn.WriteMessage(ws.OpBinary, data[:5])
+	conn.WriteMessage(ws.OpText, []byte("noise"))
+	conn.WriteMessage(ws.OpBinary, data[5:])
+	if f := readFrame(t, server); string(f.Payload) != "split" {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+
+	client.Close()
+	if _, err := server.ReadFrame(); err != io.EOF {
+		t.Fatalf("expected io.EOF after close, got %v", err)
+	}
+}
@@ -0,0 +1,428 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+const (
+	DefaultRetransmitInterval = 2 * time.Second
+	DefaultMaxRetransmits     = 3
+	DefaultUDPIdleTimeout     = 5 * time.Minute
+
+	maxDatagramSize = 65535
+	udpInboxSize    = 16
+	udpSeqSize      = 4
+)
+
+// UDPConfig 配置 UDP 链路。开启 Ack 后每个数据报是 seq(4) + 帧，序号从 1 开始按发送方递增；
+// 双方对每个数据报回一个序号为 0 的 CmdAck，负载是被确认的序号。
+// 发送方在 RetransmitInterval 内没有收到确认就重传，最多 MaxRetransmits 次。
+// 接收方按（源地址，序号）丢弃最近 64 个序号内的重复数据报，这只是尽力去重而不是恰好一次：
+// 重传全部失败时帧会丢失，落后窗口太多的数据报按对端重启处理仍会交付。
+type UDPConfig struct {
+	Ack                bool
+	RetransmitInterval time.Duration
+	MaxRetransmits     int
+	IdleTimeout        time.Duration // 源地址在该时间内没有数据报时关闭对应的 Transport
+}
+
+// UDPListener 按源地址把数据报分到各自的 Transport，每个数据报恰好是一帧。
+// 充电桩 ID 与会话的关联和 TCP 一样由 Register 建立。
+type UDPListener struct {
+	conn *net.UDPConn
+	cfg  UDPConfig
+
+	mu     sync.Mutex
+	peers  map[string]*udpTransport
+	accept chan Transport
+	done   chan struct{}
+	once   sync.Once
+}
+
+// ListenUDP 在 addr 上监听 UDP，cfg 中为零的字段使用缺省值
+func ListenUDP(addr string, cfg UDPConfig) (*UDPListener, error) {
+	if cfg.RetransmitInterval <= 0 {
+		cfg.RetransmitInterval = DefaultRetransmitInterval
+	}
+	if cfg.MaxRetransmits <= 0 {
+		cfg.MaxRetransmits = DefaultMaxRetransmits
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultUDPIdleTimeout
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &UDPListener{
+		conn:   conn,
+		cfg:    cfg,
+		peers:  make(map[string]*udpTransport),
+		accept: make(chan Transport),
+		done:   make(chan struct{}),
+	}
+	go l.readLoop()
+	go l.expireLoop()
+	return l, nil
+}
+
+func (l *UDPListener) Accept() (Transport, error) {
+	select {
+	case t := <-l.accept:
+		return t, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *UDPListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.conn.Close()
+
+		l.mu.Lock()
+		peers := make([]*udpTransport, 0, len(l.peers))
+		for _, p := range l.peers {
+			peers = append(peers, p)
+		}
+		l.mu.Unlock()
+		for _, p := range peers {
+			p.Close()
+		}
+	})
+	return err
+}
+
+func (l *UDPListener) Addr() string {
+	return l.conn.LocalAddr().String()
+}
+
+func (l *UDPListener) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Printf("[transport] udp read error: %v\n", err)
+			continue
+		}
+		// 解析出的负载引用 data，不能复用读缓冲
+		data := append([]byte(nil), buf[:n]...)
+		seq, frame, err := l.unpack(data)
+
+		// 无法解析的数据报不为陌生地址建立会话
+		if err != nil && !l.known(addr) {
+			fmt.Printf("[transport] udp drop datagram from %s: %v\n", addr, err)
+			continue
+		}
+		p, ok := l.peer(addr)
+		if !ok {
+			return
+		}
+		p.receive(seq, frame, err)
+	}
+}
+
+// unpack 解析数据报，开启确认时先取出序号
+func (l *UDPListener) unpack(data []byte) (uint32, *protocol.Frame, error) {
+	var seq uint32
+	if l.cfg.Ack {
+		if len(data) < udpSeqSize {
+			return 0, nil, protocol.ErrMalformedDatagram
+		}
+		seq = binary.BigEndian.Uint32(data)
+		data = data[udpSeqSize:]
+	}
+	frame, err := protocol.Unpack(data, protocol.DefaultMaxPayloadSize)
+	return seq, frame, err
+}
+
+func (l *UDPListener) known(addr *net.UDPAddr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.peers[addr.String()]
+	return ok
+}
+
+// peer 返回源地址对应的 Transport，新地址会交给 Accept
+func (l *UDPListener) peer(addr *net.UDPAddr) (*udpTransport, bool) {
+	key := addr.String()
+	l.mu.Lock()
+	p, ok := l.peers[key]
+	if !ok {
+		p = newUDPTransport(l, addr)
+		l.peers[key] = p
+	}
+	l.mu.Unlock()
+	if ok {
+		return p, true
+	}
+
+	select {
+	case l.accept <- p:
+		return p, true
+	case <-l.done:
+		return nil, false
+	}
+}
+
+func (l *UDPListener) removePeer(p *udpTransport) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.peers[p.addr.String()] == p {
+		delete(l.peers, p.addr.String())
+	}
+}
+
+func (l *UDPListener) expireLoop() {
+	ticker := time.NewTicker(l.cfg.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			var idle []*udpTransport
+			for _, p := range l.peers {
+				if p.idleSince() > l.cfg.IdleTimeout {
+					idle = append(idle, p)
+				}
+			}
+			l.mu.Unlock()
+			for _, p := range idle {
+				fmt.Printf("[transport] udp peer %s idle, closing\n", p.addr)
+				p.Close()
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+type udpPacket struct {
+	frame protocol.Frame
+	err   error
+}
+
+// udpTransport 是一个源地址上的虚拟连接
+type udpTransport struct {
+	l    *UDPListener
+	addr *net.UDPAddr
+
+	inbox chan udpPacket
+	done  chan struct{}
+	once  sync.Once
+
+	mu       sync.Mutex
+	lastSeen time.Time
+	nextSeq  uint32
+	pending  map[uint32]*time.Timer // 等待确认的下行数据报，键为序号
+	received protocol.ReplayWindow  // 最近收到的上行序号，用于去重
+}
+
+func newUDPTransport(l *UDPListener, addr *net.UDPAddr) *udpTransport {
+	return &udpTransport{
+		l:        l,
+		addr:     addr,
+		inbox:    make(chan udpPacket, udpInboxSize),
+		done:     make(chan struct{}),
+		lastSeen: time.Now(),
+		pending:  make(map[uint32]*time.Timer),
+	}
+}
+
+func (t *udpTransport) receive(seq uint32, frame *protocol.Frame, err error) {
+	t.mu.Lock()
+	t.lastSeen = time.Now()
+	t.mu.Unlock()
+
+	if err != nil {
+		t.deliver(udpPacket{err: &FrameError{Err: err}})
+		return
+	}
+
+	if t.l.cfg.Ack {
+		if frame.Cmd == protocol.CmdAck {
+			t.acked(frame.Payload)
+			return
+		}
+		if seq == 0 {
+			t.deliver(udpPacket{err: &FrameError{Err: protocol.ErrMalformedDatagram}})
+			return
+		}
+		// 重复的数据报说明对端没收到确认，再确认一次但不重复交付
+		t.sendAck(seq)
+		if !t.firstReceipt(seq) {
+			return
+		}
+	}
+	t.deliver(udpPacket{frame: *frame})
+}
+
+// firstReceipt 记录收到的序号，重复的序号返回 false
+func (t *udpTransport) firstReceipt(seq uint32) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.received.Check(uint64(seq)) {
+		if !t.received.Behind(uint64(seq)) {
+			return false
+		}
+		// 序号远落后于窗口，对端重启后从头计数
+		t.received = protocol.ReplayWindow{}
+	}
+	t.received.Accept(uint64(seq))
+	return true
+}
+
+// deliver 把数据报交给 ReadFrame；读取方跟不上时丢弃，与 UDP 本身的语义一致
+func (t *udpTransport) deliver(p udpPacket) {
+	select {
+	case t.inbox <- p:
+	case <-t.done:
+	default:
+		fmt.Printf("[transport] udp peer %s inbox full, dropping datagram\n", t.addr)
+	}
+}
+
+func (t *udpTransport) sendAck(seq uint32) {
+	payload := binary.BigEndian.AppendUint32(nil, seq)
+	data, err := t.l.pack(0, protocol.NewFrame(protocol.ProtocolV1, protocol.CmdAck, payload))
+	if err != nil {
+		return
+	}
+	t.l.conn.WriteToUDP(data, t.addr)
+}
+
+func (t *udpTransport) acked(payload []byte) {
+	if len(payload) != udpSeqSize {
+		return
+	}
+	seq := binary.BigEndian.Uint32(payload)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if timer, ok := t.pending[seq]; ok {
+		timer.Stop()
+		delete(t.pending, seq)
+	}
+}
+
+func (t *udpTransport) idleSince() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Since(t.lastSeen)
+}
+
+func (t *udpTransport) ReadFrame() (protocol.Frame, error) {
+	select {
+	case p := <-t.inbox:
+		return p.frame, p.err
+	case <-t.done:
+		return protocol.Frame{}, io.EOF
+	}
+}
+
+func (t *udpTransport) WriteFrame(f *protocol.Frame) error {
+	select {
+	case <-t.done:
+		return net.ErrClosed
+	default:
+	}
+
+	if !t.l.cfg.Ack {
+		data, err := t.l.pack(0, f)
+		if err != nil {
+			return err
+		}
+		_, err = t.l.conn.WriteToUDP(data, t.addr)
+		return err
+	}
+
+	// 登记重传和写出在同一把锁下，确认不会早于登记到达
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextSeq++
+	if t.nextSeq == 0 {
+		t.nextSeq = 1
+	}
+	seq := t.nextSeq
+	data, err := t.l.pack(seq, f)
+	if err != nil {
+		return err
+	}
+	if _, err := t.l.conn.WriteToUDP(data, t.addr); err != nil {
+		return err
+	}
+	t.awaitAck(seq, data)
+	return nil
+}
+
+// awaitAck 在收到确认前定时重传，超过次数后放弃。调用方持锁
+func (t *udpTransport) awaitAck(seq uint32, data []byte) {
+	tries := 0
+	var timer *time.Timer
+	timer = time.AfterFunc(t.l.cfg.RetransmitInterval, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.pending[seq] != timer {
+			return
+		}
+		if tries >= t.l.cfg.MaxRetransmits {
+			delete(t.pending, seq)
+			fmt.Printf("[transport] udp peer %s did not ack datagram %d, giving up\n", t.addr, seq)
+			return
+		}
+		tries++
+		t.l.conn.WriteToUDP(data, t.addr)
+		timer.Reset(t.l.cfg.RetransmitInterval)
+	})
+	t.pending[seq] = timer
+}
+
+func (t *udpTransport) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+		t.mu.Lock()
+		for seq, timer := range t.pending {
+			timer.Stop()
+			delete(t.pending, seq)
+		}
+		t.mu.Unlock()
+		t.l.removePeer(t)
+	})
+	return nil
+}
+
+func (t *udpTransport) RemoteAddr() string {
+	return t.addr.String()
+}
+
+// pack 编码一个数据报，开启确认时在帧前加上序号
+func (l *UDPListener) pack(seq uint32, f *protocol.Frame) ([]byte, error) {
+	var buf bytes.Buffer
+	if l.cfg.Ack {
+		binary.Write(&buf, binary.BigEndian, seq)
+	}
+	if err := f.Packe(&buf); err != nil {
+		return nil, err
+	}
+	if buf.Len() > maxDatagramSize {
+		return nil, fmt.Errorf("frame of %d bytes does not fit in a datagram", buf.Len())
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,247 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/protocol"
+)
+
+func listenUDP(t *testing.T, cfg UDPConfig) (*UDPListener, *net.UDPConn) {
+	t.Helper()
+	ln, err := ListenUDP("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	addr, _ := net.ResolveUDPAddr("udp", ln.Addr())
+	client, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return ln, client
+}
+
+func sendDatagram(t *testing.T, c *net.UDPConn, f *protocol.Frame) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := f.Packe(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func recvDatagram(t *testing.T, c *net.UDPConn, timeout time.Duration) (*protocol.Frame, bool) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, maxDatagramSize)
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, false
+	}
+	f, err := protocol.Unpack(buf[:n], protocol.DefaultMaxPayloadSize)
+	if err != nil {
+		t.Fatalf("bad datagram from gateway: %v", err)
+	}
+	return f, true
+}
+
+func accept(t *testing.T, ln Listener) Transport {
+	t.Helper()
+	ch := make(chan Transport, 1)
+	go func() {
+		if tr, err := ln.Accept(); err == nil {
+			ch <- tr
+		}
+	}()
+	select {
+	case tr := <-ch:
+		return tr
+	case <-time.After(2 * time.Second):
+		t.Fatal("no connection accepted")
+	}
+	return nil
+}
+
+func TestUDP_DatagramPerFrame(t *testing.T) {
+	ln, client := listenUDP(t, UDPConfig{})
+
+	// 垃圾数据报不会为陌生地址建立会话
+	client.Write([]byte("garbage"))
+	sendDatagram(t, client, protocol.NewFrame(protocol.ProtocolV1, protocol.CmdHeartbeat, nil))
+
+	tr := accept(t, ln)
+	if tr.RemoteAddr() != client.LocalAddr().String() {
+		t.Errorf("expected remote %s, got %s", client.LocalAddr(), tr.RemoteAddr())
+	}
+	if f := readFrame(t, tr); f.Cmd != protocol.CmdHeartbeat {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+
+	// 已知地址上的坏数据报作为 FrameError 交给读取方
+	client.Write([]byte{0xAA, 0x55, 0x01})
+	if _, err := tr.ReadFrame(); err == nil {
+		t.Fatal("expected a frame error for a truncated datagram")
+	}
+
+	if err := tr.WriteFrame(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdStatus, []byte("ok"))); err != nil {
+		t.Fatal(err)
+	}
+	f, ok := recvDatagram(t, client, time.Second)
+	if !ok || f.Cmd != protocol.CmdStatus || string(f.Payload) != "ok" {
+		t.Fatalf("expected reply to the source address, got %+v", f)
+	}
+}
+
+// sendSequenced 按开启确认时的格式发送 seq(4) + 帧
+func sendSequenced(t *testing.T, c *net.UDPConn, seq uint32, f *protocol.Frame) {
+	t.Helper()
+	buf := bytes.NewBuffer(binary.BigEndian.AppendUint32(nil, seq))
+	if err := f.Packe(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func recvSequenced(t *testing.T, c *net.UDPConn, timeout time.Duration) (uint32, *protocol.Frame, bool) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, maxDatagramSize)
+	n, err := c.Read(buf)
+	if err != nil {
+		return 0, nil, false
+	}
+	if n < udpSeqSize {
+		t.Fatalf("short datagram from gateway: %x", buf[:n])
+	}
+	f, err := protocol.Unpack(buf[udpSeqSize:n], protocol.DefaultMaxPayloadSize)
+	if err != nil {
+		t.Fatalf("bad datagram from gateway: %v", err)
+	}
+	return binary.BigEndian.Uint32(buf), f, true
+}
+
+func TestUDP_AckAndRetransmit(t *testing.T) {
+	ln, client := listenUDP(t, UDPConfig{Ack: true, RetransmitInterval: 20 * time.Millisecond, MaxRetransmits: 2})
+
+	up := protocol.NewFrame(protocol.ProtocolV1, protocol.CmdStatus, []byte("up"))
+	sendSequenced(t, client, 1, up)
+	tr := accept(t, ln)
+	readFrame(t, tr)
+
+	seq, ack, ok := recvSequenced(t, client, time.Second)
+	if !ok || seq != 0 || ack.Cmd != protocol.CmdAck || binary.BigEndian.Uint32(ack.Payload) != 1 {
+		t.Fatalf("expected ack for uplink datagram 1, got %d %+v", seq, ack)
+	}
+
+	// 确认丢失后的重传再确认一次，但不重复交付；内容相同的新数据报照常交付
+	sendSequenced(t, client, 1, up)
+	if _, ack, ok := recvSequenced(t, client, time.Second); !ok || binary.BigEndian.Uint32(ack.Payload) != 1 {
+		t.Fatalf("expected the duplicate to be acked again, got %+v", ack)
+	}
+	sendSequenced(t, client, 2, up)
+	recvSequenced(t, client, time.Second)
+	if f := readFrame(t, tr); string(f.Payload) != "up" {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+	select {
+	case p := <-tr.(*udpTransport).inbox:
+		t.Fatalf("duplicate datagram delivered: %+v", p)
+	default:
+	}
+
+	// 不确认时重传 MaxRetransmits 次后放弃
+	if err := tr.WriteFrame(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdHeartbeat, []byte("down"))); err != nil {
+		t.Fatal(err)
+	}
+	copies := 0
+	for {
+		if _, _, ok := recvSequenced(t, client, 200*time.Millisecond); !ok {
+			break
+		}
+		copies++
+	}
+	if copies != 3 {
+		t.Fatalf("expected original plus 2 retransmits, got %d", copies)
+	}
+
+}
+
+func TestUDP_AckBySequence(t *testing.T) {
+	ln, client := listenUDP(t, UDPConfig{Ack: true, RetransmitInterval: 50 * time.Millisecond, MaxRetransmits: 20})
+	sendSequenced(t, client, 1, protocol.NewFrame(protocol.ProtocolV1, protocol.CmdHeartbeat, nil))
+	tr := accept(t, ln)
+	readFrame(t, tr)
+	recvSequenced(t, client, time.Second)
+
+	// 两个内容相同的下行帧各有序号，确认其中一个不影响另一个重传
+	tr.WriteFrame(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdHeartbeat, []byte("down")))
+	tr.WriteFrame(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdHeartbeat, []byte("down")))
+	first, _, ok := recvSequenced(t, client, time.Second)
+	second, _, ok2 := recvSequenced(t, client, time.Second)
+	if !ok || !ok2 || first == second {
+		t.Fatalf("expected two datagrams with distinct sequence numbers, got %d %d", first, second)
+	}
+	ackSeq := func(seq uint32) {
+		sendSequenced(t, client, 0, protocol.NewFrame(protocol.ProtocolV1, protocol.CmdAck, binary.BigEndian.AppendUint32(nil, seq)))
+	}
+	ackSeq(first)
+	retransmits := 0
+	for {
+		seq, _, ok := recvSequenced(t, client, 150*time.Millisecond)
+		if !ok {
+			break
+		}
+		if seq == first {
+			t.Fatalf("datagram %d retransmitted after its ack", first)
+		}
+		if retransmits++; retransmits == 2 {
+			break
+		}
+	}
+	if retransmits != 2 {
+		t.Fatalf("expected datagram %d to keep being retransmitted, got %d copies", second, retransmits)
+	}
+
+	ackSeq(second)
+	time.Sleep(60 * time.Millisecond)
+	for {
+		if _, _, ok := recvSequenced(t, client, 10*time.Millisecond); !ok {
+			break
+		}
+	}
+	if seq, f, ok := recvSequenced(t, client, 150*time.Millisecond); ok {
+		t.Fatalf("unexpected retransmit after ack: %d %+v", seq, f)
+	}
+}
+
+func TestUDP_IdlePeerClosed(t *testing.T) {
+	ln, client := listenUDP(t, UDPConfig{IdleTimeout: 40 * time.Millisecond})
+	sendDatagram(t, client, protocol.NewFrame(protocol.ProtocolV1, protocol.CmdHeartbeat, nil))
+	tr := accept(t, ln)
+	readFrame(t, tr)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := tr.ReadFrame()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the idle transport to close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle transport was not closed")
+	}
+}
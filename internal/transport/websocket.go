@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/x14n/evgateway/internal/ws"
+)
+
+// NewWebSocket 把 WebSocket 连接包装成 Transport。
+// 二进制消息首尾相连视为字节流，一帧可以跨消息；文本消息被忽略。
+func NewWebSocket(c *ws.Conn) Transport {
+	return newStream(&wsReader{c: c}, &wsWriter{c: c}, c, c.RemoteAddr().String())
+}
+
+type wsReader struct {
+	c   *ws.Conn
+	buf []byte
+}
+
+func (r *wsReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		op, data, err := r.c.ReadMessage()
+		if err != nil {
+			if errors.Is(err, ws.ErrClosed) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		if op == ws.OpBinary {
+			r.buf = data
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// wsWriter 每次 Write 发送一条二进制消息，stream 保证一次 Write 正好是一帧
+type wsWriter struct {
+	c *ws.Conn
+}
+
+func (w *wsWriter) Write(p []byte) (int, error) {
+	if err := w.c.WriteMessage(ws.OpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WebSocketListener 是接受 WebSocket 连接的 http.Handler，同时实现 Listener
+type WebSocketListener struct {
+	addr  string
+	conns chan Transport
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewWebSocketListener 创建 WebSocket 监听器，addr 仅用于 Addr() 的展示，
+// 需要把监听器挂到 HTTP 服务上才能接受连接
+func NewWebSocketListener(addr string) *WebSocketListener {
+	return &WebSocketListener{
+		addr:  addr,
+		conns: make(chan Transport),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *WebSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-l.done:
+		http.Error(w, "listener closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	c, err := ws.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Printf("[transport] websocket upgrade from %s failed: %v\n", r.RemoteAddr, err)
+		return
+	}
+	select {
+	case l.conns <- NewWebSocket(c):
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *WebSocketListener) Accept() (Transport, error) {
+	select {
+	case t := <-l.conns:
+		return t, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *WebSocketListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *WebSocketListener) Addr() string {
+	return l.addr
+}
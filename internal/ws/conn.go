@@ -0,0 +1,280 @@
+package ws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// 消息类型（RFC 6455 opcode）
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// 关闭状态码
+const (
+	CloseNormal          = 1000
+	CloseProtocolError   = 1002
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+	DefaultMaxMessageLen = 1 << 20
+)
+
+var (
+	ErrClosed          = errors.New("websocket closed")
+	ErrMessageTooLarge = errors.New("websocket message too large")
+	ErrProtocol        = errors.New("websocket protocol error")
+)
+
+// Conn 是一条已完成握手的 WebSocket 连接，读写可以分别在不同的 goroutine 中进行
+type Conn struct {
+	conn        net.Conn
+	br          *bufio.Reader
+	client      bool // 客户端发送的帧需要掩码
+	subprotocol string
+
+	// MaxMessageLen 限制单条消息（含分片）的最大长度
+	MaxMessageLen int
+
+	// OnPong 在读 goroutine 中收到 pong 时调用，可以为空
+	OnPong func(data []byte)
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	closed    bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool, subprotocol string) *Conn {
+	return &Conn{
+		conn:          conn,
+		br:            br,
+		client:        client,
+		subprotocol:   subprotocol,
+		MaxMessageLen: DefaultMaxMessageLen,
+	}
+}
+
+// Subprotocol 返回握手时协商出的子协议
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// NetConn 返回底层连接
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadDeadline 设置读超时
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// ReadMessage 读取下一条完整的数据消息，自动应答 ping 并处理关闭帧
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var (
+		msgOp int
+		msg   []byte
+	)
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case OpPing:
+			if err := c.writeFrame(OpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			if c.OnPong != nil {
+				c.OnPong(payload)
+			}
+			continue
+		case OpClose:
+			code := CloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			_ = c.closeWith(code, "")
+			return 0, nil, ErrClosed
+		case OpText, OpBinary:
+			if msg != nil {
+				return 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+			}
+			msgOp = op
+			msg = payload
+		case OpContinuation:
+			if msg == nil {
+				return 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+			}
+			msg = append(msg, payload...)
+		default:
+			return 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+		}
+
+		if len(msg) > c.MaxMessageLen {
+			return 0, nil, c.fail(CloseMessageTooBig, ErrMessageTooLarge)
+		}
+		if fin {
+			if msg == nil {
+				msg = []byte{}
+			}
+			return msgOp, msg, nil
+		}
+	}
+}
+
+// WriteMessage 以单帧发送一条消息
+func (c *Conn) WriteMessage(op int, data []byte) error {
+	return c.writeFrame(op, data)
+}
+
+// Ping 发送 ping 控制帧
+func (c *Conn) Ping(data []byte) error {
+	return c.writeFrame(OpPing, data)
+}
+
+// Close 发送关闭帧并关闭底层连接
+func (c *Conn) Close() error {
+	return c.closeWith(CloseNormal, "")
+}
+
+func (c *Conn) fail(code int, err error) error {
+	_ = c.closeWith(code, err.Error())
+	return err
+}
+
+func (c *Conn) closeWith(code int, reason string) error {
+	var err error
+	c.closeOnce.Do(func() {
+		payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+		_ = c.writeFrame(OpClose, payload)
+
+		c.writeMu.Lock()
+		c.closed = true
+		c.writeMu.Unlock()
+		err = c.conn.Close()
+	})
+	return err
+}
+
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := head[0]&0x80 != 0
+	if head[0]&0x70 != 0 {
+		// 没有协商任何扩展，RSV 位必须为 0
+		return false, 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+	}
+	op := int(head[0] & 0x0F)
+	masked := head[1]&0x80 != 0
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	// 客户端发往服务端的帧必须带掩码，控制帧不能超过 125 字节
+	if !c.client && !masked {
+		return false, 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+	}
+	if op >= OpClose && (length > 125 || !fin) {
+		return false, 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+	}
+	if length > uint64(c.MaxMessageLen) {
+		return false, 0, nil, c.fail(CloseMessageTooBig, ErrMessageTooLarge)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+func (c *Conn) writeFrame(op int, data []byte) error {
+	frame := make([]byte, 0, 14+len(data))
+	frame = append(frame, 0x80|byte(op))
+
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(data) < 126:
+		frame = append(frame, maskBit|byte(len(data)))
+	case len(data) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(data)))
+	}
+
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, data...)
+		for i := range data {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, data...)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		return fmt.Errorf("websocket write: %w", err)
+	}
+	return nil
+}
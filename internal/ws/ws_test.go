@@ -0,0 +1,117 @@
+package ws
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func echoServer(t *testing.T, protocols []string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r, protocols)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			op, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(op, msg); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func wsURL(srv *httptest.Server, path string) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + path
+}
+
+func TestEcho(t *testing.T) {
+	srv := echoServer(t, []string{"ocpp1.6"})
+	c, err := Dial(wsURL(srv, "/ocpp/CP-1"), []string{"ocpp2.0.1", "ocpp1.6"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Subprotocol() != "ocpp1.6" {
+		t.Fatalf("expected subprotocol ocpp1.6, got %q", c.Subprotocol())
+	}
+
+	for _, msg := range [][]byte{[]byte(`[2,"1","Heartbeat",{}]`), bytes.Repeat([]byte("x"), 70000), {}} {
+		if err := c.WriteMessage(OpText, msg); err != nil {
+			t.Fatal(err)
+		}
+		op, got, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != OpText || !bytes.Equal(got, msg) {
+			t.Fatalf("echo mismatch: op=%d len=%d want len=%d", op, len(got), len(msg))
+		}
+	}
+}
+
+func TestFragmentedMessageAndPing(t *testing.T) {
+	srv := echoServer(t, nil)
+	c, err := Dial(wsURL(srv, "/"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 分片消息中间夹一个 ping，服务端应先回 pong 再回显完整消息
+	writeRaw := func(fin bool, op int, data []byte) {
+		t.Helper()
+		// 掩码键全为 0，负载不需要变换
+		frame := []byte{byte(op), 0x80 | byte(len(data)), 0, 0, 0, 0}
+		if fin {
+			frame[0] |= 0x80
+		}
+		if _, err := c.conn.Write(append(frame, data...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRaw(false, OpText, []byte("hel"))
+	writeRaw(true, OpPing, []byte("p"))
+	writeRaw(true, OpContinuation, []byte("lo"))
+
+	_, msg, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "hello" {
+		t.Fatalf("expected hello, got %q", msg)
+	}
+}
+
+func TestUpgradeRejectsUnknownSubprotocol(t *testing.T) {
+	srv := echoServer(t, []string{"ocpp1.6"})
+	if _, err := Dial(wsURL(srv, "/"), []string{"ocpp1.5"}); !errors.Is(err, ErrBadHandshake) {
+		t.Fatalf("expected ErrBadHandshake, got %v", err)
+	}
+}
+
+func TestMaxMessageLen(t *testing.T) {
+	srv := echoServer(t, nil)
+	c, err := Dial(wsURL(srv, "/"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.WriteMessage(OpBinary, make([]byte, DefaultMaxMessageLen+1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadMessage(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected server to close the connection, got %v", err)
+	}
+}
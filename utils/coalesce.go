@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+// Coalescer 让同一 key 的任务串行执行并合并重复请求：执行期间再来的请求只记一次，
+// 当前执行结束后再执行一次。零值可直接使用
+type Coalescer struct {
+	mu      sync.Mutex
+	running map[string]bool
+	again   map[string]bool
+}
+
+// Do 执行 fn 并返回 true；同一 key 已有执行在进行时只做标记，返回 false。
+// ctx 取消后不再补执行
+func (c *Coalescer) Do(ctx context.Context, key string, fn func()) bool {
+	c.mu.Lock()
+	if c.running == nil {
+		c.running = make(map[string]bool)
+		c.again = make(map[string]bool)
+	}
+	if c.running[key] {
+		c.again[key] = true
+		c.mu.Unlock()
+		return false
+	}
+	c.running[key] = true
+	c.mu.Unlock()
+
+	for {
+		fn()
+		c.mu.Lock()
+		if !c.again[key] || ctx.Err() != nil {
+			delete(c.running, key)
+			delete(c.again, key)
+			c.mu.Unlock()
+			return true
+		}
+		delete(c.again, key)
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCoalescer(t *testing.T) {
+	var c Coalescer
+	ctx := context.Background()
+	runs := 0
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		done <- c.Do(ctx, "a", func() {
+			runs++
+			if runs == 1 {
+				close(entered)
+				<-release
+			}
+		})
+	}()
+	<-entered
+	// 执行期间的重复请求只合并为一次补执行
+	for range 3 {
+		if c.Do(ctx, "a", func() { t.Error("concurrent run") }) {
+			t.Fatal("duplicate request should be coalesced")
+		}
+	}
+	// 其他 key 不受影响
+	if !c.Do(ctx, "b", func() {}) {
+		t.Fatal("other key blocked")
+	}
+	close(release)
+	if !<-done {
+		t.Fatal("first request should run")
+	}
+	if runs != 2 {
+		t.Fatalf("runs = %d, want 2", runs)
+	}
+}
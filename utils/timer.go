@@ -2,26 +2,134 @@ package utils
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/protocol"
+	"github.com/x14n/evgateway/internal/timewheel"
 )
 
-func StartSessionCleaner(gw *gateway.Gateway, ttl time.Duration) {
+const (
+	DefaultProbeInterval  = 10 * time.Second
+	DefaultProbeMaxMissed = 3
+)
+
+// ProbeConfig 配置存活探测。会话空闲超过 Idle 后，每个 Interval 发一次 CmdPing，
+// 连续 MaxMissed 次没有收到任何数据就判定死亡。
+type ProbeConfig struct {
+	Interval  time.Duration
+	Idle      time.Duration
+	MaxMissed int
+}
+
+// prober 给每个已注册的会话在时间轮上挂一个定时器，不再周期性扫描全部会话。
+// 收到数据时不动定时器，到期时比较 LastSeen，有新数据就顺延 Idle；
+// 因此最长 2*Idle + MaxMissed*Interval 发现断线。
+type prober struct {
+	gw    *gateway.Gateway
+	wheel *timewheel.Wheel
+	cfg   ProbeConfig
+
+	mu      sync.Mutex
+	tracked map[*gateway.Session]*probeEntry
+	stopped bool
+}
+
+type probeEntry struct {
+	timer *timewheel.Timer
+	last  time.Time // 上次检查时看到的 LastSeen
+}
+
+// StartLivenessProber 启动存活探测，会话在连接建立或注册后纳入探测，返回的函数停止探测
+func StartLivenessProber(gw *gateway.Gateway, wheel *timewheel.Wheel, cfg ProbeConfig) (stop func()) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultProbeInterval
+	}
+	if cfg.Idle <= 0 {
+		cfg.Idle = cfg.Interval
+	}
+	if cfg.MaxMissed <= 0 {
+		cfg.MaxMissed = DefaultProbeMaxMissed
+	}
+	p := &prober{gw: gw, wheel: wheel, cfg: cfg, tracked: make(map[*gateway.Session]*probeEntry)}
+
+	sub := gw.Subscribe(p.onEvent, gateway.Types(gateway.EventSessionConnected, gateway.EventSessionRegistered))
+	for _, s := range gw.ListSessions() {
+		if s.ID != "" {
+			p.track(s)
+		}
+	}
+	return func() {
+		sub.Close()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.stopped = true
+		for s, e := range p.tracked {
+			e.timer.Stop()
+			delete(p.tracked, s)
+		}
+	}
+}
+
+func (p *prober) onEvent(e gateway.Event) {
+	// 未注册的连接由注册超时负责
+	if e.ChargerID == "" {
+		return
+	}
+	if s, ok := p.gw.GetSession(e.ChargerID); ok {
+		p.track(s)
+	}
+}
+
+func (p *prober) track(s *gateway.Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.tracked[s]; ok || p.stopped {
+		return
+	}
+	p.tracked[s] = &probeEntry{
+		last:  s.LastSeen(),
+		timer: p.wheel.AfterFunc(p.cfg.Idle, func() { p.check(s) }),
+	}
+}
+
+// check 在时间轮的 goroutine 中调用
+func (p *prober) check(s *gateway.Session) {
+	p.mu.Lock()
+	e, ok := p.tracked[s]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	if cur, ok := p.gw.GetSession(s.ID); !ok || cur != s {
+		// 会话已经断开，或者被同一充电桩的新连接替换
+		delete(p.tracked, s)
+		p.mu.Unlock()
+		return
+	}
+	if seen := s.LastSeen(); !seen.Equal(e.last) {
+		e.last = seen
+		e.timer.Reset(p.cfg.Idle)
+		p.mu.Unlock()
+		return
+	}
+	if s.Probed() >= p.cfg.MaxMissed {
+		delete(p.tracked, s)
+		p.mu.Unlock()
+		fmt.Printf("[liveness] %s missed %d probes, removing session\n", s.ID, p.cfg.MaxMissed)
+		s.Close()
+		p.gw.RemoveSession(s)
+		p.gw.Emit(gateway.Event{Type: gateway.EventSessionExpired, ChargerID: s.ID, Data: gateway.SessionExpiredEvent{Addr: s.Addr, LastSeen: e.last}})
+		return
+	}
+	e.timer.Reset(p.cfg.Interval)
+	p.mu.Unlock()
+
+	// 下行可能阻塞，不占用时间轮的 goroutine；发送失败算作一次未应答的探测
 	go func() {
-		ticker := time.NewTicker(time.Minute)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			now := time.Now()
-			sessions := gw.ListSessions()
-			for _, s := range sessions {
-				if now.Sub(s.Lastseen) > ttl {
-					fmt.Printf("[session_cleaner] remove expired session: %s", s.ID)
-					s.Close()
-					gw.RemoveSession(s.ID)
-				}
-			}
+		if err := s.Send(protocol.NewFrame(protocol.ProtocolV1, protocol.CmdPing, nil)); err != nil {
+			fmt.Printf("[liveness] ping %s error: %v\n", s.ID, err)
 		}
 	}()
 }
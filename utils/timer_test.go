@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/x14n/evgateway/internal/gateway"
+	"github.com/x14n/evgateway/internal/protocol"
+	"github.com/x14n/evgateway/internal/timewheel"
+	"github.com/x14n/evgateway/internal/transport"
+)
+
+func newPipeSession(gw *gateway.Gateway, id string) (*gateway.Session, transport.Transport) {
+	server, charger := transport.Pipe()
+	s := &gateway.Session{ID: id, Addr: id, Transport: server, Lastseen: time.Now()}
+	gw.AddSession(s)
+	return s, charger
+}
+
+func TestLivenessProber(t *testing.T) {
+	gw := gateway.NewGateway()
+	expired := make(chan string, 2)
+	gw.Subscribe(func(e gateway.Event) { expired <- e.ChargerID }, gateway.Types(gateway.EventSessionExpired))
+
+	// CP-ALIVE 每次被探测都应答，CP-DEAD 从不应答
+	alive, aliveCharger := newPipeSession(gw, "CP-ALIVE")
+	defer aliveCharger.Close()
+	go func() {
+		for {
+			f, err := aliveCharger.ReadFrame()
+			if err != nil {
+				return
+			}
+			if f.Cmd == protocol.CmdPing {
+				alive.UpdateLastSeen()
+			}
+		}
+	}()
+	_, deadCharger := newPipeSession(gw, "CP-DEAD")
+	pings := make(chan struct{}, 8)
+	go func() {
+		for {
+			f, err := deadCharger.ReadFrame()
+			if err != nil {
+				return
+			}
+			if f.Cmd == protocol.CmdPing {
+				pings <- struct{}{}
+			}
+		}
+	}()
+
+	wheel := timewheel.New(time.Millisecond, nil)
+	wheel.Start()
+	defer wheel.Stop()
+	stop := StartLivenessProber(gw, wheel, ProbeConfig{Interval: 5 * time.Millisecond, Idle: 5 * time.Millisecond, MaxMissed: 2})
+	defer stop()
+
+	select {
+	case id := <-expired:
+		if id != "CP-DEAD" {
+			t.Fatalf("%s expired, expected CP-DEAD", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dead session was never expired")
+	}
+	for range 2 {
+		select {
+		case <-pings:
+		case <-time.After(time.Second):
+			t.Fatal("expected 2 pings before expiry")
+		}
+	}
+	if _, ok := gw.GetSession("CP-DEAD"); ok {
+		t.Error("dead session still registered")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := gw.GetSession("CP-ALIVE"); !ok {
+		t.Error("responsive session was expired")
+	}
+}